@@ -1,18 +1,39 @@
 import { createApi, fetchBaseQuery } from "@reduxjs/toolkit/query/react";
 
-import { API_BASE_PATH } from "./const";
+import { API_BASE_PATH, NAMESPACE_HEADER } from "./const";
 import type {
   Service,
   FullFlow,
   Signature,
   TickInfo,
   Flow,
+  FlowsPage,
   FlowsQuery,
+  Namespaces,
+  TagInfo,
+  Rule,
+  RuleChange,
+  RuleReload,
+  RetroJob,
 } from "./types";
 
 export const tulipApi = createApi({
-  baseQuery: fetchBaseQuery({ baseUrl: API_BASE_PATH }),
+  baseQuery: fetchBaseQuery({
+    baseUrl: API_BASE_PATH,
+    prepareHeaders: (headers, { getState }) => {
+      const { namespace } = (getState() as { filter: { namespace?: string } })
+        .filter;
+      if (namespace) {
+        headers.set(NAMESPACE_HEADER, namespace);
+      }
+      return headers;
+    },
+  }),
+  tagTypes: ["Tags", "Rules", "RetroJobs"],
   endpoints: (builder) => ({
+    getNamespaces: builder.query<Namespaces, void>({
+      query: () => "/namespaces",
+    }),
     getServices: builder.query<Service[], void>({
       query: () => "/services",
     }),
@@ -22,7 +43,7 @@ export const tulipApi = createApi({
     getFlow: builder.query<FullFlow, string>({
       query: (id) => `/flow/${id}`,
     }),
-    getFlows: builder.query<Flow[], FlowsQuery>({
+    getFlows: builder.query<FlowsPage, FlowsQuery>({
       query: (query) => ({
         url: `/query`,
         method: "POST",
@@ -43,8 +64,84 @@ export const tulipApi = createApi({
         }),
       }),
     }),
-    getTags: builder.query<string[], void>({
+    getTags: builder.query<TagInfo[], void>({
       query: () => `/tags`,
+      providesTags: ["Tags"],
+    }),
+    createTag: builder.mutation<
+      TagInfo,
+      Pick<TagInfo, "name" | "color" | "description">
+    >({
+      query: (tag) => ({ url: `/tags`, method: "POST", body: tag }),
+      invalidatesTags: ["Tags"],
+    }),
+    updateTag: builder.mutation<
+      TagInfo,
+      Pick<TagInfo, "name" | "color" | "description">
+    >({
+      query: ({ name, ...tag }) => ({
+        url: `/tags/${encodeURIComponent(name)}`,
+        method: "PUT",
+        body: tag,
+      }),
+      invalidatesTags: ["Tags"],
+    }),
+    deleteTag: builder.mutation<void, string>({
+      query: (name) => ({
+        url: `/tags/${encodeURIComponent(name)}`,
+        method: "DELETE",
+      }),
+      invalidatesTags: ["Tags"],
+    }),
+    getRules: builder.query<Rule[], void>({
+      query: () => `/rules`,
+      providesTags: ["Rules"],
+    }),
+    createRule: builder.mutation<
+      RuleChange,
+      { rule: string; enabled?: boolean }
+    >({
+      query: (body) => ({ url: `/rules`, method: "POST", body }),
+      invalidatesTags: ["Rules"],
+    }),
+    updateRule: builder.mutation<
+      RuleChange,
+      { sid: number; rule?: string; enabled?: boolean }
+    >({
+      query: ({ sid, ...body }) => ({
+        url: `/rules/${sid}`,
+        method: "PUT",
+        body,
+      }),
+      invalidatesTags: ["Rules"],
+    }),
+    validateRule: builder.mutation<
+      { valid: boolean; error?: string; rule?: Rule },
+      string
+    >({
+      query: (rule) => ({
+        url: `/rules/validate`,
+        method: "POST",
+        body: { rule },
+      }),
+    }),
+    reloadRules: builder.mutation<RuleReload, void>({
+      query: () => ({ url: `/rules/reload`, method: "POST" }),
+    }),
+    getRetroJobs: builder.query<RetroJob[], void>({
+      query: () => `/rules/retro`,
+      providesTags: ["RetroJobs"],
+    }),
+    startRetroJob: builder.mutation<
+      RetroJob,
+      { sids?: number[]; tick_from?: number; tick_to?: number }
+    >({
+      query: (body) => ({ url: `/rules/retro`, method: "POST", body }),
+      invalidatesTags: ["RetroJobs"],
+    }),
+    cancelRetroJob: builder.mutation<void, number>({
+      query: (id) => ({ url: `/rules/retro/${id}`, method: "DELETE" }),
+      invalidatesTags: ["RetroJobs"],
     }),
     getTickInfo: builder.query<TickInfo, void>({
       query: () => `/tick_info`,
@@ -108,12 +205,24 @@ export const tulipApi = createApi({
 });
 
 export const {
+  useGetNamespacesQuery,
   useGetServicesQuery,
   useGetFlagRegexQuery,
   useGetFlowQuery,
   useGetFlowsQuery,
   useLazyGetFlowsQuery,
   useGetTagsQuery,
+  useCreateTagMutation,
+  useUpdateTagMutation,
+  useDeleteTagMutation,
+  useGetRulesQuery,
+  useCreateRuleMutation,
+  useUpdateRuleMutation,
+  useValidateRuleMutation,
+  useReloadRulesMutation,
+  useGetRetroJobsQuery,
+  useStartRetroJobMutation,
+  useCancelRetroJobMutation,
   useGetSignatureQuery,
   useGetTickInfoQuery,
   useLazyToPwnToolsQuery,
@@ -4,6 +4,7 @@ import type { Flow } from "../types";
 import {
   SERVICE_FILTER_KEY,
   TEXT_FILTER_KEY,
+  TEXT_MODE_KEY,
   START_FILTER_KEY,
   END_FILTER_KEY,
   CORRELATION_MODE_KEY,
@@ -58,7 +59,6 @@ export function Corrie() {
   const { data: services } = useGetServicesQuery();
   const includeTags = useAppSelector((state) => state.filter.includeTags);
   const excludeTags = useAppSelector((state) => state.filter.excludeTags);
-  const filterTags = useAppSelector((state) => state.filter.filterTags);
   const filterFlags = useAppSelector((state) => state.filter.filterFlags);
   const filterFlagids = useAppSelector((state) => state.filter.filterFlagids);
 
@@ -68,6 +68,7 @@ export function Corrie() {
   const service = services && services.find((s) => s.name == service_name);
 
   const text_filter = searchParams.get(TEXT_FILTER_KEY) ?? undefined;
+  const text_mode = searchParams.get(TEXT_MODE_KEY) ?? "search";
   const from_filter = searchParams.get(START_FILTER_KEY) ?? undefined;
   const to_filter = searchParams.get(END_FILTER_KEY) ?? undefined;
 
@@ -79,7 +80,10 @@ export function Corrie() {
 
   const { data: flowData, isLoading } = useGetFlowsQuery(
     {
-      "flow.data": debounced_text_filter,
+      "flow.data": text_mode === "regex" ? debounced_text_filter : undefined,
+      search: text_mode === "search" ? debounced_text_filter : undefined,
+      contains: text_mode === "bytes" ? debounced_text_filter : undefined,
+      query: text_mode === "query" ? debounced_text_filter : undefined,
       dst_ip: service?.ip,
       dst_port: service?.port,
       from_time: from_filter_num,
@@ -87,7 +91,6 @@ export function Corrie() {
       service: "", // FIXME
       includeTags: includeTags,
       excludeTags: excludeTags,
-      tags: filterTags,
       flags: filterFlags,
       flagids: filterFlagids,
     },
@@ -99,7 +102,7 @@ export function Corrie() {
 
   // TODO: fix the below transformation - move it to server
   // Diederik gives you a beer once it has been fixed
-  const transformedFlowData = flowData?.map((flow) => ({
+  const transformedFlowData = flowData?.flows.map((flow) => ({
     ...flow,
     service_tag:
       services?.find((s) => s.ip === flow.dst_ip && s.port === flow.dst_port)
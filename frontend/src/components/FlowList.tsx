@@ -5,6 +5,7 @@ import type { Flow } from "../types";
 import {
   SERVICE_FILTER_KEY,
   TEXT_FILTER_KEY,
+  TEXT_MODE_KEY,
   START_FILTER_KEY,
   END_FILTER_KEY,
   FLOW_LIST_REFETCH_INTERVAL_MS,
@@ -43,7 +44,8 @@ export function FlowList() {
   // Infinite scroll state
   const PAGE_SIZE = 50;
   const [allFlows, setAllFlows] = useState<Flow[]>([]);
-  const [hasMore, setHasMore] = useState(true);
+  const [nextCursor, setNextCursor] = useState<string | undefined>();
+  const hasMore = nextCursor !== undefined;
   const [isLoadingMore, setIsLoadingMore] = useState(false);
 
   const { data: availableTags } = useGetTagsQuery();
@@ -109,6 +111,7 @@ export function FlowList() {
   const service = services?.find((s) => s.name == serviceName);
 
   const text_filter = searchParams.get(TEXT_FILTER_KEY) ?? undefined;
+  const text_mode = searchParams.get(TEXT_MODE_KEY) ?? "search";
   const from_filter = searchParams.get(START_FILTER_KEY) ?? undefined;
   const to_filter = searchParams.get(END_FILTER_KEY) ?? undefined;
 
@@ -120,23 +123,26 @@ export function FlowList() {
 
   // Base query parameters
   const baseQuery = {
-    "flow.data": debounced_text_filter,
+    "flow.data": text_mode === "regex" ? debounced_text_filter : undefined,
+    search: text_mode === "search" ? debounced_text_filter : undefined,
+    contains: text_mode === "bytes" ? debounced_text_filter : undefined,
+    query: text_mode === "query" ? debounced_text_filter : undefined,
     dst_ip: service?.ip,
     dst_port: service?.port,
     from_time: from_filter_num,
     to_time: to_filter_num,
     service: service?.name ?? "",
-    tags: filterTags.include,
     flags: filterFlags,
     flagids: filterFlagids,
     includeTags: filterTags.include,
     excludeTags: filterTags.exclude,
     limit: PAGE_SIZE,
-    offset: 0,
+    count: "estimated" as const,
   };
 
   const {
     data: flowData,
+    error: flowError,
     isLoading,
     refetch,
   } = useGetFlowsQuery(
@@ -157,15 +163,14 @@ export function FlowList() {
     try {
       const result = await getFlowsTrigger({
         ...baseQuery,
-        offset: allFlows.length,
+        cursor: nextCursor,
+        count: undefined,
       }).unwrap();
-      
-      if (result.length < PAGE_SIZE) {
-        setHasMore(false);
-      }
-      
+
+      setNextCursor(result.next);
+
       // Transform new flows with service tags
-      const transformedNewFlows = result.map((flow) => ({
+      const transformedNewFlows = result.flows.map((flow) => ({
         ...flow,
         service_tag:
           services?.find((s) => s.ip === flow.dst_ip && s.port === flow.dst_port)
@@ -189,18 +194,18 @@ export function FlowList() {
   // Reset flows when filters change
   useEffect(() => {
     if (flowData) {
-      const transformed = flowData.map((flow) => ({
+      const transformed = flowData.flows.map((flow) => ({
         ...flow,
         service_tag:
           services?.find((s) => s.ip === flow.dst_ip && s.port === flow.dst_port)
             ?.name ?? "unknown",
       }));
       setAllFlows(transformed);
-      setHasMore(flowData.length === PAGE_SIZE);
+      setNextCursor(flowData.next);
     } else if (!isLoading) {
       // Clear flows if no data and not loading
       setAllFlows([]);
-      setHasMore(false);
+      setNextCursor(undefined);
     }
   }, [flowData, services, isLoading]);
 
@@ -288,7 +293,7 @@ export function FlowList() {
     "i",
     () => {
       setShowFilters(true);
-      if ((availableTags ?? []).includes("flag-in")) {
+      if ((availableTags ?? []).some((tag) => tag.name === "flag-in")) {
         dispatch(toggleFilterTag("flag-in"));
       }
     },
@@ -299,7 +304,7 @@ export function FlowList() {
     "o",
     () => {
       setShowFilters(true);
-      if ((availableTags ?? []).includes("flag-out")) {
+      if ((availableTags ?? []).some((tag) => tag.name === "flag-out")) {
         dispatch(toggleFilterTag("flag-out"));
       }
     },
@@ -315,13 +320,10 @@ export function FlowList() {
     setManualLoading(true);
     try {
       // Use lazy query to force a fresh request
-      const result = await getFlowsTrigger({
-        ...baseQuery,
-        offset: 0, // Always start from the beginning for refresh
-      }).unwrap();
+      const result = await getFlowsTrigger(baseQuery).unwrap();
       
       // Transform the data
-      const transformed = result.map((flow) => ({
+      const transformed = result.flows.map((flow) => ({
         ...flow,
         service_tag:
           services?.find((s) => s.ip === flow.dst_ip && s.port === flow.dst_port)
@@ -330,7 +332,7 @@ export function FlowList() {
       
       // Replace all flows with fresh data
       setAllFlows(transformed);
-      setHasMore(result.length === PAGE_SIZE);
+      setNextCursor(result.next);
       
       // Reset flow selection to first item and scroll to top
       setFlowIndex(0);
@@ -403,14 +405,16 @@ export function FlowList() {
             <div className="flex gap-2 flex-wrap">
               {(availableTags ?? []).map((tag) => (
                 <Tag
-                  key={tag}
-                  tag={tag}
+                  key={tag.name}
+                  tag={tag.name}
+                  color={tag.color}
+                  description={tag.description}
                   disabled={
-                    !filterTags.include.includes(tag) &&
-                    !filterTags.exclude.includes(tag)
+                    !filterTags.include.includes(tag.name) &&
+                    !filterTags.exclude.includes(tag.name)
                   }
-                  excluded={filterTags.exclude.includes(tag)}
-                  onClick={() => onTagClick(tag)}
+                  excluded={filterTags.exclude.includes(tag.name)}
+                  onClick={() => onTagClick(tag.name)}
                 />
               ))}
             </div>
@@ -431,6 +435,18 @@ export function FlowList() {
               <span className="text-gray-500 dark:text-gray-300 text-lg">Refreshing…</span>
             </div>
           )}
+          {flowError && "data" in flowError && (
+            <div className="px-2 py-1 text-xs text-red-600 dark:text-red-400 border-b border-gray-200 dark:border-gray-700">
+              {(flowError.data as { error?: string })?.error ??
+                "Invalid filters"}
+            </div>
+          )}
+          {flowData?.total !== undefined && (
+            <div className="px-2 py-1 text-xs text-gray-500 dark:text-gray-400 border-b border-gray-200 dark:border-gray-700">
+              {flowData.total}
+              {flowData.estimated ? "+" : ""} flows
+            </div>
+          )}
           <Virtuoso
             className={classNames(["flex", "flex-col", "flex-1"], {
               "sidebar-loading": isLoading,
@@ -494,6 +510,9 @@ function FlowListEntry({ flow, isActive, onHeartClick }: FlowListEntryProps) {
   const formatted_time_h_m_s = format(new Date(flow.time), "HH:mm:ss");
   const formatted_time_ms = format(new Date(flow.time), ".SSS");
 
+  // shared with the tag filter, fetched once
+  const { data: availableTags } = useGetTagsQuery();
+
   const isStarred = flow.tags.includes("starred");
   // Filter tag list for tags that are handled specially
   const filteredTagList = flow.tags.filter((t) => t != "starred");
@@ -559,9 +578,17 @@ function FlowListEntry({ flow, isActive, onHeartClick }: FlowListEntryProps) {
 
           <hr className="border-gray-200 dark:border-gray-700 my-2" />
           <div className="flex gap-2 flex-wrap">
-            {filteredTagList.map((tag) => (
-              <Tag key={tag} tag={tag}></Tag>
-            ))}
+            {filteredTagList.map((tag) => {
+              const info = availableTags?.find((t) => t.name === tag);
+              return (
+                <Tag
+                  key={tag}
+                  tag={tag}
+                  color={info?.color}
+                  description={info?.description}
+                ></Tag>
+              );
+            })}
           </div>
         </div>
       </div>
@@ -7,13 +7,58 @@ import {
   SERVICE_FILTER_KEY,
   START_FILTER_KEY,
   TEXT_FILTER_KEY,
+  TEXT_MODE_KEY,
   FIRST_DIFF_KEY,
   SECOND_DIFF_KEY,
   SERVICE_REFETCH_INTERVAL_MS,
   TICK_REFETCH_INTERVAL_MS,
 } from "../const";
 
-import { useGetServicesQuery, useGetTickInfoQuery } from "../api";
+import {
+  tulipApi,
+  useGetNamespacesQuery,
+  useGetServicesQuery,
+  useGetTickInfoQuery,
+} from "../api";
+import { useAppDispatch, useAppSelector } from "../store";
+import { setNamespace } from "../store/filter";
+
+function NamespaceSelection() {
+  const dispatch = useAppDispatch();
+  const namespace = useAppSelector((state) => state.filter.namespace);
+  const { data } = useGetNamespacesQuery();
+
+  // nothing to switch to until a previous game is archived
+  if (!data || data.namespaces.length <= 1) {
+    return null;
+  }
+
+  const onChangeNamespace = (event: React.ChangeEvent<HTMLSelectElement>) => {
+    const selected = event.target.value;
+    dispatch(setNamespace(selected === data.live ? undefined : selected));
+    // cached flows, tags and services belong to the previous namespace
+    dispatch(tulipApi.util.resetApiState());
+  };
+
+  return (
+    <select
+      className="w-28 border border-gray-300 dark:border-gray-700 rounded-md bg-gray-100 dark:bg-gray-800 text-gray-800 dark:text-gray-100 px-2 py-1 focus:outline-none focus:ring-2 focus:ring-blue-400 dark:focus:ring-blue-300 transition-colors"
+      title="Game"
+      value={namespace ?? data.live}
+      onChange={onChangeNamespace}
+    >
+      {data.namespaces.map((name) => (
+        <option
+          key={name}
+          value={name}
+          className="bg-white dark:bg-gray-800 text-gray-800 dark:text-gray-100"
+        >
+          {name === data.live ? `${name} (live)` : name}
+        </option>
+      ))}
+    </select>
+  );
+}
 
 function ServiceSelection() {
   const FILTER_KEY = SERVICE_FILTER_KEY;
@@ -59,9 +104,35 @@ function ServiceSelection() {
   );
 }
 
+const TEXT_MODES: Record<TextMode, { placeholder: string; title: string }> = {
+  search: {
+    placeholder: 'search: admin "GET /flag" -404',
+    title: 'Full-text search: words, prefix*, "phrases", AND, OR, NOT, -word, (groups)',
+  },
+  regex: {
+    placeholder: "regex",
+    title: "Case-insensitive regex on the payloads (slower)",
+  },
+  bytes: {
+    placeholder: "bytes: flag{ or |de ad be ef|",
+    title: "Case-sensitive byte sequence, with hex bytes between pipes",
+  },
+  query: {
+    placeholder: 'query: tag:flag-out not tag:starred data~"admin"',
+    title:
+      "Flow query: field:value, field:>n, field:a..b, src/dst:CIDR, data:search, data~regex, contains:bytes, and, or, not, (groups)",
+  },
+};
+
 function TextSearch() {
   const FILTER_KEY = TEXT_FILTER_KEY;
   const [searchParams, setSearchParams] = useSearchParams();
+  const [mode, setMode] = useSearchParam<TextMode>(
+    TEXT_MODE_KEY,
+    "search",
+    (value) => (value === "search" ? null : value),
+    (value) => value as TextMode,
+  );
 
   useHotkeys("s", (e) => {
     const el = document.getElementById("search") as HTMLInputElement;
@@ -71,10 +142,11 @@ function TextSearch() {
   });
 
   return (
-    <div>
+    <div className="flex gap-1">
       <input
         type="text"
-        placeholder="regex"
+        placeholder={TEXT_MODES[mode].placeholder}
+        title={TEXT_MODES[mode].title}
         id="search"
         value={searchParams.get(FILTER_KEY) || ""}
         onChange={(event) => {
@@ -88,6 +160,22 @@ function TextSearch() {
         }}
         className="w-full border border-gray-300 dark:border-gray-700 rounded-md bg-gray-100 dark:bg-gray-800 text-gray-800 dark:text-gray-100 px-2 py-1 focus:outline-none focus:ring-2 focus:ring-blue-400 dark:focus:ring-blue-300 transition-colors"
       />
+      <select
+        className="w-20 border border-gray-300 dark:border-gray-700 rounded-md bg-gray-100 dark:bg-gray-800 text-gray-800 dark:text-gray-100 px-2 py-1 focus:outline-none focus:ring-2 focus:ring-blue-400 dark:focus:ring-blue-300 transition-colors"
+        title="Search mode"
+        value={mode}
+        onChange={(event) => setMode(event.target.value as TextMode)}
+      >
+        {(Object.keys(TEXT_MODES) as TextMode[]).map((value) => (
+          <option
+            key={value}
+            value={value}
+            className="bg-white dark:bg-gray-800 text-gray-800 dark:text-gray-100"
+          >
+            {value}
+          </option>
+        ))}
+      </select>
     </div>
   );
 }
@@ -294,7 +382,7 @@ function Diff() {
 }
 
 import { useSearchParam } from "../store/param";
-import type { Service } from "../types";
+import type { Service, TextMode } from "../types";
 
 export function Header() {
   const [searchParams] = useSearchParams();
@@ -323,6 +411,11 @@ export function Header() {
       <div>
         <TextSearch></TextSearch>
       </div>
+      <div>
+        <Suspense>
+          <NamespaceSelection></NamespaceSelection>
+        </Suspense>
+      </div>
       <div>
         <Suspense>
           <ServiceSelection></ServiceSelection>
@@ -9,20 +9,31 @@ const computeColorFromString = (str: string) => {
   return Color(`hsl(${hue}, 100%, 50%)`).hex();
 };
 
-// Hardcode colors here
-const tagColorMap: Record<string, string> = {
-  fishy: "rgb(191, 219, 254)",
-  blocked: "rgb(233, 213, 255)",
-  flag_out: "rgb(254, 204, 204)",
-  flag_in: "rgb(209, 213, 219)",
+// Palette of the named colors of tags, as used in the Suricata rules
+// (`metadata: tag FLAG OUT, color danger;`)
+const namedColors: Record<string, string> = {
+  primary: "rgb(191, 219, 254)",
+  secondary: "rgb(229, 231, 235)",
+  success: "rgb(187, 247, 208)",
+  danger: "rgb(254, 204, 204)",
+  warning: "rgb(254, 240, 138)",
+  info: "rgb(165, 243, 252)",
+  light: "rgb(249, 250, 251)",
+  dark: "rgb(55, 65, 81)",
 };
 
-export function tagToColor(tag: string) {
-  return tagColorMap[tag] ?? computeColorFromString(tag);
+// tagToColor returns the color of a tag from the color of its record, named
+// or #rrggbb, or derives one from its name
+export function tagToColor(tag: string, color?: string) {
+  if (color) {
+    return namedColors[color] ?? color;
+  }
+  return computeColorFromString(tag);
 }
 interface TagProps {
   tag: string;
   color?: string;
+  description?: string;
   disabled?: boolean;
   excluded?: boolean;
   onClick?: () => void;
@@ -30,11 +41,12 @@ interface TagProps {
 export const Tag = ({
   tag,
   color,
+  description,
   disabled = false,
   excluded = false,
   onClick,
 }: TagProps) => {
-  let tagBackgroundColor = disabled ? undefined : (color ?? tagToColor(tag));
+  let tagBackgroundColor = disabled ? undefined : tagToColor(tag, color);
   let tagTextColor = disabled
     ? undefined
     : Color(tagBackgroundColor ?? "#eee").isDark()
@@ -49,6 +61,7 @@ export const Tag = ({
   return (
     <div
       onClick={onClick}
+      title={description || undefined}
       className={classNames(
         "p-3 cursor-pointer rounded-md uppercase text-xs h-5 text-center flex items-center hover:opacity-90 transition-colors duration-250 text-ellipsis overflow-hidden whitespace-nowrap border",
         {
@@ -1,6 +1,10 @@
 export const API_BASE_PATH = "/api";
+// Header selecting the namespace (game) of API requests
+export const NAMESPACE_HEADER = "X-Tulip-Namespace";
 
 export const TEXT_FILTER_KEY = "text";
+// How the text filter is applied, see TextMode
+export const TEXT_MODE_KEY = "mode";
 export const SERVICE_FILTER_KEY = "service";
 export const START_FILTER_KEY = "start";
 export const END_FILTER_KEY = "end";
@@ -5,6 +5,7 @@ import type { FlowData, FullFlow } from "../types";
 import { Buffer } from "buffer";
 import {
   TEXT_FILTER_KEY,
+  TEXT_MODE_KEY,
   MAX_LENGTH_FOR_HIGHLIGHT,
   API_BASE_PATH,
 } from "../const";
@@ -25,6 +26,7 @@ import {
   useToSinglePythonRequestQuery,
   useGetFlagRegexQuery,
 } from "../api";
+import { useAppSelector } from "../store";
 import escapeStringRegexp from "escape-string-regexp";
 
 const SECONDARY_NAVBAR_HEIGHT = 50;
@@ -384,6 +386,22 @@ function FlowOverview({ flow }: { flow: FullFlow }) {
   const FILTER_KEY = TEXT_FILTER_KEY;
 
   const [searchParams, setSearchParams] = useSearchParams();
+  // write the value as the current text filter mode expects it
+  const filterFor = (value: string) => {
+    switch (searchParams.get(TEXT_MODE_KEY)) {
+      case "regex":
+        return escapeStringRegexp(value);
+      case "bytes":
+        return value.replaceAll("\\", "\\\\").replaceAll("|", "\\|");
+      default:
+        return `"${value.replaceAll('"', " ")}"`;
+    }
+  };
+  const namespace = useAppSelector((state) => state.filter.namespace);
+  // links are not fetched through the API slice, pass the namespace explicitly
+  const namespaceParam = namespace
+    ? `namespace=${encodeURIComponent(namespace)}`
+    : "";
 
   return (
     <div>
@@ -407,7 +425,7 @@ function FlowOverview({ flow }: { flow: FullFlow }) {
             <tbody>
               {flow.signatures.map((sig) => {
                 return (
-                  <tr key={sig.id}>
+                  <tr key={sig._id}>
                     <td className="text-right">
                       <code>{sig.id}</code>
                     </td>
@@ -438,13 +456,24 @@ function FlowOverview({ flow }: { flow: FullFlow }) {
           <span>
             <a
               className="underline"
-              href={`${API_BASE_PATH}/download/?file=${flow.filename}`}
+              href={`${API_BASE_PATH}/download/?file=${flow.filename}&${namespaceParam}`}
             >
               {flow.filename}
               <ArrowDownTrayIcon className="inline-flex items-baseline w-5 h-5" />
             </a>
           </span>
 
+          <span className="text-right">Packets: </span>
+          <span>
+            <a
+              className="underline"
+              href={`${API_BASE_PATH}/flow/${flow._id}/pcap?${namespaceParam}`}
+            >
+              flow-{flow._id}.pcap
+              <ArrowDownTrayIcon className="inline-flex items-baseline w-5 h-5" />
+            </a>
+          </span>
+
           <div className="text-right">Tags: </div>
           <div>[{flow.tags.join(", ")}]</div>
 
@@ -459,7 +488,7 @@ function FlowOverview({ flow }: { flow: FullFlow }) {
                   className="underline hover:bg-gray-100 dark:hover:bg-gray-700 cursor-pointer"
                   title="Filter by this flag"
                   onClick={() => {
-                    searchParams.set(FILTER_KEY, escapeStringRegexp(query));
+                    searchParams.set(FILTER_KEY, filterFor(query));
                     setSearchParams(searchParams);
                   }}
                 >
@@ -478,7 +507,7 @@ function FlowOverview({ flow }: { flow: FullFlow }) {
                 <button
                   className="font-bold"
                   onClick={() => {
-                    searchParams.set(FILTER_KEY, escapeStringRegexp(query));
+                    searchParams.set(FILTER_KEY, filterFor(query));
                     setSearchParams(searchParams);
                   }}
                 >
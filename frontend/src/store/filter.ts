@@ -6,6 +6,8 @@ export interface TulipFilterState {
   filterFlagids: string[];
   includeTags: string[];
   excludeTags: string[];
+  // Namespace (game) being browsed, the live one if undefined
+  namespace?: string;
   // startTick?: number;
   // endTick?: number;
   // service?: string;
@@ -68,9 +70,12 @@ export const filterSlice = createSlice({
         ? state.filterFlagids.filter((t) => t !== action.payload)
         : [...state.filterFlagids, action.payload];
     },
+    setNamespace: (state, action: PayloadAction<string | undefined>) => {
+      state.namespace = action.payload;
+    },
   },
 });
 
-export const { toggleFilterTag } = filterSlice.actions;
+export const { toggleFilterTag, setNamespace } = filterSlice.actions;
 
 export default filterSlice.reducer;
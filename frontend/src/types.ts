@@ -16,6 +16,36 @@ export interface Flow {
   flagids: string[];
   suricata: number[];
   filename: string;
+  tick: number;
+  service: string;
+  community_id: string;
+  app: AppLayer;
+  vars: RuleVars;
+}
+
+// Variables set on a flow by the Suricata rules, the fields are missing when
+// empty
+export interface RuleVars {
+  flowints?: Record<string, number>; // e.g. tag_FLAG_OUT, at the highest value reported
+  flowvars?: { name: string; value: string }[]; // e.g. the flow:match captures
+}
+
+// Metadata of the Suricata app-layer events of a flow, the fields are
+// missing when empty
+export interface AppLayer {
+  protocols?: string[];
+  hostnames?: string[];
+  urls?: string[];
+  statuses?: number[];
+  user_agents?: string[];
+  ja3?: string[];
+  file_hashes?: string[];
+  anomalies?: string[];
+}
+
+export interface Namespaces {
+  live: string;
+  namespaces: string[];
 }
 
 export interface TickInfo {
@@ -37,27 +67,106 @@ export interface FlowData {
   time: number;
 }
 
+export interface TagInfo {
+  name: string;
+  color: string; // a named color (danger, success, ...) or #rrggbb, empty to derive one from the name
+  description: string;
+  origin: "" | "assembler" | "suricata" | "user" | "rule";
+  created_at: number;
+}
+
+export interface Rule {
+  sid: number;
+  rev?: number;
+  msg: string;
+  action: string;
+  enabled: boolean; // disabled rules are commented out in the rule file
+  rule: string;
+  line: number;
+}
+
+export interface RuleReload {
+  ok: boolean;
+  error?: string;
+  failed_rules?: { rule: string; filename?: string; line?: number }[];
+}
+
+export interface RuleChange {
+  rule: Rule;
+  reload?: RuleReload; // missing when the API has no Suricata socket
+}
+
+export interface RetroJob {
+  id: number;
+  namespace: string;
+  sids: number[];
+  state: "running" | "done" | "failed" | "cancelled";
+  error?: string;
+  total: number; // flows to scan
+  scanned: number;
+  matched: number; // signatures attached to flows
+  skipped?: { sid: number; error: string }[]; // rules the matcher does not support
+  started_at: number;
+  finished_at?: number;
+}
+
 export interface Signature {
+  _id: Id;
+  gid: number;
   id: number;
+  rev: number;
   msg: string;
   action: string;
+  tags?: string[];
+  severity: number; // 1 for the most severe, 0 if unknown
+  category: string;
+}
+
+export interface SignatureStats {
+  signature: Signature;
+  hits: number;
+  ticks: { tick: number; hits: number }[];
 }
 
 export type FlowsQuery = {
-  // Text filter
+  // Text filter, as a regex, a full-text search or a byte pattern
   "flow.data"?: string;
+  search?: string;
+  contains?: string;
+  query?: string; // Flow query language, see TextMode
   service: string;
+  src_ip?: string;
+  src_port?: number;
   dst_ip?: string; // TODO: remove this, use service
   dst_port?: number; // TODO: remove this, use service
   from_time?: number;
   to_time?: number;
+  tick?: number;
+  tick_from?: number;
+  tick_to?: number;
   includeTags: string[];
   excludeTags: string[];
-  tags: string[];
   flags: string[];
   flagids: string[];
+  // Inclusive ranges, in milliseconds, bytes and packets
+  duration_min?: number;
+  duration_max?: number;
+  size_min?: number;
+  size_max?: number;
+  packets_min?: number;
+  packets_max?: number;
   limit?: number;
-  offset?: number;
+  offset?: number; // slower than cursor on deep pages
+  cursor?: string; // next or prev of a previous page
+  count?: "exact" | "estimated";
+};
+
+export type FlowsPage = {
+  flows: Flow[];
+  next?: string; // cursor of the older flows, missing on the last page
+  prev?: string; // cursor of the newer flows, missing on an empty page
+  total?: number; // flows matching the query, if requested with count
+  estimated?: boolean; // total stopped counting, there are more flows
 };
 
 export type Service = {
@@ -65,3 +174,8 @@ export type Service = {
   port: number;
   name: string;
 };
+
+// search: full-text search, regex: regex on the payloads,
+// bytes: byte sequence with |hex| parts, as in Suricata rules,
+// query: flow query language, e.g. service:web tag:flag-out tick:>40
+export type TextMode = "search" | "regex" | "bytes" | "query";
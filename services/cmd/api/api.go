@@ -6,57 +6,192 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"tulip/pkg/assembler"
 	"tulip/pkg/db"
+	"tulip/pkg/lifecycle"
 
 	"github.com/labstack/echo/v4"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// maxPcapExportFlows is the maximum number of flows exported by /query/pcap.
+const maxPcapExportFlows = 1000
+
+// maxEstimatedCount is where /query stops counting the flows for an
+// estimated total.
+const maxEstimatedCount = 10000
+
+// namespaceHeader selects the namespace (game) a request works on. The
+// "namespace" query parameter can be used instead, e.g. in download links.
+const namespaceHeader = "X-Tulip-Namespace"
+
 // Router holds dependencies for handlers
 type Router struct {
-	DB     db.MongoDatabase
+	DB     db.Database // Namespace of the live game, used when a request does not select one
 	Config *Config
+
+	mu         sync.Mutex
+	namespaces map[string]db.Database // Handles of the other namespaces, by name
+	rulesMu    sync.Mutex             // Serializes the edits of the rule file
+	jobsMu     sync.Mutex
+	jobs       []*retroJob // Retro matching jobs, oldest first
 }
 
 // RegisterRoutes registers all API endpoints to the Echo router
 func (api *Router) RegisterRoutes(e *echo.Echo) {
+	e.Use(api.selectNamespace)
+
 	e.GET("/", api.helloWorld)
+	e.GET("/namespaces", api.getNamespaces)
 	e.GET("/tick_info", api.getTickInfo)
 	e.GET("/tags", api.getTags)
 	e.GET("/signature/:id", api.getSignature)
+	e.GET("/signatures/top", api.getTopSignatures)
+	e.GET("/dead_letters", api.getDeadLetters)
 	e.GET("/star/:flow_id/:star_to_set", api.setStar)
 	e.GET("/services", api.getServices)
 	e.GET("/flag_regex", api.getFlagRegex)
 	e.GET("/flow/:id", api.getFlowDetail)
+	e.GET("/flow/:id/pcap", api.exportFlowPcap)
 	e.GET("/to_python_request/:id", api.convertToPythonRequests)
 	e.GET("/to_pwn/:id", api.convertToPwn)
 	e.GET("/download/", api.downloadFile)
+	e.GET("/archive", api.getArchivedTicks)
 
 	e.POST("/query", api.query)
+	e.POST("/query/pcap", api.exportQueryPcap)
 	e.POST("/to_single_python_request", api.convertToSinglePythonRequest)
+	e.POST("/archive/:tick/restore", api.restoreTick)
+	e.POST("/tags", api.createTag)
+	e.PUT("/tags/:name", api.updateTag)
+	e.DELETE("/tags/:name", api.deleteTag)
+	e.GET("/rules", api.getRules)
+	e.POST("/rules", api.createRule)
+	e.POST("/rules/validate", api.validateRule)
+	e.POST("/rules/reload", api.reloadRules)
+	e.PUT("/rules/:sid", api.updateRule)
+	e.GET("/rules/retro", api.getRetroJobs)
+	e.POST("/rules/retro", api.startRetroJob)
+	e.DELETE("/rules/retro/:id", api.cancelRetroJob)
 }
 
 type apiError struct {
 	Error string `json:"error"`
 }
 
+// selectNamespace stores in the context the database of the namespace
+// requested through namespaceHeader, see Router.db.
+func (api *Router) selectNamespace(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.Request().Header.Get(namespaceHeader)
+		if name == "" {
+			name = c.QueryParam("namespace")
+		}
+		if name == "" || name == api.DB.Namespace() {
+			c.Set("db", api.DB)
+			return next(c)
+		}
+
+		if err := db.ValidateNamespace(name); err != nil {
+			return c.JSON(http.StatusBadRequest, apiError{err.Error()})
+		}
+		database, err := api.namespace(c.Request().Context(), name)
+		var schemaErr *db.SchemaError
+		if errors.Is(err, db.ErrNotFound) {
+			return c.JSON(http.StatusNotFound, apiError{"Namespace not found"})
+		} else if errors.As(err, &schemaErr) {
+			return c.JSON(http.StatusConflict, apiError{err.Error()})
+		} else if err != nil {
+			slog.Error("Failed to open namespace", slog.String("namespace", name), slog.Any("err", err))
+			return c.JSON(http.StatusInternalServerError, apiError{"Could not open namespace. See server logs for details."})
+		}
+		c.Set("db", database)
+		return next(c)
+	}
+}
+
+// namespace returns the database of an existing namespace, ErrNotFound if it
+// holds no data and a SchemaError if it must be migrated first.
+func (api *Router) namespace(ctx context.Context, name string) (db.Database, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	if database, ok := api.namespaces[name]; ok {
+		return database, nil
+	}
+
+	names, err := api.DB.ListNamespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(names, name) {
+		return nil, db.ErrNotFound
+	}
+
+	database, err := api.DB.WithNamespace(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.CheckSchema(ctx, database); err != nil {
+		return nil, err
+	}
+	if api.namespaces == nil {
+		api.namespaces = make(map[string]db.Database)
+	}
+	api.namespaces[name] = database
+	return database, nil
+}
+
+// db returns the database of the namespace selected by the request.
+func (api *Router) db(c echo.Context) db.Database {
+	if database, ok := c.Get("db").(db.Database); ok {
+		return database
+	}
+	return api.DB
+}
+
 // --- Handlers ---
 
 func (api *Router) helloWorld(c echo.Context) error {
 	return c.String(http.StatusOK, "Hello, World!")
 }
 
+func (api *Router) getNamespaces(c echo.Context) error {
+	type namespaces struct {
+		Live       string   `json:"live"`       // Namespace used when a request does not select one
+		Namespaces []string `json:"namespaces"` // Namespaces holding data, including the live one
+	}
+
+	names, err := api.DB.ListNamespaces(c.Request().Context())
+	if err != nil {
+		slog.Error("Failed to list namespaces", slog.Any("err", err))
+		return c.JSON(http.StatusInternalServerError, apiError{"Could not list namespaces. See server logs for details."})
+	}
+	if !slices.Contains(names, api.DB.Namespace()) {
+		// the live game may have no flows yet
+		names = append(names, api.DB.Namespace())
+		slices.Sort(names)
+	}
+	return c.JSON(http.StatusOK, namespaces{Live: api.DB.Namespace(), Namespaces: names})
+}
+
 func (api *Router) getTickInfo(c echo.Context) error {
 	type tickInfo struct {
 		StartDate  string `json:"startDate"`  // Start date of the tick
@@ -67,93 +202,220 @@ func (api *Router) getTickInfo(c echo.Context) error {
 	return c.JSON(http.StatusOK, info)
 }
 
-func (api *Router) query(c echo.Context) error {
-
-	// TODO: this is horrible, the API layer should not be aware of the database structure
+// badFlowQuery reports an error returned by parseFlowQuery. Errors in the
+// query language also carry their byte offset in the query, for the clients
+// to point at it.
+func badFlowQuery(c echo.Context, err error) error {
+	var queryErr *db.QueryError
+	if errors.As(err, &queryErr) {
+		return c.JSON(http.StatusBadRequest, struct {
+			apiError
+			Position int `json:"position"`
+		}{apiError{err.Error()}, queryErr.Pos})
+	}
+	return c.JSON(http.StatusBadRequest, apiError{err.Error()})
+}
 
+// parseFlowQuery builds the flow filters from a /query request body, along
+// with the requested total count: "exact", "estimated" or empty for none.
+// Unknown fields and invalid values are errors, to be reported with
+// badFlowQuery.
+func (api *Router) parseFlowQuery(c echo.Context) (*db.GetFlowsOptions, string, error) {
 	type flowQueryRequest struct {
+		Query       string   `json:"query"` // Flow query language, see db.ParseFlowQuery
 		IncludeTags []string `json:"includeTags"`
 		ExcludeTags []string `json:"excludeTags"`
-		FlowData    string   `json:"flow.data"`
+		FlowData    string   `json:"flow.data"` // Regex on the payloads
+		Search      string   `json:"search"`    // Full-text search on the payloads
+		Contains    string   `json:"contains"`  // Byte pattern in the payloads
+		SrcIp       string   `json:"src_ip"`
+		SrcPort     int      `json:"src_port"`
 		DstIp       string   `json:"dst_ip"`
-		DstPort     int      `json:"dst_port"`
+		DstPort     int      `json:"dst_port"` // -1 for the ports of no service
 		FromTime    int64    `json:"from_time"`
 		ToTime      int64    `json:"to_time"`
 		FlagIds     []string `json:"flagids"`
 		Flags       []string `json:"flags"`
 		Service     string   `json:"service"`
+		Tick        *int     `json:"tick"`
+		TickFrom    *int     `json:"tick_from"`
+		TickTo      *int     `json:"tick_to"`
+		DurationMin *int     `json:"duration_min"` // Milliseconds
+		DurationMax *int     `json:"duration_max"`
+		SizeMin     *int     `json:"size_min"` // Bytes
+		SizeMax     *int     `json:"size_max"`
+		PacketsMin  *int     `json:"packets_min"`
+		PacketsMax  *int     `json:"packets_max"`
 		Limit       int      `json:"limit"`
-		Offset      int      `json:"offset"`
+		Offset      int      `json:"offset"` // Slower than cursor on deep pages
+		Cursor      string   `json:"cursor"` // next or prev cursor of a previous response
+		Count       string   `json:"count"`  // Total to return, exact or estimated
+
+		// Suricata app-layer metadata, see db.AppLayer
+		Hostname   string `json:"hostname"`
+		URL        string `json:"url"`
+		HTTPStatus int    `json:"http_status"`
+		UserAgent  string `json:"user_agent"`
+		JA3        string `json:"ja3"`
+		FileHash   string `json:"file_hash"`
+		Anomaly    string `json:"anomaly"`
 	}
 
 	var req flowQueryRequest
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, apiError{Error: "Invalid request format"})
+	dec := json.NewDecoder(c.Request().Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return nil, "", fmt.Errorf("invalid request body: %v", err)
 	}
 
-	filter := bson.D{}
-
-	// Handle "flow.data" regex filter
+	for name, ip := range map[string]string{"src_ip": req.SrcIp, "dst_ip": req.DstIp} {
+		if ip != "" && net.ParseIP(ip) == nil {
+			return nil, "", fmt.Errorf("invalid %s %q", name, ip)
+		}
+	}
+	if req.SrcPort < 0 || req.SrcPort > 65535 {
+		return nil, "", fmt.Errorf("invalid src_port %d", req.SrcPort)
+	}
+	if req.DstPort < -1 || req.DstPort > 65535 {
+		return nil, "", fmt.Errorf("invalid dst_port %d", req.DstPort)
+	}
+	if req.FromTime < 0 || req.ToTime < 0 {
+		return nil, "", errors.New("from_time and to_time must not be negative")
+	}
+	if req.Limit < 0 || req.Offset < 0 {
+		return nil, "", errors.New("limit and offset must not be negative")
+	}
+	if req.Cursor != "" && req.Offset > 0 {
+		return nil, "", errors.New("cursor cannot be combined with offset")
+	}
+	if req.Count != "" && req.Count != "exact" && req.Count != "estimated" {
+		return nil, "", fmt.Errorf("invalid count %q, want exact or estimated", req.Count)
+	}
 	if req.FlowData != "" {
-		filter = append(filter, bson.E{
-			Key: "flow.data",
-			Value: bson.M{
-				"$regex":   req.FlowData,
-				"$options": "i", // Case-insensitive regex
-			},
-		})
-	}
-
-	// Handle "dst_ip"
-	if req.DstIp != "" {
-		filter = append(filter, bson.E{Key: "dst_ip", Value: req.DstIp})
-	}
-
-	// Handle "dst_port"
-	if req.DstPort != 0 {
-		if req.DstPort == -1 {
-			// Remove dst_ip
-			for i, e := range filter {
-				if e.Key == "dst_ip" {
-					filter = append(filter[:i], filter[i+1:]...)
-					break
-				}
-			}
+		if _, err := regexp.Compile("(?i)" + req.FlowData); err != nil {
+			return nil, "", fmt.Errorf("invalid flow.data regex: %v", err)
+		}
+	}
+	if req.HTTPStatus < 0 {
+		return nil, "", fmt.Errorf("invalid http_status %d", req.HTTPStatus)
+	}
+	if req.Tick != nil {
+		if req.TickFrom != nil || req.TickTo != nil {
+			return nil, "", errors.New("tick cannot be combined with tick_from or tick_to")
+		}
+		req.TickFrom, req.TickTo = req.Tick, req.Tick
+	}
+	if req.TickFrom != nil && req.TickTo != nil && *req.TickFrom > *req.TickTo {
+		return nil, "", errors.New("tick_from is after tick_to")
+	}
+	for name, bounds := range map[string][2]*int{
+		"duration": {req.DurationMin, req.DurationMax},
+		"size":     {req.SizeMin, req.SizeMax},
+		"packets":  {req.PacketsMin, req.PacketsMax},
+	} {
+		if err := checkRange(name, bounds[0], bounds[1]); err != nil {
+			return nil, "", err
+		}
+	}
+
+	opts := &db.GetFlowsOptions{
+		FromTime:    req.FromTime,
+		ToTime:      req.ToTime,
+		IncludeTags: req.IncludeTags,
+		ExcludeTags: req.ExcludeTags,
+		SrcIp:       req.SrcIp,
+		SrcPort:     req.SrcPort,
+		DstIp:       req.DstIp,
+		DstPort:     req.DstPort,
+		Limit:       req.Limit,
+		Offset:      req.Offset,
+		FlowData:    req.FlowData,
+		Flags:       req.Flags,
+		FlagIds:     req.FlagIds,
+		DurationMin: req.DurationMin,
+		DurationMax: req.DurationMax,
+		SizeMin:     req.SizeMin,
+		SizeMax:     req.SizeMax,
+		PacketsMin:  req.PacketsMin,
+		PacketsMax:  req.PacketsMax,
+
+		// Tick and service are stamped on the flows by the assembler
+		TickFrom: req.TickFrom,
+		TickTo:   req.TickTo,
+		Service:  req.Service,
+
+		// App-layer metadata is attached to the flows by the enricher
+		Hostname:   req.Hostname,
+		URL:        req.URL,
+		HTTPStatus: req.HTTPStatus,
+		UserAgent:  req.UserAgent,
+		JA3:        req.JA3,
+		FileHash:   req.FileHash,
+		Anomaly:    req.Anomaly,
+	}
 
-			// Exclude all service ports
-			ninPorts := []int{}
-			for _, svc := range api.Config.Services {
-				if svc.Port != 0 {
-					ninPorts = append(ninPorts, svc.Port)
-				}
+	if req.DstPort == -1 {
+		// the traffic of no service: any address, but none of the service ports
+		opts.DstIp, opts.DstPort = "", 0
+		for _, svc := range api.Config.Services {
+			if svc.Port != 0 {
+				opts.ExcludePorts = append(opts.ExcludePorts, svc.Port)
 			}
-			filter = append(filter, bson.E{Key: "dst_port", Value: bson.M{"$nin": ninPorts}})
-		} else {
-			filter = append(filter, bson.E{Key: "dst_port", Value: req.DstPort})
 		}
 	}
 
-	// Handle time range
-	if req.FromTime != 0 && req.ToTime != 0 {
-		filter = append(filter, bson.E{Key: "time", Value: bson.D{
-			{Key: "$gte", Value: req.FromTime},
-			{Key: "$lt", Value: req.ToTime},
-		}})
+	if req.Cursor != "" {
+		cursor, err := db.ParseFlowCursor(req.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		opts.Cursor = &cursor
+	}
+	if req.Search != "" {
+		if _, err := db.ParseSearch(req.Search); err != nil {
+			return nil, "", err
+		}
+		opts.Search = req.Search
+	}
+	if req.Contains != "" {
+		pattern, err := db.ParsePattern(req.Contains)
+		if err != nil {
+			return nil, "", err
+		}
+		opts.Contains = pattern
+	}
+	if req.Query != "" {
+		query, err := db.ParseFlowQuery(req.Query)
+		if err != nil {
+			return nil, "", err
+		}
+		opts.Query = query
 	}
 
-	// Handle tags
-	tagQueries := bson.M{}
+	return opts, req.Count, nil
+}
 
-	if len(req.IncludeTags) > 0 {
-		tagQueries["$all"] = req.IncludeTags
+// checkRange validates the optional bounds of a name_min and name_max pair of
+// /query filters.
+func checkRange(name string, lo, hi *int) error {
+	switch {
+	case (lo != nil && *lo < 0) || (hi != nil && *hi < 0):
+		return fmt.Errorf("%s_min and %s_max must not be negative", name, name)
+	case lo != nil && hi != nil && *lo > *hi:
+		return fmt.Errorf("%s_min is greater than %s_max", name, name)
 	}
+	return nil
+}
 
-	if len(req.ExcludeTags) > 0 {
-		tagQueries["$nin"] = req.ExcludeTags
+func (api *Router) query(c echo.Context) error {
+	opts, count, err := api.parseFlowQuery(c)
+	if err != nil {
+		return badFlowQuery(c, err)
 	}
 
-	if len(tagQueries) > 0 {
-		filter = append(filter, bson.E{Key: "tags", Value: tagQueries})
+	// Set default limit if not specified
+	if opts.Limit <= 0 {
+		opts.Limit = 50
 	}
 
 	type apiFlowEntry struct {
@@ -176,77 +438,50 @@ func (api *Router) query(c echo.Context) error {
 		Size         int                `json:"size"`    // Size of the flow in bytes
 		Flags        []string           `json:"flags"`   // Flags contained in the flow
 		Flagids      []string           `json:"flagids"` // Flag IDs associated with this flow
+		Tick         int                `json:"tick"`    // Game tick the flow started in, -1 if unknown
+		Service      string             `json:"service"` // Name of the game service, empty if none
+		App          db.AppLayer        `json:"app"`     // Suricata app-layer metadata
+		Vars         db.RuleVars        `json:"vars"`    // Flowints and flowvars set by the Suricata rules
 	}
 
-	// Convert bson.D filter to GetFlowsOptions
-	opts := &db.GetFlowsOptions{
-		Limit:  req.Limit,
-		Offset: req.Offset,
+	type flowPage struct {
+		Flows     []apiFlowEntry `json:"flows"`
+		Next      string         `json:"next,omitempty"`      // Cursor of the older flows, missing on the last page
+		Prev      string         `json:"prev,omitempty"`      // Cursor of the newer flows, missing on an empty page
+		Total     *int           `json:"total,omitempty"`     // Flows matching the filters, if requested with count
+		Estimated bool           `json:"estimated,omitempty"` // Total stopped counting at maxEstimatedCount
 	}
 
-	// Set default limit if not specified
-	if opts.Limit <= 0 {
-		opts.Limit = 50
+	database := api.db(c)
+	page, err := db.GetFlowPage(c.Request().Context(), database, opts)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 	}
 
-	// Parse filter to populate options
-	for _, elem := range filter {
-		switch elem.Key {
-		case "dst_ip":
-			if str, ok := elem.Value.(string); ok {
-				opts.DstIp = str
-			}
-		case "dst_port":
-			if port, ok := elem.Value.(int); ok {
-				opts.DstPort = port
-			}
-		case "time":
-			if timeRange, ok := elem.Value.(bson.D); ok {
-				for _, timeElem := range timeRange {
-					switch timeElem.Key {
-					case "$gte":
-						if val, ok := timeElem.Value.(int64); ok {
-							opts.FromTime = val
-						}
-					case "$lt":
-						if val, ok := timeElem.Value.(int64); ok {
-							opts.ToTime = val
-						}
-					}
-				}
-			}
-		case "tags":
-			if tagQuery, ok := elem.Value.(bson.M); ok {
-				if all, exists := tagQuery["$all"]; exists {
-					if tags, ok := all.([]string); ok {
-						opts.IncludeTags = tags
-					}
-				}
-				if nin, exists := tagQuery["$nin"]; exists {
-					if tags, ok := nin.([]string); ok {
-						opts.ExcludeTags = tags
-					}
-				}
-			}
-		case "flow.data":
-			if regexQuery, ok := elem.Value.(bson.M); ok {
-				if regex, exists := regexQuery["$regex"]; exists {
-					if str, ok := regex.(string); ok {
-						opts.FlowData = str
-					}
-				}
-			}
-		}
+	var res flowPage
+	if page.Next != nil {
+		res.Next = page.Next.String()
 	}
-
-	results, err := api.DB.GetFlows(c.Request().Context(), opts)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	if page.Prev != nil {
+		res.Prev = page.Prev.String()
+	}
+	if count != "" {
+		countOpts := *opts
+		// an exact total of a full scan would decompress the whole namespace
+		if count == "estimated" || opts.FullScan() {
+			countOpts.MaxCount = maxEstimatedCount
+		}
+		total, err := database.CountFlows(c.Request().Context(), &countOpts)
+		if err != nil {
+			slog.Error("Failed to count flows", slog.Any("err", err))
+			return c.JSON(http.StatusInternalServerError, apiError{"Could not count flows. See server logs for details."})
+		}
+		res.Total, res.Estimated = &total, countOpts.Capped(total)
 	}
 
-	apiResults := make([]apiFlowEntry, len(results))
-	for i, flow := range results {
-		res := apiFlowEntry{
+	res.Flows = make([]apiFlowEntry, len(page.Flows))
+	for i, flow := range page.Flows {
+		entry := apiFlowEntry{
 			Id:           flow.Id,
 			SrcPort:      flow.SrcPort,
 			DstPort:      flow.DstPort,
@@ -265,27 +500,31 @@ func (api *Router) query(c echo.Context) error {
 			Size:         flow.Size,
 			Flags:        flow.Flags,
 			Flagids:      flow.Flagids,
+			Tick:         flow.Tick,
+			Service:      flow.Service,
+			App:          flow.App,
+			Vars:         flow.Vars,
 		}
 
-		res.Signatures = make([]db.Signature, 0, len(flow.Suricata))
+		entry.Signatures = make([]db.Signature, 0, len(flow.Suricata))
 		for _, sigID := range flow.Suricata {
-			sig, err := api.DB.GetSignature(sigID)
+			sig, err := database.GetSignature(c.Request().Context(), sigID)
 			if err != nil {
 				slog.Error("Failed to fetch signature", slog.String("id", sigID), slog.Any("err", err))
 				return c.JSON(http.StatusInternalServerError,
 					apiError{"Could not fetch signature. See server logs for details."})
 			}
-			res.Signatures = append(res.Signatures, sig)
+			entry.Signatures = append(entry.Signatures, sig)
 		}
 
-		apiResults[i] = res
+		res.Flows[i] = entry
 	}
 
-	return c.JSON(http.StatusOK, apiResults)
+	return c.JSON(http.StatusOK, res)
 }
 
 func (api *Router) getTags(c echo.Context) error {
-	tags, err := api.DB.GetTagList()
+	tags, err := api.db(c).GetTags(c.Request().Context())
 	if err != nil {
 		slog.Error("Failed to fetch tags", slog.Any("err", err))
 		return c.JSON(http.StatusInternalServerError, apiError{"Could not fetch tags. See server logs for details."})
@@ -293,28 +532,229 @@ func (api *Router) getTags(c echo.Context) error {
 	return c.JSON(http.StatusOK, tags)
 }
 
+// tagRequest is the body of the requests creating or updating a tag.
+type tagRequest struct {
+	Name        string `json:"name"` // Only used when creating a tag
+	Color       string `json:"color"`
+	Description string `json:"description"`
+}
+
+// findTag returns the tag called name, registered or found on flows.
+func findTag(ctx context.Context, database db.Database, name string) (db.Tag, error) {
+	tags, err := database.GetTags(ctx)
+	if err != nil {
+		return db.Tag{}, err
+	}
+	for _, tag := range tags {
+		if tag.Name == name {
+			return tag, nil
+		}
+	}
+	return db.Tag{}, db.ErrNotFound
+}
+
+func (api *Router) createTag(c echo.Context) error {
+	var req tagRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{"Invalid request body"})
+	}
+	tag := db.Tag{
+		Name:        req.Name,
+		Color:       req.Color,
+		Description: req.Description,
+		Origin:      db.TagOriginUser,
+		CreatedAt:   time.Now().UnixMilli(),
+	}
+	if err := db.ValidateTag(tag); err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{err.Error()})
+	}
+
+	ctx := c.Request().Context()
+	database := api.db(c)
+	if _, err := findTag(ctx, database, tag.Name); err == nil {
+		return c.JSON(http.StatusConflict, apiError{"Tag already exists"})
+	} else if !errors.Is(err, db.ErrNotFound) {
+		slog.Error("Failed to fetch tags", slog.Any("err", err))
+		return c.JSON(http.StatusInternalServerError, apiError{"Could not fetch tags. See server logs for details."})
+	}
+	if err := database.InsertTag(ctx, tag); err != nil {
+		slog.Error("Failed to create tag", slog.String("tag", tag.Name), slog.Any("err", err))
+		return c.JSON(http.StatusInternalServerError, apiError{"Could not create tag. See server logs for details."})
+	}
+	return c.JSON(http.StatusCreated, tag)
+}
+
+func (api *Router) updateTag(c echo.Context) error {
+	var req tagRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{"Invalid request body"})
+	}
+	tag := db.Tag{Name: c.Param("name"), Color: req.Color, Description: req.Description, Origin: db.TagOriginUser}
+	if err := db.ValidateTag(tag); err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{err.Error()})
+	}
+
+	ctx := c.Request().Context()
+	database := api.db(c)
+	if _, err := findTag(ctx, database, tag.Name); errors.Is(err, db.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, apiError{"Tag not found"})
+	} else if err != nil {
+		slog.Error("Failed to fetch tags", slog.Any("err", err))
+		return c.JSON(http.StatusInternalServerError, apiError{"Could not fetch tags. See server logs for details."})
+	}
+	if err := database.UpdateTag(ctx, tag); err != nil {
+		slog.Error("Failed to update tag", slog.String("tag", tag.Name), slog.Any("err", err))
+		return c.JSON(http.StatusInternalServerError, apiError{"Could not update tag. See server logs for details."})
+	}
+
+	updated, err := findTag(ctx, database, tag.Name)
+	if err != nil {
+		slog.Error("Failed to fetch tags", slog.Any("err", err))
+		return c.JSON(http.StatusInternalServerError, apiError{"Could not fetch tags. See server logs for details."})
+	}
+	return c.JSON(http.StatusOK, updated)
+}
+
+func (api *Router) deleteTag(c echo.Context) error {
+	name := c.Param("name")
+	if slices.ContainsFunc(db.DefaultTags, func(tag db.Tag) bool { return tag.Name == name }) {
+		return c.JSON(http.StatusBadRequest, apiError{"Default tags cannot be deleted"})
+	}
+
+	err := api.db(c).DeleteTag(c.Request().Context(), name)
+	if errors.Is(err, db.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, apiError{"Tag not found"})
+	} else if err != nil {
+		slog.Error("Failed to delete tag", slog.String("tag", name), slog.Any("err", err))
+		return c.JSON(http.StatusInternalServerError, apiError{"Could not delete tag. See server logs for details."})
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
 func (api *Router) getSignature(c echo.Context) error {
 	id := c.Param("id")
-	sig, err := api.DB.GetSignature(id)
-	if err != nil {
+	sig, err := api.db(c).GetSignature(c.Request().Context(), id)
+	if errors.Is(err, db.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, apiError{"Signature not found"})
+	} else if err != nil {
 		slog.Error("Failed to fetch signature", slog.String("id", id), slog.Any("err", err))
 		return c.JSON(http.StatusInternalServerError, apiError{"Could not fetch signature. See server logs for details."})
 	}
 	return c.JSON(http.StatusOK, sig)
 }
 
+// defaultTopSignatures is the number of signatures returned by
+// /signatures/top when no limit is given.
+const defaultTopSignatures = 10
+
+func (api *Router) getTopSignatures(c echo.Context) error {
+	opts := &db.SignatureStatsOptions{Limit: defaultTopSignatures}
+	for name, dest := range map[string]**int{"tick_from": &opts.TickFrom, "tick_to": &opts.TickTo} {
+		param := c.QueryParam(name)
+		if param == "" {
+			continue
+		}
+		tick, err := strconv.Atoi(param)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, apiError{"Invalid " + name})
+		}
+		*dest = &tick
+	}
+	if param := c.QueryParam("limit"); param != "" {
+		limit, err := strconv.Atoi(param)
+		if err != nil || limit <= 0 {
+			return c.JSON(http.StatusBadRequest, apiError{"Invalid limit"})
+		}
+		opts.Limit = limit
+	}
+
+	stats, err := api.db(c).GetTopSignatures(c.Request().Context(), opts)
+	if err != nil {
+		slog.Error("Failed to fetch signature statistics", slog.Any("err", err))
+		return c.JSON(http.StatusInternalServerError, apiError{"Could not fetch signatures. See server logs for details."})
+	}
+	return c.JSON(http.StatusOK, stats)
+}
+
+// defaultDeadLetters is the number of events returned by /dead_letters when
+// no limit is given.
+const defaultDeadLetters = 100
+
+// getDeadLetters lists the Suricata events the enricher could not match to a
+// flow, newest first.
+func (api *Router) getDeadLetters(c echo.Context) error {
+	limit := defaultDeadLetters
+	if param := c.QueryParam("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit <= 0 {
+			return c.JSON(http.StatusBadRequest, apiError{"Invalid limit"})
+		}
+	}
+
+	letters, err := api.db(c).GetDeadLetters(c.Request().Context(), limit)
+	if err != nil {
+		slog.Error("Failed to fetch dead letters", slog.Any("err", err))
+		return c.JSON(http.StatusInternalServerError, apiError{"Could not fetch dead letters. See server logs for details."})
+	}
+	return c.JSON(http.StatusOK, letters)
+}
+
 func (api *Router) setStar(c echo.Context) error {
 	flowID := c.Param("flow_id")
 	starToSet := c.Param("star_to_set")
 	star := starToSet != "0"
-	err := api.DB.SetStar(flowID, star)
-	if err != nil {
+	err := api.db(c).SetStar(c.Request().Context(), flowID, star)
+	if errors.Is(err, db.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, apiError{"Flow not found"})
+	} else if err != nil {
 		slog.Error("Failed to set star", slog.String("flow_id", flowID), slog.Any("err", err))
 		return c.JSON(http.StatusInternalServerError, apiError{"Could not set star. See server logs for details."})
 	}
 	return c.String(http.StatusOK, "ok!")
 }
 
+func (api *Router) getArchivedTicks(c echo.Context) error {
+	type archivedTicks struct {
+		Ticks []int `json:"ticks"` // Ticks whose flows were archived, -1 for the flows without a tick
+	}
+
+	archive := lifecycle.Archive{Dir: api.Config.FlowsDir}
+	ticks, err := archive.Ticks(api.db(c).Namespace())
+	if err != nil {
+		slog.Error("Failed to list archived ticks", slog.Any("err", err))
+		return c.JSON(http.StatusInternalServerError, apiError{"Could not list archived ticks. See server logs for details."})
+	}
+	if ticks == nil {
+		ticks = []int{}
+	}
+	return c.JSON(http.StatusOK, archivedTicks{Ticks: ticks})
+}
+
+func (api *Router) restoreTick(c echo.Context) error {
+	type restoredTick struct {
+		Restored int `json:"restored"` // Number of flows inserted back in the database
+	}
+
+	tick, err := strconv.Atoi(c.Param("tick"))
+	if err != nil || tick < -1 {
+		return c.JSON(http.StatusBadRequest, apiError{"Invalid tick"})
+	}
+	if api.Config.FlowsDir == "" {
+		return c.JSON(http.StatusNotFound, apiError{"Flow archive not configured"})
+	}
+
+	archive := lifecycle.Archive{Dir: api.Config.FlowsDir}
+	n, err := archive.Restore(c.Request().Context(), api.db(c), tick)
+	if errors.Is(err, db.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, apiError{"Tick not archived"})
+	} else if err != nil {
+		slog.Error("Failed to restore archived tick", slog.Int("tick", tick), slog.Int("restored", n), slog.Any("err", err))
+		return c.JSON(http.StatusInternalServerError, apiError{"Could not restore tick. See server logs for details."})
+	}
+	slog.Info("Restored archived tick", slog.Int("tick", tick), slog.Int("flows", n))
+	return c.JSON(http.StatusOK, restoredTick{Restored: n})
+}
+
 func (api *Router) getServices(c echo.Context) error {
 
 	type apiService struct {
@@ -339,8 +779,10 @@ func (api *Router) getFlagRegex(c echo.Context) error {
 func (api *Router) getFlowDetail(c echo.Context) error {
 	id := c.Param("id")
 
-	flow, err := api.DB.GetFlowDetail(id)
-	if err != nil {
+	flow, err := api.db(c).GetFlowByID(c.Request().Context(), id)
+	if errors.Is(err, db.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, apiError{"Flow not found"})
+	} else if err != nil {
 		slog.Error("Failed to fetch flow detail", slog.String("id", id), slog.Any("err", err))
 		return c.JSON(http.StatusInternalServerError, apiError{"Could not fetch flow detail. See server logs for details."})
 	}
@@ -380,7 +822,7 @@ func (api *Router) convertToSinglePythonRequest(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Query parameter 'id' is required")
 	}
 
-	flow, err := api.DB.GetFlowDetail(id)
+	flow, err := api.db(c).GetFlowByID(c.Request().Context(), id)
 	if err != nil || flow == nil {
 		return c.String(http.StatusBadRequest, "Invalid flow id")
 	}
@@ -406,7 +848,7 @@ func (api *Router) convertToPythonRequests(c echo.Context) error {
 	tokenize, _ := strconv.ParseBool(c.QueryParam("tokenize"))
 	useSession, _ := strconv.ParseBool(c.QueryParam("use_requests_session"))
 
-	flow, err := api.DB.GetFlowDetail(id)
+	flow, err := api.db(c).GetFlowByID(c.Request().Context(), id)
 	if err != nil || flow == nil {
 		return c.String(http.StatusBadRequest, "Invalid flow: Invalid flow id")
 	}
@@ -421,7 +863,7 @@ func (api *Router) convertToPythonRequests(c echo.Context) error {
 
 func (api *Router) convertToPwn(c echo.Context) error {
 	id := c.Param("id")
-	flow, err := api.DB.GetFlowDetail(id)
+	flow, err := api.db(c).GetFlowByID(c.Request().Context(), id)
 	if err != nil || flow == nil {
 		return c.String(http.StatusBadRequest, "Invalid flow: Invalid flow id")
 	}
@@ -441,16 +883,23 @@ func (api *Router) downloadFile(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid 'file': Could not resolve path")
 	}
 
-	//
-	trafficDir := api.Config.TrafficDir
-	trafficDirAbs, err := filepath.Abs(trafficDir)
-	if err != nil {
-		return c.String(http.StatusInternalServerError,
-			"Internal error: could not resolve traffic_dir. Contact the administrator.")
+	// The file may have been archived or compressed after it was processed
+	pcap, err := api.db(c).GetPcap(c.Request().Context(), fileParam)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		slog.Error("Failed to fetch pcap file", slog.String("file", fileParam), slog.Any("err", err))
+		return c.String(http.StatusInternalServerError, "Could not fetch pcap file. See server logs for details.")
+	} else if err == nil {
+		if pcap.Removed {
+			return c.String(http.StatusGone, "Invalid 'file': 'file' was deleted by the retention policy")
+		}
+		absPath, err = filepath.Abs(pcap.Path())
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid 'file': Could not resolve path")
+		}
 	}
 
-	// Ensure requested file is within trafficDir
-	if !isSubPath(absPath, trafficDirAbs) {
+	// Ensure requested file is within trafficDir or archiveDir
+	if !api.isPcapPath(absPath) {
 		return c.String(http.StatusBadRequest, "Invalid 'file': 'file' was not in a subdirectory of traffic_dir")
 	}
 
@@ -460,7 +909,87 @@ func (api *Router) downloadFile(c echo.Context) error {
 		return c.String(http.StatusNotFound, "Invalid 'file': 'file' not found")
 	}
 
-	return c.File(absPath) // This will write the file to the response
+	if filepath.Ext(absPath) == ".pcap" {
+		return c.File(absPath) // This will write the file to the response
+	}
+
+	// Compressed archive: decompress on the fly, so it can be opened directly
+	reader, err := lifecycle.Open(absPath)
+	if err != nil {
+		slog.Error("Failed to open archived pcap", slog.String("file", absPath), slog.Any("err", err))
+		return c.String(http.StatusInternalServerError, "Could not open archived file. See server logs for details.")
+	}
+	defer reader.Close()
+
+	c.Response().Header().Set(echo.HeaderContentDisposition,
+		fmt.Sprintf("attachment; filename=%q", filepath.Base(fileParam)))
+	return c.Stream(http.StatusOK, "application/vnd.tcpdump.pcap", reader)
+}
+
+// exportFlowPcap returns a pcap with only the packets of a single flow.
+func (api *Router) exportFlowPcap(c echo.Context) error {
+	id := c.Param("id")
+
+	flow, err := api.db(c).GetFlowByID(c.Request().Context(), id)
+	if err != nil || flow == nil {
+		return c.String(http.StatusBadRequest, "Invalid flow: Invalid flow id")
+	}
+
+	return api.writePcap(c, fmt.Sprintf("flow-%s.pcap", id), []db.FlowEntry{*flow})
+}
+
+// exportQueryPcap returns a single pcap with the packets of all the flows
+// matching a /query request body.
+func (api *Router) exportQueryPcap(c echo.Context) error {
+	opts, _, err := api.parseFlowQuery(c)
+	if err != nil {
+		return badFlowQuery(c, err)
+	}
+
+	// Bulk exports read every pcap file involved, keep them bounded
+	if opts.Limit <= 0 || opts.Limit > maxPcapExportFlows {
+		opts.Limit = maxPcapExportFlows
+	}
+
+	flows, err := api.db(c).GetFlows(c.Request().Context(), opts)
+	if err != nil {
+		slog.Error("Failed to fetch flows for export", slog.Any("err", err))
+		return c.JSON(http.StatusInternalServerError, apiError{"Could not fetch flows. See server logs for details."})
+	}
+
+	return api.writePcap(c, "tulip-export.pcap", flows)
+}
+
+// writePcap exports the packets of flows as a pcap attachment.
+func (api *Router) writePcap(c echo.Context, filename string, flows []db.FlowEntry) error {
+	buf := &bytes.Buffer{}
+	err := assembler.NewExporter(api.db(c)).Export(c.Request().Context(), buf, flows)
+	if errors.Is(err, assembler.ErrPcapUnavailable) {
+		return c.String(http.StatusGone, "The pcap files of the requested flows were deleted by the retention policy")
+	} else if err != nil {
+		slog.Error("Failed to export pcap", slog.Any("err", err))
+		return c.JSON(http.StatusInternalServerError, apiError{"Could not export pcap. See server logs for details."})
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	return c.Blob(http.StatusOK, "application/vnd.tcpdump.pcap", buf.Bytes())
+}
+
+// isPcapPath reports whether path is inside the traffic or archive directory.
+func (api *Router) isPcapPath(path string) bool {
+	for _, dir := range []string{api.Config.TrafficDir, api.Config.ArchiveDir} {
+		if dir == "" {
+			continue
+		}
+		dirAbs, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		if isSubPath(path, dirAbs) {
+			return true
+		}
+	}
+	return false
 }
 
 // --- Helpers ---
@@ -9,53 +9,24 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
-	"strings"
+	"tulip/pkg/game"
 )
 
-// Service represents a single service with a name and port.
-type Service struct {
-	Name string
-	Port int
-}
-
 // Config holds all configuration values for the application.
 type Config struct {
 	TickLength int
 	StartDate  string
 	MongoHost  string
+	Database   string // Optional database URI, replacing MongoHost
+	Namespace  string // Namespace of the live game, the default one if empty
 	FlagRegex  string
 	TrafficDir string
+	ArchiveDir string // Optional directory where the assembler archives processed pcaps
+	FlowsDir   string // Optional directory where the assembler archives the flows removed from the database
+	RulesFile  string // Optional Suricata rule file managed through /rules
+	RulesSock  string // Optional unix command socket of Suricata, to reload the rules
 	VMIP       string
-	Services   []Service
-}
-
-// ParseServices parses a space-separated list of service:port pairs.
-func ParseServices(s string) ([]Service, error) {
-	var services []Service
-	s = strings.TrimSpace(s)
-	if s == "" {
-		return services, nil
-	}
-
-	parts := strings.FieldsSeq(s)
-	for part := range parts {
-		split := strings.Split(part, ":")
-		if len(split) != 2 {
-			return nil, fmt.Errorf("invalid service definition: %s", part)
-		}
-
-		name := split[0]
-		port, err := strconv.Atoi(split[1])
-		if err != nil {
-			return nil, fmt.Errorf("invalid port for service %s: %v", part, err)
-		} else if port <= 0 || port > 65535 {
-			return nil, fmt.Errorf("port out of range for service %s: %d", part, port)
-		}
-
-		services = append(services, Service{Name: name, Port: port})
-	}
-
-	return services, nil
+	Services   []game.Service
 }
 
 // LoadConfig reads configuration from environment variables.
@@ -81,7 +52,15 @@ func LoadConfig() (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	mongoHost, err := getenv("TULIP_MONGO", true)
+	database, err := getenv("TULIP_DB", false)
+	if err != nil {
+		return nil, err
+	}
+	mongoHost, err := getenv("TULIP_MONGO", database == "")
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := getenv("TULIP_NAMESPACE", false)
 	if err != nil {
 		return nil, err
 	}
@@ -97,6 +76,41 @@ func LoadConfig() (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	archiveDir, err := getenv("TULIP_ARCHIVE_DIR", false)
+	if err != nil {
+		return nil, err
+	}
+	if archiveDir != "" {
+		// the assembler creates it when the first file is archived
+		archiveDir, err = filepath.Abs(archiveDir)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve TULIP_ARCHIVE_DIR: %v", err)
+		}
+	}
+	flowsDir, err := getenv("TULIP_FLOW_ARCHIVE_DIR", false)
+	if err != nil {
+		return nil, err
+	}
+	if flowsDir != "" {
+		flowsDir, err = filepath.Abs(flowsDir)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve TULIP_FLOW_ARCHIVE_DIR: %v", err)
+		}
+	}
+	rulesFile, err := getenv("TULIP_RULES_FILE", false)
+	if err != nil {
+		return nil, err
+	}
+	if rulesFile != "" {
+		rulesFile, err = filepath.Abs(rulesFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve TULIP_RULES_FILE: %v", err)
+		}
+	}
+	rulesSock, err := getenv("TULIP_SURICATA_SOCKET", false)
+	if err != nil {
+		return nil, err
+	}
 	vmIP, err := getenv("VM_IP", true)
 	if err != nil {
 		return nil, err
@@ -105,7 +119,7 @@ func LoadConfig() (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	services, err := ParseServices(servicesStr)
+	gameConfig, err := game.New(startDate, tickLengthStr, servicesStr)
 	if err != nil {
 		return nil, err
 	}
@@ -114,15 +128,24 @@ func LoadConfig() (*Config, error) {
 		TickLength: tickLength,
 		StartDate:  startDate,
 		MongoHost:  mongoHost,
+		Database:   database,
+		Namespace:  namespace,
 		FlagRegex:  flagRegex,
 		TrafficDir: trafficDir,
+		ArchiveDir: archiveDir,
+		FlowsDir:   flowsDir,
+		RulesFile:  rulesFile,
+		RulesSock:  rulesSock,
 		VMIP:       vmIP,
-		Services:   services,
+		Services:   gameConfig.Services,
 	}, nil
 }
 
-// MongoServer returns the MongoDB connection string.
-func (c *Config) MongoServer() string {
+// DatabaseURI returns the database connection string.
+func (c *Config) DatabaseURI() string {
+	if c.Database != "" {
+		return c.Database
+	}
 	return fmt.Sprintf("mongodb://%s/", c.MongoHost)
 }
 
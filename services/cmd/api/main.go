@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"os"
 
 	"github.com/joho/godotenv"
@@ -27,11 +28,15 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Initialize MongoDB connection using pkg/db
-	mongoURI := cfg.MongoServer()
-	mdb, err := db.ConnectMongo(mongoURI)
+	// Initialize the database connection using pkg/db
+	mdb, err := db.ConnectNamespace(cfg.DatabaseURI(), cfg.Namespace)
 	if err != nil {
-		slog.Error("Failed to connect to MongoDB", slog.Any("err", err))
+		slog.Error("Failed to connect to database", slog.Any("err", err))
+		os.Exit(1)
+	}
+	if err := db.CheckSchema(context.Background(), mdb); err != nil {
+		slog.Error("Incompatible database", slog.Any("err", err))
+		os.Exit(1)
 	}
 
 	// Set up Echo server
@@ -0,0 +1,323 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+	"tulip/pkg/rules"
+
+	"github.com/labstack/echo/v4"
+)
+
+type ruleRequest struct {
+	Rule    *string `json:"rule"`    // Text of the rule, unchanged if missing
+	Enabled *bool   `json:"enabled"` // Whether the rule is enabled, unchanged if missing
+}
+
+// ruleResponse is a rule written to the rule file, with the outcome of the
+// reload of the rules by Suricata.
+type ruleResponse struct {
+	Rule   rules.Rule    `json:"rule"`
+	Reload *reloadResult `json:"reload,omitempty"` // Missing when no Suricata socket is configured
+}
+
+type reloadResult struct {
+	OK          bool               `json:"ok"` // All the rules were loaded
+	Error       string             `json:"error,omitempty"`
+	FailedRules []rules.FailedRule `json:"failed_rules,omitempty"` // Rules skipped by Suricata
+}
+
+// loadRules reads the rule file. On failure it replies to the request and
+// returns a nil file, with the error of the reply. The caller must hold
+// rulesMu.
+func (api *Router) loadRules(c echo.Context) (*rules.File, error) {
+	if api.Config.RulesFile == "" {
+		return nil, c.JSON(http.StatusNotFound, apiError{"Rule management is disabled, set TULIP_RULES_FILE to enable it"})
+	}
+	file, err := rules.Load(api.Config.RulesFile)
+	if err != nil {
+		slog.Error("Failed to load rules", slog.String("file", api.Config.RulesFile), slog.Any("err", err))
+		return nil, c.JSON(http.StatusInternalServerError, apiError{"Could not load rules. See server logs for details."})
+	}
+	return file, nil
+}
+
+// reload asks Suricata to reload the rules, if its socket is configured.
+func (api *Router) reload(c echo.Context) *reloadResult {
+	if api.Config.RulesSock == "" {
+		return nil
+	}
+	failed, err := rules.Reload(c.Request().Context(), api.Config.RulesSock)
+	if err != nil {
+		slog.Error("Failed to reload rules", slog.String("socket", api.Config.RulesSock), slog.Any("err", err))
+		return &reloadResult{Error: err.Error()}
+	}
+	result := &reloadResult{OK: len(failed) == 0, FailedRules: failed}
+	if len(failed) > 0 {
+		result.Error = fmt.Sprintf("suricata could not load %d rules", len(failed))
+		slog.Warn("Rules failed to load", slog.Int("count", len(failed)))
+	}
+	return result
+}
+
+// saveRules writes the edited rule file, reloads the rules and replies with
+// the edited rule.
+func (api *Router) saveRules(c echo.Context, file *rules.File, rule rules.Rule, status int) error {
+	if err := file.Save(); err != nil {
+		slog.Error("Failed to save rules", slog.String("file", api.Config.RulesFile), slog.Any("err", err))
+		return c.JSON(http.StatusInternalServerError, apiError{"Could not save rules. See server logs for details."})
+	}
+	return c.JSON(status, ruleResponse{Rule: rule, Reload: api.reload(c)})
+}
+
+func (api *Router) getRules(c echo.Context) error {
+	api.rulesMu.Lock()
+	defer api.rulesMu.Unlock()
+
+	file, err := api.loadRules(c)
+	if file == nil {
+		return err
+	}
+	list := file.Rules()
+	if list == nil {
+		list = []rules.Rule{}
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+func (api *Router) createRule(c echo.Context) error {
+	var req ruleRequest
+	if err := c.Bind(&req); err != nil || req.Rule == nil {
+		return c.JSON(http.StatusBadRequest, apiError{"Invalid request body"})
+	}
+	rule, err := rules.Parse(*req.Rule)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{err.Error()})
+	}
+	if req.Enabled != nil {
+		rule.Enabled = *req.Enabled
+	}
+
+	api.rulesMu.Lock()
+	defer api.rulesMu.Unlock()
+
+	file, err := api.loadRules(c)
+	if file == nil {
+		return err
+	}
+	rule, err = file.Add(rule)
+	if errors.Is(err, rules.ErrExists) {
+		return c.JSON(http.StatusConflict, apiError{err.Error()})
+	}
+	return api.saveRules(c, file, rule, http.StatusCreated)
+}
+
+func (api *Router) updateRule(c echo.Context) error {
+	sid, err := strconv.Atoi(c.Param("sid"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{"Invalid sid"})
+	}
+	var req ruleRequest
+	if err := c.Bind(&req); err != nil || (req.Rule == nil && req.Enabled == nil) {
+		return c.JSON(http.StatusBadRequest, apiError{"Invalid request body"})
+	}
+
+	api.rulesMu.Lock()
+	defer api.rulesMu.Unlock()
+
+	file, err := api.loadRules(c)
+	if file == nil {
+		return err
+	}
+	if req.Rule == nil {
+		// toggling a rule only comments or uncomments its line
+		rule, err := file.SetEnabled(sid, *req.Enabled)
+		if errors.Is(err, rules.ErrNotFound) {
+			return c.JSON(http.StatusNotFound, apiError{"Rule not found"})
+		}
+		return api.saveRules(c, file, rule, http.StatusOK)
+	}
+
+	rule, err := file.Get(sid)
+	if errors.Is(err, rules.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, apiError{"Rule not found"})
+	}
+	edited, err := rules.Parse(*req.Rule)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{err.Error()})
+	}
+	edited.Enabled = rule.Enabled
+	if req.Enabled != nil {
+		edited.Enabled = *req.Enabled
+	}
+	rule, err = file.Replace(sid, edited)
+	if errors.Is(err, rules.ErrExists) {
+		return c.JSON(http.StatusConflict, apiError{err.Error()})
+	}
+	return api.saveRules(c, file, rule, http.StatusOK)
+}
+
+func (api *Router) validateRule(c echo.Context) error {
+	type validation struct {
+		Valid bool        `json:"valid"`
+		Error string      `json:"error,omitempty"`
+		Rule  *rules.Rule `json:"rule,omitempty"`
+	}
+	var req ruleRequest
+	if err := c.Bind(&req); err != nil || req.Rule == nil {
+		return c.JSON(http.StatusBadRequest, apiError{"Invalid request body"})
+	}
+	rule, err := rules.Parse(*req.Rule)
+	if err != nil {
+		return c.JSON(http.StatusOK, validation{Error: err.Error()})
+	}
+	return c.JSON(http.StatusOK, validation{Valid: true, Rule: &rule})
+}
+
+func (api *Router) reloadRules(c echo.Context) error {
+	if api.Config.RulesSock == "" {
+		return c.JSON(http.StatusNotFound, apiError{"No Suricata socket configured, set TULIP_SURICATA_SOCKET"})
+	}
+	api.rulesMu.Lock()
+	defer api.rulesMu.Unlock()
+
+	result := api.reload(c)
+	if result.Error != "" && result.FailedRules == nil {
+		return c.JSON(http.StatusBadGateway, result)
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// maxRetroJobs is the number of finished retro jobs kept for GET /rules/retro.
+const maxRetroJobs = 20
+
+// retroJob is a run of rules.Retro started from the API.
+type retroJob struct {
+	rules.RetroProgress
+	ID         int    `json:"id"`
+	Namespace  string `json:"namespace"`
+	SIDs       []int  `json:"sids"`
+	State      string `json:"state"` // running, done, failed or cancelled
+	Error      string `json:"error,omitempty"`
+	StartedAt  int64  `json:"started_at"`
+	FinishedAt int64  `json:"finished_at,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+func (api *Router) getRetroJobs(c echo.Context) error {
+	api.jobsMu.Lock()
+	defer api.jobsMu.Unlock()
+
+	jobs := make([]retroJob, 0, len(api.jobs))
+	for _, job := range slices.Backward(api.jobs) {
+		jobs = append(jobs, *job)
+	}
+	return c.JSON(http.StatusOK, jobs)
+}
+
+func (api *Router) startRetroJob(c echo.Context) error {
+	var req struct {
+		SIDs     []int `json:"sids"` // Rules to match, all the enabled ones if empty
+		TickFrom *int  `json:"tick_from"`
+		TickTo   *int  `json:"tick_to"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{"Invalid request body"})
+	}
+
+	api.rulesMu.Lock()
+	file, err := api.loadRules(c)
+	api.rulesMu.Unlock()
+	if file == nil {
+		return err
+	}
+	var selected []rules.Rule
+	for _, rule := range file.Rules() {
+		if (len(req.SIDs) == 0 && rule.Enabled) || slices.Contains(req.SIDs, rule.SID) {
+			selected = append(selected, rule)
+		}
+	}
+	if len(selected) == 0 || (len(req.SIDs) > 0 && len(selected) != len(req.SIDs)) {
+		return c.JSON(http.StatusNotFound, apiError{"Rule not found"})
+	}
+
+	database := api.db(c)
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &retroJob{
+		Namespace: database.Namespace(),
+		State:     "running",
+		StartedAt: time.Now().UnixMilli(),
+		cancel:    cancel,
+	}
+	for _, rule := range selected {
+		job.SIDs = append(job.SIDs, rule.SID)
+	}
+
+	api.jobsMu.Lock()
+	job.ID = 1
+	if len(api.jobs) > 0 {
+		job.ID = api.jobs[len(api.jobs)-1].ID + 1
+	}
+	api.jobs = append(api.jobs, job)
+	// forget the oldest finished jobs
+	for i := 0; len(api.jobs) > maxRetroJobs && i < len(api.jobs); {
+		if api.jobs[i].State == "running" {
+			i++
+			continue
+		}
+		api.jobs = slices.Delete(api.jobs, i, i+1)
+	}
+	snapshot := *job
+	api.jobsMu.Unlock()
+
+	go func() {
+		defer cancel()
+		progress, err := rules.Retro(ctx, database, selected, rules.RetroOptions{TickFrom: req.TickFrom, TickTo: req.TickTo}, func(progress rules.RetroProgress) {
+			api.jobsMu.Lock()
+			job.RetroProgress = progress
+			api.jobsMu.Unlock()
+		})
+
+		api.jobsMu.Lock()
+		defer api.jobsMu.Unlock()
+		job.RetroProgress = progress
+		job.FinishedAt = time.Now().UnixMilli()
+		switch {
+		case errors.Is(err, context.Canceled):
+			job.State = "cancelled"
+		case err != nil:
+			job.State, job.Error = "failed", err.Error()
+			slog.Error("Retro matching failed", slog.Int("job", job.ID), slog.Any("err", err))
+		default:
+			job.State = "done"
+			slog.Info("Retro matching done", slog.Int("job", job.ID), slog.Int("flows", progress.Scanned), slog.Int("matched", progress.Matched))
+		}
+	}()
+	return c.JSON(http.StatusAccepted, snapshot)
+}
+
+func (api *Router) cancelRetroJob(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, apiError{"Invalid job ID"})
+	}
+
+	api.jobsMu.Lock()
+	defer api.jobsMu.Unlock()
+	i := slices.IndexFunc(api.jobs, func(job *retroJob) bool { return job.ID == id })
+	if i < 0 {
+		return c.JSON(http.StatusNotFound, apiError{"Job not found"})
+	}
+	api.jobs[i].cancel()
+	return c.NoContent(http.StatusNoContent)
+}
@@ -20,20 +20,22 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
 
 	"tulip/pkg/assembler"
 	"tulip/pkg/db"
+	"tulip/pkg/game"
+	"tulip/pkg/lifecycle"
+	"tulip/pkg/watcher"
 
 	"github.com/lmittmann/tint"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
-var gDB db.MongoDatabase
+var gDB db.Database
 
 var rootCmd = &cobra.Command{
 	Use:   "assembler",
@@ -43,25 +45,65 @@ var rootCmd = &cobra.Command{
 }
 
 func init() {
-	rootCmd.Flags().String("mongo", "localhost:27017", "MongoDB DNS name + port (e.g. mongo:27017)")
+	rootCmd.PersistentFlags().String("mongo", "localhost:27017", "MongoDB DNS name + port (e.g. mongo:27017)")
+	rootCmd.PersistentFlags().String("db", "", "Database URI (mongodb://..., sqlite:///path/to/tulip.db or memory://), overrides --mongo")
+	rootCmd.PersistentFlags().String("namespace", db.DefaultNamespace, "Database namespace the flows are stored in, one per game (MongoDB database name)")
 	rootCmd.Flags().String("watch-dir", "/tmp/ingestor_ready", "Directory to watch for incoming PCAP files")
 	rootCmd.Flags().String("flag", "", "Flag regex, used for flag in/out tagging")
 	rootCmd.Flags().String("flush-interval", "15s", "Interval for flushing connections (e.g. 15s, 1m)")
 	rootCmd.Flags().Bool("tcp-lazy", false, "Enable lazy decoding for TCP packets")
 	rootCmd.Flags().Bool("experimental", false, "Enable experimental features")
 	rootCmd.Flags().Bool("nonstrict", false, "Enable non-strict mode for TCP stream assembly")
+	rootCmd.Flags().Bool("decapsulate", false, "Assemble the inner connections of GRE, VXLAN and IP-in-IP tunnels")
 	rootCmd.Flags().String("connection-timeout", "30s", "Connection timeout for both TCP and UDP flows (e.g. 30s, 1m)")
 	rootCmd.Flags().Bool("pperf", false, "Enable performance profiling (experimental)")
+	rootCmd.Flags().Bool("watch-recursive", true, "Also watch subdirectories of the watch directory")
+	rootCmd.Flags().Bool("watch-polling", false, "Poll the watch directory instead of using filesystem notifications")
+	rootCmd.Flags().String("watch-poll-interval", "2s", "Interval between watch directory checks (e.g. 2s)")
+	rootCmd.Flags().String("watch-stable-for", "5s", "Time a PCAP file size must stay unchanged before it is processed (e.g. 5s)")
+	rootCmd.Flags().String("watch-order", "name", "Processing order of ready PCAP files: name, mtime or first-packet")
+	rootCmd.Flags().String("tick-start", "", "Start time of the game (e.g. 2018-06-27T13:00+02:00), used to stamp ticks on flows")
+	rootCmd.Flags().String("tick-length", "", "Length of a game tick in milliseconds")
+	rootCmd.Flags().String("game-services", "", "Space separated list of game services (e.g. \"srv1:5000 srv2:3000\")")
+	rootCmd.Flags().String("archive-dir", "", "Directory processed PCAP files are moved to (empty to keep them in place)")
+	rootCmd.Flags().String("archive-compression", "none", "Compression applied to processed PCAP files: none, gzip or zstd")
+	rootCmd.Flags().String("archive-delay", "2m", "Minimum age of a processed PCAP file before it is archived (e.g. 2m)")
+	rootCmd.Flags().String("pcap-max-size", "", "Total size of processed PCAP files after which the oldest are deleted (e.g. 50G)")
+	rootCmd.Flags().String("pcap-max-age", "", "Age after which processed PCAP files are deleted (e.g. 12h)")
+	rootCmd.Flags().Int("flow-max-ticks", 0, "Number of most recent ticks whose flows are kept in the database, 0 to keep all")
+	rootCmd.Flags().String("flow-untagged-age", "", "Age after which flows without tags are removed from the database (e.g. 6h)")
+	rootCmd.Flags().String("flow-retention", "archive", "What happens to the flows removed from the database: archive or drop")
+	rootCmd.Flags().String("flow-archive-dir", "", "Directory removed flows are archived to, one compressed file per tick")
 
-	viper.BindPFlag("mongo", rootCmd.Flags().Lookup("mongo"))
+	viper.BindPFlag("mongo", rootCmd.PersistentFlags().Lookup("mongo"))
+	viper.BindPFlag("db", rootCmd.PersistentFlags().Lookup("db"))
+	viper.BindPFlag("namespace", rootCmd.PersistentFlags().Lookup("namespace"))
 	viper.BindPFlag("watch-dir", rootCmd.Flags().Lookup("watch-dir"))
 	viper.BindPFlag("flag", rootCmd.Flags().Lookup("flag"))
 	viper.BindPFlag("flush-interval", rootCmd.Flags().Lookup("flush-interval"))
 	viper.BindPFlag("tcp-lazy", rootCmd.Flags().Lookup("tcp-lazy"))
 	viper.BindPFlag("experimental", rootCmd.Flags().Lookup("experimental"))
 	viper.BindPFlag("nonstrict", rootCmd.Flags().Lookup("nonstrict"))
+	viper.BindPFlag("decapsulate", rootCmd.Flags().Lookup("decapsulate"))
 	viper.BindPFlag("connection-timeout", rootCmd.Flags().Lookup("connection-timeout"))
 	viper.BindPFlag("pperf", rootCmd.Flags().Lookup("pperf"))
+	viper.BindPFlag("watch-recursive", rootCmd.Flags().Lookup("watch-recursive"))
+	viper.BindPFlag("watch-polling", rootCmd.Flags().Lookup("watch-polling"))
+	viper.BindPFlag("watch-poll-interval", rootCmd.Flags().Lookup("watch-poll-interval"))
+	viper.BindPFlag("watch-stable-for", rootCmd.Flags().Lookup("watch-stable-for"))
+	viper.BindPFlag("watch-order", rootCmd.Flags().Lookup("watch-order"))
+	viper.BindPFlag("tick-start", rootCmd.Flags().Lookup("tick-start"))
+	viper.BindPFlag("tick-length", rootCmd.Flags().Lookup("tick-length"))
+	viper.BindPFlag("game-services", rootCmd.Flags().Lookup("game-services"))
+	viper.BindPFlag("archive-dir", rootCmd.Flags().Lookup("archive-dir"))
+	viper.BindPFlag("archive-compression", rootCmd.Flags().Lookup("archive-compression"))
+	viper.BindPFlag("archive-delay", rootCmd.Flags().Lookup("archive-delay"))
+	viper.BindPFlag("pcap-max-size", rootCmd.Flags().Lookup("pcap-max-size"))
+	viper.BindPFlag("pcap-max-age", rootCmd.Flags().Lookup("pcap-max-age"))
+	viper.BindPFlag("flow-max-ticks", rootCmd.Flags().Lookup("flow-max-ticks"))
+	viper.BindPFlag("flow-untagged-age", rootCmd.Flags().Lookup("flow-untagged-age"))
+	viper.BindPFlag("flow-retention", rootCmd.Flags().Lookup("flow-retention"))
+	viper.BindPFlag("flow-archive-dir", rootCmd.Flags().Lookup("flow-archive-dir"))
 
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
@@ -78,14 +120,34 @@ func runAssembler(cmd *cobra.Command, args []string) {
 
 	// Get config from viper
 	mongodb := viper.GetString("mongo")
+	dbString := viper.GetString("db")
+	namespace := viper.GetString("namespace")
 	watchDir := viper.GetString("watch-dir")
 	flagRegexStr := viper.GetString("flag")
 	flushIntervalStr := viper.GetString("flush-interval")
 	tcpLazy := viper.GetBool("tcp-lazy")
 	experimental := viper.GetBool("experimental")
 	nonstrict := viper.GetBool("nonstrict")
+	decapsulate := viper.GetBool("decapsulate")
 	connectionTimeoutStr := viper.GetString("connection-timeout")
 	pperf := viper.GetBool("pperf")
+	watchRecursive := viper.GetBool("watch-recursive")
+	watchPolling := viper.GetBool("watch-polling")
+	watchPollIntervalStr := viper.GetString("watch-poll-interval")
+	watchStableForStr := viper.GetString("watch-stable-for")
+	watchOrderStr := viper.GetString("watch-order")
+	tickStart := viper.GetString("tick-start")
+	tickLength := viper.GetString("tick-length")
+	gameServices := viper.GetString("game-services")
+	archiveDir := viper.GetString("archive-dir")
+	archiveCompressionStr := viper.GetString("archive-compression")
+	archiveDelayStr := viper.GetString("archive-delay")
+	pcapMaxSizeStr := viper.GetString("pcap-max-size")
+	pcapMaxAgeStr := viper.GetString("pcap-max-age")
+	flowMaxTicks := viper.GetInt("flow-max-ticks")
+	flowUntaggedAgeStr := viper.GetString("flow-untagged-age")
+	flowRetentionStr := viper.GetString("flow-retention")
+	flowArchiveDir := viper.GetString("flow-archive-dir")
 
 	if pperf {
 		go func() {
@@ -93,20 +155,30 @@ func runAssembler(cmd *cobra.Command, args []string) {
 		}()
 	}
 
-	// Connect to MongoDB
-	dbString := "mongodb://" + mongodb
-	slog.Info("Connecting to MongoDB...", slog.String("uri", dbString))
+	// Connect to the database
+	if dbString == "" {
+		dbString = "mongodb://" + mongodb
+	}
+	slog.Info("Connecting to database...", slog.String("uri", dbString), slog.String("namespace", namespace))
 
 	var err error
-	gDB, err = db.ConnectMongo(dbString)
+	gDB, err = db.ConnectNamespace(dbString, namespace)
 	if err != nil {
-		slog.Error("Failed to connect to MongoDB", slog.Any("err", err))
+		slog.Error("Failed to connect to database", slog.Any("err", err))
 		os.Exit(1)
 	}
-	slog.Info("Connected to MongoDB")
+	slog.Info("Connected to database")
 
-	slog.Info("Configuring MongoDB database...")
-	gDB.ConfigureDatabase()
+	if err := db.CheckSchema(context.Background(), gDB); err != nil {
+		slog.Error("Incompatible database", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	slog.Info("Configuring database...")
+	if err := gDB.ConfigureDatabase(context.Background()); err != nil {
+		slog.Error("Failed to configure database", slog.Any("err", err))
+		os.Exit(1)
+	}
 
 	// Parse flag regex if provided
 	var flagRegex *regexp.Regexp
@@ -141,6 +213,16 @@ func runAssembler(cmd *cobra.Command, args []string) {
 		}
 	}
 
+	// Parse game configuration
+	gameConfig, err := game.New(tickStart, tickLength, gameServices)
+	if err != nil {
+		slog.Error("Invalid game configuration", slog.Any("err", err))
+		os.Exit(1)
+	}
+	if !gameConfig.HasTicks() {
+		slog.Warn("Tick start or length not configured, flows will not be stamped with their tick")
+	}
+
 	// global ctx
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
@@ -148,64 +230,130 @@ func runAssembler(cmd *cobra.Command, args []string) {
 	// Create assembler service
 	flagIdUrl := os.Getenv("FLAGID_URL")
 	config := assembler.Config{
-		DB:                   &gDB,
+		DB:                   gDB,
 		TcpLazy:              tcpLazy,
 		Experimental:         experimental,
 		NonStrict:            nonstrict,
+		Decapsulate:          decapsulate,
 		FlagRegex:            flagRegex,
 		FlushInterval:        flushInterval,
 		ConnectionTcpTimeout: connectionTimeout,
 		ConnectionUdpTimeout: connectionTimeout,
 		FlagIdUrl:            flagIdUrl,
+		Game:                 gameConfig,
 	}
 	service := assembler.NewAssemblerService(config)
 
-	// Watch directory for new PCAP files and ingest them
-	slog.Info("Watching directory for new PCAP files", slog.String("dir", watchDir))
-
-	// Use polling for simplicity and reliability
-	pollInterval := 2 * time.Second
-	seen := make(map[string]struct{})
-
-watchLoop:
-	for {
-		select {
-		case <-ctx.Done():
-			break watchLoop
-		default:
+	// Parse watch settings
+	watchPollInterval, err := time.ParseDuration(watchPollIntervalStr)
+	if err != nil {
+		slog.Error("Invalid watch-poll-interval", slog.String("watch-poll-interval", watchPollIntervalStr), slog.Any("err", err))
+		os.Exit(1)
+	}
+	watchStableFor, err := time.ParseDuration(watchStableForStr)
+	if err != nil {
+		slog.Error("Invalid watch-stable-for", slog.String("watch-stable-for", watchStableForStr), slog.Any("err", err))
+		os.Exit(1)
+	}
+	watchOrder, err := watcher.ParseOrder(watchOrderStr)
+	if err != nil {
+		slog.Error("Invalid watch-order", slog.String("watch-order", watchOrderStr), slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	// Parse the lifecycle policy of processed PCAP files
+	policy := lifecycle.Policy{ArchiveDir: archiveDir}
+	policy.Compression, err = lifecycle.ParseCompression(archiveCompressionStr)
+	if err != nil {
+		slog.Error("Invalid archive-compression", slog.String("archive-compression", archiveCompressionStr), slog.Any("err", err))
+		os.Exit(1)
+	}
+	policy.Delay, err = time.ParseDuration(archiveDelayStr)
+	if err != nil {
+		slog.Error("Invalid archive-delay", slog.String("archive-delay", archiveDelayStr), slog.Any("err", err))
+		os.Exit(1)
+	}
+	policy.MaxSize, err = lifecycle.ParseSize(pcapMaxSizeStr)
+	if err != nil {
+		slog.Error("Invalid pcap-max-size", slog.String("pcap-max-size", pcapMaxSizeStr), slog.Any("err", err))
+		os.Exit(1)
+	}
+	if pcapMaxAgeStr != "" {
+		policy.MaxAge, err = time.ParseDuration(pcapMaxAgeStr)
+		if err != nil {
+			slog.Error("Invalid pcap-max-age", slog.String("pcap-max-age", pcapMaxAgeStr), slog.Any("err", err))
+			os.Exit(1)
 		}
+	}
+
+	if policy.Enabled() {
+		slog.Info("Managing processed PCAP files",
+			slog.String("archive-dir", policy.ArchiveDir),
+			slog.String("compression", string(policy.Compression)),
+			slog.Int64("max-size", policy.MaxSize),
+			slog.Duration("max-age", policy.MaxAge),
+		)
+		go lifecycle.NewManager(policy, gDB).Run(ctx, time.Minute)
+	}
 
-		files, err := os.ReadDir(watchDir)
+	// Parse the retention of flows in the database
+	retention := lifecycle.Retention{MaxTicks: flowMaxTicks, ArchiveDir: flowArchiveDir}
+	retention.Mode, err = lifecycle.ParseRetentionMode(flowRetentionStr)
+	if err != nil {
+		slog.Error("Invalid flow-retention", slog.String("flow-retention", flowRetentionStr), slog.Any("err", err))
+		os.Exit(1)
+	}
+	if flowUntaggedAgeStr != "" {
+		retention.UntaggedAge, err = time.ParseDuration(flowUntaggedAgeStr)
 		if err != nil {
-			slog.Error("Failed to read watch directory", slog.Any("err", err))
-			time.Sleep(pollInterval)
-			continue
+			slog.Error("Invalid flow-untagged-age", slog.String("flow-untagged-age", flowUntaggedAgeStr), slog.Any("err", err))
+			os.Exit(1)
+		}
+	}
+
+	if retention.Enabled() {
+		if retention.Mode == lifecycle.RetentionArchive && retention.ArchiveDir == "" {
+			slog.Error("Archiving removed flows requires flow-archive-dir, or use flow-retention=drop")
+			os.Exit(1)
 		}
-		for _, file := range files {
-			select {
-			case <-ctx.Done():
-				break watchLoop
-			default:
-			}
-
-			if file.IsDir() {
-				continue
-			}
-			name := file.Name()
-			if filepath.Ext(name) != ".pcap" {
-				continue
-			}
-			fullPath := filepath.Join(watchDir, name)
-			if _, ok := seen[fullPath]; ok {
-				continue
-			}
-			seen[fullPath] = struct{}{}
-
-			slog.Info("Ingesting new PCAP file", slog.String("file", fullPath))
-			service.HandlePcapUri(ctx, fullPath)
+		if retention.MaxTicks > 0 && !gameConfig.HasTicks() {
+			slog.Warn("Tick start or length not configured, flow-max-ticks is ignored")
 		}
-		time.Sleep(pollInterval)
+		slog.Info("Removing old flows from the database",
+			slog.Int("max-ticks", retention.MaxTicks),
+			slog.Duration("untagged-age", retention.UntaggedAge),
+			slog.String("mode", string(retention.Mode)),
+			slog.String("archive-dir", retention.ArchiveDir),
+		)
+		go lifecycle.NewPruner(retention, gDB, gameConfig).Run(ctx, time.Minute)
+	}
+
+	// Watch directory for new PCAP files and ingest them
+	w, err := watcher.New(watcher.Config{
+		Dir:          watchDir,
+		Recursive:    watchRecursive,
+		Extensions:   []string{".pcap"},
+		Exclude:      []string{archiveDir},
+		StableFor:    watchStableFor,
+		PollInterval: watchPollInterval,
+		Order:        watchOrder,
+		Polling:      watchPolling,
+	})
+	if err != nil {
+		slog.Error("Failed to watch directory", slog.String("dir", watchDir), slog.Any("err", err))
+		os.Exit(1)
 	}
+
+	slog.Info("Watching directory for new PCAP files",
+		slog.String("dir", watchDir),
+		slog.Bool("recursive", watchRecursive),
+		slog.String("order", string(watchOrder)),
+	)
+
+	w.Run(ctx, func(ctx context.Context, path string) {
+		slog.Info("Ingesting new PCAP file", slog.String("file", path))
+		service.HandlePcapUri(ctx, path)
+	})
 }
 
 func main() {
@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+
+	"tulip/pkg/db"
+
+	"github.com/lmittmann/tint"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Upgrade the data of a namespace to the current schema version",
+	Long: `Migrate upgrades in place the data stored by older Tulip versions: it backfills the
+fields added over time, rebuilds the indexes and converts the stored payloads. The
+services refuse to start on a namespace until it is migrated.`,
+	Run: runMigrate,
+}
+
+func init() {
+	migrateCmd.Flags().Bool("all", false, "Migrate every namespace of the database instead of --namespace")
+	rootCmd.AddCommand(migrateCmd)
+}
+
+func runMigrate(cmd *cobra.Command, args []string) {
+	slog.SetDefault(slog.New(tint.NewHandler(os.Stderr, &tint.Options{
+		Level:      slog.LevelInfo,
+		TimeFormat: "2006-01-02 15:04:05",
+	})))
+
+	dbString := viper.GetString("db")
+	if dbString == "" {
+		dbString = "mongodb://" + viper.GetString("mongo")
+	}
+	all, _ := cmd.Flags().GetBool("all")
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	database, err := db.Connect(dbString)
+	if err != nil {
+		slog.Error("Failed to connect to database", slog.Any("err", err))
+		os.Exit(1)
+	}
+	defer database.Close(context.Background())
+
+	names := []string{viper.GetString("namespace")}
+	if all {
+		names, err = database.ListNamespaces(ctx)
+		if err != nil {
+			slog.Error("Failed to list namespaces", slog.Any("err", err))
+			os.Exit(1)
+		}
+	}
+
+	failed := false
+	for _, name := range names {
+		handle, err := database.WithNamespace(name)
+		if err != nil {
+			slog.Error("Failed to open namespace", slog.String("namespace", name), slog.Any("err", err))
+			failed = true
+			continue
+		}
+		version, err := handle.GetSchemaVersion(ctx)
+		if err != nil {
+			slog.Error("Failed to read schema version", slog.String("namespace", name), slog.Any("err", err))
+			failed = true
+			continue
+		}
+		if version == db.SchemaVersion {
+			slog.Info("Namespace is up to date", slog.String("namespace", name), slog.Int("version", version))
+			continue
+		}
+
+		slog.Info("Migrating namespace...", slog.String("namespace", name), slog.Int("from", version), slog.Int("to", db.SchemaVersion))
+		if err := handle.Migrate(ctx); err != nil {
+			slog.Error("Failed to migrate namespace", slog.String("namespace", name), slog.Any("err", err))
+			failed = true
+			continue
+		}
+		slog.Info("Migrated namespace", slog.String("namespace", name), slog.Int("version", db.SchemaVersion))
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
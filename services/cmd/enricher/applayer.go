@@ -0,0 +1,61 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"github.com/tidwall/gjson"
+
+	"tulip/pkg/db"
+)
+
+// appLayerEvents are the event types whose metadata is attached to the flows,
+// see parseAppLayer.
+var appLayerEvents = map[string]bool{
+	"http":     true,
+	"dns":      true,
+	"tls":      true,
+	"fileinfo": true,
+	"smb":      true,
+	"anomaly":  true,
+}
+
+// parseAppLayer returns the application layer metadata of an http, dns, tls,
+// fileinfo, smb or anomaly event.
+func parseAppLayer(json string) db.AppLayer {
+	var app db.AppLayer
+	// collect appends the non-empty values at paths, which may be arrays
+	collect := func(values *[]string, paths ...string) {
+		for _, result := range gjson.GetMany(json, paths...) {
+			result.ForEach(func(_, value gjson.Result) bool {
+				if s := value.String(); s != "" {
+					*values = append(*values, s)
+				}
+				return true
+			})
+		}
+	}
+
+	if proto := gjson.Get(json, "app_proto").String(); proto != "" && proto != "failed" && proto != "unknown" {
+		app.Protocols = append(app.Protocols, proto)
+	}
+	collect(&app.Hostnames, "http.hostname", "tls.sni", "dns.rrname", "dns.queries.#.rrname", "smb.ntlmssp.host")
+	collect(&app.URLs, "http.url")
+	if status := gjson.Get(json, "http.status"); status.Exists() {
+		app.Statuses = append(app.Statuses, int(status.Int()))
+	}
+	collect(&app.UserAgents, "http.http_user_agent")
+	collect(&app.JA3, "tls.ja3.hash", "tls.ja3s.hash")
+	collect(&app.FileHashes, "fileinfo.md5", "fileinfo.sha1", "fileinfo.sha256")
+
+	// decoder anomalies only have a type
+	anomaly := gjson.Get(json, "anomaly.event")
+	if !anomaly.Exists() {
+		anomaly = gjson.Get(json, "anomaly.type")
+	}
+	if anomaly.String() != "" {
+		app.Anomalies = append(app.Anomalies, anomaly.String())
+	}
+	return app
+}
@@ -0,0 +1,227 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"tulip/pkg/tail"
+)
+
+// readBatch is the number of events read at once.
+const readBatch = 100
+
+// eventSource delivers the lines of eve.json to the enricher.
+type eventSource interface {
+	// read returns the next lines, none if there are none for now.
+	read(ctx context.Context) ([]string, error)
+	// commit acknowledges the lines returned by read so far, once they
+	// were processed or queued for retry.
+	commit(ctx context.Context) error
+	close() error
+}
+
+// listSource pops the events from a Redis list, as written by Suricata with
+// the redis filetype in list mode. Popping is destructive: the events read
+// by an enricher that dies before handling them are lost.
+type listSource struct {
+	rdb *redis.Client
+	key string
+}
+
+func (s *listSource) read(ctx context.Context) ([]string, error) {
+	lines, err := s.rdb.RPopCount(ctx, s.key, readBatch).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return lines, err
+}
+
+func (s *listSource) commit(context.Context) error { return nil }
+func (s *listSource) close() error                 { return nil }
+
+// streamSource takes over the events left pending by other consumers for
+// streamClaimIdle every streamClaim.
+const (
+	streamClaim     = 30 * time.Second
+	streamClaimIdle = 5 * time.Minute
+)
+
+// streamSource reads the events from a Redis stream in a consumer group, as
+// written by Suricata with the redis filetype in stream mode. Events are
+// acknowledged once handled, so the ones read by an enricher that dies are
+// read again when it restarts, or claimed by another consumer of the group.
+type streamSource struct {
+	rdb      *redis.Client
+	stream   string
+	group    string
+	consumer string
+
+	recovering bool      // still reading the events left pending by a previous run
+	lastClaim  time.Time // last time the idle events of other consumers were claimed
+	ids        []string  // events read since the last commit
+}
+
+func newStreamSource(ctx context.Context, rdb *redis.Client, stream, group, consumer string) (*streamSource, error) {
+	err := rdb.XGroupCreateMkStream(ctx, stream, group, "0").Err()
+	if err != nil && !redis.HasErrorPrefix(err, "BUSYGROUP") {
+		return nil, fmt.Errorf("failed to create consumer group %s: %v", group, err)
+	}
+	return &streamSource{rdb: rdb, stream: stream, group: group, consumer: consumer, recovering: true, lastClaim: time.Now()}, nil
+}
+
+func (s *streamSource) read(ctx context.Context) ([]string, error) {
+	var messages []redis.XMessage
+	switch {
+	case s.recovering:
+		streams, err := s.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: s.group, Consumer: s.consumer, Streams: []string{s.stream, "0"}, Count: readBatch, Block: -1,
+		}).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+		if len(streams) > 0 {
+			messages = streams[0].Messages
+		}
+		s.recovering = len(messages) > 0
+	case time.Since(s.lastClaim) > streamClaim:
+		var err error
+		messages, _, err = s.rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream: s.stream, Group: s.group, Consumer: s.consumer, MinIdle: streamClaimIdle, Start: "0-0", Count: readBatch,
+		}).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+		s.lastClaim = time.Now()
+	}
+	if len(messages) == 0 && !s.recovering {
+		streams, err := s.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: s.group, Consumer: s.consumer, Streams: []string{s.stream, ">"}, Count: readBatch, Block: -1,
+		}).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+		if len(streams) > 0 {
+			messages = streams[0].Messages
+		}
+	}
+
+	lines := make([]string, 0, len(messages))
+	for _, message := range messages {
+		s.ids = append(s.ids, message.ID)
+		lines = append(lines, streamLine(message))
+	}
+	return lines, nil
+}
+
+// streamLine returns the event of a stream entry, in the eve field written
+// by Suricata, or in the only field of the entry.
+func streamLine(message redis.XMessage) string {
+	if line, ok := message.Values["eve"].(string); ok {
+		return line
+	}
+	if len(message.Values) == 1 {
+		for _, value := range message.Values {
+			line, _ := value.(string)
+			return line
+		}
+	}
+	return ""
+}
+
+func (s *streamSource) commit(ctx context.Context) error {
+	if len(s.ids) == 0 {
+		return nil
+	}
+	if err := s.rdb.XAck(ctx, s.stream, s.group, s.ids...).Err(); err != nil {
+		return err
+	}
+	s.ids = s.ids[:0]
+	return nil
+}
+
+func (s *streamSource) close() error { return nil }
+
+// fileSource tails an eve.json file, following its rotations. The position
+// in the file is saved in a state file on commit, with the events of retry
+// when the enricher runs without Redis, so that a restarted enricher resumes
+// where the last one stopped.
+type fileSource struct {
+	follower *tail.Follower
+	state    string            // path of the state file
+	retry    *memoryRetryStore // nil when the events are retried with Redis
+}
+
+// fileState is the content of the state file of a fileSource.
+type fileState struct {
+	Position tail.Position `json:"position"`
+	Retry    []retryEntry  `json:"retry,omitempty"`
+}
+
+func newFileSource(path, state string, retry *memoryRetryStore) (*fileSource, error) {
+	var saved fileState
+	data, err := os.ReadFile(state)
+	if err == nil {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return nil, fmt.Errorf("failed to decode state file %s: %v", state, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read state file: %v", err)
+	}
+	if retry != nil {
+		retry.load(saved.Retry)
+	}
+
+	follower, err := tail.Open(path, saved.Position)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSource{follower: follower, state: state, retry: retry}, nil
+}
+
+func (s *fileSource) read(context.Context) ([]string, error) {
+	return s.follower.ReadLines(readBatch)
+}
+
+// commit saves the state atomically, replacing the previous one.
+func (s *fileSource) commit(context.Context) error {
+	state := fileState{Position: s.follower.Position()}
+	if s.retry != nil {
+		state.Retry = s.retry.entries()
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.state), filepath.Base(s.state)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to save state: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save state: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save state: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.state); err != nil {
+		return fmt.Errorf("failed to save state: %v", err)
+	}
+	return nil
+}
+
+func (s *fileSource) close() error {
+	return s.follower.Close()
+}
@@ -27,24 +27,53 @@ import (
 	"tulip/pkg/db"
 )
 
-var gDb db.MongoDatabase
+var gDb db.Database
 
+// WINDOW is the tolerance on the flow times reported by Suricata. Flows are
+// matched on their Community ID, the 5-tuple is only matched as a fallback,
+// see db.FlowID.
 const WINDOW = 5000 // ms
 
 func main() {
 	rootCmd := &cobra.Command{
 		Use:   "enricher",
-		Short: "Enrich flows with Suricata tags from Redis",
+		Short: "Enrich flows with the Suricata events read from eve.json or Redis",
 		Run:   runEnricher,
 	}
 
 	rootCmd.Flags().String("mongo", "localhost:27017", "MongoDB dns name + port (e.g. mongo:27017)")
+	rootCmd.Flags().String("db", "", "Database URI (mongodb://... or sqlite:///path/to/tulip.db), overrides --mongo")
+	rootCmd.Flags().String("namespace", db.DefaultNamespace, "Database namespace the flows are stored in, one per game (MongoDB database name)")
 	rootCmd.Flags().Bool("flowbits", true, "Tag flows with their flowbits")
+	rootCmd.Flags().Bool("flowvars", true, "Record the flowints and flowvars of the flows, such as the flow:match captures")
+	rootCmd.Flags().Bool("app-layer", true, "Attach the metadata of the http, dns, tls, fileinfo, smb and anomaly events to the flows")
 	rootCmd.Flags().String("redis", "", "Redis connection string")
+	rootCmd.Flags().String("redis-key", "suricata", "Redis list or stream Suricata writes the events to")
+	rootCmd.Flags().String("redis-mode", "list", "How Suricata writes the events to Redis: list (popped) or stream (read in a consumer group)")
+	rootCmd.Flags().String("redis-group", "tulip", "Consumer group of the enrichers reading a Redis stream")
+	rootCmd.Flags().String("redis-consumer", "", "Name of this enricher in the consumer group, the host name if empty")
+	rootCmd.Flags().String("eve", "", "Tail this eve.json file instead of reading the events from Redis")
+	rootCmd.Flags().String("eve-state", "", "File saving the position in the eve.json file, <eve>.state if empty")
+	rootCmd.Flags().Duration("retry-delay", 5*time.Second, "Delay before retrying an event that matched no flow, doubled after every attempt")
+	rootCmd.Flags().Duration("retry-max-delay", 2*time.Minute, "Maximum delay between two attempts at an event")
+	rootCmd.Flags().Duration("retry-max-age", 30*time.Minute, "Age after which an event that matched no flow is stored as a dead letter")
 
 	viper.BindPFlag("mongo", rootCmd.Flags().Lookup("mongo"))
+	viper.BindPFlag("db", rootCmd.Flags().Lookup("db"))
+	viper.BindPFlag("namespace", rootCmd.Flags().Lookup("namespace"))
 	viper.BindPFlag("flowbits", rootCmd.Flags().Lookup("flowbits"))
+	viper.BindPFlag("flowvars", rootCmd.Flags().Lookup("flowvars"))
+	viper.BindPFlag("app-layer", rootCmd.Flags().Lookup("app-layer"))
 	viper.BindPFlag("redis", rootCmd.Flags().Lookup("redis"))
+	viper.BindPFlag("redis-key", rootCmd.Flags().Lookup("redis-key"))
+	viper.BindPFlag("redis-mode", rootCmd.Flags().Lookup("redis-mode"))
+	viper.BindPFlag("redis-group", rootCmd.Flags().Lookup("redis-group"))
+	viper.BindPFlag("redis-consumer", rootCmd.Flags().Lookup("redis-consumer"))
+	viper.BindPFlag("eve", rootCmd.Flags().Lookup("eve"))
+	viper.BindPFlag("eve-state", rootCmd.Flags().Lookup("eve-state"))
+	viper.BindPFlag("retry-delay", rootCmd.Flags().Lookup("retry-delay"))
+	viper.BindPFlag("retry-max-delay", rootCmd.Flags().Lookup("retry-max-delay"))
+	viper.BindPFlag("retry-max-age", rootCmd.Flags().Lookup("retry-max-age"))
 
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
@@ -64,26 +93,108 @@ func main() {
 
 func runEnricher(cmd *cobra.Command, args []string) {
 	var (
-		mongodb     = viper.GetString("mongo")
-		tagFlowbits = viper.GetBool("flowbits")
-		redisConn   = viper.GetString("redis")
+		mongodb   = viper.GetString("mongo")
+		dbString  = viper.GetString("db")
+		namespace = viper.GetString("namespace")
+		options   = eveOptions{
+			flowbits: viper.GetBool("flowbits"),
+			flowvars: viper.GetBool("flowvars"),
+			appLayer: viper.GetBool("app-layer"),
+		}
+		redisConn = viper.GetString("redis")
+		redisKey  = viper.GetString("redis-key")
+		redisMode = viper.GetString("redis-mode")
+		evePath   = viper.GetString("eve")
+		eveState  = viper.GetString("eve-state")
+		retry     = retryQueue{
+			delay:    viper.GetDuration("retry-delay"),
+			maxDelay: viper.GetDuration("retry-max-delay"),
+			maxAge:   viper.GetDuration("retry-max-age"),
+		}
 	)
 
-	if redisConn == "" {
-		slog.Warn("No redis connection supplied. Exiting.")
+	if redisConn == "" && evePath == "" {
+		slog.Error("No input supplied: set --eve or --redis")
+		os.Exit(1)
+	}
+	if redisMode != "list" && redisMode != "stream" {
+		slog.Error("Invalid redis mode, expected list or stream", slog.String("mode", redisMode))
+		os.Exit(1)
+	}
+	if retry.delay <= 0 || retry.maxDelay < retry.delay {
+		slog.Error("Invalid retry delays", slog.Duration("delay", retry.delay), slog.Duration("max_delay", retry.maxDelay))
 		os.Exit(1)
 	}
 
 	var err error
-	dbString := "mongodb://" + mongodb
-	slog.Info("Connecting to MongoDB", slog.String("uri", dbString))
-	gDb, err = db.ConnectMongo(dbString)
+	if dbString == "" {
+		dbString = "mongodb://" + mongodb
+	}
+	slog.Info("Connecting to database", slog.String("uri", dbString), slog.String("namespace", namespace))
+	gDb, err = db.ConnectNamespace(dbString, namespace)
+	if err != nil {
+		slog.Error("Failed to connect to database", slog.Any("err", err))
+		os.Exit(1)
+	}
+	if err := db.CheckSchema(context.Background(), gDb); err != nil {
+		slog.Error("Incompatible database", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+
+	// the events that matched no flow are retried from Redis when there is
+	// one, see retryQueue
+	var (
+		rdb         *redis.Client
+		memoryRetry *memoryRetryStore
+	)
+	if redisConn != "" {
+		opt, err := redis.ParseURL(redisConn)
+		if err != nil {
+			slog.Error("Failed to parse redis url", slog.Any("err", err))
+			os.Exit(1)
+		}
+		slog.Info("Connecting to redis", slog.String("url", redisConn))
+		rdb = redis.NewClient(opt)
+		defer func() {
+			if err := rdb.Close(); err != nil {
+				slog.Error("Failed to close redis connection", slog.Any("err", err))
+			}
+		}()
+		retry.store = &redisRetryStore{rdb: rdb, key: redisKey + ":retry"}
+	} else {
+		memoryRetry = newMemoryRetryStore()
+		retry.store = memoryRetry
+	}
+
+	var source eventSource
+	switch {
+	case evePath != "":
+		if eveState == "" {
+			eveState = evePath + ".state"
+		}
+		slog.Info("Tailing eve.json", slog.String("path", evePath), slog.String("state", eveState))
+		source, err = newFileSource(evePath, eveState, memoryRetry)
+	case redisMode == "stream":
+		consumer := viper.GetString("redis-consumer")
+		if consumer == "" {
+			consumer, _ = os.Hostname()
+		}
+		group := viper.GetString("redis-group")
+		slog.Info("Reading redis stream", slog.String("stream", redisKey), slog.String("group", group), slog.String("consumer", consumer))
+		source, err = newStreamSource(ctx, rdb, redisKey, group, consumer)
+	default:
+		slog.Info("Popping redis list", slog.String("key", redisKey))
+		source = &listSource{rdb: rdb, key: redisKey}
+	}
 	if err != nil {
-		slog.Error("Failed to connect to MongoDB", slog.Any("err", err))
+		slog.Error("Failed to open input", slog.Any("err", err))
 		os.Exit(1)
 	}
+	defer source.close()
 
-	watchRedis(redisConn, tagFlowbits)
+	enrich(ctx, source, &retry, options)
 }
 
 /*
@@ -122,9 +233,29 @@ type suricataLog struct {
 	signature db.Signature
 }
 
-func handleEveLine(json string, tagFlowbits bool) (bool, error) {
+var (
+	// errNoFlow is returned by handleEveLine when no flow matched the event
+	// yet, the event is then retried, see retryQueue.
+	errNoFlow = errors.New("no matching flow")
+	// errInvalidEvent is returned by handleEveLine for lines that cannot be
+	// parsed, which are not retried.
+	errInvalidEvent = errors.New("invalid json in eve line")
+)
+
+// eveOptions are the parts of the events handleEveLine attaches to the flows,
+// besides the alerts.
+type eveOptions struct {
+	flowbits bool // Tag the flows with their flowbits
+	flowvars bool // Record the flowints and flowvars of the flows, see parseRuleVars
+	appLayer bool // Attach the metadata of the app-layer events, see parseAppLayer
+}
+
+// handleEveLine attaches the alert, flowbits, rule variables and app-layer
+// metadata of an event to its flow, returning errNoFlow if there is none.
+// Other events are ignored.
+func handleEveLine(ctx context.Context, json string, options eveOptions) error {
 	if !gjson.Valid(json) {
-		return false, errors.New("Invalid json in eve line")
+		return errInvalidEvent
 	}
 
 	src_port := gjson.Get(json, "src_port")
@@ -132,25 +263,33 @@ func handleEveLine(json string, tagFlowbits bool) (bool, error) {
 	dst_port := gjson.Get(json, "dest_port")
 	dst_ip := gjson.Get(json, "dest_ip")
 	start_time := gjson.Get(json, "flow.start")
+	community_id := gjson.Get(json, "community_id")
 
 	sig_msg := gjson.Get(json, "alert.signature")
 	sig_id := gjson.Get(json, "alert.signature_id")
 	sig_action := gjson.Get(json, "alert.action")
-	tag := ""
-	jtag := gjson.Get(json, "alert.metadata.tag.0")
 	flowbits := gjson.Get(json, "metadata.flowbits")
 
 	src_ip_str := net.ParseIP(src_ip.String()).String()
 	dst_ip_str := net.ParseIP(dst_ip.String()).String()
 
 	start_time_obj, _ := time.Parse("2006-01-02T15:04:05.999999999-0700", start_time.String())
-
-	if jtag.Exists() {
-		tag = jtag.String()
+	if !start_time.Exists() {
+		// app-layer events have no flow, they happened while it was going on
+		start_time_obj, _ = time.Parse("2006-01-02T15:04:05.999999999-0700", gjson.Get(json, "timestamp").String())
 	}
 
-	if !(sig_action.Exists() || (flowbits.Exists() && tagFlowbits)) {
-		return false, nil
+	tagFlowbits := flowbits.Exists() && options.flowbits
+	vars := db.RuleVars{}
+	if options.flowvars {
+		vars = parseRuleVars(json)
+	}
+	app := db.AppLayer{}
+	if options.appLayer && appLayerEvents[gjson.Get(json, "event_type").String()] {
+		app = parseAppLayer(json)
+	}
+	if !(sig_action.Exists() || tagFlowbits || !vars.IsZero() || !app.IsZero()) {
+		return nil
 	}
 
 	id := db.FlowID{
@@ -159,6 +298,9 @@ func handleEveLine(json string, tagFlowbits bool) (bool, error) {
 		Dst_port: int(dst_port.Int()),
 		Dst_ip:   dst_ip_str,
 		Time:     start_time_obj,
+		// the same in both directions, so the reversed id only falls back to
+		// the 5-tuple
+		CommunityID: community_id.String(),
 	}
 
 	id_rev := db.FlowID{
@@ -169,73 +311,144 @@ func handleEveLine(json string, tagFlowbits bool) (bool, error) {
 		Time:     start_time_obj,
 	}
 
-	ret := false
+	// once the alert is attached, retrying would count it twice
+	attached := false
 	if sig_action.Exists() {
 		sig := db.Signature{
-			ID:     int(sig_id.Int()),
-			Msg:    sig_msg.String(),
-			Action: sig_action.String(),
-			Tag:    tag,
+			GID:      int(gjson.Get(json, "alert.gid").Int()),
+			ID:       int(sig_id.Int()),
+			Rev:      int(gjson.Get(json, "alert.rev").Int()),
+			Msg:      sig_msg.String(),
+			Action:   sig_action.String(),
+			Severity: int(gjson.Get(json, "alert.severity").Int()),
+			Category: gjson.Get(json, "alert.category").String(),
+		}
+		for _, tag := range parseRuleTags(json) {
+			if err := registerTag(ctx, tag); err != nil {
+				return err
+			}
+			sig.Tags = append(sig.Tags, tag.Name)
+		}
+		var err error
+		attached, err = updateEitherDirection(id, id_rev, func(id db.FlowID) (bool, error) {
+			return gDb.AddSignatureToFlow(ctx, id, sig, WINDOW)
+		})
+		if err != nil {
+			return err
+		}
+		if !attached {
+			return errNoFlow
 		}
-		ret = gDb.AddSignatureToFlow(id, sig, WINDOW)
-		ret = ret || gDb.AddSignatureToFlow(id_rev, sig, WINDOW)
 	}
 
-	if !(flowbits.Exists() && tagFlowbits) {
-		return ret, nil
+	// the other updates can be repeated
+	var updates []func(db.FlowID) (bool, error)
+	if tagFlowbits {
+		tags := []string{}
+		flowbits.ForEach(func(key, value gjson.Result) bool {
+			tags = append(tags, value.String())
+			return true
+		})
+		for _, tag := range tags {
+			if err := registerTag(ctx, db.Tag{Name: tag, Description: "Suricata flowbit", Origin: db.TagOriginSuricata}); err != nil {
+				return err
+			}
+		}
+		updates = append(updates, func(id db.FlowID) (bool, error) {
+			return gDb.AddTagsToFlow(ctx, id, tags, WINDOW)
+		})
 	}
-
-	tags := []string{}
-	flowbits.ForEach(func(key, value gjson.Result) bool {
-		tags = append(tags, value.String())
-		return true
-	})
-
-	ret = gDb.AddTagsToFlow(id, tags, WINDOW)
-	ret = ret || gDb.AddTagsToFlow(id_rev, tags, WINDOW)
-	return ret, nil
-}
-
-func watchRedis(redisUrl string, tagFlowbits bool) {
-	opt, err := redis.ParseURL(redisUrl)
-	if err != nil {
-		slog.Error("Failed to parse redis url", slog.Any("err", err))
-		return
+	if !vars.IsZero() {
+		updates = append(updates, func(id db.FlowID) (bool, error) {
+			return gDb.AddVarsToFlow(ctx, id, vars, WINDOW)
+		})
+	}
+	if !app.IsZero() {
+		updates = append(updates, func(id db.FlowID) (bool, error) {
+			return gDb.AddAppLayerToFlow(ctx, id, app, WINDOW)
+		})
 	}
 
-	slog.Info("Connecting to redis", slog.String("url", redisUrl))
-	rdb := redis.NewClient(opt)
-	defer func() {
-		err := rdb.Close()
+	for _, update := range updates {
+		found, err := updateEitherDirection(id, id_rev, update)
 		if err != nil {
-			slog.Error("Failed to close redis connection", slog.Any("err", err))
+			return err
+		}
+		if !found && !attached {
+			return errNoFlow
 		}
-	}()
+	}
+	return nil
+}
+
+// registeredTags are the tags already registered by registerTag.
+var registeredTags = map[string]bool{}
+
+// registerTag records a tag seen in the eve log with its metadata, once per
+// run: the record of an existing tag keeps the values set in the UI.
+func registerTag(ctx context.Context, tag db.Tag) error {
+	if registeredTags[tag.Name] {
+		return nil
+	}
+	if err := db.ValidateTag(tag); err != nil {
+		slog.Warn("Ignoring the metadata of a Suricata tag", slog.String("tag", tag.Name), slog.Any("err", err))
+		tag = db.Tag{Name: tag.Name, Origin: tag.Origin}
+	}
+	if err := gDb.InsertTag(ctx, tag); err != nil {
+		return err
+	}
+	registeredTags[tag.Name] = true
+	return nil
+}
 
-	slog.Info("Connected to redis")
+// updateEitherDirection applies update to the flow as reported by Suricata,
+// or to the reversed one if no flow was found, as the direction of the flow
+// may differ from the one seen by the assembler.
+func updateEitherDirection(id, id_rev db.FlowID, update func(db.FlowID) (bool, error)) (bool, error) {
+	ok, err := update(id)
+	if err != nil || ok {
+		return ok, err
+	}
+	return update(id_rev)
+}
 
+// enrich handles the events of source, forever.
+func enrich(ctx context.Context, source eventSource, retry *retryQueue, options eveOptions) {
+	process := func(line string) error {
+		return handleEveLine(ctx, line, options)
+	}
 	for {
-		lines, err := rdb.RPopCount(context.TODO(), "suricata", 100).Result()
+		lines, err := source.read(ctx)
 		if err != nil {
-			if errors.Is(err, redis.Nil) {
-				time.Sleep(1 * time.Second)
-				continue
-			}
-			slog.Warn("Failed to pop from redis", slog.Any("err", err))
-			time.Sleep(1 * time.Second)
-			continue
+			slog.Warn("Failed to read events", slog.Any("err", err))
 		}
 
 		processed := 0
+		now := time.Now().UnixMilli()
 		for _, line := range lines {
-			_, err = handleEveLine(line, tagFlowbits)
+			ok, err := retry.handle(ctx, pendingEvent{Line: line, FirstSeen: now}, "", process)
 			if err != nil {
-				slog.Error("Failed to handle eve line", slog.String("line", line), slog.Any("err", err))
+				slog.Error("Failed to queue eve line for retry", slog.String("line", line), slog.Any("err", err))
 				continue
 			}
-			processed++
+			if ok {
+				processed++
+			}
+		}
+
+		retried, matched, err := retry.retryDue(ctx, process)
+		if err != nil {
+			slog.Warn("Failed to retry eve lines", slog.Any("err", err))
 		}
 
-		slog.Info("Processed lines from redis", slog.Int("processed", processed))
+		if len(lines) == 0 && retried == 0 {
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		if err := source.commit(ctx); err != nil {
+			slog.Error("Failed to commit events", slog.Any("err", err))
+		}
+		slog.Info("Processed events", slog.Int("processed", processed), slog.Int("unmatched", len(lines)-processed),
+			slog.Int("retried", retried), slog.Int("matched", matched))
 	}
 }
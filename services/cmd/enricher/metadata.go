@@ -0,0 +1,58 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"github.com/tidwall/gjson"
+
+	"tulip/pkg/db"
+)
+
+// parseRuleTags returns the tags of the metadata of the rule of an alert,
+// from "metadata: tag FLAG OUT, color danger". Each tag gets the color at the
+// same position, or the last one when the rule has fewer colors than tags.
+func parseRuleTags(json string) []db.Tag {
+	var colors []string
+	gjson.Get(json, "alert.metadata.color").ForEach(func(_, value gjson.Result) bool {
+		colors = append(colors, value.String())
+		return true
+	})
+
+	var tags []db.Tag
+	gjson.Get(json, "alert.metadata.tag").ForEach(func(_, value gjson.Result) bool {
+		tag := db.Tag{Name: value.String(), Origin: db.TagOriginSuricata}
+		if len(colors) > 0 {
+			tag.Color = colors[min(len(tags), len(colors)-1)]
+		}
+		if tag.Name != "" {
+			tags = append(tags, tag)
+		}
+		return true
+	})
+	return tags
+}
+
+// parseRuleVars returns the flowints and flowvars of an event, written by
+// Suricata in its metadata as
+//
+//	"flowints": {"tag_FLAG_OUT": 1}, "flowvars": [{"match": "FLAG{...}"}]
+func parseRuleVars(json string) db.RuleVars {
+	var vars db.RuleVars
+	gjson.Get(json, "metadata.flowints").ForEach(func(name, value gjson.Result) bool {
+		if vars.Flowints == nil {
+			vars.Flowints = map[string]int{}
+		}
+		vars.Flowints[name.String()] = int(value.Int())
+		return true
+	})
+	gjson.Get(json, "metadata.flowvars").ForEach(func(_, flowvar gjson.Result) bool {
+		flowvar.ForEach(func(name, value gjson.Result) bool {
+			vars.Flowvars = append(vars.Flowvars, db.FlowVar{Name: name.String(), Value: value.String()})
+			return true
+		})
+		return true
+	})
+	return vars
+}
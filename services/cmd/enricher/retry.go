@@ -0,0 +1,250 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"tulip/pkg/db"
+)
+
+// retryBatch is the number of due events retried at once.
+const retryBatch = 100
+
+// retryQueue holds the Suricata events that matched no flow yet: Suricata and
+// the assembler read the pcaps independently, and Suricata may report a flow
+// before the assembler stores it. The events are retried with exponential
+// backoff until they are older than maxAge, they are then stored as dead
+// letters, see db.DeadLetter.
+type retryQueue struct {
+	store    retryStore
+	delay    time.Duration // Delay before the first retry, doubled after every attempt
+	maxDelay time.Duration // Maximum delay between two attempts
+	maxAge   time.Duration // Time after which an event is given up
+}
+
+// pendingEvent is an event in the retry queue.
+type pendingEvent struct {
+	Line      string `json:"line"`
+	Attempts  int    `json:"attempts"`
+	FirstSeen int64  `json:"first_seen"` // epoch ms
+}
+
+// backoff returns the delay before the next attempt at an event, after the
+// given number of attempts.
+func (q *retryQueue) backoff(attempts int) time.Duration {
+	delay := q.delay
+	for i := 1; i < attempts && delay < q.maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, q.maxDelay)
+}
+
+// handle processes an event with process, which returns errNoFlow when no
+// flow matched it yet. The event is retried later if it failed, or given up
+// once too old. member is the entry of the event in the queue, empty for a
+// new event. It reports whether the event was processed.
+func (q *retryQueue) handle(ctx context.Context, event pendingEvent, member string, process func(string) error) (bool, error) {
+	event.Attempts++
+	err := process(event.Line)
+	if err == nil {
+		return true, q.remove(ctx, member)
+	}
+	if !errors.Is(err, errNoFlow) {
+		slog.Error("Failed to handle eve line", slog.String("line", event.Line), slog.Any("err", err))
+	}
+
+	now := time.Now()
+	next := now.Add(q.backoff(event.Attempts))
+	if errors.Is(err, errInvalidEvent) || next.Sub(time.UnixMilli(event.FirstSeen)) > q.maxAge {
+		letter := db.DeadLetter{
+			Event:     event.Line,
+			Reason:    err.Error(),
+			Attempts:  event.Attempts,
+			FirstSeen: event.FirstSeen,
+			DeadAt:    now.UnixMilli(),
+		}
+		dbErr := gDb.AddDeadLetter(ctx, letter)
+		if dbErr == nil {
+			slog.Warn("Gave up on eve line", slog.String("line", event.Line), slog.Int("attempts", event.Attempts),
+				slog.Any("err", err))
+			return false, q.remove(ctx, member)
+		}
+		// keep it in the queue rather than losing it
+		slog.Error("Failed to store dead letter", slog.Any("err", dbErr))
+	}
+
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return false, err
+	}
+	return false, q.store.schedule(ctx, string(encoded), next.UnixMilli(), member)
+}
+
+// remove removes an event from the queue, if it was there.
+func (q *retryQueue) remove(ctx context.Context, member string) error {
+	if member == "" {
+		return nil
+	}
+	return q.store.remove(ctx, member)
+}
+
+// retryDue retries the events whose next attempt is due, returning how many
+// were tried and how many of them were processed.
+func (q *retryQueue) retryDue(ctx context.Context, process func(string) error) (int, int, error) {
+	members, err := q.store.due(ctx, time.Now().UnixMilli(), retryBatch)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	processed := 0
+	for _, member := range members {
+		var event pendingEvent
+		if err := json.Unmarshal([]byte(member), &event); err != nil {
+			// not written by us, keep the raw entry
+			event = pendingEvent{Line: member, FirstSeen: time.Now().UnixMilli()}
+		}
+		ok, err := q.handle(ctx, event, member, process)
+		if err != nil {
+			return len(members), processed, err
+		}
+		if ok {
+			processed++
+		}
+	}
+	return len(members), processed, nil
+}
+
+// retryStore keeps the events of a retryQueue, encoded, with the time of
+// their next attempt.
+type retryStore interface {
+	schedule(ctx context.Context, member string, at int64, replaced string) error // Add an event, replacing another one if not empty
+	remove(ctx context.Context, member string) error                              // Remove an event
+	due(ctx context.Context, now int64, count int) ([]string, error)              // Claim up to count events due at now
+}
+
+// retryLease is how long an event claimed by redisRetryStore.due is hidden
+// from the other enrichers, it is retried after that if the enricher died.
+const retryLease = time.Minute
+
+// redisRetryStore keeps the events in a Redis sorted set scored by the time
+// of their next attempt, shared by the enrichers and surviving restarts.
+type redisRetryStore struct {
+	rdb *redis.Client
+	key string
+}
+
+func (s *redisRetryStore) schedule(ctx context.Context, member string, at int64, replaced string) error {
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if replaced != "" {
+			pipe.ZRem(ctx, s.key, replaced)
+		}
+		pipe.ZAdd(ctx, s.key, redis.Z{Score: float64(at), Member: member})
+		return nil
+	})
+	return err
+}
+
+func (s *redisRetryStore) remove(ctx context.Context, member string) error {
+	return s.rdb.ZRem(ctx, s.key, member).Err()
+}
+
+// due claims the events by pushing their next attempt by retryLease, only
+// one enricher succeeds.
+func (s *redisRetryStore) due(ctx context.Context, now int64, count int) ([]string, error) {
+	members, err := s.rdb.ZRangeByScore(ctx, s.key, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now, 10),
+		Count: int64(count),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	claimed := members[:0]
+	lease := float64(now + retryLease.Milliseconds())
+	for _, member := range members {
+		changed, err := s.rdb.ZAddArgs(ctx, s.key, redis.ZAddArgs{
+			XX: true, GT: true, Ch: true,
+			Members: []redis.Z{{Score: lease, Member: member}},
+		}).Result()
+		if err != nil {
+			return claimed, err
+		}
+		if changed == 1 {
+			claimed = append(claimed, member)
+		}
+	}
+	return claimed, nil
+}
+
+// memoryRetryStore keeps the events in memory, for the enrichers running
+// without Redis. It is saved along with the position in eve.json, see
+// fileSource.
+type memoryRetryStore struct {
+	events map[string]int64 // time of the next attempt by event
+}
+
+// retryEntry is an event of a memoryRetryStore as saved.
+type retryEntry struct {
+	Member string `json:"member"`
+	At     int64  `json:"at"`
+}
+
+func newMemoryRetryStore() *memoryRetryStore {
+	return &memoryRetryStore{events: map[string]int64{}}
+}
+
+func (s *memoryRetryStore) schedule(_ context.Context, member string, at int64, replaced string) error {
+	delete(s.events, replaced)
+	s.events[member] = at
+	return nil
+}
+
+func (s *memoryRetryStore) remove(_ context.Context, member string) error {
+	delete(s.events, member)
+	return nil
+}
+
+func (s *memoryRetryStore) due(_ context.Context, now int64, count int) ([]string, error) {
+	var due []retryEntry
+	for member, at := range s.events {
+		if at <= now {
+			due = append(due, retryEntry{member, at})
+		}
+	}
+	slices.SortFunc(due, func(a, b retryEntry) int { return cmp.Compare(a.At, b.At) })
+
+	members := make([]string, 0, min(len(due), count))
+	for _, entry := range due[:min(len(due), count)] {
+		members = append(members, entry.Member)
+	}
+	return members, nil
+}
+
+// entries returns the events to save.
+func (s *memoryRetryStore) entries() []retryEntry {
+	entries := make([]retryEntry, 0, len(s.events))
+	for member, at := range s.events {
+		entries = append(entries, retryEntry{member, at})
+	}
+	return entries
+}
+
+// load adds saved events.
+func (s *memoryRetryStore) load(entries []retryEntry) {
+	for _, entry := range entries {
+		s.events[entry.Member] = entry.At
+	}
+}
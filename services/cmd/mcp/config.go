@@ -11,6 +11,8 @@ import (
 
 type Config struct {
 	MongoHost string
+	Database  string // Optional database URI, replacing MongoHost
+	Namespace string // Namespace of the live game, the default one if empty
 }
 
 // LoadConfig reads configuration from environment variables.
@@ -23,17 +25,30 @@ func LoadConfig() (*Config, error) {
 		return val, nil
 	}
 
-	mongoHost, err := getenv("MONGO_HOST", true)
+	database, err := getenv("TULIP_DB", false)
+	if err != nil {
+		return nil, err
+	}
+	mongoHost, err := getenv("MONGO_HOST", database == "")
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := getenv("TULIP_NAMESPACE", false)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Config{
 		MongoHost: mongoHost,
+		Database:  database,
+		Namespace: namespace,
 	}, nil
 }
 
-// MongoServer returns the MongoDB connection string.
-func (c *Config) MongoServer() string {
+// DatabaseURI returns the database connection string.
+func (c *Config) DatabaseURI() string {
+	if c.Database != "" {
+		return c.Database
+	}
 	return fmt.Sprintf("mongodb://%s/", c.MongoHost)
 }
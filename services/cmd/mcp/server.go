@@ -8,16 +8,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"tulip/pkg/db"
 
 	"github.com/lmittmann/tint"
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
 func main() {
@@ -35,11 +38,14 @@ func main() {
 		return
 	}
 
-	// Initialize MongoDB connection using pkg/db
-	mongoURI := config.MongoServer()
-	mdb, err := db.ConnectMongo(mongoURI)
+	// Initialize the database connection using pkg/db
+	mdb, err := db.ConnectNamespace(config.DatabaseURI(), config.Namespace)
 	if err != nil {
-		slog.Error("Failed to connect to MongoDB", slog.Any("err", err))
+		slog.Error("Failed to connect to database", slog.Any("err", err))
+		return
+	}
+	if err := db.CheckSchema(context.Background(), mdb); err != nil {
+		slog.Error("Incompatible database", slog.Any("err", err))
 		return
 	}
 
@@ -58,7 +64,7 @@ func main() {
 		server.WithToolCapabilities(false),
 	)
 
-	addTools(mcpServ, &mdb)
+	addTools(mcpServ, mdb)
 
 	// Create HTTP server
 	httpServer := server.NewStreamableHTTPServer(mcpServ)
@@ -81,20 +87,156 @@ func strToClientServer(str string) string {
 	}
 }
 
-func addTools(mcpServ *server.MCPServer, database *db.MongoDatabase) {
+// writeAppLayer writes the non-empty app-layer metadata of a flow.
+func writeAppLayer(content *bytes.Buffer, app db.AppLayer) {
+	statuses := make([]string, len(app.Statuses))
+	for i, status := range app.Statuses {
+		statuses[i] = strconv.Itoa(status)
+	}
+	for _, field := range []struct {
+		name   string
+		values []string
+	}{
+		{"Application protocols", app.Protocols},
+		{"Hostnames", app.Hostnames},
+		{"URLs", app.URLs},
+		{"HTTP statuses", statuses},
+		{"User agents", app.UserAgents},
+		{"JA3 hashes", app.JA3},
+		{"File hashes", app.FileHashes},
+		{"Anomalies", app.Anomalies},
+	} {
+		if len(field.values) > 0 {
+			fmt.Fprintf(content, "%s: %s\n", field.name, strings.Join(field.values, ", "))
+		}
+	}
+}
+
+// tickRange returns the inclusive tick range requested through the tick,
+// tick_from and tick_to arguments. A nil bound is not filtered on.
+func tickRange(request mcp.CallToolRequest) (from, to *int) {
+	args := request.GetArguments()
+	optional := func(key string) *int {
+		if _, ok := args[key]; !ok {
+			return nil
+		}
+		v := request.GetInt(key, 0)
+		return &v
+	}
+
+	if tick := optional("tick"); tick != nil {
+		return tick, tick
+	}
+	return optional("tick_from"), optional("tick_to")
+}
+
+// maxEstimatedCount is where getFlows stops counting the flows for an
+// estimated total, and flowCount and getFlows for the filters that would
+// scan the whole namespace, see db.GetFlowsOptions.FullScan.
+const maxEstimatedCount = 10000
+
+// namespaceArg selects the namespace (game) a tool works on.
+var namespaceArg = mcp.WithString("namespace",
+	mcp.Description("Namespace (game) to search, as returned by listNamespaces. Defaults to the live game"))
+
+// queryArg filters the flows of a tool with the flow query language, see
+// db.ParseFlowQuery.
+var queryArg = mcp.WithString("query",
+	mcp.Description("Flow query, combined with the other filters. Conditions field:value joined with and (implicit), or, not "+
+		"and parentheses, e.g. service:web tag:flag-out not tag:starred data~\"admin\" tick:>40. "+
+		"Fields: service, tag, flag, flagid, src, dst (IP or CIDR such as 10.60.0.0/16), src_port, dst_port, "+
+		"time, tick, duration, size, packets, http_status (numbers: 42, >40, <=40, 10..20), "+
+		"protocol, hostname, url, user_agent, ja3, file_hash, anomaly, "+
+		"data (full-text search, or data~ for a case-insensitive regex) and contains (bytes, GET |2f|flag). "+
+		"Quote values with spaces: data:\"GET /flag\""))
+
+// flowQuery parses the query argument of a tool, returning nil if it is not
+// set or a tool error if it is invalid.
+func flowQuery(request mcp.CallToolRequest) (*db.FlowQuery, *mcp.CallToolResult) {
+	query := request.GetString("query", "")
+	if query == "" {
+		return nil, nil
+	}
+	q, err := db.ParseFlowQuery(query)
+	if err != nil {
+		return nil, mcp.NewToolResultError(err.Error())
+	}
+	return q, nil
+}
+
+// namespaceOf returns the database of the namespace requested through the
+// namespace argument, or a tool error if it does not exist.
+func namespaceOf(ctx context.Context, root db.Database, request mcp.CallToolRequest) (db.Database, *mcp.CallToolResult) {
+	name := request.GetString("namespace", "")
+	if name == "" || name == root.Namespace() {
+		return root, nil
+	}
+	if err := db.ValidateNamespace(name); err != nil {
+		return nil, mcp.NewToolResultError(err.Error())
+	}
+
+	names, err := root.ListNamespaces(ctx)
+	if err != nil {
+		slog.Error("Failed to list namespaces", slog.Any("err", err))
+		return nil, mcp.NewToolResultError("Could not list namespaces")
+	}
+	if !slices.Contains(names, name) {
+		return nil, mcp.NewToolResultError("Namespace not found")
+	}
+
+	database, err := root.WithNamespace(name)
+	if err != nil {
+		return nil, mcp.NewToolResultError(err.Error())
+	}
+	if err := db.CheckSchema(ctx, database); err != nil {
+		return nil, mcp.NewToolResultError(err.Error())
+	}
+	return database, nil
+}
+
+func addTools(mcpServ *server.MCPServer, root db.Database) {
+
+	// List Namespaces Tool
+	mcpServ.AddTool(
+		mcp.NewTool(
+			"listNamespaces",
+			mcp.WithDescription("List the namespaces holding flows, one per game. "+
+				"Pass one as the namespace argument of the other tools to browse an archived game"),
+		),
+		func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+			names, err := root.ListNamespaces(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list namespaces: %v", err)
+			}
+			return mcp.NewToolResultText(fmt.Sprintf("Namespaces: %s\nLive game: %s",
+				strings.Join(names, ", "), root.Namespace())), nil
+		},
+	)
 
 	// List Tags Tool
 	mcpServ.AddTool(
 		mcp.NewTool(
 			"listTags",
-			mcp.WithDescription("List all unique tags used in flows"),
+			mcp.WithDescription("List all tags used in flows, with their description"),
+			namespaceArg,
 		),
 		func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-			tags, err := database.GetTagList()
+			database, failed := namespaceOf(ctx, root, request)
+			if failed != nil {
+				return failed, nil
+			}
+			tags, err := database.GetTags(ctx)
 			if err != nil {
 				return nil, fmt.Errorf("failed to list tags: %v", err)
 			}
-			return mcp.NewToolResultText(fmt.Sprintf("Tags: %s", strings.Join(tags, ", "))), nil
+			lines := make([]string, len(tags))
+			for i, tag := range tags {
+				lines[i] = "- " + tag.Name
+				if tag.Description != "" {
+					lines[i] += ": " + tag.Description
+				}
+			}
+			return mcp.NewToolResultText("Tags:\n" + strings.Join(lines, "\n")), nil
 		},
 	)
 
@@ -110,31 +252,45 @@ func addTools(mcpServ *server.MCPServer, database *db.MongoDatabase) {
 			mcp.WithArray("tags", mcp.Description("Tags to filter flows"), mcp.Items(map[string]any{"type": "string"})),
 			mcp.WithString("start_time", mcp.Description("Start time to filter flows (RFC3339 format)")),
 			mcp.WithString("end_time", mcp.Description("End time to filter flows (RFC3339 format)")),
+			mcp.WithString("service", mcp.Description("Name of the game service the flows belong to")),
+			mcp.WithNumber("tick", mcp.Description("Game tick the flows started in")),
+			mcp.WithNumber("tick_from", mcp.Description("First game tick of the range to filter flows (inclusive)")),
+			mcp.WithNumber("tick_to", mcp.Description("Last game tick of the range to filter flows (inclusive)")),
+			queryArg,
+			namespaceArg,
 		),
 		func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-			// Build filters similar to GetFlowList
-			filters := bson.D{}
-			if v := request.GetString("src_ip", ""); v != "" {
-				filters = append(filters, bson.E{Key: "src_ip", Value: v})
-			}
-			if v := request.GetString("dst_ip", ""); v != "" {
-				filters = append(filters, bson.E{Key: "dst_ip", Value: v})
+			database, failed := namespaceOf(ctx, root, request)
+			if failed != nil {
+				return failed, nil
 			}
-			if v := request.GetInt("src_port", 0); v != 0 {
-				filters = append(filters, bson.E{Key: "src_port", Value: v})
+			query, failed := flowQuery(request)
+			if failed != nil {
+				return failed, nil
 			}
-			if v := request.GetInt("dst_port", 0); v != 0 {
-				filters = append(filters, bson.E{Key: "dst_port", Value: v})
-			}
-			if tags := request.GetStringSlice("tags", []string{}); len(tags) > 0 {
-				filters = append(filters, bson.E{Key: "tags", Value: map[string]any{"$all": tags}})
+			opts := &db.GetFlowsOptions{
+				Query:       query,
+				SrcIp:       request.GetString("src_ip", ""),
+				DstIp:       request.GetString("dst_ip", ""),
+				SrcPort:     request.GetInt("src_port", 0),
+				DstPort:     request.GetInt("dst_port", 0),
+				IncludeTags: request.GetStringSlice("tags", []string{}),
+				Service:     request.GetString("service", ""),
 			}
+			opts.TickFrom, opts.TickTo = tickRange(request)
 			// Optionally add time range filtering if your schema supports it
 
-			count, err := database.CountFlows(filters)
+			if opts.FullScan() {
+				opts.MaxCount = maxEstimatedCount
+			}
+
+			count, err := database.CountFlows(ctx, opts)
 			if err != nil {
 				return nil, fmt.Errorf("failed to count flows: %v", err)
 			}
+			if opts.Capped(count) {
+				return mcp.NewToolResultText(fmt.Sprintf("Total flows: at least %d", count)), nil
+			}
 			return mcp.NewToolResultText(fmt.Sprintf("Total flows: %d", count)), nil
 		},
 	)
@@ -148,6 +304,10 @@ func addTools(mcpServ *server.MCPServer, database *db.MongoDatabase) {
 				"ports, tags, and time range"),
 
 			mcp.WithNumber("limit", mcp.Required(), mcp.Description("Number of flows to fetch")),
+			mcp.WithString("cursor", mcp.Description("Next or previous page cursor returned by an earlier getFlows call with the same filters")),
+			mcp.WithString("count", mcp.Description("Also count the matching flows: exact, or estimated to stop counting at 10000. "+
+				"flow_regex and the query conditions on the flow data are always estimated"),
+				mcp.Enum("exact", "estimated")),
 			mcp.WithString("src_ip", mcp.Description("Source IP address to filter flows")),
 			mcp.WithString("dst_ip", mcp.Description("Destination IP address to filter flows")),
 			mcp.WithNumber("src_port", mcp.Description("Source port to filter flows")),
@@ -155,9 +315,30 @@ func addTools(mcpServ *server.MCPServer, database *db.MongoDatabase) {
 			mcp.WithArray("tags", mcp.Description("Tags to filter flows"), mcp.Items(map[string]any{"type": "number"})),
 			mcp.WithString("start_time", mcp.Description("Start time to filter flows (RFC3339 format)")),
 			mcp.WithString("end_time", mcp.Description("End time to filter flows (RFC3339 format)")),
-			mcp.WithString("flow_data", mcp.Description("Flow data to filter flows, you can insert any string you want to search for in the flow data")),
+			mcp.WithString("flow_data", mcp.Description("Full-text search on the flow data. Terms match whole words, case-insensitively: "+
+				"admin, prefix terms adm*, phrases \"GET /flag\", AND (implicit), OR, NOT or -term, and parentheses")),
+			mcp.WithString("flow_regex", mcp.Description("Case-insensitive regex on the flow data, slower than flow_data")),
+			mcp.WithString("flow_contains", mcp.Description("Byte sequence in the flow data, case-sensitive. "+
+				"Text with hex bytes between pipes, as in Suricata rules: GET |2f|flag|0d 0a|")),
+			mcp.WithString("service", mcp.Description("Name of the game service the flows belong to")),
+			mcp.WithNumber("tick", mcp.Description("Game tick the flows started in")),
+			mcp.WithNumber("tick_from", mcp.Description("First game tick of the range to filter flows (inclusive)")),
+			mcp.WithNumber("tick_to", mcp.Description("Last game tick of the range to filter flows (inclusive)")),
+			mcp.WithString("hostname", mcp.Description("HTTP host, TLS SNI or DNS query name seen by Suricata in the flows")),
+			mcp.WithString("url", mcp.Description("HTTP URL requested in the flows")),
+			mcp.WithNumber("http_status", mcp.Description("HTTP status code returned in the flows")),
+			mcp.WithString("user_agent", mcp.Description("HTTP user agent of the flows")),
+			mcp.WithString("ja3", mcp.Description("JA3 or JA3S hash of the TLS handshake of the flows")),
+			mcp.WithString("file_hash", mcp.Description("MD5, SHA-1 or SHA-256 of a file transferred in the flows")),
+			mcp.WithString("anomaly", mcp.Description("Anomaly reported by Suricata on the flows, e.g. stream.pkt_invalid_timestamp")),
+			queryArg,
+			namespaceArg,
 		),
 		func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+			database, failed := namespaceOf(ctx, root, request)
+			if failed != nil {
+				return failed, nil
+			}
 			opts := &db.GetFlowsOptions{}
 
 			// Parse the request parameters
@@ -175,20 +356,88 @@ func addTools(mcpServ *server.MCPServer, database *db.MongoDatabase) {
 			opts.IncludeTags = request.GetStringSlice("tags", []string{})
 			opts.FromTime = int64(request.GetInt("start_time", 0))
 			opts.ToTime = int64(request.GetInt("end_time", 0))
+			opts.Search = request.GetString("flow_data", "")
+			opts.FlowData = request.GetString("flow_regex", "")
+			if opts.FlowData != "" {
+				if _, err := regexp.Compile("(?i)" + opts.FlowData); err != nil {
+					return mcp.NewToolResultError(fmt.Sprintf("invalid flow_regex: %v", err)), nil
+				}
+			}
+			if opts.Search != "" {
+				if _, err := db.ParseSearch(opts.Search); err != nil {
+					return mcp.NewToolResultError(err.Error()), nil
+				}
+			}
+			if contains := request.GetString("flow_contains", ""); contains != "" {
+				pattern, err := db.ParsePattern(contains)
+				if err != nil {
+					return mcp.NewToolResultError(err.Error()), nil
+				}
+				opts.Contains = pattern
+			}
 
-			flows, err := database.GetFlows(ctx, opts)
+			opts.Service = request.GetString("service", "")
+			opts.TickFrom, opts.TickTo = tickRange(request)
+
+			opts.Hostname = request.GetString("hostname", "")
+			opts.URL = request.GetString("url", "")
+			opts.HTTPStatus = request.GetInt("http_status", 0)
+			opts.UserAgent = request.GetString("user_agent", "")
+			opts.JA3 = request.GetString("ja3", "")
+			opts.FileHash = request.GetString("file_hash", "")
+			opts.Anomaly = request.GetString("anomaly", "")
+
+			if opts.Query, failed = flowQuery(request); failed != nil {
+				return failed, nil
+			}
+
+			if cursor := request.GetString("cursor", ""); cursor != "" {
+				c, err := db.ParseFlowCursor(cursor)
+				if err != nil {
+					return mcp.NewToolResultError(err.Error()), nil
+				}
+				opts.Cursor = &c
+			}
+			count := request.GetString("count", "")
+			if count != "" && count != "exact" && count != "estimated" {
+				return mcp.NewToolResultError("count must be exact or estimated"), nil
+			}
+
+			page, err := db.GetFlowPage(ctx, database, opts)
 			if err != nil {
 				return nil, fmt.Errorf("failed to fetch flows: %v", err)
 			}
 
 			content := bytes.NewBufferString("")
-			fmt.Fprintf(content, "\nTotal flows found: %d\n", len(flows))
+			fmt.Fprintf(content, "\nFlows in this page: %d\n", len(page.Flows))
+			if count != "" {
+				if count == "estimated" || opts.FullScan() {
+					opts.MaxCount = maxEstimatedCount
+				}
+				total, err := database.CountFlows(ctx, opts)
+				if err != nil {
+					return nil, fmt.Errorf("failed to count flows: %v", err)
+				}
+				if opts.Capped(total) {
+					fmt.Fprintf(content, "Total flows matching: at least %d\n", total)
+				} else {
+					fmt.Fprintf(content, "Total flows matching: %d\n", total)
+				}
+			}
+			if page.Next != nil {
+				fmt.Fprintf(content, "Next page (older flows) cursor: %s\n", page.Next)
+			}
+			if page.Prev != nil {
+				fmt.Fprintf(content, "Previous page (newer flows) cursor: %s\n", page.Prev)
+			}
 
 			fmt.Fprintf(content, "Flows:\n")
-			for _, flow := range flows {
+			for _, flow := range page.Flows {
 
 				fmt.Fprintf(content, "\tFlow ID: %s\n", flow.Id)
 				fmt.Fprintf(content, "\tTimestamp: %d\n", flow.Time)
+				fmt.Fprintf(content, "\tTick: %d\n", flow.Tick)
+				fmt.Fprintf(content, "\tService: %s\n", flow.Service)
 				fmt.Fprintf(content, "\tSource: %s:%d\n", flow.SrcIp, flow.SrcPort)
 				fmt.Fprintf(content, "\tDestination: %s:%d\n", flow.DstIp, flow.DstPort)
 				fmt.Fprintf(content, "\tFound flags: %s\n", flow.Flags)
@@ -208,29 +457,39 @@ func addTools(mcpServ *server.MCPServer, database *db.MongoDatabase) {
 			"getFlow",
 			mcp.WithDescription("Fetch a single flow by its ID"),
 			mcp.WithString("flow_id", mcp.Required(), mcp.Description("The ID of the flow to fetch")),
+			namespaceArg,
 		),
 		func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+			database, failed := namespaceOf(ctx, root, request)
+			if failed != nil {
+				return failed, nil
+			}
 			flowID := request.GetString("flow_id", "")
 			if flowID == "" {
 				return mcp.NewToolResultError("flow_id is required"), nil
 			}
 
 			flow, err := database.GetFlowByID(ctx, flowID)
-			if err != nil {
-				return nil, fmt.Errorf("failed to fetch flow: %v", err)
-			}
-			if flow == nil {
+			if errors.Is(err, db.ErrNotFound) {
 				return mcp.NewToolResultError("Flow not found"), nil
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to fetch flow: %v", err)
 			}
 
 			content := bytes.NewBufferString("")
 
 			fmt.Fprintf(content, "Flow ID: %s\n", flow.Id)
 			fmt.Fprintf(content, "Timestamp: %d\n", flow.Time)
+			fmt.Fprintf(content, "Tick: %d\n", flow.Tick)
+			fmt.Fprintf(content, "Service: %s\n", flow.Service)
 			fmt.Fprintf(content, "Source: %s:%d\n", flow.SrcIp, flow.SrcPort)
 			fmt.Fprintf(content, "Destination: %s:%d\n", flow.DstIp, flow.DstPort)
 			fmt.Fprintf(content, "Found flags: %s\n", strings.Join(flow.Flags, ", "))
 			fmt.Fprintf(content, "Tags: %s\n", strings.Join(flow.Tags, ", "))
+			writeAppLayer(content, flow.App)
+			for _, flowvar := range flow.Vars.Flowvars {
+				fmt.Fprintf(content, "Flowvar %s: %s\n", flowvar.Name, flowvar.Value)
+			}
 			fmt.Fprintf(content, "Number of messages: %d\n", len(flow.Flow))
 			fmt.Fprintf(content, "\n")
 
@@ -14,17 +14,20 @@ package assembler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/netip"
 	"os"
 	"regexp"
 	"time"
+	"tulip/pkg/communityid"
 	"tulip/pkg/db"
+	"tulip/pkg/game"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/ip4defrag"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcapgo"
 	"github.com/google/gopacket/reassembly"
 	"github.com/panjf2000/ants/v2"
 )
@@ -49,11 +52,14 @@ type Config struct {
 	TcpLazy       bool           // Lazy decoding for TCP packets
 	Experimental  bool           // Experimental features enabled
 	NonStrict     bool           // Non-strict mode for TCP stream assembly
+	Decapsulate   bool           // Assemble the inner connection of GRE, VXLAN and IP-in-IP tunnels
 
 	ConnectionTcpTimeout time.Duration
 	ConnectionUdpTimeout time.Duration
 
 	FlagIdUrl string // URL del servizio flagid
+
+	Game *game.Config // Game configuration, used to stamp ticks and services on flows
 }
 
 func NewAssemblerService(opts Config) *Service {
@@ -93,7 +99,7 @@ func (s *Service) HandlePcapUri(ctx context.Context, fname string) {
 	}
 	defer file.Close()
 
-	reader, err := pcapgo.NewReader(file)
+	reader, err := NewPcapReader(file)
 	if err != nil {
 		slog.Error("Failed to create PCAP reader", "file", fname, "err", err)
 		return
@@ -130,7 +136,7 @@ func (s *Service) FlushConnections() {
 }
 
 // ProcessPcapHandle processes a PCAP handle, reading packets and processing them.
-func (s *Service) ProcessPcapHandle(ctx context.Context, handle *pcapgo.Reader, fname string) {
+func (s *Service) ProcessPcapHandle(ctx context.Context, handle *PcapReader, fname string) {
 	defer func() {
 		if r := recover(); r != nil {
 			slog.Error("Recovered from panic in ProcessPcapHandle", "error", r, "file", fname)
@@ -138,9 +144,12 @@ func (s *Service) ProcessPcapHandle(ctx context.Context, handle *pcapgo.Reader,
 	}()
 
 	// Check if the file has already been processed
-	exists, file := s.DB.GetPcap(fname)
+	file, err := s.DB.GetPcap(ctx, fname)
 	processedCount := int64(0)
-	if exists {
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		slog.Error("Failed to get PCAP file status", "file", fname, "error", err)
+		return
+	} else if err == nil {
 		if file.Finished {
 			slog.Info("PCAP file already processed", "file", fname)
 			return
@@ -177,7 +186,7 @@ packetLoop:
 
 		data := packet.Data()
 		bytes += int64(len(data))
-		done := s.processPacket(packet, fname, nodefrag)
+		done := s.processPacket(packet, fname, count, nodefrag)
 		if done {
 			finished = false
 			break
@@ -200,32 +209,20 @@ packetLoop:
 		"file", fname, "finished", finished,
 	)
 
-	s.DB.InsertPcap(db.PcapFile{
+	// record the progress even if ctx was cancelled, to resume from there
+	err = s.DB.InsertPcap(context.WithoutCancel(ctx), db.PcapFile{
 		FileName: fname,
 		Position: count,
 		Finished: finished,
 	})
-}
-
-// checkProcessedCount returns the count of already processed packets for a given file.
-func (s *Service) checkProcessedCount(fname string) int64 {
-	exists, file := s.DB.GetPcap(fname)
-	if exists {
-		return file.Position
+	if err != nil {
+		slog.Error("Failed to record PCAP file progress", "file", fname, "error", err)
 	}
-	return 0
 }
 
 // setupPacketSource initializes the gopacket.PacketSource based on the link type.
-func (s *Service) setupPacketSource(handle *pcapgo.Reader) *gopacket.PacketSource {
-	linktype := handle.LinkType()
-	var source *gopacket.PacketSource
-	switch linktype {
-	case layers.LinkTypeIPv4:
-		source = gopacket.NewPacketSource(handle, layers.LayerTypeIPv4)
-	default:
-		source = gopacket.NewPacketSource(handle, linktype)
-	}
+func (s *Service) setupPacketSource(handle *PcapReader) *gopacket.PacketSource {
+	source := gopacket.NewPacketSource(handle, handle.Decoder())
 	source.Lazy = s.TcpLazy
 	source.NoCopy = true
 	return source
@@ -233,11 +230,14 @@ func (s *Service) setupPacketSource(handle *pcapgo.Reader) *gopacket.PacketSourc
 
 // processPacket handles a single packet: skipping, defragmentation, protocol dispatch (TCP/UDP), and error handling.
 // Returns true if processing should stop.
-func (s *Service) processPacket(packet gopacket.Packet, fname string, nodefrag bool) bool {
+func (s *Service) processPacket(packet gopacket.Packet, fname string, index int64, nodefrag bool) bool {
+	network, transport := flowLayers(packet, s.Decapsulate)
+	if network == nil {
+		return false
+	}
+
 	// defrag the IPv4 packet if required
-	ip4Layer := packet.Layer(layers.LayerTypeIPv4)
-	if !nodefrag && ip4Layer != nil {
-		ip4 := ip4Layer.(*layers.IPv4)
+	if ip4, ok := network.(*layers.IPv4); !nodefrag && ok {
 		l := ip4.Length
 		newip4, err := s.Defragmenter.DefragIPv4(ip4)
 		if err != nil {
@@ -253,10 +253,10 @@ func (s *Service) processPacket(packet gopacket.Packet, fname string, nodefrag b
 			}
 			nextDecoder := newip4.NextLayerType()
 			nextDecoder.Decode(newip4.Payload, pb)
+			_, transport = flowLayers(packet, s.Decapsulate)
 		}
 	}
 
-	transport := packet.TransportLayer()
 	if transport == nil {
 		return false
 	}
@@ -264,16 +264,16 @@ func (s *Service) processPacket(packet gopacket.Packet, fname string, nodefrag b
 	switch transport.LayerType() {
 	case layers.LayerTypeTCP:
 		tcp := transport.(*layers.TCP)
-		flow := packet.NetworkLayer().NetworkFlow()
+		flow := network.NetworkFlow()
 		captureInfo := packet.Metadata().CaptureInfo
 		captureInfo.AncillaryData = []any{fname}
-		context := &Context{CaptureInfo: captureInfo}
+		context := &Context{CaptureInfo: captureInfo, Source: fname, PacketIndex: index}
 		s.AssemblerTcp.AssembleWithContext(flow, tcp, context)
 	case layers.LayerTypeUDP:
 		udp := transport.(*layers.UDP)
-		flow := packet.NetworkLayer().NetworkFlow()
+		flow := network.NetworkFlow()
 		captureInfo := packet.Metadata().CaptureInfo
-		s.AssemblerUdp.Assemble(flow, udp, &captureInfo, fname)
+		s.AssemblerUdp.Assemble(flow, udp, &captureInfo, fname, index)
 	default:
 		slog.Warn("Unsupported transport layer", "layer", transport.LayerType().String(), "file", fname)
 	}
@@ -287,11 +287,18 @@ func (s *Service) shouldFlushConnections(lastFlush time.Time) bool {
 
 // TODO; FIXME; RDJ; this is kinda gross, but this is PoC level code
 func (s *Service) reassemblyCallback(entry db.FlowEntry) {
+	s.applyGameInfo(&entry)
 	s.parseAndTagHttp(&entry)
 	s.applyFlagRegexTags(&entry)
 	s.insertFlowEntry(&entry)
 }
 
+// applyGameInfo stamps the game tick and the service name on the flow entry.
+func (s *Service) applyGameInfo(entry *db.FlowEntry) {
+	entry.Tick = s.Game.Tick(int64(entry.Time))
+	entry.Service = s.Game.ServiceName(entry.SrcPort, entry.DstPort)
+}
+
 // parseAndTagHttp parses HTTP flows and decodes encodings to plaintext.
 func (s *Service) parseAndTagHttp(entry *db.FlowEntry) {
 	s.ParseHttpFlow(entry)
@@ -305,6 +312,15 @@ func (s *Service) applyFlagRegexTags(entry *db.FlowEntry) {
 	ApplyFlagTags(entry, *s.FlagRegex)
 }
 
+// communityID computes the Community ID of a flow, which Suricata reports in
+// its events to correlate them with the flow.
+func communityID(proto uint8, net gopacket.Flow, srcPort, dstPort uint16) string {
+	src, dst := net.Endpoints()
+	srcIP, _ := netip.AddrFromSlice(src.Raw())
+	dstIP, _ := netip.AddrFromSlice(dst.Raw())
+	return communityid.Hash(communityid.DefaultSeed, proto, srcIP, srcPort, dstIP, dstPort)
+}
+
 // insertFlowEntry inserts the processed flow entry into the database.
 func (s *Service) insertFlowEntry(entry *db.FlowEntry) {
 	s.flowChannel <- *entry // Send to channel for processing
@@ -320,7 +336,10 @@ func (s *Service) insertFlows() error {
 
 	for entry := range s.flowChannel {
 		pool.Submit(func() {
-			s.DB.InsertFlow(entry)
+			if err := s.DB.InsertFlow(context.Background(), entry); err != nil {
+				slog.Error("Failed to insert flow, no data will be available for it",
+					"file", entry.Filename, "error", err)
+			}
 		})
 	}
 
@@ -14,7 +14,6 @@ import (
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/pcapgo"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
 // Helper to create a minimal valid classic PCAP file in memory
@@ -54,21 +53,9 @@ func writeTempFile(t *testing.T, data []byte, suffix string) string {
 	return fname
 }
 
-type NoopDatabase struct{}
-
-func (n *NoopDatabase) GetFlowList(bson.D) ([]db.FlowEntry, error)     { return nil, nil }
-func (n *NoopDatabase) GetTagList() ([]string, error)                  { return nil, nil }
-func (n *NoopDatabase) GetSignature(string) (db.Signature, error)      { return db.Signature{}, nil }
-func (n *NoopDatabase) SetStar(string, bool) error                     { return nil }
-func (n *NoopDatabase) GetFlowDetail(id string) (*db.FlowEntry, error) { return nil, nil }
-func (n *NoopDatabase) InsertFlow(db.FlowEntry)                        {}
-func (n *NoopDatabase) GetPcap(string) (bool, db.PcapFile)             { return false, db.PcapFile{} }
-func (n *NoopDatabase) InsertPcap(db.PcapFile) bool                    { return true }
-func (n *NoopDatabase) GetFlagIds() ([]db.FlagIdEntry, error)          { return nil, nil }
-
 func makeTestAssembler() *Service {
 	cfg := Config{
-		DB:                   &NoopDatabase{},
+		DB:                   db.NewMemoryDatabase(),
 		TcpLazy:              false,
 		Experimental:         false,
 		NonStrict:            false,
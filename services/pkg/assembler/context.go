@@ -12,13 +12,28 @@
 
 package assembler
 
-import "github.com/google/gopacket"
+import (
+	"tulip/pkg/db"
+
+	"github.com/google/gopacket"
+)
 
 // Context implements reassembly.AssemblerContext
 type Context struct {
 	CaptureInfo gopacket.CaptureInfo
+	Source      string // pcap file the packet was read from
+	PacketIndex int64  // 1-based index of the packet in Source
 }
 
 func (c *Context) GetCaptureInfo() gopacket.CaptureInfo {
 	return c.CaptureInfo
 }
+
+// addPcapRef extends the packet ranges of a flow with a new packet.
+func addPcapRef(refs []db.PcapRef, file string, index int64) []db.PcapRef {
+	if l := len(refs); l > 0 && refs[l-1].File == file {
+		refs[l-1].LastPacket = max(refs[l-1].LastPacket, index)
+		return refs
+	}
+	return append(refs, db.PcapRef{File: file, FirstPacket: index, LastPacket: index})
+}
@@ -0,0 +1,200 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package assembler
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Link types not (correctly) handled by gopacket. Note that gopacket's
+// layers.LinkType is 8 bits wide, while pcap link types are 16 bits.
+const (
+	// linkTypeRawBSD is the value of DLT_RAW on most BSDs, found in some
+	// captures instead of LINKTYPE_RAW.
+	linkTypeRawBSD = 12
+	// linkTypeRawOpenBSD is the value of DLT_RAW on OpenBSD.
+	linkTypeRawOpenBSD = 14
+	// LinkTypeLinuxSLL2 is the Linux "cooked" capture v2 used by `tcpdump -i any`.
+	LinkTypeLinuxSLL2 = 276
+)
+
+var (
+	// LayerTypeLinuxSLL2 is the layer type of Linux cooked capture v2 headers.
+	LayerTypeLinuxSLL2 = gopacket.RegisterLayerType(1276, gopacket.LayerTypeMetadata{
+		Name:    "LinuxSLL2",
+		Decoder: gopacket.DecodeFunc(decodeLinuxSLL2),
+	})
+
+	// linuxSLLDecoder decodes Linux cooked capture v1 headers.
+	linuxSLLDecoder = gopacket.DecodeFunc(decodeLinuxSLL)
+)
+
+// PcapReader is a pcapgo.Reader that also knows the full link type of the
+// file, which gopacket truncates to 8 bits.
+type PcapReader struct {
+	*pcapgo.Reader
+	linkType uint32
+}
+
+// NewPcapReader reads the header of a pcap file.
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(24)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pcap header: %w", err)
+	}
+
+	reader, err := pcapgo.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	var order binary.ByteOrder = binary.BigEndian
+	if magic := binary.LittleEndian.Uint32(header[0:4]); magic == 0xa1b2c3d4 || magic == 0xa1b23c4d {
+		order = binary.LittleEndian
+	}
+	// the upper 16 bits may carry FCS information
+	linkType := order.Uint32(header[20:24]) & 0xffff
+
+	return &PcapReader{Reader: reader, linkType: linkType}, nil
+}
+
+// LinkType returns the link type of the file.
+func (r *PcapReader) LinkType() uint32 {
+	return r.linkType
+}
+
+// Decoder returns the decoder for the packets of the file.
+func (r *PcapReader) Decoder() gopacket.Decoder {
+	return packetDecoder(r.linkType)
+}
+
+// packetDecoder returns the decoder for packets of the given link type.
+func packetDecoder(linkType uint32) gopacket.Decoder {
+	switch linkType {
+	case uint32(layers.LinkTypeIPv4):
+		return layers.LayerTypeIPv4
+	case uint32(layers.LinkTypeIPv6):
+		return layers.LayerTypeIPv6
+	case linkTypeRawBSD, linkTypeRawOpenBSD:
+		return layers.LinkTypeRaw
+	case uint32(layers.LinkTypeLinuxSLL):
+		return linuxSLLDecoder
+	case LinkTypeLinuxSLL2:
+		return LayerTypeLinuxSLL2
+	}
+	if linkType > 0xff {
+		return gopacket.DecodePayload // not known to gopacket
+	}
+	return layers.LinkType(linkType)
+}
+
+// flowLayers returns the network and transport layers a packet is assembled
+// on. With decapsulate, the innermost ones are used, so that traffic tunneled
+// in GRE, VXLAN or IP-in-IP is assembled as the inner connection; otherwise
+// the outermost ones are.
+func flowLayers(packet gopacket.Packet, decapsulate bool) (gopacket.NetworkLayer, gopacket.TransportLayer) {
+	if !decapsulate {
+		return packet.NetworkLayer(), packet.TransportLayer()
+	}
+
+	var (
+		network   gopacket.NetworkLayer
+		transport gopacket.TransportLayer
+	)
+	for _, layer := range packet.Layers() {
+		switch l := layer.(type) {
+		case *layers.IPv4, *layers.IPv6:
+			// a transport layer only belongs to the network layer it follows
+			network, transport = l.(gopacket.NetworkLayer), nil
+		case *layers.TCP, *layers.UDP:
+			if transport == nil {
+				transport = l.(gopacket.TransportLayer)
+			}
+		}
+	}
+	return network, transport
+}
+
+// LinuxSLL2 is the header of a Linux cooked capture v2 packet.
+// See https://www.tcpdump.org/linktypes/LINKTYPE_LINUX_SLL2.html
+type LinuxSLL2 struct {
+	layers.BaseLayer
+	ProtocolType    layers.EthernetType
+	InterfaceIndex  uint32
+	ARPHardwareType uint16
+	PacketType      layers.LinuxSLLPacketType
+	AddrLen         uint8
+	Addr            net.HardwareAddr
+}
+
+const linuxSLL2HeaderLen = 20
+
+func (sll *LinuxSLL2) LayerType() gopacket.LayerType { return LayerTypeLinuxSLL2 }
+
+func (sll *LinuxSLL2) CanDecode() gopacket.LayerClass { return LayerTypeLinuxSLL2 }
+
+func (sll *LinuxSLL2) NextLayerType() gopacket.LayerType { return sll.ProtocolType.LayerType() }
+
+func (sll *LinuxSLL2) LinkFlow() gopacket.Flow {
+	return gopacket.NewFlow(layers.EndpointMAC, sll.Addr, nil)
+}
+
+func (sll *LinuxSLL2) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < linuxSLL2HeaderLen {
+		df.SetTruncated()
+		return errors.New("Linux SLL2 packet too small")
+	}
+	sll.ProtocolType = layers.EthernetType(binary.BigEndian.Uint16(data[0:2]))
+	sll.InterfaceIndex = binary.BigEndian.Uint32(data[4:8])
+	sll.ARPHardwareType = binary.BigEndian.Uint16(data[8:10])
+	sll.PacketType = layers.LinuxSLLPacketType(data[10])
+	sll.AddrLen = min(data[11], 8)
+	sll.Addr = net.HardwareAddr(data[12 : 12+sll.AddrLen])
+	sll.BaseLayer = layers.BaseLayer{Contents: data[:linuxSLL2HeaderLen], Payload: data[linuxSLL2HeaderLen:]}
+	return nil
+}
+
+func decodeLinuxSLL2(data []byte, p gopacket.PacketBuilder) error {
+	sll := &LinuxSLL2{}
+	if err := sll.DecodeFromBytes(data, p); err != nil {
+		return err
+	}
+	p.AddLayer(sll)
+	p.SetLinkLayer(sll)
+	return p.NextDecoder(sll.ProtocolType)
+}
+
+// decodeLinuxSLL decodes a Linux cooked capture v1 header. Unlike the
+// gopacket decoder, it doesn't panic on link-layer addresses longer than the
+// 8 bytes reserved for them in the header.
+func decodeLinuxSLL(data []byte, p gopacket.PacketBuilder) error {
+	if len(data) < 16 {
+		p.SetTruncated()
+		return errors.New("Linux SLL packet too small")
+	}
+
+	addrLen := min(binary.BigEndian.Uint16(data[4:6]), 8)
+	sll := &layers.LinuxSLL{
+		BaseLayer:    layers.BaseLayer{Contents: data[:16], Payload: data[16:]},
+		PacketType:   layers.LinuxSLLPacketType(binary.BigEndian.Uint16(data[0:2])),
+		AddrType:     binary.BigEndian.Uint16(data[2:4]),
+		AddrLen:      addrLen,
+		Addr:         net.HardwareAddr(data[6 : 6+addrLen]),
+		EthernetType: layers.EthernetType(binary.BigEndian.Uint16(data[14:16])),
+	}
+	p.AddLayer(sll)
+	p.SetLinkLayer(sll)
+	return p.NextDecoder(sll.EthernetType)
+}
@@ -0,0 +1,132 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package assembler
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func serialize(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		t.Fatalf("failed to serialize packet: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// innerLayers returns the layers of the connection 10.0.0.1:1234 -> 10.0.0.2:80.
+func innerLayers() []gopacket.SerializableLayer {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	tcp := &layers.TCP{SrcPort: 1234, DstPort: 80, SYN: true, Window: 1024}
+	tcp.SetNetworkLayerForChecksum(ip)
+	return []gopacket.SerializableLayer{ip, tcp}
+}
+
+func outerLayers(proto layers.IPProtocol) []gopacket.SerializableLayer {
+	return []gopacket.SerializableLayer{
+		&layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, TTL: 64, Protocol: proto, SrcIP: net.IP{192, 168, 0, 1}, DstIP: net.IP{192, 168, 0, 2}},
+	}
+}
+
+func TestFlowLayers(t *testing.T) {
+	inner := serialize(t, innerLayers()...)
+
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP,
+		SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("fd00::2")}
+	tcp6 := &layers.TCP{SrcPort: 1234, DstPort: 80, SYN: true, Window: 1024}
+	tcp6.SetNetworkLayerForChecksum(ip6)
+
+	sll := append([]byte{0, 0, 0, 1, 0, 6, 0, 0, 0, 0, 0, 1, 0, 0, 0x08, 0x00}, inner...)
+	sll2 := append([]byte{0x08, 0x00, 0, 0, 0, 0, 0, 3, 0, 1, 0, 6, 0, 0, 0, 0, 0, 1, 0, 0}, inner...)
+
+	gre := serialize(t, append(outerLayers(layers.IPProtocolGRE),
+		append([]gopacket.SerializableLayer{&layers.GRE{Protocol: layers.EthernetTypeIPv4}}, innerLayers()...)...)...)
+	ipip := serialize(t, append(outerLayers(layers.IPProtocolIPv4), innerLayers()...)...)
+
+	vxlanOuter := outerLayers(layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: 50000, DstPort: 4789}
+	udp.SetNetworkLayerForChecksum(vxlanOuter[1].(*layers.IPv4))
+	vxlanOuter = append(vxlanOuter, udp,
+		&layers.VXLAN{ValidIDFlag: true, VNI: 42},
+		&layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 3}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 4},
+			EthernetType: layers.EthernetTypeIPv4})
+	vxlan := serialize(t, append(vxlanOuter, innerLayers()...)...)
+
+	cases := []struct {
+		name        string
+		linkType    uint32
+		data        []byte
+		decapsulate bool
+		want        string // src -> dst of the assembled connection
+	}{
+		{"raw", uint32(layers.LinkTypeRaw), inner, false, "10.0.0.1:1234 -> 10.0.0.2:80"},
+		{"raw_bsd", linkTypeRawBSD, inner, false, "10.0.0.1:1234 -> 10.0.0.2:80"},
+		{"ipv4", uint32(layers.LinkTypeIPv4), inner, false, "10.0.0.1:1234 -> 10.0.0.2:80"},
+		{"ipv6", uint32(layers.LinkTypeIPv6), serialize(t, ip6, tcp6), false, "fd00::1:1234 -> fd00::2:80"},
+		{"sll", uint32(layers.LinkTypeLinuxSLL), sll, false, "10.0.0.1:1234 -> 10.0.0.2:80"},
+		{"sll2", LinkTypeLinuxSLL2, sll2, false, "10.0.0.1:1234 -> 10.0.0.2:80"},
+		{"gre", uint32(layers.LinkTypeEthernet), gre, true, "10.0.0.1:1234 -> 10.0.0.2:80"},
+		{"ipip", uint32(layers.LinkTypeEthernet), ipip, true, "10.0.0.1:1234 -> 10.0.0.2:80"},
+		{"vxlan", uint32(layers.LinkTypeEthernet), vxlan, true, "10.0.0.1:1234 -> 10.0.0.2:80"},
+		{"vxlan_tunnel", uint32(layers.LinkTypeEthernet), vxlan, false, "192.168.0.1:50000 -> 192.168.0.2:4789"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			packet := gopacket.NewPacket(tc.data, packetDecoder(tc.linkType), gopacket.Default)
+			network, transport := flowLayers(packet, tc.decapsulate)
+			if network == nil || transport == nil {
+				t.Fatalf("missing layers: %v", packet)
+			}
+
+			src, dst := network.NetworkFlow().Endpoints()
+			sport, dport := transport.TransportFlow().Endpoints()
+			if got := src.String() + ":" + sport.String() + " -> " + dst.String() + ":" + dport.String(); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewPcapReader_WideLinkType(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := writePcapHeader(buf, 65535, LinkTypeLinuxSLL2); err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte{0x08, 0x00, 0, 0, 0, 0, 0, 3, 0, 1, 0, 6, 0, 0, 0, 0, 0, 1, 0, 0}, serialize(t, innerLayers()...)...)
+	ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}
+	if err := pcapgo.NewWriter(buf).WritePacket(ci, data); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewPcapReader(buf)
+	if err != nil {
+		t.Fatalf("NewPcapReader failed: %v", err)
+	}
+	if reader.LinkType() != LinkTypeLinuxSLL2 {
+		t.Fatalf("LinkType = %d, want %d", reader.LinkType(), LinkTypeLinuxSLL2)
+	}
+
+	pkt, _, err := reader.ReadPacketData()
+	if err != nil {
+		t.Fatalf("ReadPacketData failed: %v", err)
+	}
+	packet := gopacket.NewPacket(pkt, reader.Decoder(), gopacket.Default)
+	if packet.Layer(LayerTypeLinuxSLL2) == nil || packet.Layer(layers.LayerTypeTCP) == nil {
+		t.Errorf("packet not decoded: %v", packet)
+	}
+}
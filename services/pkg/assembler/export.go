@@ -0,0 +1,336 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package assembler
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"slices"
+	"time"
+	"tulip/pkg/db"
+	"tulip/pkg/lifecycle"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// DefaultExportGrace is how long after the last recorded packet of a flow the
+// exporter keeps looking for its teardown (FIN/ACK, RST).
+const DefaultExportGrace = 5 * time.Second
+
+// exportSnaplen is the snapshot length written in exported pcap headers.
+const exportSnaplen = 262144
+
+// ErrPcapUnavailable is returned when none of the packets of the exported
+// flows can be read, because their pcap files were deleted.
+var ErrPcapUnavailable = errors.New("pcap files are no longer available")
+
+// Exporter extracts the packets of flows from the processed pcap files.
+type Exporter struct {
+	DB    db.Database
+	Grace time.Duration // Time window after the last recorded packet still searched for teardown packets
+}
+
+// NewExporter creates a new Exporter using the default grace period.
+func NewExporter(database db.Database) *Exporter {
+	return &Exporter{DB: database, Grace: DefaultExportGrace}
+}
+
+// endpoint is one side of a connection.
+type endpoint struct {
+	ip   string
+	port int
+}
+
+// flowKey identifies a connection regardless of the direction of a packet.
+type flowKey struct {
+	udp  bool
+	a, b endpoint
+}
+
+func keyOf(flow *db.FlowEntry) flowKey {
+	return flowKey{
+		udp: slices.Contains(flow.Tags, "udp"),
+		a:   endpoint{flow.SrcIp, flow.SrcPort},
+		b:   endpoint{flow.DstIp, flow.DstPort},
+	}
+}
+
+// span is the part of a pcap file that holds the packets of a flow.
+type span struct {
+	key         flowKey
+	first, last int64 // packet index range recorded by the assembler
+	until       int64 // for flows without packet indexes: end of the flow (epoch ms)
+	lastSeen    time.Time
+	done        bool
+}
+
+// packetInfo is what the exporter needs to know about a packet to match it.
+type packetInfo struct {
+	udp      bool
+	src, dst endpoint
+	fragment bool // IPv4 fragment without (complete) transport header
+	syn      bool // TCP SYN opening a new connection
+}
+
+// match returns the description of the packet matching the connection, or
+// nil if the packet belongs to another one.
+func (k flowKey) match(infos []packetInfo) *packetInfo {
+	for i := range infos {
+		if k.matches(&infos[i]) {
+			return &infos[i]
+		}
+	}
+	return nil
+}
+
+// matches reports whether the packet belongs to the connection.
+func (k flowKey) matches(p *packetInfo) bool {
+	if p.fragment {
+		return (p.src.ip == k.a.ip && p.dst.ip == k.b.ip) || (p.src.ip == k.b.ip && p.dst.ip == k.a.ip)
+	}
+	if p.udp != k.udp {
+		return false
+	}
+	return (p.src == k.a && p.dst == k.b) || (p.src == k.b && p.dst == k.a)
+}
+
+type exportedPacket struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+}
+
+// Export writes a pcap file with the packets of the given flows to w, sorted
+// by timestamp. Flows recorded before packet indexes were stored are
+// searched in their pcap file by 5-tuple and time.
+func (e *Exporter) Export(ctx context.Context, w io.Writer, flows []db.FlowEntry) error {
+	spans := make(map[string][]*span)
+	for i := range flows {
+		flow := &flows[i]
+		key := keyOf(flow)
+		if len(flow.Pcaps) == 0 {
+			if flow.Filename == "" {
+				continue
+			}
+			spans[flow.Filename] = append(spans[flow.Filename], &span{
+				key:      key,
+				first:    1,
+				last:     math.MaxInt64,
+				until:    int64(flow.Time + flow.Duration),
+				lastSeen: time.UnixMilli(int64(flow.Time + flow.Duration)),
+			})
+			continue
+		}
+		for _, ref := range flow.Pcaps {
+			spans[ref.File] = append(spans[ref.File], &span{key: key, first: ref.FirstPacket, last: ref.LastPacket})
+		}
+	}
+
+	files := make([]string, 0, len(spans))
+	for file := range spans {
+		files = append(files, file)
+	}
+	slices.Sort(files)
+
+	var (
+		packets     []exportedPacket
+		linkType    uint32
+		haveLink    bool
+		unavailable int
+	)
+	for _, file := range files {
+		fileLink, found, err := e.exportFile(ctx, file, spans[file], &packets)
+		if errors.Is(err, ErrPcapUnavailable) {
+			slog.Warn("Skipping unavailable pcap file in export", slog.String("file", file))
+			unavailable++
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		if haveLink && fileLink != linkType {
+			return fmt.Errorf("cannot merge pcap files with different link types (%d and %d)", linkType, fileLink)
+		}
+		linkType, haveLink = fileLink, true
+	}
+
+	if len(packets) == 0 && unavailable > 0 {
+		return ErrPcapUnavailable
+	}
+	if !haveLink {
+		linkType = uint32(layers.LinkTypeEthernet)
+	}
+
+	slices.SortStableFunc(packets, func(a, b exportedPacket) int {
+		return a.ci.Timestamp.Compare(b.ci.Timestamp)
+	})
+
+	// pcapgo.Writer can't write link types wider than 8 bits in the header
+	if err := writePcapHeader(w, exportSnaplen, linkType); err != nil {
+		return fmt.Errorf("failed to write pcap header: %w", err)
+	}
+	writer := pcapgo.NewWriter(w)
+	for _, p := range packets {
+		if err := writer.WritePacket(p.ci, p.data); err != nil {
+			return fmt.Errorf("failed to write packet: %w", err)
+		}
+	}
+	return nil
+}
+
+// exportFile appends the packets of a single pcap file matching spans to
+// packets. It reports the link type of the file and whether any packet was found.
+func (e *Exporter) exportFile(ctx context.Context, name string, spans []*span, packets *[]exportedPacket) (uint32, bool, error) {
+	path := name
+	pcap, err := e.DB.GetPcap(ctx, name)
+	if err == nil {
+		if pcap.Removed {
+			return 0, false, ErrPcapUnavailable
+		}
+		path = pcap.Path()
+	} else if !errors.Is(err, db.ErrNotFound) {
+		return 0, false, fmt.Errorf("failed to get pcap file %s: %w", name, err)
+	}
+
+	file, err := lifecycle.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, false, ErrPcapUnavailable
+	} else if err != nil {
+		return 0, false, fmt.Errorf("failed to open pcap file %s: %w", name, err)
+	}
+	defer file.Close()
+
+	reader, err := NewPcapReader(file)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read pcap file %s: %w", name, err)
+	}
+	decoder := reader.Decoder()
+
+	firstIndex := int64(math.MaxInt64)
+	for _, sp := range spans {
+		firstIndex = min(firstIndex, sp.first)
+	}
+
+	found := false
+	for index := int64(1); ; index++ {
+		data, ci, err := reader.ReadPacketData()
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			break // a truncated last packet is expected while a file is being written
+		} else if err != nil {
+			return 0, false, fmt.Errorf("failed to read packet %d of %s: %w", index, name, err)
+		}
+		if index < firstIndex {
+			continue
+		}
+
+		var (
+			infos   []packetInfo
+			decoded bool
+		)
+		included, active := false, false
+		for _, sp := range spans {
+			if sp.done || index < sp.first {
+				active = active || !sp.done
+				continue
+			}
+			active = true
+
+			inRange := index <= sp.last && (sp.until == 0 || ci.Timestamp.UnixMilli() <= sp.until)
+			if !inRange && (sp.lastSeen.IsZero() || ci.Timestamp.Sub(sp.lastSeen) > e.Grace) {
+				sp.done = true
+				continue
+			}
+
+			if !decoded {
+				infos, decoded = decodePacketInfo(data, decoder), true
+			}
+			info := sp.key.match(infos)
+			if info == nil {
+				continue
+			}
+			if !inRange && info.syn {
+				sp.done = true // the 5-tuple is being reused by a new connection
+				continue
+			}
+
+			sp.lastSeen = ci.Timestamp
+			included = true
+		}
+
+		if included {
+			*packets = append(*packets, exportedPacket{ci: ci, data: data})
+			found = true
+		}
+		if !active {
+			break
+		}
+	}
+
+	return reader.LinkType(), found, nil
+}
+
+// writePcapHeader writes the header of a microsecond resolution pcap file.
+func writePcapHeader(w io.Writer, snaplen, linkType uint32) error {
+	var header [24]byte
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], snaplen)
+	binary.LittleEndian.PutUint32(header[20:24], linkType)
+	_, err := w.Write(header[:])
+	return err
+}
+
+// decodePacketInfo extracts the addresses of a packet, both of the outermost
+// and of the innermost (tunneled) connection, as flows may have been
+// assembled with or without decapsulation. Non-IP packets have none.
+func decodePacketInfo(data []byte, decoder gopacket.Decoder) []packetInfo {
+	packet := gopacket.NewPacket(data, decoder, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+
+	infos := make([]packetInfo, 0, 2)
+	for _, decapsulate := range []bool{false, true} {
+		info, ok := layersInfo(flowLayers(packet, decapsulate))
+		if ok && (len(infos) == 0 || infos[0] != info) {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// layersInfo describes the connection of a network and transport layer.
+func layersInfo(network gopacket.NetworkLayer, transport gopacket.TransportLayer) (packetInfo, bool) {
+	if network == nil {
+		return packetInfo{}, false
+	}
+
+	src, dst := network.NetworkFlow().Endpoints()
+	info := packetInfo{src: endpoint{ip: src.String()}, dst: endpoint{ip: dst.String()}}
+
+	if ip4, ok := network.(*layers.IPv4); ok && (ip4.FragOffset != 0 || ip4.Flags&layers.IPv4MoreFragments != 0) {
+		info.fragment = true
+		return info, true
+	}
+
+	switch transport := transport.(type) {
+	case *layers.TCP:
+		info.src.port, info.dst.port = int(transport.SrcPort), int(transport.DstPort)
+		info.syn = transport.SYN && !transport.ACK
+	case *layers.UDP:
+		info.udp = true
+		info.src.port, info.dst.port = int(transport.SrcPort), int(transport.DstPort)
+	default:
+		return packetInfo{}, false
+	}
+	return info, true
+}
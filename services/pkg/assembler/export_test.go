@@ -0,0 +1,156 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package assembler
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+	"tulip/pkg/db"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+type tcpSegment struct {
+	client   bool
+	flags    string // S, A, F, P
+	payload  string
+	seq, ack uint32
+}
+
+// makeTcpPcap writes two interleaved TCP connections, each with handshake,
+// one request/response and teardown, to a pcap file.
+func makeTcpPcap(t *testing.T) string {
+	t.Helper()
+
+	conn := []tcpSegment{
+		{client: true, flags: "S", seq: 100},
+		{client: false, flags: "SA", seq: 500, ack: 101},
+		{client: true, flags: "A", seq: 101, ack: 501},
+		{client: true, flags: "PA", payload: "GET / HTTP/1.0\r\n\r\n", seq: 101, ack: 501},
+		{client: false, flags: "PA", payload: "HTTP/1.0 200 OK\r\n\r\n", seq: 501, ack: 119},
+		{client: true, flags: "FA", seq: 119, ack: 520},
+		{client: false, flags: "FA", seq: 520, ack: 120},
+		{client: true, flags: "A", seq: 120, ack: 521},
+	}
+
+	buf := &bytes.Buffer{}
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Add(-time.Hour)
+	for i, seg := range conn {
+		for c, clientPort := range []layers.TCPPort{40000, 40001} {
+			ts := start.Add(time.Duration(2*i+c) * 10 * time.Millisecond)
+			data := serializeTcp(t, seg, net.IP{10, 0, 0, byte(1 + c)}, clientPort)
+			ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(data), Length: len(data)}
+			if err := w.WritePacket(ci, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return writeTempFile(t, buf.Bytes(), ".pcap")
+}
+
+func serializeTcp(t *testing.T, seg tcpSegment, clientIP net.IP, clientPort layers.TCPPort) []byte {
+	t.Helper()
+
+	serverIP := net.IP{10, 0, 0, 100}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: clientIP, DstIP: serverIP}
+	tcp := &layers.TCP{SrcPort: clientPort, DstPort: 80, Seq: seg.seq, Ack: seg.ack, Window: 1024}
+	if !seg.client {
+		ip.SrcIP, ip.DstIP = serverIP, clientIP
+		tcp.SrcPort, tcp.DstPort = 80, clientPort
+	}
+	for _, f := range seg.flags {
+		switch f {
+		case 'S':
+			tcp.SYN = true
+		case 'A':
+			tcp.ACK = true
+		case 'F':
+			tcp.FIN = true
+		case 'P':
+			tcp.PSH = true
+		}
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(seg.payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExport_SingleFlow(t *testing.T) {
+	fname := makeTcpPcap(t)
+
+	store := db.NewMemoryDatabase()
+	service := NewAssemblerService(Config{DB: store})
+	service.HandlePcapUri(t.Context(), fname)
+	service.AssemblerTcp.FlushAll()
+
+	var flow *db.FlowEntry
+	for deadline := time.Now().Add(2 * time.Second); flow == nil && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		flows, _ := store.GetFlows(t.Context(), &db.GetFlowsOptions{SrcPort: 40000})
+		if len(flows) > 0 {
+			flow = &flows[0]
+		}
+	}
+	if flow == nil {
+		t.Fatal("flow was not inserted")
+	}
+	if len(flow.Pcaps) != 1 || flow.Pcaps[0].File != fname || flow.Pcaps[0].FirstPacket != 1 {
+		t.Fatalf("unexpected pcap references: %+v", flow.Pcaps)
+	}
+
+	legacy := *flow
+	legacy.Pcaps = nil
+
+	for name, flow := range map[string]db.FlowEntry{"indexed": *flow, "legacy": legacy} {
+		t.Run(name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			if err := NewExporter(store).Export(t.Context(), out, []db.FlowEntry{flow}); err != nil {
+				t.Fatalf("Export failed: %v", err)
+			}
+
+			r, err := pcapgo.NewReader(out)
+			if err != nil {
+				t.Fatalf("exported file is not a pcap: %v", err)
+			}
+			count := 0
+			for {
+				data, _, err := r.ReadPacketData()
+				if err != nil {
+					break
+				}
+				count++
+				packet := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.Default)
+				tcp := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+				if tcp.SrcPort != 40000 && tcp.DstPort != 40000 {
+					t.Errorf("packet %d belongs to another connection: %v", count, tcp.TransportFlow())
+				}
+			}
+			if count != 8 {
+				t.Errorf("exported %d packets, want 8 (handshake, data and teardown)", count)
+			}
+		})
+	}
+}
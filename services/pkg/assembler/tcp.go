@@ -12,7 +12,9 @@
 package assembler
 
 import (
+	"slices"
 	"sync"
+	"tulip/pkg/communityid"
 	"tulip/pkg/db"
 
 	"time"
@@ -85,6 +87,7 @@ type TcpStream struct {
 	dstPort    layers.TCPPort
 	totalSize  int
 	numPackets int
+	pcaps      []db.PcapRef // packets of the connection in the pcap files
 
 	nonStrict bool // non-strict mode, used for testing
 
@@ -94,6 +97,11 @@ type TcpStream struct {
 }
 
 func (t *TcpStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	// Every packet of the connection is part of its pcap export, even if rejected below
+	if c, ok := ac.(*Context); ok {
+		t.pcaps = addPcapRef(t.pcaps, c.Source, c.PacketIndex)
+	}
+
 	// FSM
 	if !t.tcpFSM.CheckState(tcp, dir) {
 		if !t.tcpFSMErr {
@@ -218,6 +226,8 @@ func (t *TcpStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
 		Size:        t.totalSize,
 		Flags:       make([]string, 0),
 		Flagids:     make([]string, 0),
+		Pcaps:       slices.Clone(t.pcaps),
+		CommunityID: communityID(communityid.ProtoTCP, t.net, uint16(t.srcPort), uint16(t.dstPort)),
 	}
 
 	t.onComplete(entry)
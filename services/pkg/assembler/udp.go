@@ -7,6 +7,7 @@
 package assembler
 
 import (
+	"tulip/pkg/communityid"
 	"tulip/pkg/db"
 
 	"time"
@@ -27,7 +28,7 @@ func NewUdpAssembler() *UdpAssembler {
 	}
 }
 
-func (assembler *UdpAssembler) Assemble(flow gopacket.Flow, udp *layers.UDP, captureInfo *gopacket.CaptureInfo, source string) *UdpStream {
+func (assembler *UdpAssembler) Assemble(flow gopacket.Flow, udp *layers.UDP, captureInfo *gopacket.CaptureInfo, source string, index int64) *UdpStream {
 	endpointSrc := flow.Src().FastHash()
 	endpointDst := flow.Dst().FastHash()
 	portSrc := uint16(udp.SrcPort)
@@ -63,7 +64,7 @@ func (assembler *UdpAssembler) Assemble(flow gopacket.Flow, udp *layers.UDP, cap
 		assembler.Streams[id] = stream
 	}
 
-	stream.ProcessSegment(flow, udp, captureInfo)
+	stream.ProcessSegment(flow, udp, captureInfo, source, index)
 	return stream
 }
 
@@ -112,5 +113,7 @@ func (a *UdpAssembler) CompleteReassembly(stream *UdpStream) *db.FlowEntry {
 		Flagids:      []string{},
 		Fingerprints: []uint32{},
 		Size:         int(stream.PacketSize),
+		Pcaps:        stream.Pcaps,
+		CommunityID:  communityID(communityid.ProtoUDP, stream.Flow, uint16(stream.PortSrc), uint16(stream.PortDst)),
 	}
 }
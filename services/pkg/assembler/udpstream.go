@@ -31,9 +31,12 @@ type UdpStream struct {
 	PortDst     layers.UDPPort
 	Source      string
 	LastSeen    time.Time
+	Pcaps       []db.PcapRef
 }
 
-func (stream *UdpStream) ProcessSegment(flow gopacket.Flow, udp *layers.UDP, captureInfo *gopacket.CaptureInfo) {
+func (stream *UdpStream) ProcessSegment(flow gopacket.Flow, udp *layers.UDP, captureInfo *gopacket.CaptureInfo, source string, index int64) {
+	stream.Pcaps = addPcapRef(stream.Pcaps, source, index)
+
 	if len(udp.Payload) == 0 {
 		return
 	}
@@ -0,0 +1,61 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package communityid computes the Community ID of flows, the hash of their
+// 5-tuple that Suricata writes in eve.json as community_id, so that alerts can
+// be matched to flows exactly. See
+// https://github.com/corelight/community-id-spec.
+package communityid
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"net/netip"
+)
+
+// IP protocol numbers of the flows reassembled by Tulip.
+const (
+	ProtoTCP uint8 = 6
+	ProtoUDP uint8 = 17
+)
+
+// DefaultSeed is the seed used by Suricata unless community-id-seed is set.
+const DefaultSeed uint16 = 0
+
+// Hash returns the version 1 Community ID of a flow, such as
+// "1:LQU9qZlK+B5F3KDmev6m5PMibrg=". It is the same in both directions.
+func Hash(seed uint16, proto uint8, srcIP netip.Addr, srcPort uint16, dstIP netip.Addr, dstPort uint16) string {
+	src, dst := srcIP.Unmap().AsSlice(), dstIP.Unmap().AsSlice()
+
+	// the smaller endpoint comes first
+	if c := bytes.Compare(src, dst); c > 0 || (c == 0 && srcPort > dstPort) {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+	}
+
+	h := sha1.New()
+	binary.Write(h, binary.BigEndian, seed)
+	h.Write(src)
+	h.Write(dst)
+	h.Write([]byte{proto, 0})
+	binary.Write(h, binary.BigEndian, srcPort)
+	binary.Write(h, binary.BigEndian, dstPort)
+	return "1:" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// FromStrings is Hash for addresses in text form, it returns an empty string
+// if one of them is invalid.
+func FromStrings(seed uint16, proto uint8, srcIP string, srcPort int, dstIP string, dstPort int) string {
+	src, err := netip.ParseAddr(srcIP)
+	if err != nil {
+		return ""
+	}
+	dst, err := netip.ParseAddr(dstIP)
+	if err != nil {
+		return ""
+	}
+	return Hash(seed, proto, src, uint16(srcPort), dst, uint16(dstPort))
+}
@@ -0,0 +1,43 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package communityid
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	cases := []struct {
+		name             string
+		seed             uint16
+		proto            uint8
+		srcIP, dstIP     string
+		srcPort, dstPort uint16
+		want             string
+	}{
+		{"tcp", 0, ProtoTCP, "128.232.110.120", "66.35.250.204", 34855, 80, "1:LQU9qZlK+B5F3KDmev6m5PMibrg="},
+		{"tcp reversed", 0, ProtoTCP, "66.35.250.204", "128.232.110.120", 80, 34855, "1:LQU9qZlK+B5F3KDmev6m5PMibrg="},
+		{"udp", 0, ProtoUDP, "192.168.1.52", "8.8.8.8", 54585, 53, "1:d/FP5EW3wiY1vCndhwleRRKHowQ="},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Hash(tc.seed, tc.proto, netip.MustParseAddr(tc.srcIP), tc.srcPort, netip.MustParseAddr(tc.dstIP), tc.dstPort)
+			if got != tc.want {
+				t.Errorf("Hash = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFromStrings(t *testing.T) {
+	want := Hash(DefaultSeed, ProtoTCP, netip.MustParseAddr("10.0.0.1"), 1234, netip.MustParseAddr("10.0.0.2"), 80)
+	if got := FromStrings(DefaultSeed, ProtoTCP, "::ffff:10.0.0.1", 1234, "10.0.0.2", 80); got != want {
+		t.Errorf("FromStrings of a mapped address = %s, want %s", got, want)
+	}
+	if got := FromStrings(DefaultSeed, ProtoTCP, "nope", 1234, "10.0.0.2", 80); got != "" {
+		t.Errorf("FromStrings of an invalid address = %q, want empty", got)
+	}
+}
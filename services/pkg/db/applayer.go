@@ -0,0 +1,80 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import "slices"
+
+// maxAppValues is the number of values kept in each field of AppLayer, so
+// that a flow with many transactions does not grow forever.
+const maxAppValues = 100
+
+// AppLayer is the application layer metadata of a flow, taken from the http,
+// dns, tls, fileinfo, smb and anomaly events of Suricata. Every field holds
+// the distinct values seen on the flow, in the order they were seen.
+type AppLayer struct {
+	Protocols  []string `bson:"protocols,omitempty" json:"protocols,omitempty"`     // Application protocols detected by Suricata (app_proto)
+	Hostnames  []string `bson:"hostnames,omitempty" json:"hostnames,omitempty"`     // HTTP hosts, TLS SNIs, DNS query names and SMB NTLMSSP hosts
+	URLs       []string `bson:"urls,omitempty" json:"urls,omitempty"`               // HTTP URLs
+	Statuses   []int    `bson:"statuses,omitempty" json:"statuses,omitempty"`       // HTTP status codes
+	UserAgents []string `bson:"user_agents,omitempty" json:"user_agents,omitempty"` // HTTP user agents
+	JA3        []string `bson:"ja3,omitempty" json:"ja3,omitempty"`                 // JA3 and JA3S hashes of the TLS handshakes
+	FileHashes []string `bson:"file_hashes,omitempty" json:"file_hashes,omitempty"` // MD5, SHA-1 and SHA-256 of the transferred files
+	Anomalies  []string `bson:"anomalies,omitempty" json:"anomalies,omitempty"`     // Anomaly events, e.g. "stream.pkt_invalid_timestamp", or their type if unnamed
+}
+
+// IsZero reports whether there is no metadata.
+func (a AppLayer) IsZero() bool {
+	return len(a.Protocols) == 0 && len(a.Hostnames) == 0 && len(a.URLs) == 0 && len(a.Statuses) == 0 &&
+		len(a.UserAgents) == 0 && len(a.JA3) == 0 && len(a.FileHashes) == 0 && len(a.Anomalies) == 0
+}
+
+// merge adds the values of other missing from a, up to maxAppValues.
+func (a *AppLayer) merge(other AppLayer) {
+	a.Protocols = addToSetMax(a.Protocols, other.Protocols)
+	a.Hostnames = addToSetMax(a.Hostnames, other.Hostnames)
+	a.URLs = addToSetMax(a.URLs, other.URLs)
+	a.Statuses = addToSetMax(a.Statuses, other.Statuses)
+	a.UserAgents = addToSetMax(a.UserAgents, other.UserAgents)
+	a.JA3 = addToSetMax(a.JA3, other.JA3)
+	a.FileHashes = addToSetMax(a.FileHashes, other.FileHashes)
+	a.Anomalies = addToSetMax(a.Anomalies, other.Anomalies)
+}
+
+func addToSetMax[T comparable](set, values []T) []T {
+	set = addToSet(set, values...)
+	return set[:min(len(set), maxAppValues)]
+}
+
+// appFilter is a filter of GetFlowsOptions on a field of AppLayer: one of the
+// values of the field must be equal to value.
+type appFilter struct {
+	field string // Name of the field in the stored flows
+	value any
+	match func(app *AppLayer) bool
+}
+
+// appFilters returns the filters of opts on the AppLayer of the flows.
+func appFilters(opts *GetFlowsOptions) []appFilter {
+	var filters []appFilter
+	add := func(field, value string, values func(app *AppLayer) []string) {
+		if value != "" {
+			filters = append(filters, appFilter{field, value, func(app *AppLayer) bool {
+				return slices.Contains(values(app), value)
+			}})
+		}
+	}
+	add("hostnames", opts.Hostname, func(app *AppLayer) []string { return app.Hostnames })
+	add("urls", opts.URL, func(app *AppLayer) []string { return app.URLs })
+	add("user_agents", opts.UserAgent, func(app *AppLayer) []string { return app.UserAgents })
+	add("ja3", opts.JA3, func(app *AppLayer) []string { return app.JA3 })
+	add("file_hashes", opts.FileHash, func(app *AppLayer) []string { return app.FileHashes })
+	add("anomalies", opts.Anomaly, func(app *AppLayer) []string { return app.Anomalies })
+	if opts.HTTPStatus > 0 {
+		filters = append(filters, appFilter{"statuses", opts.HTTPStatus, func(app *AppLayer) bool {
+			return slices.Contains(app.Statuses, opts.HTTPStatus)
+		}})
+	}
+	return filters
+}
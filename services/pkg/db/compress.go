@@ -0,0 +1,188 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// dictTrainingSamples is the number of messages of a service collected
+	// before training its dictionary.
+	dictTrainingSamples = 500
+	// dictSampleSize caps the bytes of a message used for training, the
+	// boilerplate worth sharing is at its start.
+	dictSampleSize = 4 << 10
+	// maxDictSize is the size of the trained dictionaries.
+	maxDictSize = 64 << 10
+)
+
+// dictStore persists the compression dictionaries of a namespace, so that
+// all the services can decompress the payloads.
+type dictStore interface {
+	loadDict(ctx context.Context, id uint32) ([]byte, error)                // ErrNotFound if it does not exist
+	latestDict(ctx context.Context, service string) (uint32, []byte, error) // ErrNotFound if the service has none
+	saveDict(ctx context.Context, id uint32, service string, dict []byte) error
+}
+
+// payloadCodec compresses the payloads of flows with zstd. The payloads of a
+// service share most of their boilerplate, so each service gets a dictionary
+// trained on its first messages. Until then, payloads are compressed without
+// a dictionary (ID 0).
+type payloadCodec struct {
+	store dictStore
+
+	mu       sync.Mutex
+	services map[string]*serviceCodec
+	decoders map[uint32]*zstd.Decoder
+}
+
+// serviceCodec compresses the new payloads of a service.
+type serviceCodec struct {
+	dictID  uint32
+	encoder *zstd.Encoder
+	samples [][]byte // messages collected to train the dictionary
+}
+
+func newPayloadCodec(store dictStore) *payloadCodec {
+	return &payloadCodec{
+		store:    store,
+		services: map[string]*serviceCodec{},
+		decoders: map[uint32]*zstd.Decoder{},
+	}
+}
+
+func newEncoder(dict []byte) *zstd.Encoder {
+	opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+	if dict != nil {
+		opts = append(opts, zstd.WithEncoderDict(dict))
+	}
+	encoder, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		panic(err) // only fails on invalid options or dictionaries, which we build
+	}
+	return encoder
+}
+
+// compress compresses the messages of a flow of service, returning the ID of
+// the dictionary used.
+func (c *payloadCodec) compress(ctx context.Context, service string, items []FlowItem) (uint32, [][]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sc, err := c.serviceCodec(ctx, service)
+	if err != nil {
+		return 0, nil, err
+	}
+	if sc.dictID == 0 {
+		c.sample(ctx, service, sc, items)
+	}
+
+	out := make([][]byte, len(items))
+	for i, item := range items {
+		out[i] = sc.encoder.EncodeAll([]byte(item.Data), nil)
+	}
+	return sc.dictID, out, nil
+}
+
+// serviceCodec returns the codec of service, using the latest dictionary
+// stored for it.
+func (c *payloadCodec) serviceCodec(ctx context.Context, service string) (*serviceCodec, error) {
+	if sc, ok := c.services[service]; ok {
+		return sc, nil
+	}
+
+	sc := &serviceCodec{}
+	id, dict, err := c.store.latestDict(ctx, service)
+	switch {
+	case err == nil:
+		sc.dictID, sc.encoder = id, newEncoder(dict)
+	case errors.Is(err, ErrNotFound):
+		sc.encoder = newEncoder(nil)
+	default:
+		return nil, fmt.Errorf("failed to load the dictionary of %q: %v", service, err)
+	}
+	c.services[service] = sc
+	return sc, nil
+}
+
+// sample collects the messages of a flow, training the dictionary of the
+// service once enough were collected. Failures are not fatal: the payloads
+// are still compressed, only less.
+func (c *payloadCodec) sample(ctx context.Context, service string, sc *serviceCodec, items []FlowItem) {
+	for _, item := range items {
+		if len(item.Data) > 0 {
+			sc.samples = append(sc.samples, []byte(item.Data[:min(len(item.Data), dictSampleSize)]))
+		}
+	}
+	if len(sc.samples) < dictTrainingSamples {
+		return
+	}
+
+	samples := sc.samples
+	sc.samples = nil
+	trained, err := dict.BuildZstdDict(samples, dict.Options{MaxDictSize: maxDictSize, HashBytes: 6})
+	if err != nil {
+		slog.Warn("Failed to train compression dictionary", "service", service, "err", err)
+		return
+	}
+	info, err := zstd.InspectDictionary(trained)
+	if err != nil {
+		slog.Warn("Failed to train compression dictionary", "service", service, "err", err)
+		return
+	}
+	if err := c.store.saveDict(ctx, info.ID(), service, trained); err != nil {
+		slog.Warn("Failed to store compression dictionary", "service", service, "err", err)
+		return
+	}
+
+	sc.dictID, sc.encoder = info.ID(), newEncoder(trained)
+	slog.Info("Trained compression dictionary", "service", service, "id", info.ID(), "size", len(trained))
+}
+
+// decompress decompresses a payload compressed with dictionary dictID.
+func (c *payloadCodec) decompress(ctx context.Context, dictID uint32, data []byte) ([]byte, error) {
+	decoder, err := c.decoder(ctx, dictID)
+	if err != nil {
+		return nil, err
+	}
+	out, err := decoder.DecodeAll(data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress payload: %v", err)
+	}
+	return out, nil
+}
+
+func (c *payloadCodec) decoder(ctx context.Context, dictID uint32) (*zstd.Decoder, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if decoder, ok := c.decoders[dictID]; ok {
+		return decoder, nil
+	}
+
+	opts := []zstd.DOption{zstd.WithDecoderConcurrency(0)}
+	if dictID != 0 {
+		// trained by another service, or before a restart
+		dict, err := c.store.loadDict(ctx, dictID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load compression dictionary %d: %v", dictID, err)
+		}
+		opts = append(opts, zstd.WithDecoderDicts(dict))
+	}
+	decoder, err := zstd.NewReader(nil, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compression dictionary %d: %v", dictID, err)
+	}
+	c.decoders[dictID] = decoder
+	return decoder, nil
+}
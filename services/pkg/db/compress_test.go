@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// memoryDicts is a dictStore in memory.
+type memoryDicts struct {
+	dicts    map[uint32][]byte
+	services map[string]uint32
+}
+
+func (m *memoryDicts) loadDict(_ context.Context, id uint32) ([]byte, error) {
+	if dict, ok := m.dicts[id]; ok {
+		return dict, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memoryDicts) latestDict(_ context.Context, service string) (uint32, []byte, error) {
+	if id, ok := m.services[service]; ok {
+		return id, m.dicts[id], nil
+	}
+	return 0, nil, ErrNotFound
+}
+
+func (m *memoryDicts) saveDict(_ context.Context, id uint32, service string, dict []byte) error {
+	m.dicts[id], m.services[service] = dict, id
+	return nil
+}
+
+func TestPayloadCodec(t *testing.T) {
+	store := &memoryDicts{dicts: map[uint32][]byte{}, services: map[string]uint32{}}
+	codec := newPayloadCodec(store)
+
+	request := func(i int) []FlowItem {
+		return []FlowItem{
+			{From: "c", Data: fmt.Sprintf("GET /api/notes/%d HTTP/1.1\r\nHost: notes.local\r\nUser-Agent: python-requests/2.31.0\r\n"+
+				"Accept-Encoding: gzip, deflate\r\nAccept: */*\r\nConnection: keep-alive\r\nCookie: session=%08x\r\n\r\n", i, i*7919)},
+			{From: "s", Data: fmt.Sprintf("HTTP/1.1 200 OK\r\nServer: nginx/1.25.3\r\nContent-Type: application/json\r\n"+
+				"Connection: keep-alive\r\n\r\n{\"id\": %d, \"owner\": \"user%d\", \"note\": \"FLAG{%032x}\"}", i, i, i)},
+		}
+	}
+	roundTrip := func(codec *payloadCodec, items []FlowItem) (uint32, int) {
+		t.Helper()
+		dictID, compressed, err := codec.compress(t.Context(), "notes", items)
+		if err != nil {
+			t.Fatalf("compress failed: %v", err)
+		}
+		size := 0
+		for i, data := range compressed {
+			size += len(data)
+			got, err := codec.decompress(t.Context(), dictID, data)
+			if err != nil {
+				t.Fatalf("decompress failed: %v", err)
+			}
+			if string(got) != items[i].Data {
+				t.Fatalf("decompress = %q, want %q", got, items[i].Data)
+			}
+		}
+		return dictID, size
+	}
+
+	dictID, plainSize := roundTrip(codec, request(0))
+	if dictID != 0 {
+		t.Fatalf("dictionary %d used before training", dictID)
+	}
+	for i := 1; dictID == 0; i++ {
+		if i > dictTrainingSamples {
+			t.Fatal("no dictionary trained")
+		}
+		dictID, _ = roundTrip(codec, request(i))
+	}
+
+	trainedID, dictSize := roundTrip(codec, request(0))
+	if trainedID != dictID || dictSize >= plainSize {
+		t.Errorf("with dictionary %d: %d bytes, without: %d bytes", trainedID, dictSize, plainSize)
+	}
+
+	// other services load the dictionary from the store
+	other := newPayloadCodec(store)
+	if id, _ := roundTrip(other, request(1)); id != dictID {
+		t.Errorf("new codec uses dictionary %d, want the stored %d", id, dictID)
+	}
+	if _, err := other.decompress(t.Context(), dictID+1, nil); err == nil {
+		t.Error("decompress with an unknown dictionary succeeded")
+	}
+}
@@ -0,0 +1,967 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"tulip/pkg/communityid"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testNamespace is the second namespace used by the conformance suite.
+const testNamespace = "tulip-test_archive"
+
+// testConformance checks that a Database implementation behaves as the
+// services expect. newDB must return an empty database.
+func testConformance(t *testing.T, newDB func(t *testing.T) Database) {
+	base := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	epoch := int(base.UnixMilli())
+
+	flow := func(srcPort, offsetMs int, tags ...string) FlowEntry {
+		return FlowEntry{
+			SrcIp: "10.0.0.1", SrcPort: srcPort, DstIp: "10.0.0.2", DstPort: 80,
+			Time: epoch + offsetMs, Tags: tags, Tick: offsetMs / 1000, Service: "web",
+			Flow: []FlowItem{{From: "c", Data: "GET /flag\x00\x01 HTTP/1.0", Time: epoch + offsetMs}},
+		}
+	}
+	ports := func(flows []FlowEntry) []int {
+		res := make([]int, 0, len(flows))
+		for _, f := range flows {
+			res = append(res, f.SrcPort)
+		}
+		return res
+	}
+
+	t.Run("InsertAndGetFlow", func(t *testing.T) {
+		database := newDB(t)
+		if err := database.InsertFlow(t.Context(), flow(1000, 0, "tcp")); err != nil {
+			t.Fatalf("InsertFlow failed: %v", err)
+		}
+
+		flows, err := database.GetFlows(t.Context(), nil)
+		if err != nil || len(flows) != 1 {
+			t.Fatalf("GetFlows = %d flows, %v; want 1", len(flows), err)
+		}
+		if flows[0].Id.IsZero() {
+			t.Error("inserted flow has no ID")
+		}
+		if raw := string(flows[0].Flow[0].Raw); raw != "GET /flag\x00\x01 HTTP/1.0" {
+			t.Errorf("Raw = %q, want all the bytes of Data", raw)
+		}
+
+		got, err := database.GetFlowByID(t.Context(), flows[0].Id.Hex())
+		if err != nil {
+			t.Fatalf("GetFlowByID failed: %v", err)
+		}
+		if got.SrcPort != 1000 || got.Service != "web" || !slices.Equal(got.Tags, []string{"tcp"}) {
+			t.Errorf("GetFlowByID = %+v", got)
+		}
+
+		for _, id := range []string{primitive.NewObjectID().Hex(), "not-an-id"} {
+			if _, err := database.GetFlowByID(t.Context(), id); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetFlowByID(%q) error = %v, want ErrNotFound", id, err)
+			}
+		}
+	})
+
+	t.Run("GetFlowsFilters", func(t *testing.T) {
+		database := newDB(t)
+		leak := flow(2, 1000, "tcp", "flag-out")
+		leak.Flags, leak.Flagids = []string{"FLAG{a}", "FLAG{b}"}, []string{"alice"}
+		leak.Duration, leak.Size, leak.Num_packets = 100, 200, 4
+		udp := flow(3, 2000, "udp")
+		udp.Flags = []string{"FLAG{a}"}
+		udp.Duration, udp.Size, udp.Num_packets = 50, 500, 10
+		for _, f := range []FlowEntry{flow(1, 0, "tcp"), leak, udp} {
+			if err := database.InsertFlow(t.Context(), f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		other := flow(4, 3000, "tcp")
+		other.DstIp, other.DstPort, other.Service = "10.0.0.3", 22, "ssh"
+		other.Flow[0].Data = "SSH-2.0-OpenSSH"
+		if err := database.InsertFlow(t.Context(), other); err != nil {
+			t.Fatal(err)
+		}
+
+		ptr := func(v int) *int { return &v }
+		q := func(s string) *FlowQuery {
+			query, err := ParseFlowQuery(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return query
+		}
+		cases := []struct {
+			name string
+			opts GetFlowsOptions
+			want []int
+		}{
+			{"all", GetFlowsOptions{}, []int{4, 3, 2, 1}},
+			{"from_time", GetFlowsOptions{FromTime: int64(epoch + 1000)}, []int{4, 3, 2}},
+			{"to_time", GetFlowsOptions{ToTime: int64(epoch + 1000)}, []int{1}},
+			{"dst_port", GetFlowsOptions{DstPort: 22}, []int{4}},
+			{"dst_ip", GetFlowsOptions{DstIp: "10.0.0.2"}, []int{3, 2, 1}},
+			{"src_port", GetFlowsOptions{SrcPort: 2}, []int{2}},
+			{"src_ip", GetFlowsOptions{SrcIp: "10.0.0.9"}, []int{}},
+			{"include_tags", GetFlowsOptions{IncludeTags: []string{"tcp", "flag-out"}}, []int{2}},
+			{"exclude_tags", GetFlowsOptions{ExcludeTags: []string{"flag-out", "udp"}}, []int{4, 1}},
+			{"tick_range", GetFlowsOptions{TickFrom: ptr(1), TickTo: ptr(2)}, []int{3, 2}},
+			{"service", GetFlowsOptions{Service: "ssh"}, []int{4}},
+			{"exclude_ports", GetFlowsOptions{ExcludePorts: []int{80, 443}}, []int{4}},
+			{"dst_port_excluded", GetFlowsOptions{DstPort: 80, ExcludePorts: []int{80}}, []int{}},
+			{"flags", GetFlowsOptions{Flags: []string{"FLAG{a}"}}, []int{3, 2}},
+			{"flags_all", GetFlowsOptions{Flags: []string{"FLAG{a}", "FLAG{b}"}}, []int{2}},
+			{"flagids", GetFlowsOptions{FlagIds: []string{"alice"}}, []int{2}},
+			{"duration_range", GetFlowsOptions{DurationMin: ptr(50), DurationMax: ptr(100)}, []int{3, 2}},
+			{"size_min", GetFlowsOptions{SizeMin: ptr(300)}, []int{3}},
+			{"packets_max", GetFlowsOptions{PacketsMax: ptr(4)}, []int{4, 2, 1}},
+			{"flow_data", GetFlowsOptions{FlowData: "get /FLAG"}, []int{3, 2, 1}},
+			{"flow_data_regex", GetFlowsOptions{FlowData: "^ssh-[0-9.]+-"}, []int{4}},
+			{"search_term", GetFlowsOptions{Search: "FLAG"}, []int{3, 2, 1}},
+			{"search_phrase", GetFlowsOptions{Search: `"get flag http"`}, []int{3, 2, 1}},
+			{"search_phrase_order", GetFlowsOptions{Search: `"flag get"`}, []int{}},
+			{"search_word_not_prefix", GetFlowsOptions{Search: "fla"}, []int{}},
+			{"search_prefix", GetFlowsOptions{Search: "open*"}, []int{4}},
+			{"search_and", GetFlowsOptions{Search: "ssh AND openssh"}, []int{4}},
+			{"search_or_not", GetFlowsOptions{Search: "openssh OR (http -flag)"}, []int{4}},
+			{"search_not_only", GetFlowsOptions{Search: "NOT ssh"}, []int{3, 2, 1}},
+			{"search_and_regex", GetFlowsOptions{Search: "get", FlowData: "flag"}, []int{3, 2, 1}},
+			{"query_service", GetFlowsOptions{Query: q("service:ssh")}, []int{4}},
+			{"query_not_tag", GetFlowsOptions{Query: q("tag:tcp and not tag:flag-out")}, []int{4, 1}},
+			{"query_or_range", GetFlowsOptions{Query: q("src_port:2..3 or dst_port:22")}, []int{4, 3, 2}},
+			{"query_compare", GetFlowsOptions{Query: q("tick:>1 packets:<=10")}, []int{4, 3}},
+			{"query_address", GetFlowsOptions{Query: q("dst:10.0.0.3")}, []int{4}},
+			{"query_cidr", GetFlowsOptions{Query: q("src:10.0.0.0/30 and not dst:10.0.0.2/32")}, []int{4}},
+			{"query_cidr_octets", GetFlowsOptions{Query: q("dst:10.0.0.0/8 dst_port:80")}, []int{3, 2, 1}},
+			{"query_cidr_large", GetFlowsOptions{Query: q("not dst:10.0.0.0/17")}, []int{}},
+			{"query_flag", GetFlowsOptions{Query: q("flag:FLAG{a} size:..300")}, []int{2}},
+			{"query_data", GetFlowsOptions{Query: q(`data:"get flag"`)}, []int{3, 2, 1}},
+			{"query_data_regex", GetFlowsOptions{Query: q(`data~"^ssh-"`)}, []int{4}},
+			{"query_contains", GetFlowsOptions{Query: q(`contains:"|00 01|"`)}, []int{3, 2, 1}},
+			{"query_data_or", GetFlowsOptions{Query: q("not data:flag or tick:0")}, []int{4, 1}},
+			{"query_and_options", GetFlowsOptions{Service: "web", Query: q("(tag:udp or service:ssh) or tick:0")}, []int{3, 1}},
+			{"limit", GetFlowsOptions{Limit: 2}, []int{4, 3}},
+			{"offset", GetFlowsOptions{Limit: 2, Offset: 3}, []int{1}},
+		}
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				flows, err := database.GetFlows(t.Context(), &tc.opts)
+				if err != nil {
+					t.Fatalf("GetFlows failed: %v", err)
+				}
+				if got := ports(flows); !slices.Equal(got, tc.want) {
+					t.Errorf("GetFlows = %v, want %v", got, tc.want)
+				}
+
+				count, err := database.CountFlows(t.Context(), &tc.opts)
+				if err != nil {
+					t.Fatalf("CountFlows failed: %v", err)
+				}
+				want := len(tc.want)
+				if tc.opts.Limit > 0 {
+					want = 4 // limit and offset are ignored
+				}
+				if count != want {
+					t.Errorf("CountFlows = %d, want %d", count, want)
+				}
+			})
+		}
+
+		var searchErr *SearchError
+		if _, err := database.GetFlows(t.Context(), &GetFlowsOptions{Search: "(flag"}); !errors.As(err, &searchErr) {
+			t.Errorf("GetFlows with an invalid search error = %v, want a SearchError", err)
+		}
+	})
+
+	t.Run("Contains", func(t *testing.T) {
+		database := newDB(t)
+
+		binary := flow(2, 1000)
+		binary.Flow = append(binary.Flow, FlowItem{From: "s", Data: "\xde\xad\xbe\xef\xff flag{abc}"})
+		// too many trigrams to be indexed
+		large := flow(3, 2000)
+		noise := make([]byte, 3*maxFlowTrigrams)
+		for i, state := 0, uint32(1); i < len(noise); i++ {
+			state = state*1664525 + 1013904223
+			noise[i] = byte(state >> 24)
+		}
+		large.Flow = []FlowItem{{From: "s", Data: string(noise) + "needle"}}
+		split := flow(4, 3000)
+		split.Flow = []FlowItem{{From: "c", Data: "xxab"}, {From: "s", Data: "cdxx"}}
+
+		for _, f := range []FlowEntry{flow(1, 0), binary, large, split} {
+			if err := database.InsertFlow(t.Context(), f); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, err := database.GetFlows(t.Context(), &GetFlowsOptions{SrcPort: 2})
+		if err != nil || len(got) != 1 {
+			t.Fatalf("GetFlows = %d flows, %v; want 1", len(got), err)
+		}
+		if data := got[0].Flow[1].Data; data != binary.Flow[1].Data {
+			t.Errorf("binary payload = %q, want %q", data, binary.Flow[1].Data)
+		}
+
+		cases := []struct {
+			name    string
+			pattern string
+			srcPort int
+			want    []int
+		}{
+			{"text", "flag", 0, []int{2, 1}},
+			{"inside_token", "lag{a", 0, []int{2}},
+			{"hex", "|de ad be ef|", 0, []int{2}},
+			{"hex_and_text", "|ff 20|flag{", 0, []int{2}},
+			{"case_sensitive", "FLAG", 0, []int{}},
+			{"short", "GE", 0, []int{2, 1}},
+			{"not_indexed", "needle", 0, []int{3}},
+			{"across_messages", "abcd", 0, []int{}},
+			{"other_filters", "flag", 1, []int{1}},
+		}
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				pattern, err := ParsePattern(tc.pattern)
+				if err != nil {
+					t.Fatal(err)
+				}
+				opts := &GetFlowsOptions{Contains: pattern, SrcPort: tc.srcPort}
+				flows, err := database.GetFlows(t.Context(), opts)
+				if err != nil {
+					t.Fatalf("GetFlows failed: %v", err)
+				}
+				if got := ports(flows); !slices.Equal(got, tc.want) {
+					t.Errorf("GetFlows = %v, want %v", got, tc.want)
+				}
+				if count, err := database.CountFlows(t.Context(), opts); err != nil || count != len(tc.want) {
+					t.Errorf("CountFlows = %d, %v; want %d", count, err, len(tc.want))
+				}
+			})
+		}
+	})
+
+	t.Run("DefaultLimit", func(t *testing.T) {
+		database := newDB(t)
+		for i := range DefaultFlowsLimit + 5 {
+			if err := database.InsertFlow(t.Context(), flow(i, i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		flows, err := database.GetFlows(t.Context(), &GetFlowsOptions{})
+		if err != nil || len(flows) != DefaultFlowsLimit {
+			t.Errorf("GetFlows = %d flows, %v; want %d", len(flows), err, DefaultFlowsLimit)
+		}
+		if count, err := database.CountFlows(t.Context(), nil); err != nil || count != DefaultFlowsLimit+5 {
+			t.Errorf("CountFlows = %d, %v; want %d", count, err, DefaultFlowsLimit+5)
+		}
+	})
+
+	t.Run("Cursor", func(t *testing.T) {
+		database := newDB(t)
+		// flows 2 to 4 share their time, they are sorted by ID
+		for i, offset := range []int{0, 1000, 1000, 1000, 2000, 3000, 4000} {
+			if err := database.InsertFlow(t.Context(), flow(i+1, offset)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, opts := range []GetFlowsOptions{{Limit: 3}, {Limit: 3, Search: "flag"}} {
+			var pages [][]int
+			var last FlowPage
+			for cursor := (*FlowCursor)(nil); len(pages) == 0 || cursor != nil; cursor = last.Next {
+				opts.Cursor = cursor
+				page, err := GetFlowPage(t.Context(), database, &opts)
+				if err != nil {
+					t.Fatalf("GetFlowPage failed: %v", err)
+				}
+				pages = append(pages, ports(page.Flows))
+				last = page
+			}
+			if want := [][]int{{7, 6, 5}, {4, 3, 2}, {1}}; !slices.EqualFunc(pages, want, slices.Equal) {
+				t.Fatalf("pages = %v, want %v", pages, want)
+			}
+
+			// back to the first page
+			var back [][]int
+			for cursor := last.Prev; cursor != nil; cursor = last.Prev {
+				opts.Cursor = cursor
+				page, err := GetFlowPage(t.Context(), database, &opts)
+				if err != nil {
+					t.Fatalf("GetFlowPage failed: %v", err)
+				}
+				if len(page.Flows) > 0 && page.Next == nil {
+					t.Errorf("page %v has no next cursor", ports(page.Flows))
+				}
+				back = append(back, ports(page.Flows))
+				last = page
+			}
+			if want := [][]int{{4, 3, 2}, {7, 6, 5}, {}}; !slices.EqualFunc(back, want, slices.Equal) {
+				t.Errorf("pages back = %v, want %v", back, want)
+			}
+		}
+
+		for _, tc := range []struct {
+			opts   GetFlowsOptions
+			want   int
+			capped bool
+		}{
+			{GetFlowsOptions{MaxCount: 5}, 5, true},
+			{GetFlowsOptions{MaxCount: 10}, 7, false},
+			{GetFlowsOptions{}, 7, false},
+			{GetFlowsOptions{Service: "none"}, 0, false}, // exact, no match
+			{GetFlowsOptions{Service: "none", MaxCount: 5}, 0, false},
+		} {
+			count, err := database.CountFlows(t.Context(), &tc.opts)
+			if err != nil || count != tc.want || tc.opts.Capped(count) != tc.capped {
+				t.Errorf("CountFlows(%+v) = %d, %v, capped %v; want %d, capped %v",
+					tc.opts, count, err, tc.opts.Capped(count), tc.want, tc.capped)
+			}
+		}
+	})
+
+	t.Run("FingerprintLinking", func(t *testing.T) {
+		database := newDB(t)
+		first := flow(1, 0)
+		first.Fingerprints = []uint32{42}
+		second := flow(2, 1000)
+		second.Fingerprints = []uint32{7, 42}
+		for _, f := range []FlowEntry{first, second} {
+			if err := database.InsertFlow(t.Context(), f); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		flows, err := database.GetFlows(t.Context(), nil)
+		if err != nil || len(flows) != 2 {
+			t.Fatalf("GetFlows = %d flows, %v; want 2", len(flows), err)
+		}
+		newer, older := flows[0], flows[1]
+		if newer.ChildId != older.Id || older.ParentId != newer.Id {
+			t.Errorf("flows not linked: newer child %s, older %s parent %s, newer %s",
+				newer.ChildId.Hex(), older.Id.Hex(), older.ParentId.Hex(), newer.Id.Hex())
+		}
+	})
+
+	t.Run("SetStar", func(t *testing.T) {
+		database := newDB(t)
+		if err := database.InsertFlow(t.Context(), flow(1, 0, "tcp")); err != nil {
+			t.Fatal(err)
+		}
+		flows, _ := database.GetFlows(t.Context(), nil)
+		id := flows[0].Id.Hex()
+
+		for range 2 {
+			if err := database.SetStar(t.Context(), id, true); err != nil {
+				t.Fatalf("SetStar failed: %v", err)
+			}
+		}
+		got, _ := database.GetFlowByID(t.Context(), id)
+		if !slices.Equal(got.Tags, []string{"tcp", "starred"}) {
+			t.Errorf("tags after starring = %v", got.Tags)
+		}
+
+		if err := database.SetStar(t.Context(), id, false); err != nil {
+			t.Fatalf("SetStar failed: %v", err)
+		}
+		got, _ = database.GetFlowByID(t.Context(), id)
+		if !slices.Equal(got.Tags, []string{"tcp"}) {
+			t.Errorf("tags after unstarring = %v", got.Tags)
+		}
+
+		if err := database.SetStar(t.Context(), primitive.NewObjectID().Hex(), true); !errors.Is(err, ErrNotFound) {
+			t.Errorf("SetStar on missing flow error = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("DeleteFlows", func(t *testing.T) {
+		database := newDB(t)
+		for i := range 3 {
+			if err := database.InsertFlow(t.Context(), flow(i+1, i*1000, "tcp")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		flows, _ := database.GetFlows(t.Context(), nil)
+		ids := []string{flows[0].Id.Hex(), flows[2].Id.Hex(), primitive.NewObjectID().Hex(), "not-an-id"}
+
+		n, err := database.DeleteFlows(t.Context(), ids)
+		if err != nil || n != 2 {
+			t.Fatalf("DeleteFlows = %d, %v; want 2", n, err)
+		}
+		left, _ := database.GetFlows(t.Context(), nil)
+		if got := ports(left); !slices.Equal(got, []int{2}) {
+			t.Errorf("flows left = %v, want [2]", got)
+		}
+
+		// the payload indexes no longer find the deleted flows
+		pattern, _ := ParsePattern("flag")
+		for _, opts := range []*GetFlowsOptions{{Contains: pattern}, {Search: "flag"}} {
+			if got, err := database.GetFlows(t.Context(), opts); err != nil || !slices.Equal(ports(got), []int{2}) {
+				t.Errorf("GetFlows(%+v) = %v, %v; want [2]", opts, ports(got), err)
+			}
+		}
+
+		// deleted flows can be inserted again
+		if err := database.InsertFlow(t.Context(), flows[0]); err != nil {
+			t.Fatalf("InsertFlow of a deleted flow failed: %v", err)
+		}
+		if got, err := database.GetFlowByID(t.Context(), ids[0]); err != nil || got.SrcPort != 3 {
+			t.Errorf("GetFlowByID after reinsertion = %+v, %v", got, err)
+		}
+	})
+
+	t.Run("AddSignatureToFlow", func(t *testing.T) {
+		database := newDB(t)
+		if err := database.InsertFlow(t.Context(), flow(1, 0, "tcp")); err != nil {
+			t.Fatal(err)
+		}
+		id := FlowID{Src_port: 1, Dst_port: 80, Src_ip: "10.0.0.1", Dst_ip: "10.0.0.2", Time: base.Add(500 * time.Millisecond)}
+		sig := Signature{GID: 1, ID: 1337, Rev: 2, Msg: "flag stolen", Action: "blocked", Tags: []string{"exploit", "FLAG OUT"}, Severity: 1, Category: "Attempted Administrator Privilege Gain"}
+
+		for range 2 {
+			ok, err := database.AddSignatureToFlow(t.Context(), id, sig, 1000)
+			if err != nil || !ok {
+				t.Fatalf("AddSignatureToFlow = %v, %v; want true", ok, err)
+			}
+		}
+
+		flows, _ := database.GetFlows(t.Context(), nil)
+		got := flows[0]
+		if !got.Blocked || !slices.Equal(got.Tags, []string{"tcp", "suricata", "exploit", "FLAG OUT", "blocked"}) {
+			t.Errorf("flow after signature: blocked %v, tags %v", got.Blocked, got.Tags)
+		}
+		if len(got.Suricata) != 1 {
+			t.Fatalf("suricata = %v, want the signature once", got.Suricata)
+		}
+
+		for _, sigID := range []string{got.Suricata[0], "1337"} {
+			stored, err := database.GetSignature(t.Context(), sigID)
+			sig.MongoID = stored.MongoID
+			if err != nil || !reflect.DeepEqual(stored, sig) || stored.MongoID.Hex() != got.Suricata[0] {
+				t.Errorf("GetSignature(%q) = %+v, %v", sigID, stored, err)
+			}
+		}
+		for _, sigID := range []string{"1", primitive.NewObjectID().Hex(), "nope"} {
+			if _, err := database.GetSignature(t.Context(), sigID); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetSignature(%q) error = %v, want ErrNotFound", sigID, err)
+			}
+		}
+
+		id.Time = base.Add(2 * time.Second)
+		if ok, err := database.AddSignatureToFlow(t.Context(), id, sig, 1000); err != nil || ok {
+			t.Errorf("AddSignatureToFlow outside the window = %v, %v; want false", ok, err)
+		}
+	})
+
+	t.Run("CommunityID", func(t *testing.T) {
+		database := newDB(t)
+		reused, later, long := flow(1, 0, "tcp"), flow(1, 3000, "tcp"), flow(2, 0, "tcp")
+		reused.Duration, later.Duration, long.Duration = 100, 1000, 60000
+		for _, f := range []FlowEntry{reused, later, long} {
+			if err := database.InsertFlow(t.Context(), f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		communityID := func(srcPort int) string {
+			return communityid.FromStrings(communityid.DefaultSeed, communityid.ProtoTCP, "10.0.0.1", srcPort, "10.0.0.2", 80)
+		}
+
+		for _, tc := range []struct {
+			name  string
+			id    FlowID
+			found bool
+		}{
+			{
+				name:  "reused source port",
+				id:    FlowID{Src_port: 1, Dst_port: 80, Src_ip: "10.0.0.1", Dst_ip: "10.0.0.2", Time: base.Add(3500 * time.Millisecond), CommunityID: communityID(1)},
+				found: true,
+			},
+			{
+				name:  "long flow",
+				id:    FlowID{Src_port: 2, Dst_port: 80, Src_ip: "10.0.0.1", Dst_ip: "10.0.0.2", Time: base.Add(30 * time.Second), CommunityID: communityID(2)},
+				found: true,
+			},
+			{
+				name:  "5-tuple fallback",
+				id:    FlowID{Src_port: 1, Dst_port: 80, Src_ip: "10.0.0.1", Dst_ip: "10.0.0.2", Time: base, CommunityID: "1:unknown"},
+				found: true,
+			},
+			{
+				name: "ended flow",
+				id:   FlowID{Src_port: 2, Dst_port: 80, Src_ip: "10.0.0.1", Dst_ip: "10.0.0.2", Time: base.Add(2 * time.Minute), CommunityID: communityID(2)},
+			},
+		} {
+			tag := strings.ReplaceAll(tc.name, " ", "-")
+			if ok, err := database.AddTagsToFlow(t.Context(), tc.id, []string{tag}, 1000); err != nil || ok != tc.found {
+				t.Errorf("%s: AddTagsToFlow = %v, %v; want %v", tc.name, ok, err, tc.found)
+			}
+		}
+
+		flows, err := database.GetFlows(t.Context(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[[2]int][]string{
+			{1, epoch}:        {"tcp", "5-tuple-fallback"},
+			{1, epoch + 3000}: {"tcp", "reused-source-port"},
+			{2, epoch}:        {"tcp", "long-flow"},
+		}
+		for _, got := range flows {
+			if got.CommunityID != communityID(got.SrcPort) {
+				t.Errorf("community_id of flow %d = %q, want %q", got.SrcPort, got.CommunityID, communityID(got.SrcPort))
+			}
+			if tags := want[[2]int{got.SrcPort, got.Time}]; !slices.Equal(got.Tags, tags) {
+				t.Errorf("tags of flow %d at %d = %v, want %v", got.SrcPort, got.Time-epoch, got.Tags, tags)
+			}
+		}
+	})
+
+	t.Run("AppLayer", func(t *testing.T) {
+		database := newDB(t)
+		for i := range 2 {
+			if err := database.InsertFlow(t.Context(), flow(i+1, 0, "tcp")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		add := func(srcPort int, app AppLayer) bool {
+			t.Helper()
+			id := FlowID{Src_port: srcPort, Dst_port: 80, Src_ip: "10.0.0.1", Dst_ip: "10.0.0.2", Time: base}
+			found, err := database.AddAppLayerToFlow(t.Context(), id, app, 100)
+			if err != nil {
+				t.Fatalf("AddAppLayerToFlow failed: %v", err)
+			}
+			return found
+		}
+
+		if !add(1, AppLayer{Protocols: []string{"http"}, Hostnames: []string{"service.local"}, URLs: []string{"/flag"},
+			Statuses: []int{200}, UserAgents: []string{"curl/8.0"}}) {
+			t.Fatal("AddAppLayerToFlow did not find the flow")
+		}
+		add(1, AppLayer{Protocols: []string{"http"}, URLs: []string{"/flag", "/login", "/login"}, Statuses: []int{302}})
+		add(2, AppLayer{Protocols: []string{"tls"}, Hostnames: []string{"other.local"}, JA3: []string{"e7d705a3286e19ea42f587b344ee6865"}})
+		add(2, AppLayer{Anomalies: []string{"stream.pkt_invalid_timestamp"}, FileHashes: []string{"d41d8cd98f00b204e9800998ecf8427e"}})
+		if add(3, AppLayer{Hostnames: []string{"missing.local"}}) {
+			t.Error("AddAppLayerToFlow found a flow for an unknown 5-tuple")
+		}
+
+		flows, err := database.GetFlows(t.Context(), &GetFlowsOptions{SrcPort: 1})
+		if err != nil || len(flows) != 1 {
+			t.Fatalf("GetFlows = %d flows, %v; want 1", len(flows), err)
+		}
+		want := AppLayer{Protocols: []string{"http"}, Hostnames: []string{"service.local"}, URLs: []string{"/flag", "/login"},
+			Statuses: []int{200, 302}, UserAgents: []string{"curl/8.0"}}
+		if got := flows[0].App; !reflect.DeepEqual(got, want) {
+			t.Errorf("App = %+v, want %+v", got, want)
+		}
+
+		for _, tc := range []struct {
+			opts GetFlowsOptions
+			want []int
+		}{
+			{GetFlowsOptions{Hostname: "service.local"}, []int{1}},
+			{GetFlowsOptions{URL: "/login"}, []int{1}},
+			{GetFlowsOptions{HTTPStatus: 302}, []int{1}},
+			{GetFlowsOptions{UserAgent: "curl/8.0"}, []int{1}},
+			{GetFlowsOptions{JA3: "e7d705a3286e19ea42f587b344ee6865"}, []int{2}},
+			{GetFlowsOptions{FileHash: "d41d8cd98f00b204e9800998ecf8427e"}, []int{2}},
+			{GetFlowsOptions{Anomaly: "stream.pkt_invalid_timestamp"}, []int{2}},
+			{GetFlowsOptions{Hostname: "service.local", HTTPStatus: 404}, nil},
+			{GetFlowsOptions{Hostname: "service"}, nil},
+		} {
+			flows, err := database.GetFlows(t.Context(), &tc.opts)
+			if err != nil {
+				t.Fatalf("GetFlows(%+v) failed: %v", tc.opts, err)
+			}
+			var got []int
+			for _, f := range flows {
+				got = append(got, f.SrcPort)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("GetFlows(%+v) = flows %v, want %v", tc.opts, got, tc.want)
+			}
+		}
+	})
+
+	t.Run("RuleVars", func(t *testing.T) {
+		database := newDB(t)
+		if err := database.InsertFlow(t.Context(), flow(1, 0, "tcp")); err != nil {
+			t.Fatal(err)
+		}
+		id := FlowID{Src_port: 1, Dst_port: 80, Src_ip: "10.0.0.1", Dst_ip: "10.0.0.2", Time: base}
+		for _, vars := range []RuleVars{
+			{Flowints: map[string]int{"tag_FLAG_OUT": 2}, Flowvars: []FlowVar{{"match", "FLAG{one}"}}},
+			{Flowints: map[string]int{"tag_FLAG_OUT": 1, "tag_FLAG_IN": 1}, Flowvars: []FlowVar{{"match", "FLAG{one}"}, {"match", "FLAG{two}"}}},
+		} {
+			if ok, err := database.AddVarsToFlow(t.Context(), id, vars, 100); err != nil || !ok {
+				t.Fatalf("AddVarsToFlow = %v, %v; want true", ok, err)
+			}
+		}
+		id.Src_port = 2
+		if ok, err := database.AddVarsToFlow(t.Context(), id, RuleVars{Flowints: map[string]int{"x": 1}}, 100); err != nil || ok {
+			t.Errorf("AddVarsToFlow on an unknown flow = %v, %v; want false", ok, err)
+		}
+
+		got, err := database.GetFlows(t.Context(), nil)
+		if err != nil || len(got) != 1 {
+			t.Fatalf("GetFlows = %d flows, %v; want 1", len(got), err)
+		}
+		want := RuleVars{
+			Flowints: map[string]int{"tag_FLAG_OUT": 2, "tag_FLAG_IN": 1},
+			Flowvars: []FlowVar{{"match", "FLAG{one}"}, {"match", "FLAG{two}"}},
+		}
+		if !reflect.DeepEqual(got[0].Vars, want) {
+			t.Errorf("Vars = %+v, want %+v", got[0].Vars, want)
+		}
+	})
+
+	t.Run("Signatures", func(t *testing.T) {
+		database := newDB(t)
+		for i, offset := range []int{0, 1000, 2000, 1500} {
+			if err := database.InsertFlow(t.Context(), flow(i+1, offset, "tcp")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		alert := func(srcPort, offset int, sig Signature) {
+			t.Helper()
+			id := FlowID{Src_port: srcPort, Dst_port: 80, Src_ip: "10.0.0.1", Dst_ip: "10.0.0.2", Time: base.Add(time.Duration(offset) * time.Millisecond)}
+			if ok, err := database.AddSignatureToFlow(t.Context(), id, sig, 100); err != nil || !ok {
+				t.Fatalf("AddSignatureToFlow = %v, %v; want true", ok, err)
+			}
+		}
+
+		// editing the message keeps the revision, a new revision is kept apart
+		rev1 := Signature{GID: 1, ID: 1000, Rev: 1, Msg: "old message", Action: "allowed", Severity: 3}
+		alert(1, 0, rev1)
+		rev1.Msg = "new message"
+		alert(2, 1000, rev1)
+		alert(2, 1000, rev1) // redelivered, counted once
+		alert(4, 1500, rev1)
+		rev2 := Signature{GID: 1, ID: 1000, Rev: 2, Msg: "second revision", Action: "allowed", Severity: 2}
+		alert(3, 2000, rev2)
+		other := Signature{GID: 1, ID: 2000, Rev: 1, Msg: "other", Action: "allowed"}
+		alert(1, 0, other)
+		alert(3, 2000, other)
+
+		last, err := database.GetSignature(t.Context(), "1000")
+		if err != nil || last.Rev != 2 || last.Msg != "second revision" {
+			t.Errorf("GetSignature(1000) = %+v, %v; want the second revision", last, err)
+		}
+
+		stats, err := database.GetTopSignatures(t.Context(), nil)
+		if err != nil {
+			t.Fatalf("GetTopSignatures failed: %v", err)
+		}
+		type top struct {
+			msg   string
+			hits  int
+			ticks []SignatureHits
+		}
+		summary := func(stats []SignatureStats) []top {
+			res := make([]top, len(stats))
+			for i, stat := range stats {
+				res[i] = top{stat.Signature.Msg, stat.Hits, stat.Ticks}
+			}
+			return res
+		}
+		want := []top{
+			{"new message", 3, []SignatureHits{{Tick: 0, Hits: 1}, {Tick: 1, Hits: 2}}},
+			{"other", 2, []SignatureHits{{Tick: 0, Hits: 1}, {Tick: 2, Hits: 1}}},
+			{"second revision", 1, []SignatureHits{{Tick: 2, Hits: 1}}},
+		}
+		if got := summary(stats); !reflect.DeepEqual(got, want) {
+			t.Errorf("GetTopSignatures = %+v, want %+v", got, want)
+		}
+
+		from, to := 1, 1
+		stats, err = database.GetTopSignatures(t.Context(), &SignatureStatsOptions{TickFrom: &from, TickTo: &to, Limit: 1})
+		if got := summary(stats); err != nil || !reflect.DeepEqual(got, []top{{"new message", 2, []SignatureHits{{Tick: 1, Hits: 2}}}}) {
+			t.Errorf("GetTopSignatures of tick 1 = %+v, %v", got, err)
+		}
+	})
+
+	t.Run("Tags", func(t *testing.T) {
+		database := newDB(t)
+		if err := database.ConfigureDatabase(t.Context()); err != nil {
+			t.Fatalf("ConfigureDatabase failed: %v", err)
+		}
+		if err := database.InsertFlow(t.Context(), flow(1, 0, "tcp", "custom")); err != nil {
+			t.Fatal(err)
+		}
+		// inserting again only fills the empty fields
+		for _, tag := range []Tag{
+			{Name: "manual", Color: "info", Origin: TagOriginUser},
+			{Name: "manual", Color: "danger", Description: "by hand", Origin: TagOriginRule},
+		} {
+			if err := database.InsertTag(t.Context(), tag); err != nil {
+				t.Fatalf("InsertTag failed: %v", err)
+			}
+		}
+
+		id := FlowID{Src_port: 1, Dst_port: 80, Src_ip: "10.0.0.1", Dst_ip: "10.0.0.2", Time: base}
+		if ok, err := database.AddTagsToFlow(t.Context(), id, []string{"enriched", "tcp"}, 1000); err != nil || !ok {
+			t.Fatalf("AddTagsToFlow = %v, %v; want true", ok, err)
+		}
+		flows, _ := database.GetFlows(t.Context(), nil)
+		if !slices.Equal(flows[0].Tags, []string{"tcp", "custom", "enriched"}) {
+			t.Errorf("flow tags = %v", flows[0].Tags)
+		}
+
+		tags, err := database.GetTagList(t.Context())
+		if err != nil {
+			t.Fatalf("GetTagList failed: %v", err)
+		}
+		var want []string
+		for _, tag := range DefaultTags {
+			want = append(want, tag.Name)
+		}
+		want = append(want, "custom", "manual", "enriched")
+		slices.Sort(tags)
+		slices.Sort(want)
+		if !slices.Equal(tags, want) {
+			t.Errorf("GetTagList = %v, want %v", tags, want)
+		}
+
+		records := func() map[string]Tag {
+			t.Helper()
+			tags, err := database.GetTags(t.Context())
+			if err != nil {
+				t.Fatalf("GetTags failed: %v", err)
+			}
+			byName := map[string]Tag{}
+			for _, tag := range tags {
+				byName[tag.Name] = tag
+			}
+			return byName
+		}
+		got := records()
+		if len(got) != len(want) {
+			t.Errorf("GetTags returned %d tags, want %d", len(got), len(want))
+		}
+		if manual := got["manual"]; manual.Color != "info" || manual.Description != "by hand" || manual.Origin != TagOriginUser || manual.CreatedAt == 0 {
+			t.Errorf("manual tag = %+v, want the first color and origin and the later description", manual)
+		}
+		if flagOut := got["flag-out"]; flagOut.Color != "danger" || flagOut.Origin != TagOriginAssembler {
+			t.Errorf("flag-out tag = %+v, want the default record", flagOut)
+		}
+		if custom := got["custom"]; custom != (Tag{Name: "custom"}) {
+			t.Errorf("tag only found on flows = %+v, want an empty record", custom)
+		}
+
+		for _, tag := range []Tag{
+			{Name: "manual", Color: "#00ff00", Description: "edited", Origin: TagOriginRule},
+			{Name: "custom", Color: "success", Origin: TagOriginUser},
+		} {
+			if err := database.UpdateTag(t.Context(), tag); err != nil {
+				t.Fatalf("UpdateTag failed: %v", err)
+			}
+		}
+		got = records()
+		if manual := got["manual"]; manual.Color != "#00ff00" || manual.Description != "edited" || manual.Origin != TagOriginUser {
+			t.Errorf("updated tag = %+v, want the new color and description only", manual)
+		}
+		if custom := got["custom"]; custom.Color != "success" || custom.Origin != TagOriginUser || custom.CreatedAt == 0 {
+			t.Errorf("updated tag only found on flows = %+v, want a new record", custom)
+		}
+
+		for _, name := range []string{"custom", "manual"} {
+			if err := database.DeleteTag(t.Context(), name); err != nil {
+				t.Fatalf("DeleteTag(%q) failed: %v", name, err)
+			}
+		}
+		if err := database.DeleteTag(t.Context(), "manual"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("DeleteTag of a deleted tag = %v, want ErrNotFound", err)
+		}
+		flows, _ = database.GetFlows(t.Context(), nil)
+		if !slices.Equal(flows[0].Tags, []string{"tcp", "enriched"}) {
+			t.Errorf("flow tags after DeleteTag = %v, want [tcp enriched]", flows[0].Tags)
+		}
+		if got := records(); len(got) != len(want)-2 {
+			t.Errorf("GetTags after DeleteTag returned %d tags, want %d", len(got), len(want)-2)
+		}
+	})
+
+	t.Run("Pcaps", func(t *testing.T) {
+		database := newDB(t)
+		if _, err := database.GetPcap(t.Context(), "a.pcap"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetPcap on missing file error = %v, want ErrNotFound", err)
+		}
+
+		files := []PcapFile{{FileName: "a.pcap", Position: 10}, {FileName: "b.pcap"}, {FileName: "a.pcap", Position: 20, Finished: true}}
+		for _, file := range files {
+			if err := database.InsertPcap(t.Context(), file); err != nil {
+				t.Fatalf("InsertPcap failed: %v", err)
+			}
+		}
+
+		got, err := database.GetPcap(t.Context(), "a.pcap")
+		if err != nil || got.Position != 20 || !got.Finished {
+			t.Errorf("GetPcap = %+v, %v; want the updated record", got, err)
+		}
+		list, err := database.GetPcapList(t.Context())
+		if err != nil || len(list) != 2 {
+			t.Errorf("GetPcapList = %+v, %v; want 2 files", list, err)
+		}
+	})
+
+	t.Run("FlagIds", func(t *testing.T) {
+		database := newDB(t)
+		ids := []FlagIdEntry{
+			{Service: "web", Team: 1, Round: 3, Description: "user", FlagId: "alice"},
+			{Service: "web", Team: 2, Round: 3, Description: "user", FlagId: "bob"},
+		}
+		if err := database.InsertFlagIds(t.Context(), ids); err != nil {
+			t.Fatalf("InsertFlagIds failed: %v", err)
+		}
+		ids[0].Description = "username"
+		if err := database.InsertFlagIds(t.Context(), ids[:1]); err != nil {
+			t.Fatalf("InsertFlagIds failed: %v", err)
+		}
+
+		got, err := database.GetFlagIds(t.Context())
+		if err != nil {
+			t.Fatalf("GetFlagIds failed: %v", err)
+		}
+		slices.SortFunc(got, func(a, b FlagIdEntry) int { return a.Team - b.Team })
+		if !slices.Equal(got, ids) {
+			t.Errorf("GetFlagIds = %+v, want %+v", got, ids)
+		}
+	})
+
+	t.Run("DeadLetters", func(t *testing.T) {
+		database := newDB(t)
+		if letters, err := database.GetDeadLetters(t.Context(), 0); err != nil || len(letters) != 0 {
+			t.Fatalf("GetDeadLetters on an empty database = %v, %v; want none", letters, err)
+		}
+
+		for i := range 3 {
+			letter := DeadLetter{Event: fmt.Sprintf(`{"n":%d}`, i), Reason: "no matching flow", Attempts: i + 1,
+				FirstSeen: int64(epoch), DeadAt: int64(epoch + i)}
+			if err := database.AddDeadLetter(t.Context(), letter); err != nil {
+				t.Fatalf("AddDeadLetter failed: %v", err)
+			}
+		}
+
+		for _, tc := range []struct {
+			limit int
+			want  []string
+		}{
+			{0, []string{`{"n":2}`, `{"n":1}`, `{"n":0}`}},
+			{2, []string{`{"n":2}`, `{"n":1}`}},
+		} {
+			letters, err := database.GetDeadLetters(t.Context(), tc.limit)
+			if err != nil {
+				t.Fatalf("GetDeadLetters(%d) failed: %v", tc.limit, err)
+			}
+			var events []string
+			for _, letter := range letters {
+				events = append(events, letter.Event)
+				if letter.MongoID.IsZero() || letter.Attempts != int(letter.DeadAt-int64(epoch))+1 || letter.Reason != "no matching flow" {
+					t.Errorf("GetDeadLetters(%d) returned %+v", tc.limit, letter)
+				}
+			}
+			if !slices.Equal(events, tc.want) {
+				t.Errorf("GetDeadLetters(%d) = %v, want %v", tc.limit, events, tc.want)
+			}
+		}
+	})
+
+	t.Run("Namespaces", func(t *testing.T) {
+		database := newDB(t)
+		if err := database.ConfigureDatabase(t.Context()); err != nil {
+			t.Fatalf("ConfigureDatabase failed: %v", err)
+		}
+		if err := database.InsertFlow(t.Context(), flow(1000, 0)); err != nil {
+			t.Fatalf("InsertFlow failed: %v", err)
+		}
+		if database.Namespace() != DefaultNamespace {
+			t.Errorf("Namespace = %q, want %q", database.Namespace(), DefaultNamespace)
+		}
+
+		for _, name := range []string{"", "a.b", "a/b", "$x", strings.Repeat("a", 49)} {
+			if _, err := database.WithNamespace(name); err == nil {
+				t.Errorf("WithNamespace(%q) succeeded, want error", name)
+			}
+		}
+
+		archive, err := database.WithNamespace(testNamespace)
+		if err != nil {
+			t.Fatalf("WithNamespace failed: %v", err)
+		}
+		if archive.Namespace() != testNamespace {
+			t.Errorf("Namespace = %q, want %q", archive.Namespace(), testNamespace)
+		}
+		if names, err := database.ListNamespaces(t.Context()); err != nil || !slices.Equal(names, []string{DefaultNamespace}) {
+			t.Errorf("ListNamespaces = %v, %v; want only the default namespace", names, err)
+		}
+
+		if err := archive.InsertFlow(t.Context(), flow(2000, 0)); err != nil {
+			t.Fatalf("InsertFlow failed: %v", err)
+		}
+		if err := archive.InsertPcap(t.Context(), PcapFile{FileName: "a.pcap"}); err != nil {
+			t.Fatalf("InsertPcap failed: %v", err)
+		}
+
+		want := []string{DefaultNamespace, testNamespace}
+		slices.Sort(want)
+		if names, err := archive.ListNamespaces(t.Context()); err != nil || !slices.Equal(names, want) {
+			t.Errorf("ListNamespaces = %v, %v; want %v", names, err, want)
+		}
+
+		for _, tc := range []struct {
+			database Database
+			port     int
+			pcaps    int
+		}{{database, 1000, 0}, {archive, 2000, 1}} {
+			flows, err := tc.database.GetFlows(t.Context(), nil)
+			if err != nil || !slices.Equal(ports(flows), []int{tc.port}) {
+				t.Errorf("%s: GetFlows = %v, %v; want [%d]", tc.database.Namespace(), ports(flows), err, tc.port)
+			}
+			pcaps, err := tc.database.GetPcapList(t.Context())
+			if err != nil || len(pcaps) != tc.pcaps {
+				t.Errorf("%s: GetPcapList = %+v, %v; want %d files", tc.database.Namespace(), pcaps, err, tc.pcaps)
+			}
+		}
+
+		// handles of the same namespace see the same data
+		again, err := database.WithNamespace(testNamespace)
+		if err != nil {
+			t.Fatalf("WithNamespace failed: %v", err)
+		}
+		if n, err := again.CountFlows(t.Context(), nil); err != nil || n != 1 {
+			t.Errorf("CountFlows = %d, %v; want 1", n, err)
+		}
+	})
+
+	t.Run("Schema", func(t *testing.T) {
+		database := newDB(t)
+		if err := database.ConfigureDatabase(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+		if err := database.InsertFlow(t.Context(), flow(1, 0, "tcp")); err != nil {
+			t.Fatal(err)
+		}
+
+		// a new namespace is at the current version, migrating it is a no-op
+		for range 2 {
+			if err := CheckSchema(t.Context(), database); err != nil {
+				t.Fatalf("CheckSchema failed: %v", err)
+			}
+			if err := database.Migrate(t.Context()); err != nil {
+				t.Fatalf("Migrate failed: %v", err)
+			}
+		}
+		pattern, _ := ParsePattern("flag")
+		if got, err := database.GetFlows(t.Context(), &GetFlowsOptions{Contains: pattern}); err != nil || len(got) != 1 {
+			t.Errorf("GetFlows after Migrate = %d flows, %v; want 1", len(got), err)
+		}
+	})
+}
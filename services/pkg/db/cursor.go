@@ -0,0 +1,112 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// FlowCursor is a position in the flows returned by GetFlows, sorted newest
+// first on (time, _id). Unlike an offset, paging from a cursor does not get
+// slower the further the page is, and the pages do not shift when new flows
+// are stored.
+type FlowCursor struct {
+	Time   int
+	Id     primitive.ObjectID
+	Before bool // The flows newer than the position instead of the older ones
+}
+
+// cursorSize is the size of an encoded FlowCursor: the time, the ID and the
+// direction.
+const cursorSize = 8 + 12 + 1
+
+// String encodes the cursor as an opaque URL-safe string, see ParseFlowCursor.
+func (c FlowCursor) String() string {
+	buf := make([]byte, 0, cursorSize)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(c.Time))
+	buf = append(buf, c.Id[:]...)
+	if c.Before {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// ParseFlowCursor decodes a cursor encoded by FlowCursor.String.
+func ParseFlowCursor(s string) (FlowCursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(buf) != cursorSize || buf[cursorSize-1] > 1 {
+		return FlowCursor{}, errors.New("invalid cursor")
+	}
+	c := FlowCursor{
+		Time:   int(binary.BigEndian.Uint64(buf)),
+		Before: buf[cursorSize-1] == 1,
+	}
+	copy(c.Id[:], buf[8:])
+	return c, nil
+}
+
+// follows reports whether flow comes after the cursor in its direction.
+func (c *FlowCursor) follows(flow *FlowEntry) bool {
+	order := compareFlows(flow, &FlowEntry{Time: c.Time, Id: c.Id})
+	if c.Before {
+		return order < 0
+	}
+	return order > 0
+}
+
+// compareFlows orders flows as GetFlows, newest first.
+func compareFlows(a, b *FlowEntry) int {
+	if a.Time != b.Time {
+		return b.Time - a.Time
+	}
+	return slices.Compare(b.Id[:], a.Id[:])
+}
+
+// FlowPage is a page of flows, with the cursors of the pages around it.
+type FlowPage struct {
+	Flows []FlowEntry
+	Next  *FlowCursor // Older flows, nil on the last page
+	Prev  *FlowCursor // Newer flows, nil on an empty page as the page is unknown
+}
+
+// GetFlowPage returns the flows matching opts from opts.Cursor, newest first.
+// Prev is set on every page that is not empty, since newer flows can be
+// stored at any time.
+func GetFlowPage(ctx context.Context, database Database, opts *GetFlowsOptions) (FlowPage, error) {
+	query := *opts
+	if query.Limit <= 0 {
+		query.Limit = DefaultFlowsLimit
+	}
+	backward := query.Cursor != nil && query.Cursor.Before
+	if !backward {
+		query.Limit++ // one more to know whether there is a next page
+	}
+	flows, err := database.GetFlows(ctx, &query)
+	if err != nil {
+		return FlowPage{}, err
+	}
+
+	page := FlowPage{Flows: flows}
+	if !backward && len(flows) == query.Limit {
+		page.Flows = flows[:len(flows)-1]
+	}
+	if len(page.Flows) == 0 {
+		return page, nil
+	}
+	first, last := page.Flows[0], page.Flows[len(page.Flows)-1]
+	page.Prev = &FlowCursor{Time: first.Time, Id: first.Id, Before: true}
+	if backward || len(flows) > len(page.Flows) {
+		page.Next = &FlowCursor{Time: last.Time, Id: last.Id}
+	}
+	return page, nil
+}
@@ -0,0 +1,31 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseFlowCursor(t *testing.T) {
+	for _, cursor := range []FlowCursor{
+		{},
+		{Time: 1735689600123, Id: primitive.NewObjectID()},
+		{Time: 1735689600123, Id: primitive.NewObjectID(), Before: true},
+	} {
+		got, err := ParseFlowCursor(cursor.String())
+		if err != nil || got != cursor {
+			t.Errorf("ParseFlowCursor(%q) = %+v, %v; want %+v", cursor.String(), got, err, cursor)
+		}
+	}
+
+	valid := FlowCursor{Id: primitive.NewObjectID()}.String()
+	for _, s := range []string{"", "not a cursor", valid[:len(valid)-1], valid + "AA", valid[:len(valid)-1] + "C"} {
+		if _, err := ParseFlowCursor(s); err == nil {
+			t.Errorf("ParseFlowCursor(%q) succeeded", s)
+		}
+	}
+}
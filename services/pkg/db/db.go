@@ -11,7 +11,16 @@
 package db
 
 import (
-	"go.mongodb.org/mongo-driver/bson"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"tulip/pkg/communityid"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -19,7 +28,7 @@ import (
 type FlowItem struct {
 	From string `bson:"from" json:"from"` // From: "s" / "c" for server or client
 	Data string `bson:"data" json:"data"` // Data, in a somewhat readable format
-	Raw  []byte `bson:"raw" json:"b64"`   // The raw data, in bytes. The `b64` tag is used because this is base64 encoded in the frontend
+	Raw  []byte `bson:"raw" json:"b64"`   // All the bytes of Data, not stored. The `b64` tag is used because this is base64 encoded in the frontend
 	Time int    `bson:"time" json:"time"` // Timestamp of the first packet in the flow (Epoch / ms)
 }
 
@@ -39,20 +48,350 @@ type FlowEntry struct {
 	Fingerprints []uint32           `bson:"fingerprints" json:"fingerprints"`
 	Suricata     []string           `bson:"suricata" json:"suricata"`
 	Flow         []FlowItem         `bson:"flow" json:"flow"`
-	Tags         []string           `bson:"tags" json:"tags"`       // Tags associated with this flow, e.g. "starred", "tcp", "udp", "blocked"
-	Size         int                `bson:"size" json:"size"`       // Size of the flow in bytes
-	Flags        []string           `bson:"flags" json:"flags"`     // Flags contained in the flow
-	Flagids      []string           `bson:"flagids" json:"flagids"` // Flag IDs associated with this flow
+	Tags         []string           `bson:"tags" json:"tags"`                       // Tags associated with this flow, e.g. "starred", "tcp", "udp", "blocked"
+	Size         int                `bson:"size" json:"size"`                       // Size of the flow in bytes
+	Flags        []string           `bson:"flags" json:"flags"`                     // Flags contained in the flow
+	Flagids      []string           `bson:"flagids" json:"flagids"`                 // Flag IDs associated with this flow
+	Tick         int                `bson:"tick" json:"tick"`                       // Game tick the flow started in (-1 if unknown)
+	Service      string             `bson:"service" json:"service"`                 // Name of the game service this flow belongs to
+	Pcaps        []PcapRef          `bson:"pcaps,omitempty" json:"pcaps,omitempty"` // Packets of this flow in the pcap files
+	CommunityID  string             `bson:"community_id" json:"community_id"`       // Hash of the 5-tuple, as in the eve.json of Suricata, see package communityid
+	App          AppLayer           `bson:"app" json:"app"`                         // Application layer metadata reported by Suricata
+	Vars         RuleVars           `bson:"vars" json:"vars"`                       // Flowints and flowvars set by the Suricata rules
+}
+
+// RuleVars are the variables set on a flow by the Suricata rules.
+type RuleVars struct {
+	Flowints map[string]int `bson:"flowints,omitempty" json:"flowints,omitempty"` // Counters, e.g. tag_FLAG_OUT, at the highest value reported
+	Flowvars []FlowVar      `bson:"flowvars,omitempty" json:"flowvars,omitempty"` // Distinct values, such as the captures of a pcre with flow:match
+}
+
+// IsZero reports whether there are no variables.
+func (v RuleVars) IsZero() bool {
+	return len(v.Flowints) == 0 && len(v.Flowvars) == 0
+}
+
+// merge adds the variables of other to v, keeping the highest value of each
+// flowint.
+func (v *RuleVars) merge(other RuleVars) {
+	for name, value := range other.Flowints {
+		if current, ok := v.Flowints[name]; !ok || value > current {
+			if v.Flowints == nil {
+				v.Flowints = map[string]int{}
+			}
+			v.Flowints[name] = value
+		}
+	}
+	v.Flowvars = addToSet(v.Flowvars, other.Flowvars...)
+}
+
+// FlowVar is a flowvar of a flow.
+type FlowVar struct {
+	Name  string `bson:"name" json:"name"`
+	Value string `bson:"value" json:"value"`
+}
+
+// PcapRef locates the packets of a flow in a pcap file, as an inclusive range
+// of 1-based packet indexes. A flow spans multiple files when the connection
+// outlives a pcap rotation.
+type PcapRef struct {
+	File        string `bson:"file" json:"file"`                 // Name of the pcap file, as in PcapFile.FileName
+	FirstPacket int64  `bson:"first_packet" json:"first_packet"` // Index of the first packet of the flow
+	LastPacket  int64  `bson:"last_packet" json:"last_packet"`   // Index of the last packet seen before the flow was stored
 }
 
+// ErrNotFound is returned when the requested flow, tag, signature or pcap
+// file does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Database is the storage used by all the Tulip services.
 type Database interface {
-	GetFlowList(filters bson.D) ([]FlowEntry, error) // Get a list of flows with optional filters
-	GetTagList() ([]string, error)                   // Get a list of all tags
-	GetSignature(id string) (Signature, error)       // Get a signature by ID
-	SetStar(flowID string, star bool) error          // Set or unset the "starred" tag on a flow
-	GetFlowDetail(id string) (*FlowEntry, error)     // Get detailed flow information by ID
-	InsertFlow(flow FlowEntry)                       // Insert a new flow into the database
-	GetPcap(uri string) (bool, PcapFile)             // Check if a pcap file exists and return its metadata
-	InsertPcap(file PcapFile) bool                   // Insert a new pcap file or update its position
-	GetFlagIds() ([]FlagIdEntry, error)
+	// Flows
+	InsertFlow(ctx context.Context, flow FlowEntry) error                                         // Insert a new flow, linking it to related flows
+	GetFlows(ctx context.Context, opts *GetFlowsOptions) ([]FlowEntry, error)                     // Get the flows matching opts, newest first
+	CountFlows(ctx context.Context, opts *GetFlowsOptions) (int, error)                           // Count the flows matching opts, ignoring limit, offset and cursor
+	GetFlowByID(ctx context.Context, id string) (*FlowEntry, error)                               // Get a single flow, ErrNotFound if it does not exist
+	SetStar(ctx context.Context, flowID string, star bool) error                                  // Set or unset the "starred" tag on a flow
+	AddSignatureToFlow(ctx context.Context, flow FlowID, sig Signature, window int) (bool, error) // Record a signature and attach it to the flow matching flow within window ms, counting a hit
+	AddTagsToFlow(ctx context.Context, flow FlowID, tags []string, window int) (bool, error)      // Add tags to the flow matching flow within window ms
+	AddAppLayerToFlow(ctx context.Context, flow FlowID, app AppLayer, window int) (bool, error)   // Add application layer metadata to the flow matching flow within window ms
+	AddVarsToFlow(ctx context.Context, flow FlowID, vars RuleVars, window int) (bool, error)      // Add the variables set by the rules to the flow matching flow within window ms
+	DeleteFlows(ctx context.Context, ids []string) (int, error)                                   // Delete flows by ID, returning how many existed
+
+	// Tags and signatures
+	GetTagList(ctx context.Context) ([]string, error)                                            // Get the names of all tags, registered or found on flows
+	GetTags(ctx context.Context) ([]Tag, error)                                                  // Get all tags in the order of GetTagList, with their records
+	InsertTag(ctx context.Context, tag Tag) error                                                // Register a tag, only filling the empty fields of an existing one
+	UpdateTag(ctx context.Context, tag Tag) error                                                // Set the color and description of a tag, registering it if needed
+	DeleteTag(ctx context.Context, name string) error                                            // Delete a tag and remove it from the flows, ErrNotFound if it does not exist
+	GetSignature(ctx context.Context, id string) (Signature, error)                              // Get a signature by ID, or the last revision of a sid, ErrNotFound if it does not exist
+	GetTopSignatures(ctx context.Context, opts *SignatureStatsOptions) ([]SignatureStats, error) // Get the signatures with the most alerts, most first
+
+	// Suricata events that could not be matched to a flow
+	AddDeadLetter(ctx context.Context, letter DeadLetter) error          // Store an event the enricher gave up on
+	GetDeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) // Get the stored events, newest first, all of them if limit is 0
+
+	// Pcap files
+	GetPcap(ctx context.Context, name string) (PcapFile, error) // Get an imported pcap file, ErrNotFound if it was never imported
+	InsertPcap(ctx context.Context, file PcapFile) error        // Insert a new pcap file or update its record
+	GetPcapList(ctx context.Context) ([]PcapFile, error)        // Get all the imported pcap files
+
+	// Flag IDs
+	GetFlagIds(ctx context.Context) ([]FlagIdEntry, error)
+	InsertFlagIds(ctx context.Context, ids []FlagIdEntry) error
+
+	// Schema
+	GetSchemaVersion(ctx context.Context) (int, error) // Version of the stored data, see SchemaVersion
+	Migrate(ctx context.Context) error                 // Upgrade the stored data to SchemaVersion
+
+	// Namespaces
+	Namespace() string                                    // Name of the namespace this handle works on
+	ListNamespaces(ctx context.Context) ([]string, error) // List the namespaces holding any data, sorted by name
+	WithNamespace(name string) (Database, error)          // Get a handle on another namespace, sharing the connection
+
+	ConfigureDatabase(ctx context.Context) error // Create the default tags and indexes, record the schema version of a new namespace
+	Close(ctx context.Context) error             // Close the connection, shared by the handles of all namespaces
+}
+
+// DefaultNamespace is the namespace used when none is configured. With
+// MongoDB it is the name of the database, as in older Tulip versions.
+const DefaultNamespace = "pcap"
+
+var namespaceRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{1,48}$`)
+
+// ValidateNamespace checks that name can be used as a namespace by all the
+// backends: a MongoDB database name or a prefix of SQLite table names.
+func ValidateNamespace(name string) error {
+	if !namespaceRegex.MatchString(name) {
+		return fmt.Errorf("invalid namespace %q: use up to 48 letters, digits, '_' or '-'", name)
+	}
+	return nil
+}
+
+// Connect opens the database at uri, picking the backend by its scheme:
+//
+//	mongodb://host:port/          MongoDB (also mongodb+srv://)
+//	sqlite:///path/to/tulip.db    SQLite file, created if missing (sqlite://tulip.db for a relative path)
+//	memory://                     in-memory database, lost when the process exits
+func Connect(uri string) (Database, error) {
+	scheme, path, ok := strings.Cut(uri, "://")
+	if !ok {
+		return nil, fmt.Errorf("invalid database URI %q: missing scheme", uri)
+	}
+
+	switch scheme {
+	case "mongodb", "mongodb+srv":
+		database, err := ConnectMongo(uri)
+		if err != nil {
+			return nil, err
+		}
+		return database, nil
+	case "sqlite":
+		database, err := ConnectSqlite(path)
+		if err != nil {
+			return nil, err
+		}
+		return database, nil
+	case "memory":
+		return NewMemoryDatabase(), nil
+	default:
+		return nil, fmt.Errorf("unsupported database scheme %q (use mongodb, sqlite or memory)", scheme)
+	}
+}
+
+// ConnectNamespace opens the database at uri, like Connect, and returns a
+// handle on the given namespace. An empty name selects DefaultNamespace.
+func ConnectNamespace(uri, name string) (Database, error) {
+	database, err := Connect(uri)
+	if err != nil || name == "" || name == database.Namespace() {
+		return database, err
+	}
+
+	handle, err := database.WithNamespace(name)
+	if err != nil {
+		database.Close(context.Background())
+		return nil, err
+	}
+	return handle, nil
+}
+
+// DefaultFlowsLimit is the number of flows returned by GetFlows when no limit
+// is given.
+const DefaultFlowsLimit = 100
+
+type PcapFile struct {
+	FileName string `bson:"file_name"` // Name of the pcap file
+	Position int64  `bson:"position"`  // N. of packets processed so far
+	Finished bool   `bson:"finished"`  // Indicates if the pcap file has been fully processed
+
+	Location   string `bson:"location,omitempty"`    // Current path of the file, if it was moved or compressed after processing
+	Size       int64  `bson:"size,omitempty"`        // Size on disk of the file at Location
+	ArchivedAt int64  `bson:"archived_at,omitempty"` // When the file was archived (epoch ms)
+	Removed    bool   `bson:"removed,omitempty"`     // The file was deleted to respect the disk quota or age limit
+}
+
+// Path returns the current location of the pcap file on disk.
+func (p PcapFile) Path() string {
+	if p.Location != "" {
+		return p.Location
+	}
+	return p.FileName
+}
+
+// FlowID identifies a flow reported by an external source, such as Suricata.
+// Flows are matched on CommunityID when it is set, the one in progress at
+// Time, then on the 5-tuple within a window around Time.
+type FlowID struct {
+	Src_port    int
+	Dst_port    int
+	Src_ip      string
+	Dst_ip      string
+	Time        time.Time
+	CommunityID string
+}
+
+// Signature is a revision of a Suricata rule that raised an alert. Each
+// (GID, ID, Rev) is stored once, so editing a rule without changing its
+// revision updates the record, and the older revisions are kept.
+type Signature struct {
+	MongoID  primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
+	GID      int                `bson:"gid" json:"gid"` // Generator ID, 1 for the rules
+	ID       int                `bson:"id" json:"id"`   // Signature ID (sid)
+	Rev      int                `bson:"rev" json:"rev"` // Revision of the rule, negative for the ones stored before it was recorded
+	Msg      string             `bson:"msg" json:"msg"`
+	Action   string             `bson:"action" json:"action"`                 // Action taken on the last alert, "allowed" or "blocked"
+	Tags     []string           `bson:"tags,omitempty" json:"tags,omitempty"` // Tags of the metadata of the rule, applied to the flows
+	Severity int                `bson:"severity" json:"severity"`             // 1 for the most severe, 0 if unknown
+	Category string             `bson:"category" json:"category"`
+}
+
+// SignatureHits is the number of alerts of a signature matched to the flows
+// of a tick.
+type SignatureHits struct {
+	Tick int `bson:"tick" json:"tick"` // -1 for the flows without a tick
+	Hits int `bson:"hits" json:"hits"`
+}
+
+// SignatureStats is a signature with its alerts in a range of ticks.
+type SignatureStats struct {
+	Signature Signature       `json:"signature"`
+	Hits      int             `json:"hits"`  // Total of Ticks
+	Ticks     []SignatureHits `json:"ticks"` // Oldest first, only the ticks with alerts
+}
+
+// SignatureStatsOptions selects the signatures returned by GetTopSignatures.
+type SignatureStatsOptions struct {
+	TickFrom *int // Only count the alerts of this tick and after
+	TickTo   *int // Only count the alerts of this tick and before
+	Limit    int  // Maximum number of signatures, 0 for all
+}
+
+// DeadLetter is a Suricata event the enricher gave up matching to a flow, kept
+// so that no alert is lost silently.
+type DeadLetter struct {
+	MongoID   primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
+	Event     string             `bson:"event" json:"event"`           // Line of eve.json
+	Reason    string             `bson:"reason" json:"reason"`         // Why the last attempt failed
+	Attempts  int                `bson:"attempts" json:"attempts"`     // Number of attempts at matching the event
+	FirstSeen int64              `bson:"first_seen" json:"first_seen"` // When the event was first read (epoch ms)
+	DeadAt    int64              `bson:"dead_at" json:"dead_at"`       // When the enricher gave up (epoch ms)
+}
+
+// sortSignatureStats sorts stats as returned by GetTopSignatures: most hits
+// first, then by signature ID.
+func sortSignatureStats(stats []SignatureStats) {
+	slices.SortFunc(stats, func(a, b SignatureStats) int {
+		return cmp.Or(cmp.Compare(b.Hits, a.Hits), cmp.Compare(a.Signature.MongoID.Hex(), b.Signature.MongoID.Hex()))
+	})
+}
+
+// FlagIdEntry is a flag ID published by the game server
+type FlagIdEntry struct {
+	Service     string `bson:"service"`
+	Team        int    `bson:"team"`
+	Round       int    `bson:"round"`
+	Description string `bson:"description"`
+	FlagId      string `bson:"flagid"`
+}
+
+type GetFlowsOptions struct {
+	FromTime     int64
+	ToTime       int64
+	IncludeTags  []string
+	ExcludeTags  []string
+	DstPort      int
+	DstIp        string
+	SrcPort      int
+	SrcIp        string
+	Limit        int
+	Offset       int
+	Cursor       *FlowCursor // Page from a cursor, faster than Offset on deep pages
+	MaxCount     int         // CountFlows stops counting at MaxCount, if positive
+	FlowData     string      // Case-insensitive regex on the payloads, decompressing every flow matching the other filters, see FullScan
+	Search       string      // Full-text search on the payloads, see ParseSearch
+	Contains     []byte      // Byte sequence in one of the payloads, see ParsePattern
+	Query        *FlowQuery  // Conditions in the flow query language, see ParseFlowQuery
+	TickFrom     *int        // First game tick to include
+	TickTo       *int        // Last game tick to include
+	Service      string      // Name of the game service
+	ExcludePorts []int       // Destination ports left out, such as the ones of the game services
+	Flags        []string    // Flags the flow must all contain
+	FlagIds      []string    // Flag IDs the flow must all contain
+	DurationMin  *int        // Minimum duration in ms
+	DurationMax  *int        // Maximum duration in ms
+	SizeMin      *int        // Minimum size in bytes
+	SizeMax      *int        // Maximum size in bytes
+	PacketsMin   *int        // Minimum number of packets
+	PacketsMax   *int        // Maximum number of packets
+	Hostname     string      // HTTP host, TLS SNI or DNS query name, see AppLayer
+	URL          string      // HTTP URL
+	HTTPStatus   int         // HTTP status code
+	UserAgent    string      // HTTP user agent
+	JA3          string      // JA3 or JA3S hash
+	FileHash     string      // MD5, SHA-1 or SHA-256 of a transferred file
+	Anomaly      string      // Anomaly event, see AppLayer.Anomalies
+}
+
+// Capped reports whether count, returned by CountFlows with opts, stopped at
+// MaxCount, so that more flows may match.
+func (opts *GetFlowsOptions) Capped(count int) bool {
+	return opts != nil && opts.MaxCount > 0 && count == opts.MaxCount
+}
+
+// FullScan reports whether some filters of opts are checked on the decoded
+// flows without an index narrowing the candidates: FlowData, and the
+// conditions of Query MongoDB cannot evaluate. Every flow matching the other
+// filters is then decompressed, so counting them all reads the whole
+// namespace; callers should cap the count with MaxCount.
+func (opts *GetFlowsOptions) FullScan() bool {
+	if opts == nil {
+		return false
+	}
+	if opts.Query != nil {
+		if _, exact := mongoFlowQuery(opts.Query, false); !exact {
+			return true
+		}
+	}
+	return opts.FlowData != ""
+}
+
+// flowCommunityID computes the Community ID of a flow stored without one,
+// taking the protocol from its tags.
+func flowCommunityID(flow FlowEntry) string {
+	proto := communityid.ProtoTCP
+	if slices.Contains(flow.Tags, "udp") {
+		proto = communityid.ProtoUDP
+	}
+	return communityid.FromStrings(communityid.DefaultSeed, proto, flow.SrcIp, flow.SrcPort, flow.DstIp, flow.DstPort)
+}
+
+// prepareFlow fills the fields derived from the flow data before insertion.
+func prepareFlow(flow *FlowEntry) {
+	for idx := range flow.Flow {
+		flowItem := &flow.Flow[idx]
+		flowItem.Raw = []byte(flowItem.Data)
+	}
+	if flow.CommunityID == "" {
+		flow.CommunityID = flowCommunityID(*flow)
+	}
 }
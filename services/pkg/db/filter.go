@@ -0,0 +1,108 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// flowFilter evaluates GetFlowsOptions on flows in memory, with the same
+// semantics as the MongoDB query built by flowsQuery.
+type flowFilter struct {
+	opts   *GetFlowsOptions
+	data   *regexp.Regexp
+	search *SearchQuery
+}
+
+func newFlowFilter(opts *GetFlowsOptions) (*flowFilter, error) {
+	f := &flowFilter{opts: opts}
+	if opts != nil && opts.FlowData != "" {
+		re, err := regexp.Compile("(?i)" + opts.FlowData)
+		if err != nil {
+			return nil, fmt.Errorf("invalid flow data regex: %v", err)
+		}
+		f.data = re
+	}
+	if opts != nil && opts.Search != "" {
+		search, err := ParseSearch(opts.Search)
+		if err != nil {
+			return nil, err
+		}
+		f.search = search
+	}
+	return f, nil
+}
+
+func (f *flowFilter) match(flow *FlowEntry) bool {
+	opts := f.opts
+	if opts == nil {
+		return true
+	}
+
+	switch {
+	case opts.FromTime > 0 && int64(flow.Time) < opts.FromTime,
+		opts.ToTime > 0 && int64(flow.Time) >= opts.ToTime,
+		opts.DstPort > 0 && flow.DstPort != opts.DstPort,
+		opts.DstIp != "" && flow.DstIp != opts.DstIp,
+		opts.SrcPort > 0 && flow.SrcPort != opts.SrcPort,
+		opts.SrcIp != "" && flow.SrcIp != opts.SrcIp,
+		opts.TickFrom != nil && flow.Tick < *opts.TickFrom,
+		opts.TickTo != nil && flow.Tick > *opts.TickTo,
+		opts.Service != "" && flow.Service != opts.Service,
+		slices.Contains(opts.ExcludePorts, flow.DstPort),
+		outside(flow.Duration, opts.DurationMin, opts.DurationMax),
+		outside(flow.Size, opts.SizeMin, opts.SizeMax),
+		outside(flow.Num_packets, opts.PacketsMin, opts.PacketsMax):
+		return false
+	}
+
+	for _, tag := range opts.IncludeTags {
+		if !slices.Contains(flow.Tags, tag) {
+			return false
+		}
+	}
+	for _, tag := range opts.ExcludeTags {
+		if slices.Contains(flow.Tags, tag) {
+			return false
+		}
+	}
+	for _, flag := range opts.Flags {
+		if !slices.Contains(flow.Flags, flag) {
+			return false
+		}
+	}
+	for _, flagID := range opts.FlagIds {
+		if !slices.Contains(flow.Flagids, flagID) {
+			return false
+		}
+	}
+
+	for _, filter := range appFilters(opts) {
+		if !filter.match(&flow.App) {
+			return false
+		}
+	}
+	if opts.Query != nil && !opts.Query.Match(flow) {
+		return false
+	}
+
+	if f.data != nil && !slices.ContainsFunc(flow.Flow, func(item FlowItem) bool {
+		return f.data.MatchString(item.Data)
+	}) {
+		return false
+	}
+	if len(opts.Contains) > 0 && !containsPattern(flow.Flow, opts.Contains) {
+		return false
+	}
+	return f.search == nil || f.search.Match(flow)
+}
+
+// outside reports whether value is out of the range [lo, hi], each bound
+// being optional.
+func outside(value int, lo, hi *int) bool {
+	return (lo != nil && value < *lo) || (hi != nil && value > *hi)
+}
@@ -0,0 +1,609 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryDatabase is a Database keeping everything in memory, for tests and
+// demos. It behaves like MongoDatabase, and is lost when the process exits.
+type MemoryDatabase struct {
+	mu         sync.RWMutex
+	flows      []FlowEntry // in insertion order
+	tags       []Tag       // registered tags, in insertion order
+	signatures []Signature
+	sigHits    map[string]map[int]int // alerts by signature ID and tick
+	pcaps      []PcapFile
+	flagIds    []FlagIdEntry
+	dead       []DeadLetter // in insertion order
+
+	name       string
+	namespaces *memoryNamespaces // shared by the handles of all namespaces
+}
+
+type memoryNamespaces struct {
+	mu  sync.Mutex
+	dbs map[string]*MemoryDatabase
+}
+
+var _ Database = (*MemoryDatabase)(nil)
+
+// NewMemoryDatabase creates an empty in-memory database.
+func NewMemoryDatabase() *MemoryDatabase {
+	m := &MemoryDatabase{name: DefaultNamespace}
+	m.namespaces = &memoryNamespaces{dbs: map[string]*MemoryDatabase{m.name: m}}
+	return m
+}
+
+func (m *MemoryDatabase) Namespace() string {
+	return m.name
+}
+
+func (m *MemoryDatabase) WithNamespace(name string) (Database, error) {
+	if err := ValidateNamespace(name); err != nil {
+		return nil, err
+	}
+
+	m.namespaces.mu.Lock()
+	defer m.namespaces.mu.Unlock()
+
+	other, ok := m.namespaces.dbs[name]
+	if !ok {
+		other = &MemoryDatabase{name: name, namespaces: m.namespaces}
+		m.namespaces.dbs[name] = other
+	}
+	return other, nil
+}
+
+func (m *MemoryDatabase) ListNamespaces(_ context.Context) ([]string, error) {
+	m.namespaces.mu.Lock()
+	defer m.namespaces.mu.Unlock()
+
+	names := make([]string, 0, len(m.namespaces.dbs))
+	for name, other := range m.namespaces.dbs {
+		other.mu.RLock()
+		empty := len(other.flows) == 0 && len(other.tags) == 0
+		other.mu.RUnlock()
+		if !empty {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// cloneFlow returns a copy of flow not sharing any slice or map with it.
+func cloneFlow(flow FlowEntry) FlowEntry {
+	flow.Fingerprints = slices.Clone(flow.Fingerprints)
+	flow.Suricata = slices.Clone(flow.Suricata)
+	flow.Tags = slices.Clone(flow.Tags)
+	flow.Flags = slices.Clone(flow.Flags)
+	flow.Flagids = slices.Clone(flow.Flagids)
+	flow.Pcaps = slices.Clone(flow.Pcaps)
+	flow.Vars.Flowints = maps.Clone(flow.Vars.Flowints)
+	flow.Vars.Flowvars = slices.Clone(flow.Vars.Flowvars)
+	flow.Flow = slices.Clone(flow.Flow)
+	for i := range flow.Flow {
+		flow.Flow[i].Raw = slices.Clone(flow.Flow[i].Raw)
+	}
+	return flow
+}
+
+func (m *MemoryDatabase) InsertFlow(_ context.Context, flow FlowEntry) error {
+	flow = cloneFlow(flow)
+	prepareFlow(&flow)
+	if flow.Id.IsZero() {
+		flow.Id = primitive.NewObjectID()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// link the flow to the newest flow sharing a fingerprint
+	child := -1
+	for i := range m.flows {
+		other := &m.flows[i]
+		if (child == -1 || other.Time > m.flows[child].Time) &&
+			slices.ContainsFunc(flow.Fingerprints, func(fp uint32) bool { return slices.Contains(other.Fingerprints, fp) }) {
+			child = i
+		}
+	}
+	if child != -1 {
+		flow.ChildId = m.flows[child].Id
+		m.flows[child].ParentId = flow.Id
+	}
+
+	m.flows = append(m.flows, flow)
+	return nil
+}
+
+func (m *MemoryDatabase) matchingFlows(opts *GetFlowsOptions) ([]FlowEntry, error) {
+	filter, err := newFlowFilter(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]FlowEntry, 0)
+	for i := range m.flows {
+		if filter.match(&m.flows[i]) {
+			results = append(results, m.flows[i])
+		}
+	}
+	return results, nil
+}
+
+func (m *MemoryDatabase) GetFlows(_ context.Context, opts *GetFlowsOptions) ([]FlowEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	results, err := m.matchingFlows(opts)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(results, func(a, b FlowEntry) int { return compareFlows(&a, &b) })
+
+	if opts != nil {
+		backward := opts.Cursor != nil && opts.Cursor.Before
+		if cursor := opts.Cursor; cursor != nil {
+			results = slices.DeleteFunc(results, func(flow FlowEntry) bool { return !cursor.follows(&flow) })
+		}
+		if backward {
+			slices.Reverse(results) // the page closest to the cursor
+		}
+		results = results[min(max(opts.Offset, 0), len(results)):]
+		limit := opts.Limit
+		if limit <= 0 {
+			limit = DefaultFlowsLimit
+		}
+		results = results[:min(limit, len(results))]
+		if backward {
+			slices.Reverse(results)
+		}
+	}
+
+	for i := range results {
+		results[i] = cloneFlow(results[i])
+	}
+	return results, nil
+}
+
+func (m *MemoryDatabase) CountFlows(_ context.Context, opts *GetFlowsOptions) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	results, err := m.matchingFlows(opts)
+	if opts != nil && opts.MaxCount > 0 {
+		return min(len(results), opts.MaxCount), err
+	}
+	return len(results), err
+}
+
+// flowIndex returns the index of the flow with the given ID, or -1.
+func (m *MemoryDatabase) flowIndex(id string) int {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return -1
+	}
+	return slices.IndexFunc(m.flows, func(flow FlowEntry) bool { return flow.Id == objID })
+}
+
+func (m *MemoryDatabase) GetFlowByID(_ context.Context, id string) (*FlowEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := m.flowIndex(id)
+	if i == -1 {
+		return nil, ErrNotFound
+	}
+	flow := cloneFlow(m.flows[i])
+	return &flow, nil
+}
+
+func (m *MemoryDatabase) SetStar(_ context.Context, flowID string, star bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.flowIndex(flowID)
+	if i == -1 {
+		return ErrNotFound
+	}
+	flow := &m.flows[i]
+	if star {
+		flow.Tags = addToSet(flow.Tags, "starred")
+	} else {
+		flow.Tags = slices.DeleteFunc(slices.Clone(flow.Tags), func(tag string) bool { return tag == "starred" })
+	}
+	return nil
+}
+
+func (m *MemoryDatabase) DeleteFlows(_ context.Context, ids []string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	before := len(m.flows)
+	m.flows = slices.DeleteFunc(m.flows, func(flow FlowEntry) bool { return slices.Contains(ids, flow.Id.Hex()) })
+	return before - len(m.flows), nil
+}
+
+// addToSet returns set with the missing values appended, as $addToSet does.
+func addToSet[T comparable](set []T, values ...T) []T {
+	set = slices.Clone(set)
+	for _, value := range values {
+		if !slices.Contains(set, value) {
+			set = append(set, value)
+		}
+	}
+	return set
+}
+
+// findFlow returns the latest flow with the Community ID of id in progress
+// within window ms, else the first flow matching its 5-tuple within window
+// ms, or nil.
+func (m *MemoryDatabase) findFlow(id FlowID, window int) *FlowEntry {
+	epoch := int(id.Time.UnixMilli())
+	var latest *FlowEntry
+	for i := range m.flows {
+		flow := &m.flows[i]
+		if id.CommunityID != "" && flow.CommunityID == id.CommunityID &&
+			flow.Time < epoch+window && flow.Time+flow.Duration > epoch-window &&
+			(latest == nil || flow.Time > latest.Time) {
+			latest = flow
+		}
+	}
+	if latest != nil {
+		return latest
+	}
+	for i := range m.flows {
+		flow := &m.flows[i]
+		if flow.SrcPort == id.Src_port && flow.DstPort == id.Dst_port &&
+			flow.SrcIp == id.Src_ip && flow.DstIp == id.Dst_ip &&
+			flow.Time > epoch-window && flow.Time < epoch+window {
+			return flow
+		}
+	}
+	return nil
+}
+
+// addSignature stores a signature, updating the one with the same GID, ID
+// and Rev if any, and returns its ID.
+func (m *MemoryDatabase) addSignature(sig Signature) string {
+	sig.Tags = slices.Clone(sig.Tags)
+	for i, existing := range m.signatures {
+		if existing.GID == sig.GID && existing.ID == sig.ID && existing.Rev == sig.Rev {
+			sig.MongoID = existing.MongoID
+			m.signatures[i] = sig
+			return sig.MongoID.Hex()
+		}
+	}
+	sig.MongoID = primitive.NewObjectID()
+	m.signatures = append(m.signatures, sig)
+	return sig.MongoID.Hex()
+}
+
+func (m *MemoryDatabase) AddSignatureToFlow(_ context.Context, id FlowID, sig Signature, window int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sigID := m.addSignature(sig)
+
+	tags := []string{"suricata"}
+	for _, tag := range sig.Tags {
+		m.insertTag(Tag{Name: tag})
+		tags = append(tags, tag)
+	}
+	if sig.Action == "blocked" {
+		tags = append(tags, "blocked")
+	}
+
+	flow := m.findFlow(id, window)
+	if flow == nil {
+		return false, nil
+	}
+	if sig.Action == "blocked" {
+		flow.Blocked = true
+	}
+	flow.Tags = addToSet(flow.Tags, tags...)
+	if slices.Contains(flow.Suricata, sigID) {
+		return true, nil // a redelivered alert is counted once
+	}
+	flow.Suricata = append(flow.Suricata, sigID)
+
+	if m.sigHits == nil {
+		m.sigHits = map[string]map[int]int{}
+	}
+	if m.sigHits[sigID] == nil {
+		m.sigHits[sigID] = map[int]int{}
+	}
+	m.sigHits[sigID][max(flow.Tick, -1)]++
+	return true, nil
+}
+
+func (m *MemoryDatabase) AddTagsToFlow(_ context.Context, id FlowID, tags []string, window int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, tag := range tags {
+		m.insertTag(Tag{Name: tag})
+	}
+
+	flow := m.findFlow(id, window)
+	if flow == nil {
+		return false, nil
+	}
+	flow.Tags = addToSet(flow.Tags, tags...)
+	return true, nil
+}
+
+func (m *MemoryDatabase) AddAppLayerToFlow(_ context.Context, id FlowID, app AppLayer, window int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	flow := m.findFlow(id, window)
+	if flow == nil {
+		return false, nil
+	}
+	flow.App.merge(app)
+	return true, nil
+}
+
+func (m *MemoryDatabase) AddVarsToFlow(_ context.Context, id FlowID, vars RuleVars, window int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	flow := m.findFlow(id, window)
+	if flow == nil {
+		return false, nil
+	}
+	flow.Vars.merge(vars)
+	return true, nil
+}
+
+func (m *MemoryDatabase) GetTagList(_ context.Context) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.tagNames(), nil
+}
+
+func (m *MemoryDatabase) tagNames() []string {
+	tags := make([]string, 0, len(m.tags))
+	for _, tag := range m.tags {
+		tags = append(tags, tag.Name)
+	}
+	for _, flow := range m.flows {
+		tags = addToSet(tags, flow.Tags...)
+	}
+	return tags
+}
+
+func (m *MemoryDatabase) GetTags(_ context.Context) ([]Tag, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return mergeTags(m.tagNames(), m.tags), nil
+}
+
+// insertTag registers a tag, the caller holds the lock.
+func (m *MemoryDatabase) insertTag(tag Tag) {
+	if tag.CreatedAt == 0 {
+		tag.CreatedAt = time.Now().UnixMilli()
+	}
+	for i := range m.tags {
+		if m.tags[i].Name == tag.Name {
+			fillTag(&m.tags[i], tag)
+			return
+		}
+	}
+	m.tags = append(m.tags, tag)
+}
+
+func (m *MemoryDatabase) InsertTag(_ context.Context, tag Tag) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.insertTag(tag)
+	return nil
+}
+
+func (m *MemoryDatabase) UpdateTag(_ context.Context, tag Tag) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.tags {
+		if m.tags[i].Name == tag.Name {
+			m.tags[i].Color, m.tags[i].Description = tag.Color, tag.Description
+			return nil
+		}
+	}
+	m.insertTag(tag)
+	return nil
+}
+
+func (m *MemoryDatabase) DeleteTag(_ context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	before := len(m.tags)
+	m.tags = slices.DeleteFunc(m.tags, func(tag Tag) bool { return tag.Name == name })
+	found := len(m.tags) != before
+	for i := range m.flows {
+		if slices.Contains(m.flows[i].Tags, name) {
+			m.flows[i].Tags = slices.DeleteFunc(slices.Clone(m.flows[i].Tags), func(tag string) bool { return tag == name })
+			found = true
+		}
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetSignature returns a signature by its ObjectID string, or the last
+// revision of a sid
+func (m *MemoryDatabase) GetSignature(_ context.Context, id string) (Signature, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var (
+		found Signature
+		ok    bool
+	)
+	if objID, err := primitive.ObjectIDFromHex(id); err == nil {
+		for _, sig := range m.signatures {
+			if sig.MongoID == objID {
+				found, ok = sig, true
+			}
+		}
+	} else if intID, err := strconv.Atoi(id); err == nil {
+		for _, sig := range m.signatures {
+			if sig.ID == intID && (!ok || sig.Rev > found.Rev) {
+				found, ok = sig, true
+			}
+		}
+	}
+	if !ok {
+		return Signature{}, ErrNotFound
+	}
+	return found, nil
+}
+
+func (m *MemoryDatabase) GetTopSignatures(_ context.Context, opts *SignatureStatsOptions) ([]SignatureStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if opts == nil {
+		opts = &SignatureStatsOptions{}
+	}
+	stats := make([]SignatureStats, 0)
+	for _, sig := range m.signatures {
+		stat := SignatureStats{Signature: sig}
+		for tick, hits := range m.sigHits[sig.MongoID.Hex()] {
+			if (opts.TickFrom != nil && tick < *opts.TickFrom) || (opts.TickTo != nil && tick > *opts.TickTo) {
+				continue
+			}
+			stat.Hits += hits
+			stat.Ticks = append(stat.Ticks, SignatureHits{Tick: tick, Hits: hits})
+		}
+		if stat.Hits == 0 {
+			continue
+		}
+		slices.SortFunc(stat.Ticks, func(a, b SignatureHits) int { return cmp.Compare(a.Tick, b.Tick) })
+		stats = append(stats, stat)
+	}
+	sortSignatureStats(stats)
+	if opts.Limit > 0 && len(stats) > opts.Limit {
+		stats = stats[:opts.Limit]
+	}
+	return stats, nil
+}
+
+func (m *MemoryDatabase) GetPcap(_ context.Context, name string) (PcapFile, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if i := slices.IndexFunc(m.pcaps, func(p PcapFile) bool { return p.FileName == name }); i != -1 {
+		return m.pcaps[i], nil
+	}
+	return PcapFile{}, ErrNotFound
+}
+
+func (m *MemoryDatabase) InsertPcap(_ context.Context, file PcapFile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := slices.IndexFunc(m.pcaps, func(p PcapFile) bool { return p.FileName == file.FileName }); i != -1 {
+		m.pcaps[i] = file
+	} else {
+		m.pcaps = append(m.pcaps, file)
+	}
+	return nil
+}
+
+func (m *MemoryDatabase) GetPcapList(_ context.Context) ([]PcapFile, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append(make([]PcapFile, 0, len(m.pcaps)), m.pcaps...), nil
+}
+
+func (m *MemoryDatabase) AddDeadLetter(_ context.Context, letter DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	letter.MongoID = primitive.NewObjectID()
+	m.dead = append(m.dead, letter)
+	return nil
+}
+
+func (m *MemoryDatabase) GetDeadLetters(_ context.Context, limit int) ([]DeadLetter, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	letters := make([]DeadLetter, 0, len(m.dead))
+	for i := len(m.dead) - 1; i >= 0 && (limit <= 0 || len(letters) < limit); i-- {
+		letters = append(letters, m.dead[i])
+	}
+	return letters, nil
+}
+
+func (m *MemoryDatabase) GetFlagIds(_ context.Context) ([]FlagIdEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append(make([]FlagIdEntry, 0, len(m.flagIds)), m.flagIds...), nil
+}
+
+// InsertFlagIds stores flag IDs, replacing the ones with the same service,
+// team, round and value.
+func (m *MemoryDatabase) InsertFlagIds(_ context.Context, ids []FlagIdEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range ids {
+		if id.FlagId == "" {
+			continue // not returned by GetFlagIds anyway
+		}
+		i := slices.IndexFunc(m.flagIds, func(e FlagIdEntry) bool {
+			return e.Service == id.Service && e.Team == id.Team && e.Round == id.Round && e.FlagId == id.FlagId
+		})
+		if i != -1 {
+			m.flagIds[i] = id
+		} else {
+			m.flagIds = append(m.flagIds, id)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDatabase) ConfigureDatabase(ctx context.Context) error {
+	for _, tag := range DefaultTags {
+		if err := m.InsertTag(ctx, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetSchemaVersion always returns SchemaVersion, nothing outlives the process.
+func (m *MemoryDatabase) GetSchemaVersion(_ context.Context) (int, error) {
+	return SchemaVersion, nil
+}
+
+func (m *MemoryDatabase) Migrate(_ context.Context) error {
+	return nil
+}
+
+func (m *MemoryDatabase) Close(_ context.Context) error {
+	return nil
+}
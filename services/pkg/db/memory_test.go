@@ -0,0 +1,28 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import "testing"
+
+func TestMemoryDatabase(t *testing.T) {
+	testConformance(t, func(t *testing.T) Database {
+		return NewMemoryDatabase()
+	})
+}
+
+func TestMemoryDatabase_Isolation(t *testing.T) {
+	database := NewMemoryDatabase()
+	if err := database.InsertFlow(t.Context(), FlowEntry{Tags: []string{"tcp"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	flows, _ := database.GetFlows(t.Context(), nil)
+	flows[0].Tags[0] = "changed"
+
+	flows, _ = database.GetFlows(t.Context(), nil)
+	if flows[0].Tags[0] != "tcp" {
+		t.Errorf("returned flows share memory with the database: tags %v", flows[0].Tags)
+	}
+}
@@ -12,11 +12,13 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"log/slog"
+	"regexp"
 	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -26,58 +28,64 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
+// MongoDatabase stores each namespace in its own MongoDB database.
 type MongoDatabase struct {
 	client *mongo.Client
+	name   string // name of the MongoDB database, i.e. the namespace
+	codec  *payloadCodec
 }
 
-// GetFlowList implements filtering logic similar to the Python getFlowList
-func (db MongoDatabase) GetFlowList(filters bson.D) ([]FlowEntry, error) {
-	collection := db.client.Database("pcap").Collection("pcap")
+var _ Database = (*MongoDatabase)(nil)
 
-	opt := options.Find().
-		SetLimit(0).                     // No limit, we want all matching flows
-		SetSort(bson.M{"time": -1}).     // Sort by time descending
-		SetProjection(bson.M{"flow": 0}) // Exclude flow details for performance
+func newMongoNamespace(client *mongo.Client, name string) *MongoDatabase {
+	db := &MongoDatabase{client: client, name: name}
+	db.codec = newPayloadCodec(db)
+	return db
+}
 
-	// If filters are nil, use an empty filter
-	if filters == nil {
-		filters = bson.D{}
-	}
+// mongoFlow is a flow as stored in MongoDB. Payloads are compressed, see
+// payloadCodec, and their trigrams are indexed for GetFlowsOptions.Contains
+// and Search. Ngrams is null when the flow has too many trigrams to index
+// them, or was stored by an older version.
+type mongoFlow struct {
+	FlowEntry `bson:",inline"`
+	Flow      []mongoItem `bson:"flow"`
+	Dict      uint32      `bson:"dict,omitempty"` // Dictionary the payloads were compressed with
+	Ngrams    []int32     `bson:"ngrams"`
+}
 
-	cur, err := collection.Find(context.TODO(), filters, opt)
-	if err != nil {
-		return nil, fmt.Errorf("failed to find flows: %v", err)
-	}
-	// Ensure the cursor is closed after use
-	defer cur.Close(context.TODO())
+// mongoItem is a message of a flow as stored in MongoDB. Data is compressed
+// in Z unless that makes it bigger. Raw is not stored, schema version 1 stored
+// Data uncompressed along with its printable bytes in raw.
+type mongoItem struct {
+	From string `bson:"from"`
+	Data string `bson:"data,omitempty"`
+	Z    []byte `bson:"z,omitempty"`
+	Time int    `bson:"time"`
+}
 
-	results := make([]FlowEntry, 0)
-	for cur.Next(context.TODO()) {
-		var entry FlowEntry
-		err := cur.Decode(&entry)
-		if err != nil {
-			slog.Error("Failed to decode flow entry", "error", err)
-			continue // Skip this entry if decoding fails
-		}
-		results = append(results, entry)
-	}
+// withoutNgrams leaves the trigram index out of the flows read.
+var withoutNgrams = bson.M{"ngrams": 0}
 
-	return results, nil
+func (db *MongoDatabase) flows() *mongo.Collection {
+	return db.collection("pcap")
 }
 
-// GetTagList returns all tag names (_id) from the tags collection
-func (db MongoDatabase) GetTagList() ([]string, error) {
-	tagsCollection := db.client.Database("pcap").Collection("tags")
+func (db *MongoDatabase) collection(name string) *mongo.Collection {
+	return db.client.Database(db.name).Collection(name)
+}
 
-	cur, err := tagsCollection.Find(context.TODO(), bson.M{})
+// GetTagList returns all tag names (_id) from the tags collection, together
+// with the tags used by the flows
+func (db *MongoDatabase) GetTagList(ctx context.Context) ([]string, error) {
+	cur, err := db.collection("tags").Find(ctx, bson.M{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to find tags: %v", err)
 	}
-
-	defer cur.Close(context.TODO())
+	defer cur.Close(ctx)
 
 	tags := make([]string, 0)
-	for cur.Next(context.TODO()) {
+	for cur.Next(ctx) {
 		var tag struct {
 			ID string `bson:"_id"`
 		}
@@ -98,17 +106,16 @@ func (db MongoDatabase) GetTagList() ([]string, error) {
 		}}},
 	}
 
-	flowCollection := db.client.Database("pcap").Collection("pcap")
-	cur2, err := flowCollection.Aggregate(context.TODO(), pipeline)
+	cur2, err := db.flows().Aggregate(ctx, pipeline)
 	if err != nil {
 		return nil, fmt.Errorf("failed to aggregate tags: %v", err)
 	}
-	defer cur2.Close(context.TODO())
+	defer cur2.Close(ctx)
 
 	var aggResult []struct {
 		UniqueTags []string `bson:"uniqueTags"`
 	}
-	if err := cur2.All(context.TODO(), &aggResult); err != nil {
+	if err := cur2.All(ctx, &aggResult); err != nil {
 		return nil, fmt.Errorf("failed to decode aggregation result: %v", err)
 	}
 
@@ -124,145 +131,529 @@ func (db MongoDatabase) GetTagList() ([]string, error) {
 	return tags, nil
 }
 
-// CountFlows returns the number of flows matching the given filters.
-func (db MongoDatabase) CountFlows(filters bson.D) (int, error) {
-	collection := db.client.Database("pcap").Collection("pcap")
-	count, err := collection.CountDocuments(context.TODO(), filters)
-	return int(count), err
+// CountFlows returns the number of flows matching the given options,
+// ignoring limit and offset.
+func (db *MongoDatabase) CountFlows(ctx context.Context, opts *GetFlowsOptions) (int, error) {
+	query, payload, err := flowsQuery(opts)
+	if err != nil {
+		return 0, err
+	}
+	countOpts := options.Count()
+	if opts != nil && opts.MaxCount > 0 {
+		countOpts.SetLimit(int64(opts.MaxCount))
+	}
+	if payload == nil {
+		count, err := db.flows().CountDocuments(ctx, query, countOpts)
+		if err != nil {
+			return 0, fmt.Errorf("failed to count flows: %v", err)
+		}
+		return int(count), nil
+	}
+
+	cur, err := db.flows().Find(ctx, query, options.Find().SetProjection(withoutNgrams))
+	if err != nil {
+		return 0, fmt.Errorf("failed to count flows: %v", err)
+	}
+	defer cur.Close(ctx)
+
+	count := 0
+	for cur.Next(ctx) {
+		if entry, ok := db.decodeCursor(ctx, cur); ok && payload.match(&entry) {
+			count++
+			if count == opts.MaxCount {
+				break
+			}
+		}
+	}
+	return count, cur.Err()
 }
 
 // GetSignature returns a signature document by its integer ID or ObjectID string
-func (db MongoDatabase) GetSignature(id string) (Signature, error) {
-	collection := db.client.Database("pcap").Collection("signatures")
+func (db *MongoDatabase) GetSignature(ctx context.Context, id string) (Signature, error) {
 	var result Signature
 
 	// Try as ObjectID first
-	objID, err := primitive.ObjectIDFromHex(id)
+	filter := bson.M{}
+	if objID, err := primitive.ObjectIDFromHex(id); err == nil {
+		filter["_id"] = objID
+	} else if intID, err := strconv.Atoi(id); err == nil {
+		filter["id"] = intID
+	} else {
+		return result, ErrNotFound
+	}
+
+	// the last revision of a sid
+	opts := options.FindOne().SetSort(bson.D{{Key: "rev", Value: -1}})
+	err := db.collection("signatures").FindOne(ctx, filter, opts).Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return result, ErrNotFound
+	}
+	return result, err
+}
 
-	filter := bson.M{"_id": objID}
+// GetTopSignatures sums the documents of the signature_hits collection,
+// {signature, tick, hits}, by signature.
+func (db *MongoDatabase) GetTopSignatures(ctx context.Context, opts *SignatureStatsOptions) ([]SignatureStats, error) {
+	if opts == nil {
+		opts = &SignatureStatsOptions{}
+	}
+	ticks := bson.M{}
+	if opts.TickFrom != nil {
+		ticks["$gte"] = *opts.TickFrom
+	}
+	if opts.TickTo != nil {
+		ticks["$lte"] = *opts.TickTo
+	}
+	match := bson.M{}
+	if len(ticks) > 0 {
+		match["tick"] = ticks
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$sort", Value: bson.D{{Key: "tick", Value: 1}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$signature"},
+			{Key: "hits", Value: bson.M{"$sum": "$hits"}},
+			{Key: "ticks", Value: bson.M{"$push": bson.M{"tick": "$tick", "hits": "$hits"}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "hits", Value: -1}, {Key: "_id", Value: 1}}}},
+	}
+	if opts.Limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: opts.Limit}})
+	}
+	cur, err := db.collection("signature_hits").Aggregate(ctx, pipeline)
 	if err != nil {
-		// Try as int
-		intID, err2 := toInt(id)
-		if err2 != nil {
-			return result, fmt.Errorf("invalid id: %v", id)
-		}
-		filter = bson.M{"id": intID}
+		return nil, fmt.Errorf("failed to aggregate signature hits: %v", err)
+	}
+	var groups []struct {
+		Signature string          `bson:"_id"`
+		Hits      int             `bson:"hits"`
+		Ticks     []SignatureHits `bson:"ticks"`
+	}
+	if err := cur.All(ctx, &groups); err != nil {
+		return nil, fmt.Errorf("failed to decode signature hits: %v", err)
 	}
 
-	err = collection.FindOne(context.TODO(), filter).Decode(&result)
-	return result, err
+	ids := make([]primitive.ObjectID, 0, len(groups))
+	for _, group := range groups {
+		ids = append(ids, parseHexID(group.Signature))
+	}
+	cur, err = db.collection("signatures").Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find signatures: %v", err)
+	}
+	var sigs []Signature
+	if err := cur.All(ctx, &sigs); err != nil {
+		return nil, fmt.Errorf("failed to decode signatures: %v", err)
+	}
+
+	stats := make([]SignatureStats, 0, len(groups))
+	for _, group := range groups {
+		i := slices.IndexFunc(sigs, func(sig Signature) bool { return sig.MongoID.Hex() == group.Signature })
+		if i < 0 {
+			continue
+		}
+		stats = append(stats, SignatureStats{Signature: sigs[i], Hits: group.Hits, Ticks: group.Ticks})
+	}
+	return stats, nil
 }
 
 // SetStar sets or unsets the "starred" tag on a flow
-func (db MongoDatabase) SetStar(flowID string, star bool) error {
-	collection := db.client.Database("pcap").Collection("pcap")
+func (db *MongoDatabase) SetStar(ctx context.Context, flowID string, star bool) error {
 	objID, err := primitive.ObjectIDFromHex(flowID)
 	if err != nil {
-		return err
+		return ErrNotFound
 	}
-	update := bson.M{}
+	update := bson.M{"$pull": bson.M{"tags": "starred"}}
 	if star {
-		update = bson.M{"$push": bson.M{"tags": "starred"}}
-	} else {
-		update = bson.M{"$pull": bson.M{"tags": "starred"}}
+		update = bson.M{"$addToSet": bson.M{"tags": "starred"}}
 	}
-	_, err = collection.UpdateOne(context.TODO(), bson.M{"_id": objID}, update)
-	return err
+	res, err := db.flows().UpdateOne(ctx, bson.M{"_id": objID}, update)
+	if err != nil {
+		return fmt.Errorf("failed to update flow: %v", err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
 
-// GetFlowDetail returns a flow by its ObjectID string, including signatures
-func (db MongoDatabase) GetFlowDetail(id string) (*FlowEntry, error) {
-	collection := db.client.Database("pcap").Collection("pcap")
-	objID, err := primitive.ObjectIDFromHex(id)
+func (db *MongoDatabase) DeleteFlows(ctx context.Context, ids []string) (int, error) {
+	objIDs := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		if objID, err := primitive.ObjectIDFromHex(id); err == nil {
+			objIDs = append(objIDs, objID)
+		}
+	}
+	if len(objIDs) == 0 {
+		return 0, nil
+	}
+	res, err := db.flows().DeleteMany(ctx, bson.M{"_id": bson.M{"$in": objIDs}})
 	if err != nil {
-		return nil, err
+		return 0, fmt.Errorf("failed to delete flows: %v", err)
 	}
-	var flow FlowEntry
-	if err := collection.FindOne(context.TODO(), bson.M{"_id": objID}).Decode(&flow); err != nil {
+	return int(res.DeletedCount), nil
+}
+
+func ConnectMongo(uri string) (*MongoDatabase, error) {
+	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MongoDB: %v", err)
+	}
+
+	if err := client.Ping(context.TODO(), readpref.Primary()); err != nil {
+		client.Disconnect(context.TODO())
+		return nil, fmt.Errorf("failed to ping MongoDB: %v", err)
+	}
+
+	return newMongoNamespace(client, DefaultNamespace), nil
+}
+
+func (db *MongoDatabase) Namespace() string {
+	return db.name
+}
+
+// WithNamespace returns a handle on another MongoDB database.
+func (db *MongoDatabase) WithNamespace(name string) (Database, error) {
+	if err := ValidateNamespace(name); err != nil {
 		return nil, err
 	}
+	return newMongoNamespace(db.client, name), nil
+}
 
-	// Attach signatures if present (unchanged)
-	if len(flow.Suricata) > 0 {
-		sigColl := db.client.Database("pcap").Collection("signatures")
-		var sigs []Signature
-		for _, sigID := range flow.Suricata {
-			var sig Signature
-			err := sigColl.FindOne(context.TODO(), bson.M{"id": sigID}).Decode(&sig)
-			if err == nil {
-				sigs = append(sigs, sig)
-			}
+// ListNamespaces returns the databases containing flows or tags, skipping
+// the ones used by MongoDB itself and by other applications.
+func (db *MongoDatabase) ListNamespaces(ctx context.Context) ([]string, error) {
+	names, err := db.client.ListDatabaseNames(ctx, bson.M{"name": bson.M{"$nin": bson.A{"admin", "config", "local"}}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list databases: %v", err)
+	}
+
+	namespaces := make([]string, 0, len(names))
+	for _, name := range names {
+		if ValidateNamespace(name) != nil {
+			continue
+		}
+		collections, err := db.client.Database(name).ListCollectionNames(ctx,
+			bson.M{"name": bson.M{"$in": bson.A{"pcap", "tags"}}})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list collections of %s: %v", name, err)
+		}
+		if len(collections) > 0 {
+			namespaces = append(namespaces, name)
 		}
-		// Optionally, you can add a Signatures field to FlowEntry to hold these
-		// For now, just ignore if not present in struct
 	}
+	slices.Sort(namespaces)
+	return namespaces, nil
+}
 
-	return &flow, nil
+// Close disconnects from MongoDB.
+func (db *MongoDatabase) Close(ctx context.Context) error {
+	return db.client.Disconnect(ctx)
 }
 
-// --- helpers for filter conversion ---
-func toInt(v any) (int, error) {
-	switch t := v.(type) {
-	case int:
-		return t, nil
-	case int32:
-		return int(t), nil
-	case int64:
-		return int(t), nil
-	case float64:
-		return int(t), nil
-	case string:
-		return strconv.Atoi(t)
-	default:
-		return 0, fmt.Errorf("not an int: %v", v)
+func (db *MongoDatabase) ConfigureDatabase(ctx context.Context) error {
+	for _, tag := range DefaultTags {
+		if err := db.InsertTag(ctx, tag); err != nil {
+			return err
+		}
+	}
+	if err := db.ConfigureIndexes(ctx); err != nil {
+		return err
+	}
+
+	// record the version of a new namespace, see GetSchemaVersion
+	version, err := db.GetSchemaVersion(ctx)
+	if err != nil || version != SchemaVersion {
+		return err
 	}
+	return db.setSchemaVersion(ctx, SchemaVersion)
 }
 
-func ConnectMongo(uri string) (MongoDatabase, error) {
-	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(uri))
+// GetSchemaVersion returns the version recorded in the "schema" collection. A
+// namespace without it is new if it has no flows, otherwise its flows were
+// stored before versions were recorded (version 1).
+func (db *MongoDatabase) GetSchemaVersion(ctx context.Context) (int, error) {
+	var doc struct {
+		Version int `bson:"version"`
+	}
+	err := db.collection("schema").FindOne(ctx, bson.M{"_id": "version"}).Decode(&doc)
+	if err == nil {
+		return doc.Version, nil
+	} else if !errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, fmt.Errorf("failed to read schema version: %v", err)
+	}
+
+	n, err := db.flows().CountDocuments(ctx, bson.M{}, options.Count().SetLimit(1))
 	if err != nil {
-		return MongoDatabase{}, fmt.Errorf("failed to connect to MongoDB: %v", err)
+		return 0, fmt.Errorf("failed to count flows: %v", err)
 	}
+	if n == 0 {
+		return SchemaVersion, nil
+	}
+	return 1, nil
+}
 
-	if err := client.Ping(context.TODO(), readpref.Primary()); err != nil {
-		client.Disconnect(context.TODO())
-		return MongoDatabase{}, fmt.Errorf("failed to ping MongoDB: %v", err)
+func (db *MongoDatabase) setSchemaVersion(ctx context.Context, version int) error {
+	_, err := db.collection("schema").UpdateOne(ctx, bson.M{"_id": "version"},
+		bson.M{"$set": bson.M{"version": version}}, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to record schema version: %v", err)
 	}
+	return nil
+}
 
-	return MongoDatabase{
-		client: client,
-	}, nil
+// mongoDefaults are the values of the flow fields missing from version 1
+// documents, added over time.
+var mongoDefaults = bson.M{
+	"num_packets":  0,
+	"blocked":      false,
+	"filename":     "",
+	"parent_id":    primitive.NilObjectID,
+	"child_id":     primitive.NilObjectID,
+	"fingerprints": bson.A{},
+	"suricata":     bson.A{},
+	"tags":         bson.A{},
+	"size":         0,
+	"flags":        bson.A{},
+	"flagids":      bson.A{},
+	"tick":         -1,
+	"service":      "",
 }
 
-func (db MongoDatabase) ConfigureDatabase() {
-	db.InsertTag("flag-in")
-	db.InsertTag("flag-out")
-	db.InsertTag("blocked")
-	db.InsertTag("suricata")
-	db.InsertTag("starred")
-	db.InsertTag("flagid")
-	db.InsertTag("tcp")
-	db.InsertTag("udp")
-	db.ConfigureIndexes()
+// Migrate upgrades the namespace to SchemaVersion. The fields of tags added
+// in version 3, and the app and vars of flows added in versions 6 and 7, are
+// read as empty when missing, so there is nothing to do.
+func (db *MongoDatabase) Migrate(ctx context.Context) error {
+	version, err := db.GetSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if version > SchemaVersion {
+		return &SchemaError{Namespace: db.name, Version: version}
+	}
+
+	if version < 2 {
+		if err := db.migrateV2(ctx); err != nil {
+			return err
+		}
+	}
+	// before the unique index on the signatures
+	if version < 4 {
+		if err := db.migrateV4(ctx); err != nil {
+			return err
+		}
+	}
+	if version < 5 {
+		if err := db.migrateV5(ctx); err != nil {
+			return err
+		}
+	}
+	if version < 7 {
+		if err := db.migrateV7(ctx); err != nil {
+			return err
+		}
+	}
+	if err := db.ConfigureIndexes(ctx); err != nil {
+		return err
+	}
+	return db.setSchemaVersion(ctx, SchemaVersion)
 }
 
-func (db MongoDatabase) ConfigureIndexes() {
-	// create Index
-	flowCollection := db.client.Database("pcap").Collection("pcap")
+// migrateV2 backfills the missing fields of version 1 flows, then compresses
+// their payloads and indexes their trigrams, dropping raw.
+func (db *MongoDatabase) migrateV2(ctx context.Context) error {
+	for field, value := range mongoDefaults {
+		// also matches null, which nil slices were stored as
+		if _, err := db.flows().UpdateMany(ctx, bson.M{field: nil}, bson.M{"$set": bson.M{field: value}}); err != nil {
+			return fmt.Errorf("failed to backfill %s: %v", field, err)
+		}
+	}
+
+	// flows stored since the trigram index always have the field, null
+	// when they are not indexed
+	cursor, err := db.flows().Find(ctx, bson.M{"ngrams": bson.M{"$exists": false}})
+	if err != nil {
+		return fmt.Errorf("failed to find flows: %v", err)
+	}
+	defer cursor.Close(ctx)
 
-	_, err := flowCollection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
-		// time index (range filtering)
-		{Keys: bson.D{{Key: "time", Value: 1}}},
-		// data index (context filtering)
-		{Keys: bson.D{{Key: "data", Value: "text"}}},
+	for cursor.Next(ctx) {
+		var doc mongoFlow
+		if err := cursor.Decode(&doc); err != nil {
+			return fmt.Errorf("failed to decode flow: %v", err)
+		}
+		flow, err := db.decodeFlow(ctx, &doc)
+		if err != nil {
+			return err
+		}
+		if flow.Size == 0 {
+			for _, item := range flow.Flow {
+				flow.Size += len(item.Data)
+			}
+		}
+		encoded, err := db.encodeFlow(ctx, flow)
+		if err != nil {
+			return err
+		}
+		if _, err := db.flows().ReplaceOne(ctx, bson.M{"_id": flow.Id}, encoded); err != nil {
+			return fmt.Errorf("failed to update flow %s: %v", flow.Id.Hex(), err)
+		}
+	}
+	return cursor.Err()
+}
+
+// migrateV4 backfills the new fields of the signatures. Older signatures have
+// no revision: the ones of a sid get negative revisions in the order they
+// were stored, -1 for the last one. The hits are counted from the flows, one
+// per flow.
+func (db *MongoDatabase) migrateV4(ctx context.Context) error {
+	signatures := db.collection("signatures")
+	for field, value := range map[string]any{"gid": 1, "tag": "", "severity": 0, "category": ""} {
+		if _, err := signatures.UpdateMany(ctx, bson.M{field: nil}, bson.M{"$set": bson.M{field: value}}); err != nil {
+			return fmt.Errorf("failed to backfill signature %s: %v", field, err)
+		}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "id", Value: 1}, {Key: "_id", Value: 1}}).SetProjection(bson.M{"id": 1})
+	cur, err := signatures.Find(ctx, bson.M{"rev": nil}, opts)
+	if err != nil {
+		return fmt.Errorf("failed to find signatures: %v", err)
+	}
+	var legacy []Signature
+	if err := cur.All(ctx, &legacy); err != nil {
+		return fmt.Errorf("failed to decode signatures: %v", err)
+	}
+	for start := 0; start < len(legacy); {
+		end := start + 1
+		for end < len(legacy) && legacy[end].ID == legacy[start].ID {
+			end++
+		}
+		for i := start; i < end; i++ {
+			rev := i - end
+			if _, err := signatures.UpdateOne(ctx, bson.M{"_id": legacy[i].MongoID}, bson.M{"$set": bson.M{"rev": rev}}); err != nil {
+				return fmt.Errorf("failed to update signature %s: %v", legacy[i].MongoID.Hex(), err)
+			}
+		}
+		start = end
+	}
+
+	hits := db.collection("signature_hits")
+	if _, err := hits.DeleteMany(ctx, bson.M{}); err != nil {
+		return fmt.Errorf("failed to clear signature hits: %v", err)
+	}
+	cur, err = db.flows().Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$unwind", Value: "$suricata"}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.M{"signature": "$suricata", "tick": bson.M{"$max": bson.A{"$tick", -1}}}},
+			{Key: "hits", Value: bson.M{"$sum": 1}},
+		}}},
+		{{Key: "$project", Value: bson.M{"_id": 0, "signature": "$_id.signature", "tick": "$_id.tick", "hits": 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to count signature hits: %v", err)
+	}
+	var counts []any
+	if err := cur.All(ctx, &counts); err != nil {
+		return fmt.Errorf("failed to count signature hits: %v", err)
+	}
+	if len(counts) > 0 {
+		if _, err := hits.InsertMany(ctx, counts); err != nil {
+			return fmt.Errorf("failed to store signature hits: %v", err)
+		}
+	}
+	return nil
+}
+
+// migrateV5 computes the Community ID of the flows stored without one.
+func (db *MongoDatabase) migrateV5(ctx context.Context) error {
+	opts := options.Find().SetProjection(bson.M{"src_ip": 1, "src_port": 1, "dst_ip": 1, "dst_port": 1, "tags": 1})
+	cursor, err := db.flows().Find(ctx, bson.M{"community_id": nil}, opts)
+	if err != nil {
+		return fmt.Errorf("failed to find flows: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var flow FlowEntry
+		if err := cursor.Decode(&flow); err != nil {
+			return fmt.Errorf("failed to decode flow: %v", err)
+		}
+		update := bson.M{"$set": bson.M{"community_id": flowCommunityID(flow)}}
+		if _, err := db.flows().UpdateOne(ctx, bson.M{"_id": flow.Id}, update); err != nil {
+			return fmt.Errorf("failed to update flow %s: %v", flow.Id.Hex(), err)
+		}
+	}
+	return cursor.Err()
+}
+
+// migrateV7 turns the tag of the signatures into the tags of version 7.
+func (db *MongoDatabase) migrateV7(ctx context.Context) error {
+	_, err := db.collection("signatures").UpdateMany(ctx, bson.M{"tag": bson.M{"$exists": true}}, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"tags": bson.M{"$cond": bson.A{
+			bson.M{"$in": bson.A{"$tag", bson.A{"", nil}}}, bson.A{}, bson.A{"$tag"},
+		}}}}},
+		{{Key: "$unset", Value: "tag"}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to migrate signature tags: %v", err)
+	}
+	return nil
+}
+
+func (db *MongoDatabase) ConfigureIndexes(ctx context.Context) error {
+	// older versions had text indexes on the payloads, which are now
+	// compressed and searched with the trigram index, and a time index
+	// without the _id order of GetFlows
+	for _, name := range []string{"data_text", "flow_data_text", "time_1"} {
+		if _, err := db.flows().Indexes().DropOne(ctx, name); err != nil {
+			var cmdErr mongo.CommandError
+			if !errors.As(err, &cmdErr) || (cmdErr.Name != "IndexNotFound" && cmdErr.Name != "NamespaceNotFound") {
+				return fmt.Errorf("failed to drop the old %s index: %v", name, err)
+			}
+		}
+	}
+
+	_, err := db.flows().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		// time index (range filtering and the order of GetFlows)
+		{Keys: bson.D{{Key: "time", Value: 1}, {Key: "_id", Value: 1}}},
+		// payload trigram index (substring and full-text search)
+		{Keys: bson.D{{Key: "ngrams", Value: 1}}},
 		// port combo index (traffic correlation)
 		{Keys: bson.D{{Key: "src_port", Value: 1}, {Key: "dst_port", Value: 1}}},
+		// game tick index (tick filtering)
+		{Keys: bson.D{{Key: "tick", Value: 1}}},
+		// service index (service filtering, newest first)
+		{Keys: bson.D{{Key: "service", Value: 1}, {Key: "time", Value: -1}}},
+		// community id index (alert correlation, newest first)
+		{Keys: bson.D{{Key: "community_id", Value: 1}, {Key: "time", Value: -1}}},
+		// app-layer indexes (hostname, JA3 and file hash filtering)
+		{Keys: bson.D{{Key: "app.hostnames", Value: 1}}},
+		{Keys: bson.D{{Key: "app.ja3", Value: 1}}},
+		{Keys: bson.D{{Key: "app.file_hashes", Value: 1}}},
 	})
+	if err != nil {
+		return fmt.Errorf("failed to create indexes: %v", err)
+	}
 
+	// signatures are upserted on these keys, the unique indexes make the
+	// upserts atomic
+	_, err = db.collection("signatures").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "gid", Value: 1}, {Key: "id", Value: 1}, {Key: "rev", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
 	if err != nil {
-		fmt.Println("Error creating indexes:", err)
-		panic(err)
+		return fmt.Errorf("failed to create signature index: %v", err)
 	}
+	_, err = db.collection("signature_hits").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "signature", Value: 1}, {Key: "tick", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create signature hits index: %v", err)
+	}
+	return nil
 }
 
 // Flows are either coming from a file, in which case we'll dedupe them by pcap file name.
@@ -271,24 +662,11 @@ func (db MongoDatabase) ConfigureIndexes() {
 // We can always swap this out with something better, but this is how flower currently handles deduping.
 //
 // A single flow is defined by a db.FlowEntry" struct, containing an array of flowitems and some metadata
-func (db MongoDatabase) InsertFlow(flow FlowEntry) {
-	flowCollection := db.client.Database("pcap").Collection("pcap")
+func (db *MongoDatabase) InsertFlow(ctx context.Context, flow FlowEntry) error {
+	flowCollection := db.flows()
 
 	// Process the data, so it works well in mongodb
-	for idx := range flow.Flow {
-		flowItem := &flow.Flow[idx]
-
-		flowItem.Raw = []byte(flowItem.Data)
-
-		// filter the data string down to only printable characters
-		newRaw := make([]byte, 0, len(flowItem.Data))
-		for i := 0; i < len(flowItem.Data); i++ {
-			if flowItem.Data[i] >= 32 && flowItem.Data[i] <= 126 {
-				newRaw = append(newRaw, flowItem.Data[i])
-			}
-		}
-		flowItem.Raw = newRaw
-	}
+	prepareFlow(&flow)
 
 	if len(flow.Fingerprints) > 0 {
 		query := bson.M{
@@ -302,9 +680,8 @@ func (db MongoDatabase) InsertFlow(flow FlowEntry) {
 			MongoID primitive.ObjectID `bson:"_id"`
 		}
 
-		// TODO does this return the first one? If multiple documents satisfy the given query expression, then this method will return the first document according to the natural order which reflects the order of documents on the disk.
 		connFlow := connectedFlow{}
-		err := flowCollection.FindOne(context.TODO(), query, opts).Decode(&connFlow)
+		err := flowCollection.FindOne(ctx, query, opts).Decode(&connFlow)
 
 		// There is a connected flow
 		if err == nil {
@@ -313,109 +690,182 @@ func (db MongoDatabase) InsertFlow(flow FlowEntry) {
 		}
 	}
 
-	// TODO; use insertMany instead
-	insertion, err := flowCollection.InsertOne(context.TODO(), flow)
+	doc, err := db.encodeFlow(ctx, flow)
 	if err != nil {
-		log.Println("Error occured while inserting record: ", err)
-		log.Println("NO PCAP DATA WILL BE AVAILABLE FOR: ", flow.Filename)
+		return err
+	}
+	insertion, err := flowCollection.InsertOne(ctx, doc)
+	if err != nil {
+		return fmt.Errorf("failed to insert flow: %v", err)
 	}
 
 	if flow.ChildId == primitive.NilObjectID {
-		return
+		return nil
 	}
 
 	query := bson.M{"_id": flow.ChildId}
-
 	info := bson.M{"$set": bson.M{"parent_id": insertion.InsertedID}}
+	if _, err = flowCollection.UpdateOne(ctx, query, info); err != nil {
+		return fmt.Errorf("failed to link flow to its child: %v", err)
+	}
+	return nil
+}
 
-	_, err = flowCollection.UpdateOne(context.TODO(), query, info)
-	//TODO error handling
+// encodeFlow compresses the payloads of a flow and indexes their trigrams.
+func (db *MongoDatabase) encodeFlow(ctx context.Context, flow FlowEntry) (*mongoFlow, error) {
+	dictID, compressed, err := db.codec.compress(ctx, flow.Service, flow.Flow)
 	if err != nil {
-		log.Println("Error occured while updating record: ", err)
+		return nil, err
 	}
+
+	doc := &mongoFlow{FlowEntry: flow, Dict: dictID, Flow: make([]mongoItem, len(flow.Flow))}
+	for i, item := range flow.Flow {
+		doc.Flow[i] = mongoItem{From: item.From, Time: item.Time}
+		if len(compressed[i]) < len(item.Data) {
+			doc.Flow[i].Z = compressed[i]
+		} else {
+			doc.Flow[i].Data = item.Data
+		}
+	}
+	if trigrams, ok := flowTrigrams(flow.Flow); ok {
+		doc.Ngrams = trigrams
+	}
+	return doc, nil
 }
 
-type PcapFile struct {
-	FileName string `bson:"file_name"` // Name of the pcap file
-	Position int64  `bson:"position"`  // N. of packets processed so far
-	Finished bool   `bson:"finished"`  // Indicates if the pcap file has been fully processed
+// decodeFlow decompresses the payloads of a stored flow.
+func (db *MongoDatabase) decodeFlow(ctx context.Context, doc *mongoFlow) (FlowEntry, error) {
+	flow := doc.FlowEntry
+	flow.Flow = make([]FlowItem, len(doc.Flow))
+	for i, item := range doc.Flow {
+		data := item.Data
+		if item.Z != nil {
+			decompressed, err := db.codec.decompress(ctx, doc.Dict, item.Z)
+			if err != nil {
+				return flow, fmt.Errorf("flow %s: %v", flow.Id.Hex(), err)
+			}
+			data = string(decompressed)
+		}
+		flow.Flow[i] = FlowItem{From: item.From, Data: data, Raw: []byte(data), Time: item.Time}
+	}
+	return flow, nil
 }
 
-// Insert a new pcap uri, returns true if the pcap was not present yet,
-// otherwise returns false
-func (db MongoDatabase) InsertPcap(pcap PcapFile) bool {
-	files := db.client.Database("pcap").Collection("filesImported")
+func (db *MongoDatabase) loadDict(ctx context.Context, id uint32) ([]byte, error) {
+	var doc struct {
+		Dict []byte `bson:"dict"`
+	}
+	err := db.collection("dictionaries").FindOne(ctx, bson.M{"_id": int64(id)}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	return doc.Dict, err
+}
 
-	// it could already be present, so let's update it
-	filter := bson.M{"file_name": pcap.FileName}
+func (db *MongoDatabase) latestDict(ctx context.Context, service string) (uint32, []byte, error) {
+	var doc struct {
+		ID   int64  `bson:"_id"`
+		Dict []byte `bson:"dict"`
+	}
+	opts := options.FindOne().SetSort(bson.M{"time": -1})
+	err := db.collection("dictionaries").FindOne(ctx, bson.M{"service": service}, opts).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil, ErrNotFound
+	}
+	return uint32(doc.ID), doc.Dict, err
+}
+
+func (db *MongoDatabase) saveDict(ctx context.Context, id uint32, service string, dict []byte) error {
+	_, err := db.collection("dictionaries").InsertOne(ctx, bson.M{
+		"_id": int64(id), "service": service, "dict": dict, "time": time.Now().UnixMilli(),
+	})
+	return err
+}
 
-	_, err := files.ReplaceOne(context.TODO(), filter, pcap, options.Replace().SetUpsert(true))
+// InsertPcap inserts a new pcap file, or updates it if it is already present
+func (db *MongoDatabase) InsertPcap(ctx context.Context, pcap PcapFile) error {
+	filter := bson.M{"file_name": pcap.FileName}
+	_, err := db.collection("filesImported").ReplaceOne(ctx, filter, pcap, options.Replace().SetUpsert(true))
 	if err != nil {
-		log.Println("Error occured while inserting pcap file: ", err)
-		return false
+		return fmt.Errorf("failed to insert pcap file: %v", err)
 	}
-	return true
+	return nil
 }
 
-func (db MongoDatabase) GetPcap(uri string) (bool, PcapFile) {
-	files := db.client.Database("pcap").Collection("filesImported")
+func (db *MongoDatabase) GetPcap(ctx context.Context, name string) (PcapFile, error) {
 	var result PcapFile
-	match := files.FindOne(context.TODO(), bson.M{"file_name": uri})
-	match.Decode(&result)
-	return match.Err() != mongo.ErrNoDocuments, result
+	err := db.collection("filesImported").FindOne(ctx, bson.M{"file_name": name}).Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return result, ErrNotFound
+	}
+	return result, err
 }
 
-type FlowID struct {
-	Src_port int
-	Dst_port int
-	Src_ip   string
-	Dst_ip   string
-	Time     time.Time
+func (db *MongoDatabase) AddDeadLetter(ctx context.Context, letter DeadLetter) error {
+	letter.MongoID = primitive.NilObjectID
+	if _, err := db.collection("dead_letters").InsertOne(ctx, letter); err != nil {
+		return fmt.Errorf("failed to insert dead letter: %v", err)
+	}
+	return nil
 }
 
-type Signature struct {
-	MongoID primitive.ObjectID `bson:"_id,omitempty"`
-	ID      int
-	Msg     string
-	Action  string
-	Tag     string `bson:"omitempty"`
-}
+func (db *MongoDatabase) GetDeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) {
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(int64(max(limit, 0)))
+	cur, err := db.collection("dead_letters").Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find dead letters: %v", err)
+	}
+	defer cur.Close(ctx)
 
-func (db MongoDatabase) AddSignature(sig Signature) string {
-	sigCollection := db.client.Database("pcap").Collection("signatures")
+	letters := make([]DeadLetter, 0)
+	if err := cur.All(ctx, &letters); err != nil {
+		return nil, fmt.Errorf("failed to decode dead letters: %v", err)
+	}
+	return letters, nil
+}
 
-	// TODO; there's a bit of a race here, but I'm also racing to get this code working in time
-	// for the next demo, so it all evens out.
+// GetPcapList returns all the pcap files imported so far.
+func (db *MongoDatabase) GetPcapList(ctx context.Context) ([]PcapFile, error) {
+	cur, err := db.collection("filesImported").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find pcap files: %v", err)
+	}
+	defer cur.Close(ctx)
 
-	query := bson.M{
-		"id":     sig.ID,
-		"msg":    sig.Msg,
-		"action": sig.Action,
-		"tag":    sig.Tag,
+	results := make([]PcapFile, 0)
+	if err := cur.All(ctx, &results); err != nil {
+		return nil, fmt.Errorf("failed to decode pcap files: %v", err)
 	}
+	return results, nil
+}
 
-	var existing_sig Signature
-	err := sigCollection.FindOne(context.TODO(), query).Decode(&existing_sig)
-	if err != nil {
-		// The signature does not appear in the DB yet. Let's add it.
-		res, err := sigCollection.InsertOne(context.TODO(), query)
-		if err != nil {
-			log.Println("Rule add failed with error: ", err)
-			return ""
-		}
-		ret := res.InsertedID.(primitive.ObjectID)
-		return ret.Hex()
-	} else {
-		// The signature _does_ appear in the db. Let's return it's ID directly!
-		return existing_sig.MongoID.Hex()
+// AddSignature stores a signature, updating the document with the same gid,
+// sid and rev if any, and returns its ID.
+func (db *MongoDatabase) AddSignature(ctx context.Context, sig Signature) (string, error) {
+	filter := bson.M{"gid": sig.GID, "id": sig.ID, "rev": sig.Rev}
+	update := bson.M{"$set": bson.M{
+		"msg":      sig.Msg,
+		"action":   sig.Action,
+		"tags":     nonNil(sig.Tags),
+		"severity": sig.Severity,
+		"category": sig.Category,
+	}}
+	opts := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.After).
+		SetProjection(bson.M{"_id": 1})
+
+	var stored Signature
+	if err := db.collection("signatures").FindOneAndUpdate(ctx, filter, update, opts).Decode(&stored); err != nil {
+		return "", fmt.Errorf("failed to insert signature: %v", err)
 	}
+	return stored.MongoID.Hex(), nil
 }
 
-func (db MongoDatabase) findFlowInDB(flow FlowID, window int) (mongo.Collection, bson.M) {
-	// Find a flow that more or less matches the one we're looking for
-	flowCollection := db.client.Database("pcap").Collection("pcap")
-	epoch := int(flow.Time.UnixNano() / 1000000)
-	filter := bson.M{
+// flowIDFilter matches the flows that more or less match the one we're looking for
+func flowIDFilter(flow FlowID, window int) bson.M {
+	epoch := int(flow.Time.UnixMilli())
+	return bson.M{
 		"src_port": flow.Src_port,
 		"dst_port": flow.Dst_port,
 		"src_ip":   flow.Src_ip,
@@ -425,71 +875,108 @@ func (db MongoDatabase) findFlowInDB(flow FlowID, window int) (mongo.Collection,
 			"$lt": epoch + window,
 		},
 	}
+}
 
-	return *flowCollection, filter
+// communityIDFilter matches the flows with the Community ID of flow that were
+// in progress at its time, give or take window
+func communityIDFilter(flow FlowID, window int) bson.M {
+	epoch := int(flow.Time.UnixMilli())
+	return bson.M{
+		"community_id": flow.CommunityID,
+		"time":         bson.M{"$lt": epoch + window},
+		"$expr": bson.M{
+			"$gt": bson.A{bson.M{"$add": bson.A{"$time", "$duration"}}, epoch - window},
+		},
+	}
 }
 
-func (db MongoDatabase) updateFlowInDB(flowCollection mongo.Collection, filter bson.M, update bson.M) bool {
-	// Enrich the flow with tag information
-	res, err := flowCollection.UpdateOne(context.TODO(), filter, update)
-	if err != nil {
-		log.Println("Error occured while editing record:", err)
-		return false
+// flowPreImage is the part of a flow updateFlow returns, as it was before the
+// update.
+type flowPreImage struct {
+	Tick     int      `bson:"tick"`
+	Suricata []string `bson:"suricata"`
+}
+
+// updateFlow applies update to the flow matching flow and returns it as it
+// was before, reporting whether one was found. The latest flow with the
+// Community ID of flow is preferred, the 5-tuple is only matched when there
+// is none.
+func (db *MongoDatabase) updateFlow(ctx context.Context, flow FlowID, window int, update any) (flowPreImage, bool, error) {
+	var before flowPreImage
+	projection := bson.M{"tick": 1, "suricata": 1}
+	opts := options.FindOneAndUpdate().SetProjection(projection)
+
+	if flow.CommunityID != "" {
+		latest := options.FindOneAndUpdate().SetProjection(projection).SetSort(bson.M{"time": -1})
+		err := db.flows().FindOneAndUpdate(ctx, communityIDFilter(flow, window), update, latest).Decode(&before)
+		if err == nil {
+			return before, true, nil
+		} else if !errors.Is(err, mongo.ErrNoDocuments) {
+			return before, false, fmt.Errorf("failed to update flow: %v", err)
+		}
 	}
 
-	return res.MatchedCount > 0
+	err := db.flows().FindOneAndUpdate(ctx, flowIDFilter(flow, window), update, opts).Decode(&before)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return before, false, nil
+	} else if err != nil {
+		return before, false, fmt.Errorf("failed to update flow: %v", err)
+	}
+	return before, true, nil
 }
 
-func (db MongoDatabase) AddSignatureToFlow(flow FlowID, sig Signature, window int) bool {
+func (db *MongoDatabase) AddSignatureToFlow(ctx context.Context, flow FlowID, sig Signature, window int) (bool, error) {
 	// Add the signature to the collection
-	sig_id := db.AddSignature(sig)
-	if sig_id == "" {
-		return false
+	sigID, err := db.AddSignature(ctx, sig)
+	if err != nil {
+		return false, err
 	}
 
 	tags := []string{"suricata"}
-	flowCollection, filter := db.findFlowInDB(flow, window)
 
-	// Add tag from the signature if it contained one
-	if sig.Tag != "" {
-		db.InsertTag(sig.Tag)
-		tags = append(tags, sig.Tag)
+	// Add the tags of the signature
+	for _, tag := range sig.Tags {
+		if err := db.InsertTag(ctx, Tag{Name: tag}); err != nil {
+			return false, err
+		}
+		tags = append(tags, tag)
 	}
 
-	var update bson.M
-	// TODO; This can probably be done more elegantly, right?
+	update := bson.M{}
 	if sig.Action == "blocked" {
-		update = bson.M{
-			"$set": bson.M{
-				"blocked": true,
-			},
-			"$addToSet": bson.M{
-				"tags": bson.M{
-					"$each": append(tags, "blocked"),
-				},
-				"suricata": sig_id,
-			},
-		}
-	} else {
-		update = bson.M{
-			"$addToSet": bson.M{
-				"tags": bson.M{
-					"$each": tags,
-				},
-				"suricata": sig_id,
-			},
-		}
+		update["$set"] = bson.M{"blocked": true}
+		tags = append(tags, "blocked")
+	}
+	update["$addToSet"] = bson.M{
+		"tags":     bson.M{"$each": tags},
+		"suricata": sigID,
 	}
 
-	return db.updateFlowInDB(flowCollection, filter, update)
-}
+	before, found, err := db.updateFlow(ctx, flow, window, update)
+	if !found || err != nil {
+		return false, err
+	}
+	if slices.Contains(before.Suricata, sigID) {
+		return true, nil // a redelivered alert is counted once
+	}
 
-func (db MongoDatabase) AddTagsToFlow(flow FlowID, tags []string, window int) bool {
-	flowCollection, filter := db.findFlowInDB(flow, window)
+	// count the alert in the tick of the flow
+	_, err = db.collection("signature_hits").UpdateOne(ctx,
+		bson.M{"signature": sigID, "tick": max(before.Tick, -1)},
+		bson.M{"$inc": bson.M{"hits": 1}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return false, fmt.Errorf("failed to count signature hit: %v", err)
+	}
+	return true, nil
+}
 
+func (db *MongoDatabase) AddTagsToFlow(ctx context.Context, flow FlowID, tags []string, window int) (bool, error) {
 	// Add tags to tag collection
 	for _, tag := range tags {
-		db.InsertTag(tag)
+		if err := db.InsertTag(ctx, Tag{Name: tag}); err != nil {
+			return false, err
+		}
 	}
 
 	// Update this flow with the tags
@@ -500,212 +987,463 @@ func (db MongoDatabase) AddTagsToFlow(flow FlowID, tags []string, window int) bo
 			},
 		},
 	}
-
-	// Apply update to database
-	return db.updateFlowInDB(flowCollection, filter, update)
-
-}
-func (db MongoDatabase) InsertTag(tag string) {
-	tagCollection := db.client.Database("pcap").Collection("tags")
-	// Yeah this will err... A lot.... Two more dev days till Athens, this will do.
-	tagCollection.InsertOne(context.TODO(), bson.M{"_id": tag})
+	_, found, err := db.updateFlow(ctx, flow, window, update)
+	return found, err
 }
 
-type Flagid struct {
-	ID   primitive.ObjectID `bson:"_id"`
-	Time int                `bson:"time"`
-}
-
-func (db MongoDatabase) GetFlagids(flaglifetime int) ([]Flagid, error) {
-	// Create a context with a timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Access the "pcap" database and "flagids" collection
-	collection := db.client.Database("pcap").Collection("flagids")
-
-	// Find all documents in the
-	var filter bson.M
-	if flaglifetime < 0 {
-		filter = bson.M{}
-	} else {
-		filter = bson.M{"time": bson.M{"$gt": int(time.Now().Unix()) - flaglifetime}}
+// AddAppLayerToFlow merges app into the app of the flow with an update
+// pipeline, which appends the missing values and keeps the first
+// maxAppValues of each field.
+func (db *MongoDatabase) AddAppLayerToFlow(ctx context.Context, flow FlowID, app AppLayer, window int) (bool, error) {
+	// the values added must be distinct too
+	var distinct AppLayer
+	distinct.merge(app)
+	app = distinct
+
+	set := bson.M{}
+	add := func(field string, values any, empty bool) {
+		if empty {
+			return
+		}
+		current := bson.M{"$ifNull": bson.A{"$app." + field, bson.A{}}}
+		missing := bson.M{"$filter": bson.M{
+			"input": bson.M{"$literal": values}, // values starting with $ are not field paths
+			"cond":  bson.M{"$not": bson.A{bson.M{"$in": bson.A{"$$this", current}}}},
+		}}
+		set["app."+field] = bson.M{"$slice": bson.A{bson.M{"$concatArrays": bson.A{current, missing}}, maxAppValues}}
 	}
-
-	cur, err := collection.Find(ctx, filter)
-	if err != nil {
-		return nil, fmt.Errorf("failed to find flagids: %v", err)
+	add("protocols", app.Protocols, len(app.Protocols) == 0)
+	add("hostnames", app.Hostnames, len(app.Hostnames) == 0)
+	add("urls", app.URLs, len(app.URLs) == 0)
+	add("statuses", app.Statuses, len(app.Statuses) == 0)
+	add("user_agents", app.UserAgents, len(app.UserAgents) == 0)
+	add("ja3", app.JA3, len(app.JA3) == 0)
+	add("file_hashes", app.FileHashes, len(app.FileHashes) == 0)
+	add("anomalies", app.Anomalies, len(app.Anomalies) == 0)
+	if len(set) == 0 {
+		// nothing to add, only report whether the flow exists
+		set["app"] = bson.M{"$ifNull": bson.A{"$app", bson.M{}}}
 	}
-	defer func() {
-		err := cur.Close(ctx)
-		if err != nil {
-			log.Printf("Failed to close cursor: %v", err)
-		}
-	}()
 
-	var flagids []Flagid
+	_, found, err := db.updateFlow(ctx, flow, window, mongo.Pipeline{{{Key: "$set", Value: set}}})
+	return found, err
+}
 
-	// Iterate through the cursor and extract _id values
-	for cur.Next(ctx) {
-		var flagid Flagid
-		if err := cur.Decode(&flagid); err != nil {
-			return nil, fmt.Errorf("failed to decode flagid: %v", err)
+// AddVarsToFlow keeps the highest value of each flowint with $max. Flowints
+// whose name is not a valid field name are skipped.
+func (db *MongoDatabase) AddVarsToFlow(ctx context.Context, flow FlowID, vars RuleVars, window int) (bool, error) {
+	flowints := bson.M{}
+	for name, value := range vars.Flowints {
+		if name != "" && !strings.ContainsAny(name, ".$") {
+			flowints["vars.flowints."+name] = value
 		}
-		flagids = append(flagids, flagid)
 	}
 
-	if err := cur.Err(); err != nil {
-		return nil, fmt.Errorf("cursor error: %v", err)
+	update := bson.M{}
+	if len(flowints) > 0 {
+		update["$max"] = flowints
+	}
+	if len(vars.Flowvars) > 0 {
+		update["$addToSet"] = bson.M{"vars.flowvars": bson.M{"$each": vars.Flowvars}}
+	}
+	if len(update) == 0 {
+		// nothing to add, only report whether the flow exists
+		update["$max"] = bson.M{"time": 0}
 	}
 
-	return flagids, nil
+	_, found, err := db.updateFlow(ctx, flow, window, update)
+	return found, err
+}
 
+// InsertTag adds a tag to the tags collection, or fills the empty fields of
+// an existing one. Documents written before version 3 only have an _id.
+func (db *MongoDatabase) InsertTag(ctx context.Context, tag Tag) error {
+	if tag.CreatedAt == 0 {
+		tag.CreatedAt = time.Now().UnixMilli()
+	}
+	// the values are literals, a description may start with '$'
+	fill := func(field string, value, empty any) bson.M {
+		return bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{bson.M{"$ifNull": bson.A{"$" + field, empty}}, empty}},
+			bson.M{"$literal": value},
+			"$" + field,
+		}}
+	}
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"color":       fill("color", tag.Color, ""),
+		"description": fill("description", tag.Description, ""),
+		"origin":      fill("origin", tag.Origin, ""),
+		"created_at":  fill("created_at", tag.CreatedAt, 0),
+	}}}}
+	_, err := db.collection("tags").UpdateOne(ctx, bson.M{"_id": tag.Name}, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to insert tag: %v", err)
+	}
+	return nil
 }
 
-func (db MongoDatabase) GetLastFlows(ctx context.Context, limit int) ([]FlowEntry, error) {
-	collection := db.client.Database("pcap").Collection("pcap")
+// GetTags returns the records of the tags collection for the tags of
+// GetTagList.
+func (db *MongoDatabase) GetTags(ctx context.Context) ([]Tag, error) {
+	names, err := db.GetTagList(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	opts := options.Find().SetSort(bson.M{"time": -1}).SetLimit(int64(limit))
-	cur, err := collection.Find(ctx, bson.M{}, opts)
+	cur, err := db.collection("tags").Find(ctx, bson.M{})
 	if err != nil {
-		return nil, fmt.Errorf("failed to find last flows: %v", err)
+		return nil, fmt.Errorf("failed to find tags: %v", err)
 	}
-	defer cur.Close(ctx)
+	var records []Tag
+	if err := cur.All(ctx, &records); err != nil {
+		return nil, fmt.Errorf("failed to decode tags: %v", err)
+	}
+	return mergeTags(names, records), nil
+}
 
-	var results []FlowEntry
-	for cur.Next(ctx) {
-		var entry FlowEntry
-		if err := cur.Decode(&entry); err == nil {
-			results = append(results, entry)
-		}
+func (db *MongoDatabase) UpdateTag(ctx context.Context, tag Tag) error {
+	if tag.CreatedAt == 0 {
+		tag.CreatedAt = time.Now().UnixMilli()
 	}
-	return results, nil
+	update := bson.M{
+		"$set":         bson.M{"color": tag.Color, "description": tag.Description},
+		"$setOnInsert": bson.M{"origin": tag.Origin, "created_at": tag.CreatedAt},
+	}
+	_, err := db.collection("tags").UpdateOne(ctx, bson.M{"_id": tag.Name}, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to update tag: %v", err)
+	}
+	return nil
 }
 
-type GetFlowsOptions struct {
-	FromTime    int64
-	ToTime      int64
-	IncludeTags []string
-	ExcludeTags []string
-	DstPort     int
-	DstIp       string
-	SrcPort     int
-	SrcIp       string
-	Limit       int
-	Offset      int
-	FlowData    string // Optional data field to filter flows by
+// DeleteTag removes a tag from the tags collection and from the flows.
+func (db *MongoDatabase) DeleteTag(ctx context.Context, name string) error {
+	deleted, err := db.collection("tags").DeleteOne(ctx, bson.M{"_id": name})
+	if err != nil {
+		return fmt.Errorf("failed to delete tag: %v", err)
+	}
+	updated, err := db.flows().UpdateMany(ctx, bson.M{"tags": name}, bson.M{"$pull": bson.M{"tags": name}})
+	if err != nil {
+		return fmt.Errorf("failed to remove tag from flows: %v", err)
+	}
+	if deleted.DeletedCount+updated.ModifiedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
 
-func (db MongoDatabase) GetFlows(ctx context.Context, opts *GetFlowsOptions) ([]FlowEntry, error) {
-	collection := db.client.Database("pcap").Collection("pcap")
+// flowsQuery converts the options of GetFlows to a MongoDB query, and to the
+// filter on the payloads of the flows it returns, nil if there is none.
+func flowsQuery(opts *GetFlowsOptions) (bson.M, *flowFilter, error) {
 	query := bson.M{}
+	if opts == nil {
+		return query, nil, nil
+	}
 
-	findOpts := options.Find().SetSort(bson.M{"time": -1})
+	timeQuery := bson.M{}
+	if opts.FromTime > 0 {
+		timeQuery["$gte"] = opts.FromTime
+	}
+	if opts.ToTime > 0 {
+		timeQuery["$lt"] = opts.ToTime
+	}
+	if len(timeQuery) > 0 {
+		query["time"] = timeQuery
+	}
 
-	if opts != nil {
-		if opts.Limit > 0 {
-			findOpts.SetLimit(int64(opts.Limit))
-		} else {
-			findOpts.SetLimit(100) // Default limit if not specified
-		}
+	portQuery := bson.M{}
+	if opts.DstPort > 0 {
+		portQuery["$eq"] = opts.DstPort
+	}
+	if len(opts.ExcludePorts) > 0 {
+		portQuery["$nin"] = opts.ExcludePorts
+	}
+	if len(portQuery) > 0 {
+		query["dst_port"] = portQuery
+	}
+	if opts.DstIp != "" {
+		query["dst_ip"] = opts.DstIp
+	}
+	if opts.SrcPort > 0 {
+		query["src_port"] = opts.SrcPort
+	}
+	if opts.SrcIp != "" {
+		query["src_ip"] = opts.SrcIp
+	}
 
-		if opts.Offset > 0 {
-			findOpts.SetSkip(int64(opts.Offset))
+	// ranges with optional inclusive bounds
+	for field, bounds := range map[string][2]*int{
+		"tick":        {opts.TickFrom, opts.TickTo},
+		"duration":    {opts.DurationMin, opts.DurationMax},
+		"size":        {opts.SizeMin, opts.SizeMax},
+		"num_packets": {opts.PacketsMin, opts.PacketsMax},
+	} {
+		rangeQuery := bson.M{}
+		if bounds[0] != nil {
+			rangeQuery["$gte"] = *bounds[0]
 		}
-
-		timeQuery := bson.M{}
-		if opts.FromTime > 0 {
-			timeQuery["$gte"] = opts.FromTime
+		if bounds[1] != nil {
+			rangeQuery["$lte"] = *bounds[1]
 		}
-		if opts.ToTime > 0 {
-			timeQuery["$lt"] = opts.ToTime
+		if len(rangeQuery) > 0 {
+			query[field] = rangeQuery
 		}
+	}
+
+	if opts.Service != "" {
+		query["service"] = opts.Service
+	}
 
-		if len(timeQuery) > 0 {
-			query["time"] = timeQuery
+	tagQueries := bson.M{}
+	if len(opts.IncludeTags) > 0 {
+		tagQueries["$all"] = opts.IncludeTags
+	}
+	if len(opts.ExcludeTags) > 0 {
+		tagQueries["$nin"] = opts.ExcludeTags
+	}
+	if len(tagQueries) > 0 {
+		query["tags"] = tagQueries
+	}
+	if len(opts.Flags) > 0 {
+		query["flags"] = bson.M{"$all": opts.Flags}
+	}
+	if len(opts.FlagIds) > 0 {
+		query["flagids"] = bson.M{"$all": opts.FlagIds}
+	}
+
+	for _, filter := range appFilters(opts) {
+		query["app."+filter.field] = filter.value
+	}
+
+	exact := true
+	if opts.Query != nil {
+		var filter bson.M
+		filter, exact = mongoFlowQuery(opts.Query, false)
+		if filter != nil {
+			query["$and"] = bson.A{filter}
 		}
+	}
 
-		if opts.DstPort > 0 {
-			query["dst_port"] = opts.DstPort
+	// payloads are compressed, they are filtered once decompressed. The
+	// trigram index narrows the candidates of substring and full-text
+	// searches, flows that are not indexed are always candidates.
+	var payload *flowFilter
+	if opts.FlowData != "" || opts.Search != "" || len(opts.Contains) > 0 || !exact {
+		filter, err := newFlowFilter(opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		payload = filter
+
+		patterns := [][]byte{opts.Contains}
+		if filter.search != nil {
+			patterns = append(patterns, searchPatterns(filter.search)...)
 		}
-		if opts.DstIp != "" {
-			query["dst_ip"] = opts.DstIp
+		if trigrams := patternTrigrams(patterns...); len(trigrams) > 0 {
+			query["$or"] = bson.A{
+				bson.M{"ngrams": bson.M{"$all": trigrams}},
+				bson.M{"ngrams": nil},
+			}
 		}
-		if opts.SrcPort > 0 {
-			query["src_port"] = opts.SrcPort
+	}
+	return query, payload, nil
+}
+
+// maxPrefixAddresses is the size of the largest CIDR prefix of a flow query
+// matched by listing its addresses.
+const maxPrefixAddresses = 1024
+
+// mongoFlowQuery translates a flow query to a MongoDB filter, or its negation.
+// The conditions MongoDB cannot evaluate, on the compressed payloads or on
+// large CIDR prefixes, are left out: the filter then selects more flows than
+// the query, exact is false and the flows are checked once decoded. A nil
+// filter selects every flow.
+func mongoFlowQuery(q *FlowQuery, negate bool) (filter bson.M, exact bool) {
+	switch q.op {
+	case queryNot:
+		return mongoFlowQuery(q.children[0], !negate)
+	case queryAnd, queryOr:
+		// an and, or a negated or, holds when all its children hold
+		all := (q.op == queryAnd) != negate
+		var filters bson.A
+		exact = true
+		for _, child := range q.children {
+			f, e := mongoFlowQuery(child, negate)
+			exact = exact && e
+			if f == nil {
+				if !all {
+					return nil, false // any flow may match
+				}
+				continue
+			}
+			filters = append(filters, f)
 		}
-		if opts.SrcIp != "" {
-			query["src_ip"] = opts.SrcIp
+		switch {
+		case len(filters) == 0:
+			return nil, false
+		case len(filters) == 1:
+			return filters[0].(bson.M), exact
+		case all:
+			return bson.M{"$and": filters}, exact
+		default:
+			return bson.M{"$or": filters}, exact
 		}
+	}
 
-		tagQueries := bson.M{}
-		if len(opts.IncludeTags) > 0 {
-			tagQueries["$all"] = opts.IncludeTags
+	filter, exact = mongoQueryTerm(q.term)
+	switch {
+	case filter == nil || (negate && !exact):
+		return nil, false
+	case negate:
+		return bson.M{"$nor": bson.A{filter}}, true
+	}
+	return filter, exact
+}
+
+// mongoQueryTerm translates a condition of a flow query, see mongoFlowQuery.
+func mongoQueryTerm(t *queryTerm) (bson.M, bool) {
+	between := bson.M{}
+	if t.lo != nil {
+		between["$gte"] = *t.lo
+	}
+	if t.hi != nil {
+		between["$lte"] = *t.hi
+	}
+
+	switch f := t.field; f.kind {
+	case queryString, queryList:
+		return bson.M{f.key: t.value}, true
+	case queryNumber:
+		return bson.M{f.key: between}, true
+	case queryNumbers:
+		return bson.M{f.key: bson.M{"$elemMatch": between}}, true
+	case queryAddress:
+		prefix := t.prefix
+		if size := prefix.Addr().BitLen() - prefix.Bits(); size < 31 && 1<<size <= maxPrefixAddresses {
+			var addrs bson.A
+			for addr := prefix.Addr(); addr.IsValid() && prefix.Contains(addr); addr = addr.Next() {
+				addrs = append(addrs, addr.String())
+			}
+			return bson.M{f.key: bson.M{"$in": addrs}}, true
 		}
-		if len(opts.ExcludeTags) > 0 {
-			tagQueries["$nin"] = opts.ExcludeTags
+		if prefix.Addr().Is4() && prefix.Bits() >= 8 {
+			// the addresses starting with the whole bytes of the prefix
+			octets := strings.Split(prefix.Addr().String(), ".")[:prefix.Bits()/8]
+			pattern := "^" + regexp.QuoteMeta(strings.Join(octets, ".")+".")
+			return bson.M{f.key: bson.M{"$regex": pattern}}, prefix.Bits()%8 == 0
 		}
-		if len(tagQueries) > 0 {
-			query["tags"] = tagQueries
+	}
+	return nil, false
+}
+
+func (db *MongoDatabase) GetFlows(ctx context.Context, opts *GetFlowsOptions) ([]FlowEntry, error) {
+	query, payload, err := flowsQuery(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	limit, offset := 0, 0
+	if opts != nil {
+		limit, offset = opts.Limit, max(opts.Offset, 0)
+		if limit <= 0 {
+			limit = DefaultFlowsLimit
 		}
+	}
 
-		if opts.FlowData != "" {
-			// Corretto: cerca la regex su tutti i campi 'data' dentro l'array 'flow'
-			query["flow.data"] = bson.M{"$regex": opts.FlowData, "$options": "i"} // Case-insensitive regex match
+	sort := bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}}
+	if opts != nil && opts.Cursor != nil {
+		c := opts.Cursor
+		after := bson.M{"time": bson.M{"$lte": c.Time}, "$or": bson.A{
+			bson.M{"time": bson.M{"$lt": c.Time}},
+			bson.M{"_id": bson.M{"$lt": c.Id}},
+		}}
+		if c.Before {
+			// the page closest to the cursor, reversed below
+			sort = bson.D{{Key: "time", Value: 1}, {Key: "_id", Value: 1}}
+			after = bson.M{"time": bson.M{"$gte": c.Time}, "$or": bson.A{
+				bson.M{"time": bson.M{"$gt": c.Time}},
+				bson.M{"_id": bson.M{"$gt": c.Id}},
+			}}
 		}
+		query = bson.M{"$and": bson.A{query, after}}
 	}
 
-	cur, err := collection.Find(ctx, query, findOpts)
+	findOpts := options.Find().SetSort(sort).SetProjection(withoutNgrams)
+	if payload == nil {
+		findOpts.SetLimit(int64(limit)).SetSkip(int64(offset))
+	}
+	cur, err := db.flows().Find(ctx, query, findOpts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find flows: %v", err)
 	}
 	defer cur.Close(ctx)
 
-	var results []FlowEntry
+	results := make([]FlowEntry, 0)
 	for cur.Next(ctx) {
-		var entry FlowEntry
-		if err := cur.Decode(&entry); err == nil {
-			results = append(results, entry)
+		entry, ok := db.decodeCursor(ctx, cur)
+		if !ok {
+			continue
+		}
+		if payload != nil {
+			if !payload.match(&entry) {
+				continue
+			}
+			if offset > 0 {
+				offset--
+				continue
+			}
+		}
+		results = append(results, entry)
+		if payload != nil && len(results) == limit {
+			break
 		}
 	}
-	return results, nil
+	if opts != nil && opts.Cursor != nil && opts.Cursor.Before {
+		slices.Reverse(results)
+	}
+	return results, cur.Err()
 }
 
-func (db MongoDatabase) GetFlowByID(ctx context.Context, id string) (*FlowEntry, error) {
-	collection := db.client.Database("pcap").Collection("pcap")
+// decodeCursor decodes the current flow of cur, logging the flows that can't
+// be decoded.
+func (db *MongoDatabase) decodeCursor(ctx context.Context, cur *mongo.Cursor) (FlowEntry, bool) {
+	var doc mongoFlow
+	if err := cur.Decode(&doc); err != nil {
+		slog.Error("Failed to decode flow entry", "error", err)
+		return FlowEntry{}, false
+	}
+	entry, err := db.decodeFlow(ctx, &doc)
+	if err != nil {
+		slog.Error("Failed to decode flow entry", "error", err)
+		return FlowEntry{}, false
+	}
+	return entry, true
+}
+
+func (db *MongoDatabase) GetFlowByID(ctx context.Context, id string) (*FlowEntry, error) {
 	objID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
+		return nil, ErrNotFound
+	}
+	var doc mongoFlow
+	err = db.flows().FindOne(ctx, bson.M{"_id": objID}, options.FindOne().SetProjection(withoutNgrams)).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	} else if err != nil {
 		return nil, err
 	}
-	var flow FlowEntry
-	if err := collection.FindOne(ctx, bson.M{"_id": objID}).Decode(&flow); err != nil {
+	flow, err := db.decodeFlow(ctx, &doc)
+	if err != nil {
 		return nil, err
 	}
 	return &flow, nil
 }
 
-// FlagIdEntry rappresenta un flagid estratto dal DB
-// (replica la struct usata in assembler/flagid.go)
-type FlagIdEntry struct {
-	Service     string
-	Team        int
-	Round       int
-	Description string
-	FlagId      string
-}
-
-// GetRecentFlagIds estrae tutti i flagid dal DB (ultimi 5 round, con descrizione)
-func (db MongoDatabase) GetFlagIds() ([]FlagIdEntry, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	col := db.client.Database("pcap").Collection("flagids")
-	filter := bson.M{}
-
-	cur, err := col.Find(ctx, filter)
+// GetFlagIds returns all the flag IDs stored by the flagid service
+func (db *MongoDatabase) GetFlagIds(ctx context.Context) ([]FlagIdEntry, error) {
+	cur, err := db.collection("flagids").Find(ctx, bson.M{})
 	if err != nil {
-		slog.Error("[DEBUG] Errore durante Find in MongoDB", "error", err)
-		return nil, err
+		return nil, fmt.Errorf("failed to find flag ids: %v", err)
 	}
 	defer cur.Close(ctx)
 
@@ -713,31 +1451,17 @@ func (db MongoDatabase) GetFlagIds() ([]FlagIdEntry, error) {
 	for cur.Next(ctx) {
 		var doc bson.M
 		if err := cur.Decode(&doc); err != nil {
-			slog.Error("[DEBUG] Errore nel decode del documento MongoDB", "error", err)
+			slog.Error("Failed to decode flag id", "error", err)
 			continue
 		}
 		entry := FlagIdEntry{}
 		if v, ok := doc["service"].(string); ok {
 			entry.Service = v
 		}
-		switch v := doc["team"].(type) {
-		case int32:
-			entry.Team = int(v)
-		case int64:
-			entry.Team = int(v)
-		case float64:
-			entry.Team = int(v)
-		case int:
+		if v, err := toInt(doc["team"]); err == nil {
 			entry.Team = v
 		}
-		switch v := doc["round"].(type) {
-		case int32:
-			entry.Round = int(v)
-		case int64:
-			entry.Round = int(v)
-		case float64:
-			entry.Round = int(v)
-		case int:
+		if v, err := toInt(doc["round"]); err == nil {
 			entry.Round = v
 		}
 		if v, ok := doc["description"].(string); ok {
@@ -756,6 +1480,38 @@ func (db MongoDatabase) GetFlagIds() ([]FlagIdEntry, error) {
 	return entries, nil
 }
 
-func (db MongoDatabase) GetClient() *mongo.Client {
+// InsertFlagIds stores flag IDs, replacing the ones with the same service,
+// team, round and value, as the flagid service does.
+func (db *MongoDatabase) InsertFlagIds(ctx context.Context, ids []FlagIdEntry) error {
+	col := db.collection("flagids")
+	for _, id := range ids {
+		filter := bson.M{"service": id.Service, "team": id.Team, "round": id.Round, "flagid": id.FlagId}
+		_, err := col.ReplaceOne(ctx, filter, id, options.Replace().SetUpsert(true))
+		if err != nil {
+			return fmt.Errorf("failed to insert flag id: %v", err)
+		}
+	}
+	return nil
+}
+
+// --- helpers for filter conversion ---
+func toInt(v any) (int, error) {
+	switch t := v.(type) {
+	case int:
+		return t, nil
+	case int32:
+		return int(t), nil
+	case int64:
+		return int(t), nil
+	case float64:
+		return int(t), nil
+	case string:
+		return strconv.Atoi(t)
+	default:
+		return 0, fmt.Errorf("not an int: %v", v)
+	}
+}
+
+func (db *MongoDatabase) GetClient() *mongo.Client {
 	return db.client
 }
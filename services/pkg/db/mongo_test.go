@@ -0,0 +1,35 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+// TestMongoDatabase runs the conformance suite against the MongoDB server at
+// TULIP_TEST_MONGO (e.g. mongodb://localhost:27017). The databases of the
+// default and test namespaces are dropped, so never point it to a server in use.
+func TestMongoDatabase(t *testing.T) {
+	uri := os.Getenv("TULIP_TEST_MONGO")
+	if uri == "" {
+		t.Skip("TULIP_TEST_MONGO not set")
+	}
+
+	testConformance(t, func(t *testing.T) Database {
+		database, err := ConnectMongo(uri)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		for _, name := range []string{DefaultNamespace, testNamespace} {
+			if err := database.GetClient().Database(name).Drop(t.Context()); err != nil {
+				t.Fatalf("failed to drop database: %v", err)
+			}
+		}
+		t.Cleanup(func() { database.Close(context.Background()) })
+		return database
+	})
+}
@@ -0,0 +1,194 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Substring search on flow payloads.
+//
+// GetFlowsOptions.Contains finds the flows with a message containing a byte
+// sequence, case-sensitively. The backends keep a trigram index of the
+// payloads: the distinct 3-byte sequences of each flow, with ASCII letters
+// lowercased so that full-text searches can use it too. Only the flows with
+// all the trigrams of the pattern are checked, so substrings of tokens,
+// partial flags and binary data are found without scanning every payload.
+
+// PatternError reports an invalid byte pattern.
+type PatternError struct {
+	Pattern string
+	Pos     int // Byte offset of the error in Pattern
+	Msg     string
+}
+
+func (e *PatternError) Error() string {
+	return fmt.Sprintf("invalid pattern at position %d: %s", e.Pos, e.Msg)
+}
+
+// ParsePattern parses a byte pattern written like the content of a Suricata
+// rule: text, with bytes in hex between pipes.
+//
+//	flag{
+//	|de ad be ef|
+//	GET |2f|flag|0d 0a|
+//
+// A backslash escapes a pipe or a backslash in the text.
+func ParsePattern(pattern string) ([]byte, error) {
+	errorAt := func(pos int, format string, args ...any) error {
+		return &PatternError{Pattern: pattern, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+	}
+
+	var out []byte
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '\\':
+			if i+1 == len(pattern) || (pattern[i+1] != '|' && pattern[i+1] != '\\') {
+				return nil, errorAt(i, `"\" must be followed by "|" or "\"`)
+			}
+			i++
+			out = append(out, pattern[i])
+		case '|':
+			end := strings.IndexByte(pattern[i+1:], '|')
+			if end < 0 {
+				return nil, errorAt(i, "unterminated hex bytes")
+			}
+			hex, err := parseHexBytes(pattern, i+1, i+1+end)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, hex...)
+			i += end + 1
+		default:
+			out = append(out, c)
+		}
+	}
+	if len(out) == 0 {
+		return nil, errorAt(0, "empty pattern")
+	}
+	return out, nil
+}
+
+// parseHexBytes decodes the pairs of hex digits in pattern[start:end],
+// optionally separated by spaces.
+func parseHexBytes(pattern string, start, end int) ([]byte, error) {
+	errorAt := func(pos int, format string, args ...any) error {
+		return &PatternError{Pattern: pattern, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+	}
+
+	var out []byte
+	for i := start; i < end; {
+		if pattern[i] == ' ' {
+			i++
+			continue
+		}
+		if i+1 == end || pattern[i+1] == ' ' {
+			return nil, errorAt(i, "hex bytes need two digits")
+		}
+		b, err := strconv.ParseUint(pattern[i:i+2], 16, 8)
+		if err != nil {
+			return nil, errorAt(i, "invalid hex byte %q", pattern[i:i+2])
+		}
+		out = append(out, byte(b))
+		i += 2
+	}
+	if len(out) == 0 {
+		return nil, errorAt(start, "no hex bytes between pipes")
+	}
+	return out, nil
+}
+
+// containsPattern reports whether a message of the flow contains pattern.
+func containsPattern(items []FlowItem, pattern []byte) bool {
+	substr := string(pattern)
+	return slices.ContainsFunc(items, func(item FlowItem) bool {
+		return strings.Contains(item.Data, substr)
+	})
+}
+
+const (
+	// maxFlowTrigrams caps the trigrams indexed for a flow. Flows with more,
+	// such as large binary transfers, are not indexed and always checked.
+	maxFlowTrigrams = 20000
+	// maxPatternTrigrams caps the trigrams looked up for a pattern, more only
+	// make the lookup slower without excluding many flows.
+	maxPatternTrigrams = 16
+)
+
+// trigram packs 3 bytes, lowercasing ASCII letters.
+func trigram(b []byte) int32 {
+	return int32(lowerASCII(b[0]))<<16 | int32(lowerASCII(b[1]))<<8 | int32(lowerASCII(b[2]))
+}
+
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// flowTrigrams returns the sorted distinct trigrams of the messages of a flow,
+// or false if there are too many to index them.
+func flowTrigrams(items []FlowItem) ([]int32, bool) {
+	seen := map[int32]struct{}{}
+	for _, item := range items {
+		data := []byte(item.Data)
+		for i := 0; i+3 <= len(data); i++ {
+			seen[trigram(data[i:])] = struct{}{}
+			if len(seen) > maxFlowTrigrams {
+				return nil, false
+			}
+		}
+	}
+
+	trigrams := make([]int32, 0, len(seen))
+	for t := range seen {
+		trigrams = append(trigrams, t)
+	}
+	slices.Sort(trigrams)
+	return trigrams, true
+}
+
+// patternTrigrams returns the distinct trigrams every flow containing all the
+// patterns has, spread over the patterns. There are none for patterns shorter
+// than 3 bytes.
+func patternTrigrams(patterns ...[]byte) []int32 {
+	var all []int32
+	for _, pattern := range patterns {
+		for i := 0; i+3 <= len(pattern); i++ {
+			if t := trigram(pattern[i:]); !slices.Contains(all, t) {
+				all = append(all, t)
+			}
+		}
+	}
+	if len(all) <= maxPatternTrigrams {
+		return all
+	}
+
+	picked := make([]int32, maxPatternTrigrams)
+	for i := range picked {
+		picked[i] = all[i*(len(all)-1)/(maxPatternTrigrams-1)]
+	}
+	return picked
+}
+
+// searchPatterns returns the tokens every flow matching the search contains,
+// for patternTrigrams. Tokens with non-ASCII letters are skipped, since only
+// ASCII letters are lowercased in the trigram index.
+func searchPatterns(q *SearchQuery) [][]byte {
+	var tokens [][]byte
+	for _, term := range q.required() {
+		for _, token := range term.tokens {
+			if !strings.ContainsFunc(token, func(r rune) bool { return r >= utf8.RuneSelf }) {
+				tokens = append(tokens, []byte(token))
+			}
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,74 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestParsePattern(t *testing.T) {
+	cases := map[string]string{
+		"flag{":              "flag{",
+		"|de ad be ef|":      "\xde\xad\xbe\xef",
+		"|DEADbeef|":         "\xde\xad\xbe\xef",
+		"GET |2f|flag|0d0a|": "GET /flag\r\n",
+		`a\|b\\c`:            `a|b\c`,
+		" x ":                " x ",
+	}
+	for pattern, want := range cases {
+		got, err := ParsePattern(pattern)
+		if err != nil || string(got) != want {
+			t.Errorf("ParsePattern(%q) = %q, %v; want %q", pattern, got, err, want)
+		}
+	}
+}
+
+func TestParsePattern_Errors(t *testing.T) {
+	cases := map[string]int{
+		"":          0,
+		"a|de ad":   1,
+		"||":        1,
+		"|  |":      1,
+		"x|d|":      2,
+		"x|de f|":   5,
+		"|zz|":      1,
+		"|0x41|":    1,
+		`a\b`:       1,
+		`trailing\`: 8,
+	}
+	for pattern, pos := range cases {
+		_, err := ParsePattern(pattern)
+		var patternErr *PatternError
+		if !errors.As(err, &patternErr) {
+			t.Errorf("ParsePattern(%q) error = %v, want a PatternError", pattern, err)
+			continue
+		}
+		if patternErr.Pos != pos {
+			t.Errorf("ParsePattern(%q) error at %d, want %d (%v)", pattern, patternErr.Pos, pos, err)
+		}
+	}
+}
+
+func TestTrigrams(t *testing.T) {
+	// ASCII letters are lowercased, trigrams do not span messages
+	trigrams, ok := flowTrigrams([]FlowItem{{Data: "abAB"}, {Data: "ab"}, {Data: "bab"}})
+	if want := []int32{trigram([]byte("aba")), trigram([]byte("bab"))}; !ok || !slices.Equal(trigrams, want) {
+		t.Errorf("flowTrigrams = %x, %v; want %x", trigrams, ok, want)
+	}
+
+	// the trigrams looked up cover the whole pattern
+	got := patternTrigrams([]byte("abcdefghijklmnopqrstuvwxyz"))
+	if len(got) != maxPatternTrigrams || got[0] != trigram([]byte("abc")) || got[len(got)-1] != trigram([]byte("xyz")) {
+		t.Errorf("patternTrigrams = %x, want %d trigrams from abc to xyz", got, maxPatternTrigrams)
+	}
+	if got := patternTrigrams([]byte("aaaa")); len(got) != 1 {
+		t.Errorf("patternTrigrams(\"aaaa\") = %x, want one trigram", got)
+	}
+	if got := patternTrigrams([]byte("ab")); len(got) != 0 {
+		t.Errorf("patternTrigrams(\"ab\") = %x, want none", got)
+	}
+}
@@ -0,0 +1,586 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Flow query language.
+//
+// A query is made of conditions on the fields of the flows, see queryFields:
+//
+//	service:web              a field equal to a value
+//	tag:flag-out             a list field holding a value
+//	tick:>40, size:<=1000    a number compared with a value
+//	tick:10..20, size:..500  a number in a range, bounds included and optional
+//	src:10.60.0.0/16         an address in a CIDR prefix, or equal to an address
+//	data:"GET /flag"         a full-text search on the payloads, see ParseSearch
+//	data~"adm.n"             a case-insensitive regex on the payloads
+//	contains:"|00 ff|"       a byte sequence in the payloads, see ParsePattern
+//	a and b, a b             both (and is implicit)
+//	a or b                   either
+//	not a                    not a
+//	(a or b) c               grouping
+//
+// Operators are case-insensitive. Values with spaces, parentheses or quotes
+// are written between double quotes, with \" and \\ for a quote and a
+// backslash. Times are in milliseconds or RFC 3339.
+
+// QueryError reports an invalid flow query.
+type QueryError struct {
+	Query string
+	Pos   int // Byte offset of the error in Query
+	Msg   string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("invalid query at position %d: %s", e.Pos, e.Msg)
+}
+
+type queryKind int
+
+const (
+	queryString  queryKind = iota // a string equal to the value
+	queryList                     // a list of strings holding the value
+	queryNumber                   // a number compared with the value
+	queryNumbers                  // a list of numbers, one compared with the value
+	queryAddress                  // an IP address in a prefix
+	queryPayload                  // the messages of the flow
+)
+
+// queryField is a field of the flows in a query.
+type queryField struct {
+	kind   queryKind
+	key    string // Field in MongoDB
+	sqlite string // Column in SQLite, or the arguments of json_each for lists
+	str    func(flow *FlowEntry) string
+	list   func(flow *FlowEntry) []string
+	num    func(flow *FlowEntry) int
+	nums   func(flow *FlowEntry) []int
+}
+
+func appList(name string, values func(app *AppLayer) []string) *queryField {
+	return &queryField{kind: queryList, key: "app." + name, sqlite: "flows.app, '$." + name + "'",
+		list: func(flow *FlowEntry) []string { return values(&flow.App) }}
+}
+
+func flowList(column string, values func(flow *FlowEntry) []string) *queryField {
+	return &queryField{kind: queryList, key: column, sqlite: "flows." + column, list: values}
+}
+
+func flowNumber(column string, value func(flow *FlowEntry) int) *queryField {
+	return &queryField{kind: queryNumber, key: column, sqlite: column, num: value}
+}
+
+func flowAddress(column string, value func(flow *FlowEntry) string) *queryField {
+	return &queryField{kind: queryAddress, key: column, sqlite: column, str: value}
+}
+
+// queryFields are the fields of the flows that can be queried, by name.
+var queryFields = map[string]*queryField{
+	"service": {kind: queryString, key: "service", sqlite: "service", str: func(f *FlowEntry) string { return f.Service }},
+	"tag":     flowList("tags", func(f *FlowEntry) []string { return f.Tags }),
+	"flag":    flowList("flags", func(f *FlowEntry) []string { return f.Flags }),
+	"flagid":  flowList("flagids", func(f *FlowEntry) []string { return f.Flagids }),
+
+	"src":      flowAddress("src_ip", func(f *FlowEntry) string { return f.SrcIp }),
+	"dst":      flowAddress("dst_ip", func(f *FlowEntry) string { return f.DstIp }),
+	"src_port": flowNumber("src_port", func(f *FlowEntry) int { return f.SrcPort }),
+	"dst_port": flowNumber("dst_port", func(f *FlowEntry) int { return f.DstPort }),
+
+	"time":     flowNumber("time", func(f *FlowEntry) int { return f.Time }),
+	"tick":     flowNumber("tick", func(f *FlowEntry) int { return f.Tick }),
+	"duration": flowNumber("duration", func(f *FlowEntry) int { return f.Duration }),
+	"size":     flowNumber("size", func(f *FlowEntry) int { return f.Size }),
+	"packets":  flowNumber("num_packets", func(f *FlowEntry) int { return f.Num_packets }),
+
+	"protocol":   appList("protocols", func(app *AppLayer) []string { return app.Protocols }),
+	"hostname":   appList("hostnames", func(app *AppLayer) []string { return app.Hostnames }),
+	"url":        appList("urls", func(app *AppLayer) []string { return app.URLs }),
+	"user_agent": appList("user_agents", func(app *AppLayer) []string { return app.UserAgents }),
+	"ja3":        appList("ja3", func(app *AppLayer) []string { return app.JA3 }),
+	"file_hash":  appList("file_hashes", func(app *AppLayer) []string { return app.FileHashes }),
+	"anomaly":    appList("anomalies", func(app *AppLayer) []string { return app.Anomalies }),
+	"http_status": {kind: queryNumbers, key: "app.statuses", sqlite: "flows.app, '$.statuses'",
+		nums: func(f *FlowEntry) []int { return f.App.Statuses }},
+
+	"data":     {kind: queryPayload},
+	"contains": {kind: queryPayload},
+}
+
+func init() {
+	queryFields["src_ip"] = queryFields["src"]
+	queryFields["dst_ip"] = queryFields["dst"]
+}
+
+type queryOp int
+
+const (
+	queryCond queryOp = iota
+	queryAnd
+	queryOr
+	queryNot
+)
+
+// FlowQuery is a parsed flow query, see ParseFlowQuery.
+type FlowQuery struct {
+	op       queryOp
+	term     *queryTerm // queryCond
+	children []*FlowQuery
+}
+
+// queryTerm is a condition on a field.
+type queryTerm struct {
+	field   *queryField
+	value   string         // queryString and queryList, the search or the regex of data
+	lo, hi  *int           // queryNumber and queryNumbers, inclusive
+	prefix  netip.Prefix   // queryAddress
+	search  *SearchQuery   // data:
+	regex   *regexp.Regexp // data~
+	pattern []byte         // contains:
+}
+
+// ParseFlowQuery parses a flow query.
+func ParseFlowQuery(query string) (*FlowQuery, error) {
+	p := &queryParser{query: query}
+	if p.peek().kind == queryTokEOF {
+		return nil, p.errorAt(0, "empty query")
+	}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != queryTokEOF {
+		return nil, p.errorAt(tok.pos, "unexpected %q", tok.text)
+	}
+	return q, nil
+}
+
+type queryTokKind int
+
+const (
+	queryTokEOF queryTokKind = iota
+	queryTokWord
+	queryTokTerm
+	queryTokLParen
+	queryTokRParen
+	queryTokInvalid // with the error in text
+)
+
+type queryTok struct {
+	kind     queryTokKind
+	text     string
+	pos      int
+	field    string // queryTokTerm: name of the field
+	op       string // queryTokTerm: ":", ":>", ":>=", ":<", ":<=" or "~"
+	value    string // queryTokTerm: unquoted value
+	valuePos int    // queryTokTerm: position of the value
+	quoted   bool   // queryTokTerm: the value is between quotes
+}
+
+type queryParser struct {
+	query string
+	pos   int
+	next  *queryTok
+}
+
+func (p *queryParser) errorAt(pos int, format string, args ...any) error {
+	return &QueryError{Query: p.query, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// peek returns the next lexical token without consuming it.
+func (p *queryParser) peek() queryTok {
+	if p.next == nil {
+		tok := p.lex()
+		p.next = &tok
+	}
+	return *p.next
+}
+
+func (p *queryParser) consume() queryTok {
+	tok := p.peek()
+	p.next = nil
+	return tok
+}
+
+func isQueryFieldRune(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func (p *queryParser) lex() queryTok {
+	for p.pos < len(p.query) && unicode.IsSpace(rune(p.query[p.pos])) {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.query) {
+		return queryTok{kind: queryTokEOF, pos: start}
+	}
+
+	switch p.query[p.pos] {
+	case '(':
+		p.pos++
+		return queryTok{kind: queryTokLParen, text: "(", pos: start}
+	case ')':
+		p.pos++
+		return queryTok{kind: queryTokRParen, text: ")", pos: start}
+	case '"':
+		if _, err := p.quoted(); err != "" {
+			return queryTok{kind: queryTokInvalid, text: err, pos: start}
+		}
+		return queryTok{kind: queryTokInvalid, text: "missing field before the quoted value", pos: start}
+	}
+
+	for p.pos < len(p.query) && isQueryFieldRune(p.query[p.pos]) {
+		p.pos++
+	}
+	field := p.query[start:p.pos]
+	op := ""
+	if field != "" && p.pos < len(p.query) && (p.query[p.pos] == ':' || p.query[p.pos] == '~') {
+		op = p.query[p.pos : p.pos+1]
+		p.pos++
+		for _, cmp := range []string{">=", "<=", ">", "<"} {
+			if op == ":" && strings.HasPrefix(p.query[p.pos:], cmp) {
+				op += cmp
+				p.pos += len(cmp)
+				break
+			}
+		}
+	}
+
+	if op == "" {
+		// a word, the operators
+		for p.pos < len(p.query) && !unicode.IsSpace(rune(p.query[p.pos])) && !strings.ContainsRune(`()"`, rune(p.query[p.pos])) {
+			p.pos++
+		}
+		return queryTok{kind: queryTokWord, text: p.query[start:p.pos], pos: start}
+	}
+
+	tok := queryTok{kind: queryTokTerm, pos: start, field: field, op: op, valuePos: p.pos}
+	if p.pos < len(p.query) && p.query[p.pos] == '"' {
+		value, err := p.quoted()
+		if err != "" {
+			return queryTok{kind: queryTokInvalid, text: err, pos: tok.valuePos}
+		}
+		tok.value, tok.quoted = value, true
+	} else {
+		for p.pos < len(p.query) && !unicode.IsSpace(rune(p.query[p.pos])) && !strings.ContainsRune(`()"`, rune(p.query[p.pos])) {
+			p.pos++
+		}
+		tok.value = p.query[tok.valuePos:p.pos]
+	}
+	tok.text = p.query[start:p.pos]
+	return tok
+}
+
+// quoted consumes a quoted value, returning it unescaped or an error message.
+func (p *queryParser) quoted() (string, string) {
+	var b strings.Builder
+	for i := p.pos + 1; i < len(p.query); i++ {
+		switch c := p.query[i]; {
+		case c == '"':
+			p.pos = i + 1
+			return b.String(), ""
+		case c == '\\' && i+1 < len(p.query) && (p.query[i+1] == '"' || p.query[i+1] == '\\'):
+			b.WriteByte(p.query[i+1])
+			i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	p.pos = len(p.query)
+	return "", "unterminated quoted value"
+}
+
+func isQueryOperator(tok queryTok, op string) bool {
+	return tok.kind == queryTokWord && strings.EqualFold(tok.text, op)
+}
+
+func (p *queryParser) parseOr() (*FlowQuery, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	children := []*FlowQuery{left}
+	for isQueryOperator(p.peek(), "or") {
+		p.consume()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, right)
+	}
+	if len(children) == 1 {
+		return left, nil
+	}
+	return &FlowQuery{op: queryOr, children: children}, nil
+}
+
+func (p *queryParser) parseAnd() (*FlowQuery, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	children := []*FlowQuery{left}
+	for {
+		tok := p.peek()
+		if tok.kind == queryTokEOF || tok.kind == queryTokRParen || isQueryOperator(tok, "or") {
+			break
+		}
+		if isQueryOperator(tok, "and") {
+			p.consume()
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, right)
+	}
+	if len(children) == 1 {
+		return left, nil
+	}
+	return &FlowQuery{op: queryAnd, children: children}, nil
+}
+
+func (p *queryParser) parseUnary() (*FlowQuery, error) {
+	if isQueryOperator(p.peek(), "not") {
+		p.consume()
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &FlowQuery{op: queryNot, children: []*FlowQuery{child}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (*FlowQuery, error) {
+	tok := p.consume()
+	switch tok.kind {
+	case queryTokLParen:
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.consume(); closing.kind != queryTokRParen {
+			return nil, p.errorAt(closing.pos, "missing )")
+		}
+		return q, nil
+	case queryTokTerm:
+		term, err := p.parseTerm(tok)
+		if err != nil {
+			return nil, err
+		}
+		return &FlowQuery{op: queryCond, term: term}, nil
+	case queryTokInvalid:
+		return nil, p.errorAt(tok.pos, "%s", tok.text)
+	case queryTokWord:
+		if isQueryOperator(tok, "and") || isQueryOperator(tok, "or") || isQueryOperator(tok, "not") {
+			return nil, p.errorAt(tok.pos, "missing condition before or after %s", tok.text)
+		}
+		return nil, p.errorAt(tok.pos, "expected a condition such as field:value, got %q", tok.text)
+	case queryTokEOF:
+		return nil, p.errorAt(tok.pos, "unexpected end of query")
+	default:
+		return nil, p.errorAt(tok.pos, "unexpected %q", tok.text)
+	}
+}
+
+func (p *queryParser) parseTerm(tok queryTok) (*queryTerm, error) {
+	field, ok := queryFields[strings.ToLower(tok.field)]
+	if !ok {
+		return nil, p.errorAt(tok.pos, "unknown field %q", tok.field)
+	}
+	if tok.value == "" {
+		return nil, p.errorAt(tok.valuePos, "missing value of %s", tok.field)
+	}
+	term := &queryTerm{field: field, value: tok.value}
+	// errors in the search and the pattern are reported in the query
+	inner := tok.valuePos
+	if tok.quoted {
+		inner++
+	}
+	if tok.op == "~" && field != queryFields["data"] {
+		return nil, p.errorAt(tok.pos, "%s does not support ~, only data does", tok.field)
+	}
+	if tok.op != ":" && tok.op != "~" && field.kind != queryNumber && field.kind != queryNumbers {
+		return nil, p.errorAt(tok.pos, "%s is not a number, it cannot be compared", tok.field)
+	}
+
+	switch field.kind {
+	case queryNumber, queryNumbers:
+		return term, p.parseRange(term, tok)
+	case queryAddress:
+		prefix, err := parseQueryPrefix(tok.value)
+		if err != nil {
+			return nil, p.errorAt(tok.valuePos, "invalid address %q, want an IP address or a CIDR prefix", tok.value)
+		}
+		term.prefix = prefix
+	case queryPayload:
+		switch {
+		case tok.op == "~":
+			term.value = "(?i)" + tok.value
+			re, err := regexp.Compile(term.value)
+			if err != nil {
+				return nil, p.errorAt(tok.valuePos, "invalid regex: %v", err)
+			}
+			term.regex = re
+		case field == queryFields["data"]:
+			search, err := ParseSearch(tok.value)
+			var searchErr *SearchError
+			if errors.As(err, &searchErr) {
+				return nil, p.errorAt(inner+searchErr.Pos, "invalid search: %s", searchErr.Msg)
+			} else if err != nil {
+				return nil, err
+			}
+			term.search = search
+		default:
+			pattern, err := ParsePattern(tok.value)
+			var patternErr *PatternError
+			if errors.As(err, &patternErr) {
+				return nil, p.errorAt(inner+patternErr.Pos, "invalid pattern: %s", patternErr.Msg)
+			} else if err != nil {
+				return nil, err
+			}
+			term.pattern = pattern
+		}
+	}
+	return term, nil
+}
+
+// parseRange sets the bounds of a number term.
+func (p *queryParser) parseRange(term *queryTerm, tok queryTok) error {
+	number := func(s string) (*int, error) {
+		if s == "" {
+			return nil, nil
+		}
+		if n, err := strconv.Atoi(s); err == nil {
+			return &n, nil
+		}
+		if term.field == queryFields["time"] {
+			if t, err := time.Parse(time.RFC3339, s); err == nil {
+				n := int(t.UnixMilli())
+				return &n, nil
+			}
+			return nil, p.errorAt(tok.valuePos, "invalid time %q, want milliseconds or RFC 3339", s)
+		}
+		return nil, p.errorAt(tok.valuePos, "invalid number %q", s)
+	}
+
+	if lo, hi, ok := strings.Cut(tok.value, ".."); ok && tok.op == ":" {
+		var err error
+		if term.lo, err = number(lo); err != nil {
+			return err
+		}
+		if term.hi, err = number(hi); err != nil {
+			return err
+		}
+		switch {
+		case term.lo == nil && term.hi == nil:
+			return p.errorAt(tok.valuePos, "missing bounds of the range")
+		case term.lo != nil && term.hi != nil && *term.lo > *term.hi:
+			return p.errorAt(tok.valuePos, "empty range %s", tok.value)
+		}
+		return nil
+	}
+
+	n, err := number(tok.value)
+	if err != nil {
+		return err
+	}
+	switch tok.op {
+	case ":":
+		term.lo, term.hi = n, n
+	case ":>":
+		*n++
+		term.lo = n
+	case ":>=":
+		term.lo = n
+	case ":<":
+		*n--
+		term.hi = n
+	case ":<=":
+		term.hi = n
+	}
+	return nil
+}
+
+// parseQueryPrefix parses a CIDR prefix, or an address as the prefix of its
+// length.
+func parseQueryPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Match reports whether the flow matches the query.
+func (q *FlowQuery) Match(flow *FlowEntry) bool {
+	switch q.op {
+	case queryAnd:
+		for _, child := range q.children {
+			if !child.Match(flow) {
+				return false
+			}
+		}
+		return true
+	case queryOr:
+		return slices.ContainsFunc(q.children, func(child *FlowQuery) bool { return child.Match(flow) })
+	case queryNot:
+		return !q.children[0].Match(flow)
+	default:
+		return q.term.match(flow)
+	}
+}
+
+func (t *queryTerm) match(flow *FlowEntry) bool {
+	f := t.field
+	switch f.kind {
+	case queryString:
+		return f.str(flow) == t.value
+	case queryList:
+		return slices.Contains(f.list(flow), t.value)
+	case queryNumber:
+		return t.inRange(f.num(flow))
+	case queryNumbers:
+		return slices.ContainsFunc(f.nums(flow), t.inRange)
+	case queryAddress:
+		addr, err := netip.ParseAddr(f.str(flow))
+		return err == nil && t.prefix.Contains(addr.Unmap())
+	}
+
+	switch {
+	case t.search != nil:
+		return t.search.Match(flow)
+	case t.regex != nil:
+		return slices.ContainsFunc(flow.Flow, func(item FlowItem) bool { return t.regex.MatchString(item.Data) })
+	default:
+		return containsPattern(flow.Flow, t.pattern)
+	}
+}
+
+func (t *queryTerm) inRange(n int) bool {
+	return !outside(n, t.lo, t.hi)
+}
@@ -0,0 +1,155 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseFlowQuery_Errors(t *testing.T) {
+	cases := map[string]int{
+		"":                0,
+		"service":         0,
+		"nope:1":          0,
+		"tag:":            4,
+		"service:web and": 15,
+		"and service:web": 0,
+		"(tag:a":          6,
+		"tag:a)":          5,
+		`data:"abc`:       5,
+		`tag:a "b"`:       6,
+		"tag:>1":          0,
+		"service~web":     0,
+		"tick:abc":        5,
+		"tick:5..3":       5,
+		"tick:..":         5,
+		"time:yesterday":  5,
+		"src:10.0.0.300":  4,
+		"dst:10.0.0.0/33": 4,
+		`data~"("`:        5,
+		`data:"(flag"`:    11,
+		`contains:"|zz|"`: 11,
+		"contains:x|d|":   11,
+	}
+	for query, pos := range cases {
+		_, err := ParseFlowQuery(query)
+		var queryErr *QueryError
+		if !errors.As(err, &queryErr) {
+			t.Errorf("ParseFlowQuery(%q) error = %v, want a QueryError", query, err)
+			continue
+		}
+		if queryErr.Pos != pos {
+			t.Errorf("ParseFlowQuery(%q) error at %d, want %d (%v)", query, queryErr.Pos, pos, err)
+		}
+	}
+}
+
+func TestFlowQuery_Match(t *testing.T) {
+	flow := &FlowEntry{
+		SrcIp: "10.60.3.7", SrcPort: 41000, DstIp: "fd00::2", DstPort: 8080,
+		Time: 1735689600000, Tick: 42, Size: 300, Service: "srv1",
+		Tags: []string{"tcp", "flag-out"}, Flags: []string{"FLAG{x}"},
+		App:  AppLayer{Protocols: []string{"http"}, Statuses: []int{200, 404}},
+		Flow: []FlowItem{{From: "c", Data: "GET /admin HTTP/1.1\r\n\r\n\x00\xff"}},
+	}
+
+	cases := []struct {
+		query string
+		want  bool
+	}{
+		{`service:srv1 and tag:flag-out and not tag:starred and data~"admin" and tick:>40`, true},
+		{"SERVICE:srv1 AND Tag:tcp", true},
+		{"service:srv2", false},
+		{"service:srv1 tag:starred", false},
+		{"tag:starred or tag:tcp", true},
+		{"not (tag:starred or tag:tcp)", false},
+		{"not not tag:tcp", true},
+		{"tick:42 tick:>=42 tick:<=42 tick:40..50 tick:..42 tick:42..", true},
+		{"tick:>42", false},
+		{"tick:<42", false},
+		{"time:2025-01-01T00:00:00Z", true},
+		{"src:10.60.0.0/16 src_ip:10.60.3.7 src:::ffff:10.60.3.0/120", true},
+		{"src:10.61.0.0/16", false},
+		{"dst:fd00::/64", true},
+		{"dst:10.0.0.0/8", false},
+		{"src_port:41000 dst_port:8080", true},
+		{"flag:FLAG{x} size:..300", true},
+		{"protocol:http http_status:404", true},
+		{"http_status:500..", false},
+		{`data:"get admin"`, true},
+		{`data:"admin get"`, true},
+		{`data:"\"admin get\""`, false},
+		{`data~"^get /adm.n"`, true},
+		{`data~"\\d{3}"`, false},
+		{`contains:"|00 ff|"`, true},
+		{`contains:"|ff 00|"`, false},
+	}
+	for _, tc := range cases {
+		q, err := ParseFlowQuery(tc.query)
+		if err != nil {
+			t.Errorf("ParseFlowQuery(%q) failed: %v", tc.query, err)
+			continue
+		}
+		if got := q.Match(flow); got != tc.want {
+			t.Errorf("%q matches = %v, want %v", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestMongoFlowQuery(t *testing.T) {
+	cases := []struct {
+		query  string
+		filter bool // the filter narrows the flows
+		exact  bool
+	}{
+		{"service:srv1 not tag:starred", true, true},
+		{"tick:>40 or http_status:500", true, true},
+		{"src:10.60.0.0/16 dst:10.0.0.0/22", true, true},
+		{"src:10.60.0.0/17", true, false},
+		{"not src:10.60.0.0/17", false, false},
+		{"dst:fd00::/64", false, false},
+		{"service:srv1 data:admin", true, false},
+		{"service:srv1 or data:admin", false, false},
+		{"not (service:srv1 and data:admin)", false, false},
+		{"not (service:srv1 or data:admin)", true, false},
+	}
+	for _, tc := range cases {
+		q, err := ParseFlowQuery(tc.query)
+		if err != nil {
+			t.Fatalf("ParseFlowQuery(%q) failed: %v", tc.query, err)
+		}
+		filter, exact := mongoFlowQuery(q, false)
+		if (filter != nil) != tc.filter || exact != tc.exact {
+			t.Errorf("%q MongoDB filter = %v, exact %v; want a filter %v, exact %v", tc.query, filter, exact, tc.filter, tc.exact)
+		}
+	}
+}
+
+func TestGetFlowsOptions_FullScan(t *testing.T) {
+	q := func(s string) *FlowQuery {
+		query, err := ParseFlowQuery(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return query
+	}
+	cases := []struct {
+		opts *GetFlowsOptions
+		want bool
+	}{
+		{nil, false},
+		{&GetFlowsOptions{Search: "flag", Contains: []byte("flag")}, false},
+		{&GetFlowsOptions{FlowData: "fl.g"}, true},
+		{&GetFlowsOptions{Query: q("service:web src:10.60.0.0/16")}, false},
+		{&GetFlowsOptions{Query: q("service:web data:flag")}, true},
+		{&GetFlowsOptions{Query: q("not src:10.60.0.0/17")}, true},
+	}
+	for i, tc := range cases {
+		if got := tc.opts.FullScan(); got != tc.want {
+			t.Errorf("case %d: FullScan() = %v, want %v", i, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import (
+	"context"
+	"fmt"
+)
+
+// SchemaVersion is the version of the data layout written by this version of
+// Tulip. Namespaces record the version of their data, and services refuse to
+// work on a different one, see CheckSchema. Older data is upgraded in place by
+// Database.Migrate.
+//
+//  1. The original layout, versions before did not record it. Fields added
+//     over time (num_packets, fingerprints, parent_id, child_id, flagids,
+//     tick, ...) may be missing, raw only holds the printable bytes of data,
+//     and payloads may not be indexed for Search and Contains.
+//  2. Every field is present, raw holds all the bytes of data and payloads
+//     are indexed.
+//  3. Tags have a color, description, origin and creation time, see Tag.
+//  4. Signatures are unique on (gid, sid, rev), with a severity, a category
+//     and hit counts per tick.
+//  5. Flows have a community_id, the Community ID hash of their 5-tuple.
+//  6. Flows have app, the application layer metadata of Suricata, see AppLayer.
+//  7. Signatures have all the tags of their rule, flows have the variables set
+//     by the rules, see RuleVars.
+const SchemaVersion = 7
+
+// SchemaError reports a namespace whose data has a different version than
+// SchemaVersion.
+type SchemaError struct {
+	Namespace string
+	Version   int // Version of the stored data
+}
+
+func (e *SchemaError) Error() string {
+	if e.Version < SchemaVersion {
+		return fmt.Sprintf("namespace %q has schema version %d, run `assembler migrate --namespace %s` to upgrade it to %d",
+			e.Namespace, e.Version, e.Namespace, SchemaVersion)
+	}
+	return fmt.Sprintf("namespace %q has schema version %d, newer than the supported %d: upgrade Tulip",
+		e.Namespace, e.Version, SchemaVersion)
+}
+
+// CheckSchema returns a SchemaError if the data of database is not at
+// SchemaVersion.
+func CheckSchema(ctx context.Context, database Database) error {
+	version, err := database.GetSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if version != SchemaVersion {
+		return &SchemaError{Namespace: database.Namespace(), Version: version}
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Full-text search on flow payloads.
+//
+// Payloads are split into tokens, the runs of letters and digits, compared
+// case-insensitively. A search is made of:
+//
+//	admin              a token
+//	adm*               a token prefix
+//	"GET /flag"        a phrase: consecutive tokens in the same message
+//	a AND b, a b       both (AND is implicit)
+//	a OR b             either
+//	NOT a, -a          not a
+//	(a OR b) c         grouping
+//
+// Operators are uppercase. Words with separators, such as /api/login, are
+// searched as phrases. A term matches a flow when it appears in any of its
+// messages.
+
+// SearchError reports an invalid search query.
+type SearchError struct {
+	Query string
+	Pos   int // Byte offset of the error in Query
+	Msg   string
+}
+
+func (e *SearchError) Error() string {
+	return fmt.Sprintf("invalid search query at position %d: %s", e.Pos, e.Msg)
+}
+
+type searchOp int
+
+const (
+	searchTerm searchOp = iota // one token, or a phrase of tokens
+	searchAnd
+	searchOr
+	searchNot
+)
+
+// SearchQuery is a parsed full-text search.
+type SearchQuery struct {
+	op       searchOp
+	tokens   []string // searchTerm: the tokens of the phrase, lowercase
+	prefix   bool     // searchTerm: the last token is a prefix
+	children []*SearchQuery
+}
+
+// isTokenRune reports whether r is part of a token. Same classes as the
+// unicode61 tokenizer of SQLite FTS5.
+func isTokenRune(r rune) bool {
+	return unicode.In(r, unicode.L, unicode.N, unicode.Co)
+}
+
+// searchTokens splits text into lowercase tokens.
+func searchTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !isTokenRune(r) })
+}
+
+// ParseSearch parses a full-text search query.
+func ParseSearch(query string) (*SearchQuery, error) {
+	p := &searchParser{query: query}
+	if p.peek().kind == searchTokEOF {
+		return nil, p.errorf("empty query")
+	}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != searchTokEOF {
+		return nil, p.errorAt(tok.pos, "unexpected %q", tok.text)
+	}
+	return q, nil
+}
+
+type searchTokKind int
+
+const (
+	searchTokEOF searchTokKind = iota
+	searchTokWord
+	searchTokPhrase
+	searchTokLParen
+	searchTokRParen
+	searchTokMinus
+	searchTokUnterminated // phrase without the closing quote
+)
+
+type searchTok struct {
+	kind   searchTokKind
+	text   string
+	prefix bool // word or phrase followed by *
+	pos    int
+}
+
+type searchParser struct {
+	query string
+	pos   int
+	next  *searchTok
+}
+
+func (p *searchParser) errorf(format string, args ...any) error {
+	return p.errorAt(p.pos, format, args...)
+}
+
+func (p *searchParser) errorAt(pos int, format string, args ...any) error {
+	return &SearchError{Query: p.query, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// peek returns the next lexical token without consuming it.
+func (p *searchParser) peek() searchTok {
+	if p.next == nil {
+		tok := p.lex()
+		p.next = &tok
+	}
+	return *p.next
+}
+
+func (p *searchParser) consume() searchTok {
+	tok := p.peek()
+	p.next = nil
+	return tok
+}
+
+func (p *searchParser) lex() searchTok {
+	for p.pos < len(p.query) && unicode.IsSpace(rune(p.query[p.pos])) {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.query) {
+		return searchTok{kind: searchTokEOF, pos: start}
+	}
+
+	switch p.query[p.pos] {
+	case '(':
+		p.pos++
+		return searchTok{kind: searchTokLParen, text: "(", pos: start}
+	case ')':
+		p.pos++
+		return searchTok{kind: searchTokRParen, text: ")", pos: start}
+	case '-':
+		p.pos++
+		return searchTok{kind: searchTokMinus, text: "-", pos: start}
+	case '"':
+		end := strings.IndexByte(p.query[p.pos+1:], '"')
+		if end < 0 {
+			p.pos = len(p.query)
+			return searchTok{kind: searchTokUnterminated, text: p.query[start:], pos: start}
+		}
+		text := p.query[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return searchTok{kind: searchTokPhrase, text: text, prefix: p.star(), pos: start}
+	}
+
+	for p.pos < len(p.query) && !unicode.IsSpace(rune(p.query[p.pos])) && !strings.ContainsRune(`()"`, rune(p.query[p.pos])) {
+		p.pos++
+	}
+	text := p.query[start:p.pos]
+	tok := searchTok{kind: searchTokWord, text: text, pos: start}
+	if trimmed, ok := strings.CutSuffix(text, "*"); ok {
+		tok.text, tok.prefix = trimmed, true
+	}
+	return tok
+}
+
+// star consumes a * right after a phrase.
+func (p *searchParser) star() bool {
+	if p.pos < len(p.query) && p.query[p.pos] == '*' {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func isOperator(tok searchTok, op string) bool {
+	return tok.kind == searchTokWord && !tok.prefix && tok.text == op
+}
+
+func (p *searchParser) parseOr() (*SearchQuery, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	children := []*SearchQuery{left}
+	for isOperator(p.peek(), "OR") {
+		p.consume()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, right)
+	}
+	if len(children) == 1 {
+		return left, nil
+	}
+	return &SearchQuery{op: searchOr, children: children}, nil
+}
+
+func (p *searchParser) parseAnd() (*SearchQuery, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	children := []*SearchQuery{left}
+	for {
+		tok := p.peek()
+		if tok.kind == searchTokEOF || tok.kind == searchTokRParen || isOperator(tok, "OR") {
+			break
+		}
+		if isOperator(tok, "AND") {
+			p.consume()
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, right)
+	}
+	if len(children) == 1 {
+		return left, nil
+	}
+	return &SearchQuery{op: searchAnd, children: children}, nil
+}
+
+func (p *searchParser) parseUnary() (*SearchQuery, error) {
+	if tok := p.peek(); tok.kind == searchTokMinus || isOperator(tok, "NOT") {
+		p.consume()
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &SearchQuery{op: searchNot, children: []*SearchQuery{child}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *searchParser) parsePrimary() (*SearchQuery, error) {
+	tok := p.consume()
+	switch {
+	case tok.kind == searchTokLParen:
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.consume(); closing.kind != searchTokRParen {
+			return nil, p.errorAt(closing.pos, "missing )")
+		}
+		return q, nil
+	case tok.kind == searchTokUnterminated:
+		return nil, p.errorAt(tok.pos, "unterminated phrase")
+	case tok.kind == searchTokWord && (isOperator(tok, "AND") || isOperator(tok, "OR") || isOperator(tok, "NOT")):
+		return nil, p.errorAt(tok.pos, "missing term before or after %s", tok.text)
+	case tok.kind == searchTokWord || tok.kind == searchTokPhrase:
+		tokens := searchTokens(tok.text)
+		if len(tokens) == 0 {
+			return nil, p.errorAt(tok.pos, "%q has no letters or digits to search for", tok.text)
+		}
+		return &SearchQuery{op: searchTerm, tokens: tokens, prefix: tok.prefix}, nil
+	case tok.kind == searchTokEOF:
+		return nil, p.errorAt(tok.pos, "unexpected end of query")
+	default:
+		return nil, p.errorAt(tok.pos, "unexpected %q", tok.text)
+	}
+}
+
+// Match reports whether the flow matches the search.
+func (q *SearchQuery) Match(flow *FlowEntry) bool {
+	messages := make([][]string, len(flow.Flow))
+	for i, item := range flow.Flow {
+		messages[i] = searchTokens(item.Data)
+	}
+	return q.match(messages)
+}
+
+func (q *SearchQuery) match(messages [][]string) bool {
+	switch q.op {
+	case searchAnd:
+		for _, child := range q.children {
+			if !child.match(messages) {
+				return false
+			}
+		}
+		return true
+	case searchOr:
+		return slices.ContainsFunc(q.children, func(child *SearchQuery) bool { return child.match(messages) })
+	case searchNot:
+		return !q.children[0].match(messages)
+	default:
+		return slices.ContainsFunc(messages, q.matchMessage)
+	}
+}
+
+// matchMessage reports whether the term or phrase appears in a message.
+func (q *SearchQuery) matchMessage(tokens []string) bool {
+	last := len(q.tokens) - 1
+	for start := 0; start+last < len(tokens); start++ {
+		found := true
+		for i, want := range q.tokens {
+			got := tokens[start+i]
+			if got != want && !(q.prefix && i == last && strings.HasPrefix(got, want)) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// required returns the terms every matching flow contains, used by the
+// backends to narrow the search with their full-text index.
+func (q *SearchQuery) required() []*SearchQuery {
+	switch q.op {
+	case searchTerm:
+		return []*SearchQuery{q}
+	case searchAnd:
+		var terms []*SearchQuery
+		for _, child := range q.children {
+			terms = append(terms, child.required()...)
+		}
+		return terms
+	default:
+		return nil
+	}
+}
+
+// ftsMatch converts the required terms to an FTS5 MATCH expression, empty if
+// there are none.
+func (q *SearchQuery) ftsMatch() string {
+	var parts []string
+	for _, term := range q.required() {
+		part := `"` + strings.Join(term.tokens, " ") + `"`
+		if term.prefix {
+			part += "*"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " AND ")
+}
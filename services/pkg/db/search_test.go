@@ -0,0 +1,107 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestParseSearch_Errors(t *testing.T) {
+	cases := map[string]int{
+		"":             0,
+		"   ":          3,
+		"(flag":        5,
+		"flag)":        4,
+		`"get flag`:    0,
+		"flag OR":      7,
+		"AND flag":     0,
+		"flag AND AND": 9,
+		"-":            1,
+		"/ ::":         0,
+	}
+	for query, pos := range cases {
+		_, err := ParseSearch(query)
+		var searchErr *SearchError
+		if !errors.As(err, &searchErr) {
+			t.Errorf("ParseSearch(%q) error = %v, want a SearchError", query, err)
+			continue
+		}
+		if searchErr.Pos != pos {
+			t.Errorf("ParseSearch(%q) error at %d, want %d (%v)", query, searchErr.Pos, pos, err)
+		}
+	}
+}
+
+func TestSearchQuery_Match(t *testing.T) {
+	flow := &FlowEntry{Flow: []FlowItem{
+		{From: "c", Data: "POST /api/login HTTP/1.1\r\nHost: vuln\r\n\r\nuser=Admin&pass=hunter2"},
+		{From: "s", Data: "HTTP/1.1 302 Found\r\nSet-Cookie: session=deadbeef"},
+	}}
+
+	cases := []struct {
+		query string
+		want  bool
+	}{
+		{"admin", true},
+		{"ADMIN hunter2", true},
+		{"adm", false},
+		{"adm*", true},
+		{"/api/login", true},
+		{"api/log*", true},
+		{`"login http"`, true},
+		{`"http login"`, false},
+		{`"hunter2 http"`, false}, // phrases do not span messages
+		{"hunter2 found", true},   // terms do
+		{"admin -deadbeef", false},
+		{"admin NOT (root OR guest)", true},
+		{"root OR session", true},
+		{"root OR guest", false},
+		{"(root OR admin) AND (302 OR 404)", true},
+		{"NOT NOT admin", true},
+		{"café", false},
+	}
+	for _, tc := range cases {
+		q, err := ParseSearch(tc.query)
+		if err != nil {
+			t.Errorf("ParseSearch(%q) failed: %v", tc.query, err)
+			continue
+		}
+		if got := q.Match(flow); got != tc.want {
+			t.Errorf("%q matches = %v, want %v", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestSearchQuery_Backends(t *testing.T) {
+	cases := []struct {
+		query    string
+		fts      string
+		patterns []string
+	}{
+		{"admin", `"admin"`, []string{"admin"}},
+		{"/api/log*", `"api log"*`, []string{"api", "log"}},
+		{"a (b OR c) -d", `"a"`, []string{"a"}},
+		{"a OR b", "", nil},
+		{"héllo abc", `"héllo" AND "abc"`, []string{"abc"}}, // only ASCII letters are folded by trigram
+	}
+	for _, tc := range cases {
+		q, err := ParseSearch(tc.query)
+		if err != nil {
+			t.Fatalf("ParseSearch(%q) failed: %v", tc.query, err)
+		}
+		if got := q.ftsMatch(); got != tc.fts {
+			t.Errorf("%q FTS5 expression = %s, want %s", tc.query, got, tc.fts)
+		}
+		var patterns []string
+		for _, pattern := range searchPatterns(q) {
+			patterns = append(patterns, string(pattern))
+		}
+		if !slices.Equal(patterns, tc.patterns) {
+			t.Errorf("%q trigram patterns = %q, want %q", tc.query, patterns, tc.patterns)
+		}
+	}
+}
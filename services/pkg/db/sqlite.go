@@ -0,0 +1,1788 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"modernc.org/sqlite"
+)
+
+// sqliteSchema creates the tables of a namespace, see SqliteDatabase.sql.
+// The array fields of flows are stored as JSON, payloads are also indexed in
+// flows_fts and their trigrams in flows_ngrams.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS {flows} (
+	id           TEXT PRIMARY KEY,
+	time         INTEGER NOT NULL,
+	duration     INTEGER NOT NULL,
+	src_ip       TEXT NOT NULL,
+	src_port     INTEGER NOT NULL,
+	dst_ip       TEXT NOT NULL,
+	dst_port     INTEGER NOT NULL,
+	num_packets  INTEGER NOT NULL,
+	blocked      INTEGER NOT NULL,
+	filename     TEXT NOT NULL,
+	parent_id    TEXT NOT NULL,
+	child_id     TEXT NOT NULL,
+	fingerprints TEXT NOT NULL,
+	suricata     TEXT NOT NULL,
+	flow         TEXT NOT NULL,
+	tags         TEXT NOT NULL,
+	size         INTEGER NOT NULL,
+	flags        TEXT NOT NULL,
+	flagids      TEXT NOT NULL,
+	tick         INTEGER NOT NULL,
+	service      TEXT NOT NULL,
+	pcaps        TEXT NOT NULL,
+	community_id TEXT NOT NULL,
+	app          TEXT NOT NULL,
+	vars         TEXT NOT NULL
+);
+DROP INDEX IF EXISTS {flows_time};
+CREATE INDEX IF NOT EXISTS {flows_time_id} ON {flows} (time, id);
+CREATE INDEX IF NOT EXISTS {flows_ports} ON {flows} (src_port, dst_port);
+CREATE INDEX IF NOT EXISTS {flows_tick} ON {flows} (tick);
+CREATE INDEX IF NOT EXISTS {flows_service} ON {flows} (service, time);
+
+CREATE VIRTUAL TABLE IF NOT EXISTS {flows_fts} USING fts5 (data, content='', contentless_delete=1);
+
+CREATE TABLE IF NOT EXISTS {flows_ngrams} (
+	ngram INTEGER NOT NULL, -- trigram, or unindexedTrigram
+	flow  INTEGER NOT NULL, -- rowid of the flow
+	PRIMARY KEY (ngram, flow)
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS {meta} (
+	key   TEXT PRIMARY KEY,
+	value INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS {tags} (
+	name        TEXT PRIMARY KEY,
+	color       TEXT NOT NULL,
+	description TEXT NOT NULL,
+	origin      TEXT NOT NULL,
+	created_at  INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS {signatures} (
+	id       TEXT PRIMARY KEY,
+	gid      INTEGER NOT NULL,
+	sig_id   INTEGER NOT NULL,
+	rev      INTEGER NOT NULL,
+	msg      TEXT NOT NULL,
+	action   TEXT NOT NULL,
+	tags     TEXT NOT NULL,
+	severity INTEGER NOT NULL,
+	category TEXT NOT NULL,
+	UNIQUE (gid, sig_id, rev)
+);
+
+CREATE TABLE IF NOT EXISTS {signature_hits} (
+	signature TEXT NOT NULL, -- id of the signature
+	tick      INTEGER NOT NULL,
+	hits      INTEGER NOT NULL,
+	PRIMARY KEY (signature, tick)
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS {dead_letters} (
+	id         TEXT PRIMARY KEY,
+	event      TEXT NOT NULL,
+	reason     TEXT NOT NULL,
+	attempts   INTEGER NOT NULL,
+	first_seen INTEGER NOT NULL,
+	dead_at    INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS {files_imported} (
+	file_name   TEXT PRIMARY KEY,
+	position    INTEGER NOT NULL,
+	finished    INTEGER NOT NULL,
+	location    TEXT NOT NULL,
+	size        INTEGER NOT NULL,
+	archived_at INTEGER NOT NULL,
+	removed     INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS {flagids} (
+	service     TEXT NOT NULL,
+	team        INTEGER NOT NULL,
+	round       INTEGER NOT NULL,
+	description TEXT NOT NULL,
+	flagid      TEXT NOT NULL,
+	PRIMARY KEY (service, team, round, flagid)
+);
+`
+
+// sqliteCommunityIDIndex indexes the Community ID of flows. It is not part of
+// sqliteSchema as the flows of namespaces before version 5 lack the column
+// until they are migrated.
+const sqliteCommunityIDIndex = `CREATE INDEX IF NOT EXISTS {flows_community_id} ON {flows} (community_id, time);`
+
+// sqliteTableRegex matches the table placeholders of queries.
+var sqliteTableRegex = regexp.MustCompile(`\{(\w+)\}`)
+
+const flowColumns = `id, time, duration, src_ip, src_port, dst_ip, dst_port, num_packets, blocked, filename,
+	parent_id, child_id, fingerprints, suricata, flow, tags, size, flags, flagids, tick, service, pcaps, community_id, app, vars`
+
+// SqliteDatabase is a Database stored in a single SQLite file, so that Tulip
+// can run without MongoDB.
+type SqliteDatabase struct {
+	db     *sql.DB
+	name   string
+	tables *strings.Replacer
+}
+
+var _ Database = (*SqliteDatabase)(nil)
+
+func init() {
+	// used by GetFlowsOptions.FlowData, with the same syntax as in memory
+	sqlite.MustRegisterDeterministicScalarFunction("regexp", 2, sqliteRegexp)
+	// used by GetFlowsOptions.Search, to check the candidates found with FTS5
+	sqlite.MustRegisterDeterministicScalarFunction("tulip_search", 2, sqliteSearch)
+	// used by GetFlowsOptions.Contains, to check the candidates found with flows_ngrams
+	sqlite.MustRegisterDeterministicScalarFunction("tulip_contains", 2, sqliteContains)
+	// used by GetFlowsOptions.Query, for the addresses in a CIDR prefix
+	sqlite.MustRegisterDeterministicScalarFunction("tulip_prefix", 2, sqlitePrefix)
+}
+
+// unindexedTrigram marks the flows with too many trigrams to index them.
+const unindexedTrigram = -1
+
+// ConnectSqlite opens the SQLite database at path, creating it if needed.
+func ConnectSqlite(path string) (*SqliteDatabase, error) {
+	if path == "" {
+		return nil, errors.New("missing SQLite database path")
+	}
+
+	params := url.Values{}
+	params.Add("_pragma", "busy_timeout(10000)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "synchronous(NORMAL)")
+	// flows are linked with a read followed by a write, take the lock upfront
+	params.Set("_txlock", "immediate")
+
+	conn, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database: %v", err)
+	}
+	database, err := newSqliteNamespace(conn, DefaultNamespace)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return database, nil
+}
+
+// newSqliteNamespace creates the tables of a namespace if needed.
+func newSqliteNamespace(conn *sql.DB, name string) (*SqliteDatabase, error) {
+	var names []string
+	for _, match := range sqliteTableRegex.FindAllStringSubmatch(sqliteSchema+sqliteCommunityIDIndex, -1) {
+		names = append(names, match[0], `"`+name+`_`+match[1]+`"`)
+	}
+	s := &SqliteDatabase{db: conn, name: name, tables: strings.NewReplacer(names...)}
+
+	if _, err := conn.Exec(s.sql(sqliteSchema)); err != nil {
+		return nil, fmt.Errorf("failed to create SQLite schema of %s: %v", name, err)
+	}
+	// a namespace without flows is new, see GetSchemaVersion
+	if _, err := conn.Exec(s.sql(`INSERT OR IGNORE INTO {meta} (key, value)
+		SELECT 'schema_version', ? WHERE NOT EXISTS (SELECT 1 FROM {flows})`), SchemaVersion); err != nil {
+		return nil, fmt.Errorf("failed to record the schema version of %s: %v", name, err)
+	}
+	if version, err := s.GetSchemaVersion(context.Background()); err != nil {
+		return nil, err
+	} else if version >= 5 {
+		if _, err := conn.Exec(s.sql(sqliteCommunityIDIndex)); err != nil {
+			return nil, fmt.Errorf("failed to create SQLite schema of %s: %v", name, err)
+		}
+	}
+	return s, nil
+}
+
+// sql replaces the {table} placeholders of query with the tables of the
+// namespace, which are prefixed with its name ("pcap_flows").
+func (s *SqliteDatabase) sql(query string) string {
+	return s.tables.Replace(query)
+}
+
+func (s *SqliteDatabase) Namespace() string {
+	return s.name
+}
+
+func (s *SqliteDatabase) WithNamespace(name string) (Database, error) {
+	if err := ValidateNamespace(name); err != nil {
+		return nil, err
+	}
+	return newSqliteNamespace(s.db, name)
+}
+
+// ListNamespaces returns the namespaces whose flows or tags tables are not
+// empty. Every namespace has a "<name>_flows" table.
+func (s *SqliteDatabase) ListNamespaces(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT name FROM sqlite_master WHERE type = 'table' AND name LIKE '%\_flows' ESCAPE '\'`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %v", err)
+	}
+	var candidates []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to list namespaces: %v", err)
+		}
+		if name := strings.TrimSuffix(table, "_flows"); ValidateNamespace(name) == nil {
+			candidates = append(candidates, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %v", err)
+	}
+
+	namespaces := make([]string, 0, len(candidates))
+	for _, name := range candidates {
+		var used bool
+		err := s.db.QueryRowContext(ctx, fmt.Sprintf(
+			`SELECT EXISTS (SELECT 1 FROM "%[1]s_flows") OR EXISTS (SELECT 1 FROM "%[1]s_tags")`, name)).Scan(&used)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect namespace %s: %v", name, err)
+		}
+		if used {
+			namespaces = append(namespaces, name)
+		}
+	}
+	slices.Sort(namespaces)
+	return namespaces, nil
+}
+
+// Close closes the database file.
+func (s *SqliteDatabase) Close(_ context.Context) error {
+	return s.db.Close()
+}
+
+func (s *SqliteDatabase) ConfigureDatabase(ctx context.Context) error {
+	for _, tag := range DefaultTags {
+		if err := s.InsertTag(ctx, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetSchemaVersion returns the recorded version, or 1 for the flows stored
+// before versions were recorded.
+func (s *SqliteDatabase) GetSchemaVersion(ctx context.Context) (int, error) {
+	var version int
+	err := s.db.QueryRowContext(ctx, s.sql(`SELECT value FROM {meta} WHERE key = 'schema_version'`)).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 1, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %v", err)
+	}
+	return version, nil
+}
+
+// Migrate upgrades the namespace to SchemaVersion. Version 1 flows are
+// stored with the same columns, but the SQLite backend predates the payload
+// indexes, and the messages hold the printable-only raw: the messages are
+// encoded again and flows_fts and flows_ngrams are rebuilt. Before version 3
+// the tags table only had names, the other columns are added empty. Before
+// version 4 signatures had no gid, revision, severity or hit counts, see
+// migrateSignatures. Before version 5 flows had no community_id, it is
+// computed from their 5-tuple. Before version 6 flows had no app, it is added
+// empty. Before version 7 signatures had a single tag, see
+// migrateRuleMetadata.
+func (s *SqliteDatabase) Migrate(ctx context.Context) error {
+	version, err := s.GetSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if version > SchemaVersion {
+		return &SchemaError{Namespace: s.name, Version: version}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if version < 2 {
+		if _, err := tx.ExecContext(ctx, s.sql(`INSERT INTO {flows_fts} ({flows_fts}) VALUES ('delete-all')`)); err != nil {
+			return fmt.Errorf("failed to clear the payload index: %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, s.sql(`DELETE FROM {flows_ngrams}`)); err != nil {
+			return fmt.Errorf("failed to clear the trigram index: %v", err)
+		}
+
+		for last := int64(0); ; {
+			rows, err := tx.QueryContext(ctx, s.sql(`SELECT rowid, flow FROM {flows} WHERE rowid > ? ORDER BY rowid LIMIT 1000`), last)
+			if err != nil {
+				return fmt.Errorf("failed to read flows: %v", err)
+			}
+			type storedFlow struct {
+				rowid int64
+				items []FlowItem
+			}
+			var batch []storedFlow
+			for rows.Next() {
+				var (
+					flow  storedFlow
+					items string
+				)
+				if err := rows.Scan(&flow.rowid, &items); err != nil {
+					rows.Close()
+					return fmt.Errorf("failed to read flows: %v", err)
+				}
+				if flow.items, err = decodeItems(items); err != nil {
+					rows.Close()
+					return fmt.Errorf("failed to decode flow %d: %v", flow.rowid, err)
+				}
+				batch = append(batch, flow)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return fmt.Errorf("failed to read flows: %v", err)
+			}
+			if len(batch) == 0 {
+				break
+			}
+
+			for _, flow := range batch {
+				if _, err := tx.ExecContext(ctx, s.sql(`UPDATE {flows} SET flow = ? WHERE rowid = ?`),
+					encodeItems(flow.items), flow.rowid); err != nil {
+					return fmt.Errorf("failed to update flow: %v", err)
+				}
+				if err := s.indexPayload(ctx, tx, flow.rowid, flow.items); err != nil {
+					return err
+				}
+			}
+			last = batch[len(batch)-1].rowid
+		}
+	}
+
+	if version < 3 {
+		if err := s.migrateTags(ctx, tx); err != nil {
+			return err
+		}
+	}
+	if version < 4 {
+		if err := s.migrateSignatures(ctx, tx); err != nil {
+			return err
+		}
+	}
+	if version < 5 {
+		if err := s.migrateCommunityIDs(ctx, tx); err != nil {
+			return err
+		}
+	}
+	if version < 6 {
+		if err := s.addColumns(ctx, tx, "flows", sqliteColumn{"app", `TEXT NOT NULL DEFAULT '{}'`}); err != nil {
+			return err
+		}
+	}
+	if version < 7 {
+		if err := s.migrateRuleMetadata(ctx, tx); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, s.sql(`INSERT INTO {meta} (key, value) VALUES ('schema_version', ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`), SchemaVersion); err != nil {
+		return fmt.Errorf("failed to record the schema version: %v", err)
+	}
+	return tx.Commit()
+}
+
+// columns returns the columns of a table of the namespace.
+func (s *SqliteDatabase) columns(ctx context.Context, tx *sql.Tx, table string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT name FROM pragma_table_info(?)`, s.name+"_"+table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the %s table: %v", table, err)
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, fmt.Errorf("failed to read the %s table: %v", table, err)
+		}
+		columns = append(columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the %s table: %v", table, err)
+	}
+	return columns, nil
+}
+
+// sqliteColumn is a column added to a table by a migration.
+type sqliteColumn struct{ name, definition string }
+
+// addColumns adds the missing columns to a table of the namespace.
+func (s *SqliteDatabase) addColumns(ctx context.Context, tx *sql.Tx, table string, added ...sqliteColumn) error {
+	columns, err := s.columns(ctx, tx, table)
+	if err != nil {
+		return err
+	}
+
+	for _, column := range added {
+		if slices.Contains(columns, column.name) {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, s.sql(`ALTER TABLE {`+table+`} ADD COLUMN `+column.name+` `+column.definition)); err != nil {
+			return fmt.Errorf("failed to add the %s column of %s: %v", column.name, table, err)
+		}
+	}
+	return nil
+}
+
+// migrateTags adds the metadata columns of version 3 to the tags table.
+func (s *SqliteDatabase) migrateTags(ctx context.Context, tx *sql.Tx) error {
+	return s.addColumns(ctx, tx, "tags",
+		sqliteColumn{"color", `TEXT NOT NULL DEFAULT ''`},
+		sqliteColumn{"description", `TEXT NOT NULL DEFAULT ''`},
+		sqliteColumn{"origin", `TEXT NOT NULL DEFAULT ''`},
+		sqliteColumn{"created_at", `INTEGER NOT NULL DEFAULT 0`},
+	)
+}
+
+// migrateSignatures rebuilds the signatures table of version 4, keyed on
+// (gid, sig_id, rev) instead of the whole signature. The older signatures
+// have no revision: the ones of a sid get negative revisions in the order
+// they were stored, -1 for the last one. The hits are counted from the
+// flows, one per flow.
+func (s *SqliteDatabase) migrateSignatures(ctx context.Context, tx *sql.Tx) error {
+	columns, err := s.columns(ctx, tx, "signatures")
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(columns, "rev") {
+		old := `"` + s.name + `_signatures_v3"`
+		for _, query := range []string{
+			`ALTER TABLE {signatures} RENAME TO ` + old,
+			sqliteSchema,
+			`INSERT INTO {signatures} (` + signatureColumns + `)
+				SELECT id, 1, sig_id, row_number() OVER win - count(*) OVER win - 1, msg, action,
+					CASE tag WHEN '' THEN '[]' ELSE json_array(tag) END, 0, ''
+				FROM ` + old + `
+				WINDOW win AS (PARTITION BY sig_id ORDER BY rowid ROWS BETWEEN UNBOUNDED PRECEDING AND UNBOUNDED FOLLOWING)`,
+			`DROP TABLE ` + old,
+		} {
+			if _, err := tx.ExecContext(ctx, s.sql(query)); err != nil {
+				return fmt.Errorf("failed to rebuild the signatures table: %v", err)
+			}
+		}
+	}
+
+	for _, query := range []string{
+		`DELETE FROM {signature_hits}`,
+		`INSERT INTO {signature_hits} (signature, tick, hits)
+			SELECT sig.value, max(flows.tick, -1), count(*) FROM {flows} AS flows, json_each(flows.suricata) AS sig
+			GROUP BY 1, 2`,
+	} {
+		if _, err := tx.ExecContext(ctx, s.sql(query)); err != nil {
+			return fmt.Errorf("failed to count signature hits: %v", err)
+		}
+	}
+	return nil
+}
+
+// migrateRuleMetadata turns the tag column of the signatures into the tags
+// of version 7, and adds the vars column of version 7 to the flows.
+func (s *SqliteDatabase) migrateRuleMetadata(ctx context.Context, tx *sql.Tx) error {
+	if err := s.addColumns(ctx, tx, "flows", sqliteColumn{"vars", `TEXT NOT NULL DEFAULT '{}'`}); err != nil {
+		return err
+	}
+
+	columns, err := s.columns(ctx, tx, "signatures")
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(columns, "tag") {
+		return nil
+	}
+	for _, query := range []string{
+		`ALTER TABLE {signatures} ADD COLUMN tags TEXT NOT NULL DEFAULT '[]'`,
+		`UPDATE {signatures} SET tags = json_array(tag) WHERE tag != ''`,
+		`ALTER TABLE {signatures} DROP COLUMN tag`,
+	} {
+		if _, err := tx.ExecContext(ctx, s.sql(query)); err != nil {
+			return fmt.Errorf("failed to migrate the signature tags: %v", err)
+		}
+	}
+	return nil
+}
+
+// migrateCommunityIDs adds the community_id column of version 5 to the flows
+// and computes it for the flows stored without one.
+func (s *SqliteDatabase) migrateCommunityIDs(ctx context.Context, tx *sql.Tx) error {
+	if err := s.addColumns(ctx, tx, "flows", sqliteColumn{"community_id", `TEXT NOT NULL DEFAULT ''`}); err != nil {
+		return err
+	}
+
+	for last := int64(0); ; {
+		rows, err := tx.QueryContext(ctx, s.sql(`SELECT rowid, src_ip, src_port, dst_ip, dst_port, tags FROM {flows}
+			WHERE rowid > ? AND community_id = '' ORDER BY rowid LIMIT 1000`), last)
+		if err != nil {
+			return fmt.Errorf("failed to read flows: %v", err)
+		}
+		type storedFlow struct {
+			rowid int64
+			flow  FlowEntry
+		}
+		var batch []storedFlow
+		for rows.Next() {
+			var (
+				stored storedFlow
+				tags   string
+			)
+			if err := rows.Scan(&stored.rowid, &stored.flow.SrcIp, &stored.flow.SrcPort,
+				&stored.flow.DstIp, &stored.flow.DstPort, &tags); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to read flows: %v", err)
+			}
+			if err := json.Unmarshal([]byte(tags), &stored.flow.Tags); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to decode the tags of flow %d: %v", stored.rowid, err)
+			}
+			batch = append(batch, stored)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to read flows: %v", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, stored := range batch {
+			if _, err := tx.ExecContext(ctx, s.sql(`UPDATE {flows} SET community_id = ? WHERE rowid = ?`),
+				flowCommunityID(stored.flow), stored.rowid); err != nil {
+				return fmt.Errorf("failed to update flow: %v", err)
+			}
+		}
+		last = batch[len(batch)-1].rowid
+	}
+
+	if _, err := tx.ExecContext(ctx, s.sql(sqliteCommunityIDIndex)); err != nil {
+		return fmt.Errorf("failed to index the community_id of flows: %v", err)
+	}
+	return nil
+}
+
+// sqliteRegexp implements the REGEXP operator: `text REGEXP pattern`.
+func sqliteRegexp(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	pattern, ok := args[0].(string)
+	if !ok {
+		return nil, errors.New("regexp: pattern is not a string")
+	}
+	re, err := cachedRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	switch text := args[1].(type) {
+	case string:
+		return re.MatchString(text), nil
+	case []byte:
+		return re.Match(text), nil
+	case nil:
+		return false, nil
+	default:
+		return nil, fmt.Errorf("regexp: unsupported value %T", text)
+	}
+}
+
+var (
+	regexpCacheMu sync.Mutex
+	regexpCache   = map[string]*regexp.Regexp{}
+)
+
+// cachedRegexp compiles pattern once, instead of once per row.
+func cachedRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpCacheMu.Lock()
+	defer regexpCacheMu.Unlock()
+
+	if re, ok := regexpCache[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(regexpCache) >= 256 {
+		clear(regexpCache) // patterns come from user queries, don't keep them all
+	}
+	regexpCache[pattern] = re
+	return re, nil
+}
+
+// sqliteSearch implements tulip_search(flow, query), matching the full-text
+// search on the JSON encoded messages of a flow.
+func sqliteSearch(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	items, ok := args[0].(string)
+	if !ok {
+		return nil, errors.New("tulip_search: flow is not a string")
+	}
+	query, ok := args[1].(string)
+	if !ok {
+		return nil, errors.New("tulip_search: query is not a string")
+	}
+	search, err := cachedSearch(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var flow FlowEntry
+	if flow.Flow, err = decodeItems(items); err != nil {
+		return nil, fmt.Errorf("tulip_search: %v", err)
+	}
+	return search.Match(&flow), nil
+}
+
+// sqliteContains implements tulip_contains(flow, pattern), checking whether a
+// message of the JSON encoded flow contains the bytes of pattern.
+func sqliteContains(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	items, ok := args[0].(string)
+	if !ok {
+		return nil, errors.New("tulip_contains: flow is not a string")
+	}
+	pattern, ok := args[1].([]byte)
+	if !ok {
+		return nil, errors.New("tulip_contains: pattern is not a blob")
+	}
+
+	flowItems, err := decodeItems(items)
+	if err != nil {
+		return nil, fmt.Errorf("tulip_contains: %v", err)
+	}
+	return containsPattern(flowItems, pattern), nil
+}
+
+// sqlitePrefix implements tulip_prefix(ip, prefix), checking whether an
+// address is in a CIDR prefix.
+func sqlitePrefix(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	ip, ok := args[0].(string)
+	if !ok {
+		return nil, errors.New("tulip_prefix: ip is not a string")
+	}
+	prefix, ok := args[1].(string)
+	if !ok {
+		return nil, errors.New("tulip_prefix: prefix is not a string")
+	}
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("tulip_prefix: %v", err)
+	}
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && p.Contains(addr.Unmap()), nil
+}
+
+var (
+	searchCacheMu sync.Mutex
+	searchCache   = map[string]*SearchQuery{}
+)
+
+// cachedSearch parses query once, instead of once per row.
+func cachedSearch(query string) (*SearchQuery, error) {
+	searchCacheMu.Lock()
+	defer searchCacheMu.Unlock()
+
+	if search, ok := searchCache[query]; ok {
+		return search, nil
+	}
+	search, err := ParseSearch(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(searchCache) >= 256 {
+		clear(searchCache)
+	}
+	searchCache[query] = search
+	return search, nil
+}
+
+// toJSON encodes the array fields of flows.
+func toJSON(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err) // only used with slices of plain types
+	}
+	return string(data)
+}
+
+// indexPayload adds the messages of the flow at rowid to flows_fts and
+// flows_ngrams.
+func (s *SqliteDatabase) indexPayload(ctx context.Context, tx *sql.Tx, rowid int64, items []FlowItem) error {
+	payload := make([]string, 0, len(items))
+	for _, item := range items {
+		payload = append(payload, item.Data)
+	}
+	if _, err := tx.ExecContext(ctx, s.sql(`INSERT INTO {flows_fts} (rowid, data) VALUES (?, ?)`),
+		rowid, strings.Join(payload, "\n")); err != nil {
+		return fmt.Errorf("failed to index flow payload: %v", err)
+	}
+	trigrams, ok := flowTrigrams(items)
+	if !ok {
+		trigrams = []int32{unindexedTrigram}
+	}
+	if _, err := tx.ExecContext(ctx, s.sql(`INSERT INTO {flows_ngrams} (ngram, flow) SELECT value, ? FROM json_each(?)`),
+		rowid, toJSON(trigrams)); err != nil {
+		return fmt.Errorf("failed to index flow trigrams: %v", err)
+	}
+	return nil
+}
+
+// sqliteItem is a message of a flow as stored in SQLite. JSON strings only
+// hold UTF-8 text, so binary payloads are also kept in Bytes. Raw is not
+// stored, it is the bytes of Data.
+type sqliteItem struct {
+	FlowItem
+	Raw   []byte `json:"b64,omitempty"`
+	Bytes []byte `json:"bytes,omitempty"`
+}
+
+// encodeItems encodes the messages of a flow without losing their bytes.
+func encodeItems(items []FlowItem) string {
+	stored := make([]sqliteItem, len(items))
+	for i, item := range items {
+		stored[i].FlowItem = item
+		if !utf8.ValidString(item.Data) {
+			stored[i].Bytes = []byte(item.Data)
+		}
+	}
+	return toJSON(stored)
+}
+
+func decodeItems(data string) ([]FlowItem, error) {
+	var stored []sqliteItem
+	if err := json.Unmarshal([]byte(data), &stored); err != nil {
+		return nil, err
+	}
+	items := make([]FlowItem, len(stored))
+	for i, item := range stored {
+		items[i] = item.FlowItem
+		if item.Bytes != nil {
+			items[i].Data = string(item.Bytes)
+		}
+	}
+	return items, nil
+}
+
+// hexID is the text form of an ObjectID, empty for NilObjectID.
+func hexID(id primitive.ObjectID) string {
+	if id.IsZero() {
+		return ""
+	}
+	return id.Hex()
+}
+
+func parseHexID(id string) primitive.ObjectID {
+	objID, _ := primitive.ObjectIDFromHex(id)
+	return objID
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanFlow(row rowScanner) (FlowEntry, error) {
+	var (
+		flow                                                FlowEntry
+		id, parentID, childID                               string
+		fingerprints, suricata, items, tags, flags, flagids string
+		pcaps, app, vars                                    string
+	)
+	err := row.Scan(&id, &flow.Time, &flow.Duration, &flow.SrcIp, &flow.SrcPort, &flow.DstIp, &flow.DstPort,
+		&flow.Num_packets, &flow.Blocked, &flow.Filename, &parentID, &childID, &fingerprints, &suricata,
+		&items, &tags, &flow.Size, &flags, &flagids, &flow.Tick, &flow.Service, &pcaps, &flow.CommunityID, &app, &vars)
+	if err != nil {
+		return flow, err
+	}
+
+	flow.Id, flow.ParentId, flow.ChildId = parseHexID(id), parseHexID(parentID), parseHexID(childID)
+	if flow.Flow, err = decodeItems(items); err != nil {
+		return flow, fmt.Errorf("failed to decode flow %s: %v", id, err)
+	}
+	for i := range flow.Flow {
+		flow.Flow[i].Raw = []byte(flow.Flow[i].Data)
+	}
+	for _, field := range []struct {
+		data string
+		dst  any
+	}{
+		{fingerprints, &flow.Fingerprints},
+		{suricata, &flow.Suricata},
+		{tags, &flow.Tags},
+		{flags, &flow.Flags},
+		{flagids, &flow.Flagids},
+		{pcaps, &flow.Pcaps},
+		{app, &flow.App},
+		{vars, &flow.Vars},
+	} {
+		if err := json.Unmarshal([]byte(field.data), field.dst); err != nil {
+			return flow, fmt.Errorf("failed to decode flow %s: %v", id, err)
+		}
+	}
+	return flow, nil
+}
+
+// Flows are linked to the newest flow sharing one of their fingerprints, as
+// in MongoDatabase.InsertFlow.
+func (s *SqliteDatabase) InsertFlow(ctx context.Context, flow FlowEntry) error {
+	prepareFlow(&flow)
+	if flow.Id.IsZero() {
+		flow.Id = primitive.NewObjectID()
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if len(flow.Fingerprints) > 0 {
+		var child string
+		err := tx.QueryRowContext(ctx, s.sql(`
+			SELECT id FROM {flows} AS flows
+			WHERE EXISTS (SELECT 1 FROM json_each(flows.fingerprints) WHERE value IN (SELECT value FROM json_each(?)))
+			ORDER BY time DESC, rowid LIMIT 1`), toJSON(flow.Fingerprints)).Scan(&child)
+		if err == nil {
+			flow.ChildId = parseHexID(child)
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to find connected flow: %v", err)
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, s.sql(`INSERT INTO {flows} (`+flowColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		flow.Id.Hex(), flow.Time, flow.Duration, flow.SrcIp, flow.SrcPort, flow.DstIp, flow.DstPort,
+		flow.Num_packets, flow.Blocked, flow.Filename, hexID(flow.ParentId), hexID(flow.ChildId),
+		toJSON(nonNil(flow.Fingerprints)), toJSON(nonNil(flow.Suricata)), encodeItems(flow.Flow),
+		toJSON(nonNil(flow.Tags)), flow.Size, toJSON(nonNil(flow.Flags)), toJSON(nonNil(flow.Flagids)),
+		flow.Tick, flow.Service, toJSON(nonNil(flow.Pcaps)), flow.CommunityID, toJSON(flow.App), toJSON(flow.Vars))
+	if err != nil {
+		return fmt.Errorf("failed to insert flow: %v", err)
+	}
+
+	rowid, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to insert flow: %v", err)
+	}
+	if err := s.indexPayload(ctx, tx, rowid, flow.Flow); err != nil {
+		return err
+	}
+
+	if !flow.ChildId.IsZero() {
+		if _, err := tx.ExecContext(ctx, s.sql(`UPDATE {flows} SET parent_id = ? WHERE id = ?`),
+			flow.Id.Hex(), flow.ChildId.Hex()); err != nil {
+			return fmt.Errorf("failed to link flow to its child: %v", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// nonNil stores empty slices as [] instead of null.
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
+
+// flowsQuery converts the options of GetFlows to a WHERE clause.
+func (s *SqliteDatabase) flowsQuery(opts *GetFlowsOptions) (string, []any, error) {
+	if opts == nil {
+		return "", nil, nil
+	}
+
+	var (
+		conds []string
+		args  []any
+	)
+	add := func(cond string, values ...any) {
+		conds = append(conds, cond)
+		args = append(args, values...)
+	}
+
+	if opts.FromTime > 0 {
+		add("time >= ?", opts.FromTime)
+	}
+	if opts.ToTime > 0 {
+		add("time < ?", opts.ToTime)
+	}
+	if opts.DstPort > 0 {
+		add("dst_port = ?", opts.DstPort)
+	}
+	if len(opts.ExcludePorts) > 0 {
+		add("dst_port NOT IN (SELECT value FROM json_each(?))", toJSON(opts.ExcludePorts))
+	}
+	if opts.DstIp != "" {
+		add("dst_ip = ?", opts.DstIp)
+	}
+	if opts.SrcPort > 0 {
+		add("src_port = ?", opts.SrcPort)
+	}
+	if opts.SrcIp != "" {
+		add("src_ip = ?", opts.SrcIp)
+	}
+	addRange := func(column string, lo, hi *int) {
+		if lo != nil {
+			add(column+" >= ?", *lo)
+		}
+		if hi != nil {
+			add(column+" <= ?", *hi)
+		}
+	}
+	addRange("tick", opts.TickFrom, opts.TickTo)
+	addRange("duration", opts.DurationMin, opts.DurationMax)
+	addRange("size", opts.SizeMin, opts.SizeMax)
+	addRange("num_packets", opts.PacketsMin, opts.PacketsMax)
+	if opts.Service != "" {
+		add("service = ?", opts.Service)
+	}
+	for _, filter := range appFilters(opts) {
+		add("EXISTS (SELECT 1 FROM json_each(flows.app, '$."+filter.field+"') WHERE value = ?)", filter.value)
+	}
+	for _, tag := range opts.IncludeTags {
+		add("EXISTS (SELECT 1 FROM json_each(flows.tags) WHERE value = ?)", tag)
+	}
+	if len(opts.ExcludeTags) > 0 {
+		add("NOT EXISTS (SELECT 1 FROM json_each(flows.tags) WHERE value IN (SELECT value FROM json_each(?)))",
+			toJSON(opts.ExcludeTags))
+	}
+	for _, flag := range opts.Flags {
+		add("EXISTS (SELECT 1 FROM json_each(flows.flags) WHERE value = ?)", flag)
+	}
+	for _, flagID := range opts.FlagIds {
+		add("EXISTS (SELECT 1 FROM json_each(flows.flagids) WHERE value = ?)", flagID)
+	}
+	if opts.FlowData != "" {
+		pattern := "(?i)" + opts.FlowData
+		if _, err := cachedRegexp(pattern); err != nil {
+			return "", nil, fmt.Errorf("invalid flow data regex: %v", err)
+		}
+		add("EXISTS (SELECT 1 FROM json_each(flows.flow) WHERE json_extract(value, '$.data') REGEXP ?)", pattern)
+	}
+	if opts.Search != "" {
+		search, err := cachedSearch(opts.Search)
+		if err != nil {
+			return "", nil, err
+		}
+		// FTS5 finds the flows containing the required terms anywhere in
+		// their payload, tulip_search then checks the whole query
+		if match := search.ftsMatch(); match != "" {
+			add(s.sql("flows.rowid IN (SELECT rowid FROM {flows_fts} WHERE {flows_fts} MATCH ?)"), match)
+		}
+		add("tulip_search(flows.flow, ?)", opts.Search)
+	}
+	if opts.Query != nil {
+		cond, values := sqliteFlowQuery(opts.Query)
+		add(cond, values...)
+	}
+	if len(opts.Contains) > 0 {
+		// flows_ngrams finds the flows with all the trigrams of the pattern,
+		// tulip_contains then looks for the pattern in each message
+		if trigrams := patternTrigrams(opts.Contains); len(trigrams) > 0 {
+			add(s.sql(`flows.rowid IN (
+				SELECT flow FROM {flows_ngrams} WHERE ngram IN (SELECT value FROM json_each(?))
+				GROUP BY flow HAVING COUNT(*) = ?
+				UNION ALL
+				SELECT flow FROM {flows_ngrams} WHERE ngram = ?)`),
+				toJSON(trigrams), len(trigrams), unindexedTrigram)
+		}
+		add("tulip_contains(flows.flow, ?)", opts.Contains)
+	}
+
+	if len(conds) == 0 {
+		return "", nil, nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args, nil
+}
+
+// sqliteFlowQuery translates a flow query to a condition on the flows, with
+// its arguments.
+func sqliteFlowQuery(q *FlowQuery) (string, []any) {
+	switch q.op {
+	case queryNot:
+		cond, args := sqliteFlowQuery(q.children[0])
+		return "NOT " + cond, args
+	case queryAnd, queryOr:
+		var (
+			conds []string
+			args  []any
+		)
+		for _, child := range q.children {
+			cond, values := sqliteFlowQuery(child)
+			conds = append(conds, cond)
+			args = append(args, values...)
+		}
+		sep := " AND "
+		if q.op == queryOr {
+			sep = " OR "
+		}
+		return "(" + strings.Join(conds, sep) + ")", args
+	}
+
+	t := q.term
+	between := func(column string) (string, []any) {
+		var (
+			conds []string
+			args  []any
+		)
+		if t.lo != nil {
+			conds, args = append(conds, column+" >= ?"), append(args, *t.lo)
+		}
+		if t.hi != nil {
+			conds, args = append(conds, column+" <= ?"), append(args, *t.hi)
+		}
+		return "(" + strings.Join(conds, " AND ") + ")", args
+	}
+	switch f := t.field; f.kind {
+	case queryString:
+		return "(" + f.sqlite + " = ?)", []any{t.value}
+	case queryList:
+		return "EXISTS (SELECT 1 FROM json_each(" + f.sqlite + ") WHERE value = ?)", []any{t.value}
+	case queryNumber:
+		return between(f.sqlite)
+	case queryNumbers:
+		cond, args := between("value")
+		return "EXISTS (SELECT 1 FROM json_each(" + f.sqlite + ") WHERE " + cond + ")", args
+	case queryAddress:
+		if t.prefix.IsSingleIP() {
+			return "(" + f.sqlite + " = ?)", []any{t.prefix.Addr().String()}
+		}
+		return "tulip_prefix(" + f.sqlite + ", ?)", []any{t.prefix.String()}
+	}
+
+	switch {
+	case t.search != nil:
+		return "tulip_search(flows.flow, ?)", []any{t.value}
+	case t.regex != nil:
+		return "EXISTS (SELECT 1 FROM json_each(flows.flow) WHERE json_extract(value, '$.data') REGEXP ?)", []any{t.value}
+	default:
+		return "tulip_contains(flows.flow, ?)", []any{t.pattern}
+	}
+}
+
+func (s *SqliteDatabase) GetFlows(ctx context.Context, opts *GetFlowsOptions) ([]FlowEntry, error) {
+	where, args, err := s.flowsQuery(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	order := ` ORDER BY time DESC, id DESC`
+	if opts != nil && opts.Cursor != nil {
+		cond := `time <= ? AND (time < ? OR id < ?)`
+		if opts.Cursor.Before {
+			// the page closest to the cursor, reversed below
+			cond, order = `time >= ? AND (time > ? OR id > ?)`, ` ORDER BY time, id`
+		}
+		if where == "" {
+			where = " WHERE " + cond
+		} else {
+			where += " AND " + cond
+		}
+		args = append(args, opts.Cursor.Time, opts.Cursor.Time, opts.Cursor.Id.Hex())
+	}
+
+	query := s.sql(`SELECT `+flowColumns+` FROM {flows} AS flows`) + where + order
+	if opts != nil {
+		limit := opts.Limit
+		if limit <= 0 {
+			limit = DefaultFlowsLimit
+		}
+		query += ` LIMIT ? OFFSET ?`
+		args = append(args, limit, max(opts.Offset, 0))
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find flows: %v", err)
+	}
+	defer rows.Close()
+
+	results := make([]FlowEntry, 0)
+	for rows.Next() {
+		flow, err := scanFlow(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, flow)
+	}
+	if opts != nil && opts.Cursor != nil && opts.Cursor.Before {
+		slices.Reverse(results)
+	}
+	return results, rows.Err()
+}
+
+func (s *SqliteDatabase) CountFlows(ctx context.Context, opts *GetFlowsOptions) (int, error) {
+	where, args, err := s.flowsQuery(opts)
+	if err != nil {
+		return 0, err
+	}
+
+	query := s.sql(`SELECT COUNT(*) FROM {flows} AS flows`) + where
+	if opts != nil && opts.MaxCount > 0 {
+		query = s.sql(`SELECT COUNT(*) FROM (SELECT 1 FROM {flows} AS flows`) + where + ` LIMIT ?)`
+		args = append(args, opts.MaxCount)
+	}
+	var count int
+	if err := s.db.QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count flows: %v", err)
+	}
+	return count, nil
+}
+
+func (s *SqliteDatabase) GetFlowByID(ctx context.Context, id string) (*FlowEntry, error) {
+	if _, err := primitive.ObjectIDFromHex(id); err != nil {
+		return nil, ErrNotFound
+	}
+
+	flow, err := scanFlow(s.db.QueryRowContext(ctx, s.sql(`SELECT `+flowColumns+` FROM {flows} WHERE id = ?`), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to find flow: %v", err)
+	}
+	return &flow, nil
+}
+
+// DeleteFlows also removes the flows from flows_fts and flows_ngrams. Their
+// trigrams are computed again from the payloads, so that the rows are found
+// with the primary key of flows_ngrams.
+func (s *SqliteDatabase) DeleteFlows(ctx context.Context, ids []string) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	deleted := 0
+	for _, id := range ids {
+		var (
+			rowid int64
+			items string
+		)
+		err := tx.QueryRowContext(ctx, s.sql(`SELECT rowid, flow FROM {flows} WHERE id = ?`), id).Scan(&rowid, &items)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return 0, fmt.Errorf("failed to find flow: %v", err)
+		}
+
+		flowItems, err := decodeItems(items)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decode flow %s: %v", id, err)
+		}
+		trigrams, ok := flowTrigrams(flowItems)
+		if !ok {
+			trigrams = []int32{unindexedTrigram}
+		}
+
+		if _, err := tx.ExecContext(ctx, s.sql(`DELETE FROM {flows_ngrams} WHERE ngram IN (SELECT value FROM json_each(?)) AND flow = ?`),
+			toJSON(trigrams), rowid); err != nil {
+			return 0, fmt.Errorf("failed to delete flow trigrams: %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, s.sql(`DELETE FROM {flows_fts} WHERE rowid = ?`), rowid); err != nil {
+			return 0, fmt.Errorf("failed to delete flow payload index: %v", err)
+		}
+		if _, err := tx.ExecContext(ctx, s.sql(`DELETE FROM {flows} WHERE rowid = ?`), rowid); err != nil {
+			return 0, fmt.Errorf("failed to delete flow: %v", err)
+		}
+		deleted++
+	}
+	return deleted, tx.Commit()
+}
+
+func (s *SqliteDatabase) SetStar(ctx context.Context, flowID string, star bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var tagsJSON string
+	err = tx.QueryRowContext(ctx, s.sql(`SELECT tags FROM {flows} WHERE id = ?`), flowID).Scan(&tagsJSON)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to find flow: %v", err)
+	}
+
+	var tags []string
+	if err := json.Unmarshal([]byte(tagsJSON), &tags); err != nil {
+		return fmt.Errorf("failed to decode flow tags: %v", err)
+	}
+	if star {
+		tags = addToSet(tags, "starred")
+	} else {
+		tags = slices.DeleteFunc(tags, func(tag string) bool { return tag == "starred" })
+	}
+
+	if _, err := tx.ExecContext(ctx, s.sql(`UPDATE {flows} SET tags = ? WHERE id = ?`), toJSON(nonNil(tags)), flowID); err != nil {
+		return fmt.Errorf("failed to update flow: %v", err)
+	}
+	return tx.Commit()
+}
+
+// flowUpdate is the change made to a flow by updateFlow.
+type flowUpdate struct {
+	tags  []string  // Tags to add
+	sigID string    // Signature to add, counting a hit
+	block bool      // Mark the flow as blocked
+	app   *AppLayer // Application layer metadata to merge
+	vars  *RuleVars // Rule variables to merge
+}
+
+// updateFlow applies update to the flow matching id, reporting whether a flow
+// was found. The latest flow with the Community ID of id in progress within
+// window ms is preferred, then the first one matching its 5-tuple within
+// window ms.
+func (s *SqliteDatabase) updateFlow(ctx context.Context, tx *sql.Tx, id FlowID, window int, update flowUpdate) (bool, error) {
+	epoch := int(id.Time.UnixMilli())
+
+	var (
+		flowID, tagsJSON, suricataJSON, appJSON, varsJSON string
+		tick                                              int
+	)
+	err := sql.ErrNoRows
+	if id.CommunityID != "" {
+		err = tx.QueryRowContext(ctx, s.sql(`
+			SELECT id, tags, suricata, app, vars, tick FROM {flows}
+			WHERE community_id = ? AND time < ? AND time + duration > ?
+			ORDER BY time DESC LIMIT 1`),
+			id.CommunityID, epoch+window, epoch-window,
+		).Scan(&flowID, &tagsJSON, &suricataJSON, &appJSON, &varsJSON, &tick)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		err = tx.QueryRowContext(ctx, s.sql(`
+			SELECT id, tags, suricata, app, vars, tick FROM {flows}
+			WHERE src_port = ? AND dst_port = ? AND src_ip = ? AND dst_ip = ? AND time > ? AND time < ?
+			ORDER BY rowid LIMIT 1`),
+			id.Src_port, id.Dst_port, id.Src_ip, id.Dst_ip, epoch-window, epoch+window,
+		).Scan(&flowID, &tagsJSON, &suricataJSON, &appJSON, &varsJSON, &tick)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to find flow: %v", err)
+	}
+
+	var (
+		flowTags, suricata []string
+		app                AppLayer
+		vars               RuleVars
+	)
+	if err := json.Unmarshal([]byte(tagsJSON), &flowTags); err != nil {
+		return false, fmt.Errorf("failed to decode flow tags: %v", err)
+	}
+	if err := json.Unmarshal([]byte(suricataJSON), &suricata); err != nil {
+		return false, fmt.Errorf("failed to decode flow signatures: %v", err)
+	}
+	if err := json.Unmarshal([]byte(appJSON), &app); err != nil {
+		return false, fmt.Errorf("failed to decode flow metadata: %v", err)
+	}
+	if err := json.Unmarshal([]byte(varsJSON), &vars); err != nil {
+		return false, fmt.Errorf("failed to decode flow variables: %v", err)
+	}
+	flowTags = addToSet(flowTags, update.tags...)
+	// a redelivered alert is counted once
+	newHit := update.sigID != "" && !slices.Contains(suricata, update.sigID)
+	if newHit {
+		suricata = append(suricata, update.sigID)
+	}
+	if update.app != nil {
+		app.merge(*update.app)
+	}
+	if update.vars != nil {
+		vars.merge(*update.vars)
+	}
+
+	_, err = tx.ExecContext(ctx, s.sql(`UPDATE {flows} SET tags = ?, suricata = ?, app = ?, vars = ?, blocked = blocked OR ?
+		WHERE id = ?`), toJSON(nonNil(flowTags)), toJSON(nonNil(suricata)), toJSON(app), toJSON(vars), update.block, flowID)
+	if err != nil {
+		return false, fmt.Errorf("failed to update flow: %v", err)
+	}
+
+	// count the alert in the tick of the flow
+	if newHit {
+		_, err = tx.ExecContext(ctx, s.sql(`INSERT INTO {signature_hits} (signature, tick, hits) VALUES (?, ?, 1)
+			ON CONFLICT (signature, tick) DO UPDATE SET hits = hits + 1`), update.sigID, max(tick, -1))
+		if err != nil {
+			return false, fmt.Errorf("failed to count signature hit: %v", err)
+		}
+	}
+	return true, nil
+}
+
+// addSignature stores a signature, updating the one with the same gid, sid
+// and rev if any, and returns its ID.
+func (s *SqliteDatabase) addSignature(ctx context.Context, tx *sql.Tx, sig Signature) (string, error) {
+	var id string
+	err := tx.QueryRowContext(ctx, s.sql(`
+		INSERT INTO {signatures} (id, gid, sig_id, rev, msg, action, tags, severity, category) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (gid, sig_id, rev) DO UPDATE SET
+			msg = excluded.msg, action = excluded.action, tags = excluded.tags,
+			severity = excluded.severity, category = excluded.category
+		RETURNING id`),
+		primitive.NewObjectID().Hex(), sig.GID, sig.ID, sig.Rev, sig.Msg, sig.Action, toJSON(nonNil(sig.Tags)), sig.Severity, sig.Category,
+	).Scan(&id)
+	if err != nil {
+		return "", fmt.Errorf("failed to insert signature: %v", err)
+	}
+	return id, nil
+}
+
+func (s *SqliteDatabase) AddSignatureToFlow(ctx context.Context, id FlowID, sig Signature, window int) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	sigID, err := s.addSignature(ctx, tx, sig)
+	if err != nil {
+		return false, err
+	}
+
+	tags := []string{"suricata"}
+	for _, tag := range sig.Tags {
+		if err := s.insertTag(ctx, tx, Tag{Name: tag}); err != nil {
+			return false, err
+		}
+		tags = append(tags, tag)
+	}
+	if sig.Action == "blocked" {
+		tags = append(tags, "blocked")
+	}
+
+	found, err := s.updateFlow(ctx, tx, id, window, flowUpdate{tags: tags, sigID: sigID, block: sig.Action == "blocked"})
+	if err != nil {
+		return false, err
+	}
+	return found, tx.Commit()
+}
+
+func (s *SqliteDatabase) AddTagsToFlow(ctx context.Context, id FlowID, tags []string, window int) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, tag := range tags {
+		if err := s.insertTag(ctx, tx, Tag{Name: tag}); err != nil {
+			return false, err
+		}
+	}
+
+	found, err := s.updateFlow(ctx, tx, id, window, flowUpdate{tags: tags})
+	if err != nil {
+		return false, err
+	}
+	return found, tx.Commit()
+}
+
+func (s *SqliteDatabase) AddAppLayerToFlow(ctx context.Context, id FlowID, app AppLayer, window int) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	found, err := s.updateFlow(ctx, tx, id, window, flowUpdate{app: &app})
+	if err != nil {
+		return false, err
+	}
+	return found, tx.Commit()
+}
+
+func (s *SqliteDatabase) AddVarsToFlow(ctx context.Context, id FlowID, vars RuleVars, window int) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	found, err := s.updateFlow(ctx, tx, id, window, flowUpdate{vars: &vars})
+	if err != nil {
+		return false, err
+	}
+	return found, tx.Commit()
+}
+
+func (s *SqliteDatabase) GetTagList(ctx context.Context) ([]string, error) {
+	tags := make([]string, 0)
+	for _, query := range []string{
+		`SELECT name FROM {tags} ORDER BY rowid`,
+		`SELECT DISTINCT tag.value FROM {flows} AS flows, json_each(flows.tags) AS tag`,
+	} {
+		rows, err := s.db.QueryContext(ctx, s.sql(query))
+		if err != nil {
+			return nil, fmt.Errorf("failed to find tags: %v", err)
+		}
+		for rows.Next() {
+			var tag string
+			if err := rows.Scan(&tag); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to decode tag: %v", err)
+			}
+			tags = addToSet(tags, tag)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to find tags: %v", err)
+		}
+	}
+	return tags, nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func (s *SqliteDatabase) insertTag(ctx context.Context, db execer, tag Tag) error {
+	if tag.CreatedAt == 0 {
+		tag.CreatedAt = time.Now().UnixMilli()
+	}
+	_, err := db.ExecContext(ctx, s.sql(`INSERT INTO {tags} (name, color, description, origin, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET
+			color       = iif(color = '', excluded.color, color),
+			description = iif(description = '', excluded.description, description),
+			origin      = iif(origin = '', excluded.origin, origin),
+			created_at  = iif(created_at = 0, excluded.created_at, created_at)`),
+		tag.Name, tag.Color, tag.Description, tag.Origin, tag.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert tag: %v", err)
+	}
+	return nil
+}
+
+func (s *SqliteDatabase) InsertTag(ctx context.Context, tag Tag) error {
+	return s.insertTag(ctx, s.db, tag)
+}
+
+func (s *SqliteDatabase) GetTags(ctx context.Context) ([]Tag, error) {
+	names, err := s.GetTagList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.sql(`SELECT name, color, description, origin, created_at FROM {tags}`))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find tags: %v", err)
+	}
+	defer rows.Close()
+
+	var records []Tag
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.Name, &tag.Color, &tag.Description, &tag.Origin, &tag.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to decode tag: %v", err)
+		}
+		records = append(records, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to find tags: %v", err)
+	}
+	return mergeTags(names, records), nil
+}
+
+func (s *SqliteDatabase) UpdateTag(ctx context.Context, tag Tag) error {
+	if tag.CreatedAt == 0 {
+		tag.CreatedAt = time.Now().UnixMilli()
+	}
+	_, err := s.db.ExecContext(ctx, s.sql(`INSERT INTO {tags} (name, color, description, origin, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET color = excluded.color, description = excluded.description`),
+		tag.Name, tag.Color, tag.Description, tag.Origin, tag.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to update tag: %v", err)
+	}
+	return nil
+}
+
+func (s *SqliteDatabase) DeleteTag(ctx context.Context, name string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	deleted, err := tx.ExecContext(ctx, s.sql(`DELETE FROM {tags} WHERE name = ?`), name)
+	if err != nil {
+		return fmt.Errorf("failed to delete tag: %v", err)
+	}
+	updated, err := tx.ExecContext(ctx, s.sql(`UPDATE {flows}
+		SET tags = (SELECT json_group_array(value) FROM json_each(tags) WHERE value != ?1)
+		WHERE EXISTS (SELECT 1 FROM json_each(tags) WHERE value = ?1)`), name)
+	if err != nil {
+		return fmt.Errorf("failed to remove tag from flows: %v", err)
+	}
+
+	n, _ := deleted.RowsAffected()
+	m, _ := updated.RowsAffected()
+	if n+m == 0 {
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
+
+// GetSignature returns a signature by its integer ID or ObjectID string
+func (s *SqliteDatabase) GetSignature(ctx context.Context, id string) (Signature, error) {
+	query := s.sql(`SELECT ` + signatureColumns + ` FROM {signatures} `)
+	var arg any
+	if _, err := primitive.ObjectIDFromHex(id); err == nil {
+		query, arg = query+`WHERE id = ?`, id
+	} else if intID, err := strconv.Atoi(id); err == nil {
+		query, arg = query+`WHERE sig_id = ? ORDER BY rev DESC, rowid LIMIT 1`, intID
+	} else {
+		return Signature{}, ErrNotFound
+	}
+
+	sig, err := scanSignature(s.db.QueryRowContext(ctx, query, arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Signature{}, ErrNotFound
+	} else if err != nil {
+		return Signature{}, fmt.Errorf("failed to find signature: %v", err)
+	}
+	return sig, nil
+}
+
+const signatureColumns = `id, gid, sig_id, rev, msg, action, tags, severity, category`
+
+func scanSignature(row rowScanner) (Signature, error) {
+	var (
+		sig         Signature
+		objID, tags string
+	)
+	err := row.Scan(&objID, &sig.GID, &sig.ID, &sig.Rev, &sig.Msg, &sig.Action, &tags, &sig.Severity, &sig.Category)
+	if err != nil {
+		return sig, err
+	}
+	sig.MongoID = parseHexID(objID)
+	return sig, decodeSignatureTags(&sig, tags)
+}
+
+// decodeSignatureTags decodes the tags column of a signature.
+func decodeSignatureTags(sig *Signature, tags string) error {
+	if err := json.Unmarshal([]byte(tags), &sig.Tags); err != nil {
+		return fmt.Errorf("failed to decode the tags of signature %s: %v", sig.MongoID.Hex(), err)
+	}
+	if len(sig.Tags) == 0 {
+		sig.Tags = nil
+	}
+	return nil
+}
+
+func (s *SqliteDatabase) GetTopSignatures(ctx context.Context, opts *SignatureStatsOptions) ([]SignatureStats, error) {
+	if opts == nil {
+		opts = &SignatureStatsOptions{}
+	}
+	tickFrom, tickTo := math.MinInt, math.MaxInt
+	if opts.TickFrom != nil {
+		tickFrom = *opts.TickFrom
+	}
+	if opts.TickTo != nil {
+		tickTo = *opts.TickTo
+	}
+	limit := -1
+	if opts.Limit > 0 {
+		limit = opts.Limit
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.sql(`
+		WITH top AS (
+			SELECT signature, sum(hits) AS total FROM {signature_hits}
+			WHERE tick BETWEEN ?1 AND ?2
+			GROUP BY signature ORDER BY total DESC, signature LIMIT ?3
+		)
+		SELECT top.total, hits.tick, hits.hits,
+			sig.id, sig.gid, sig.sig_id, sig.rev, sig.msg, sig.action, sig.tags, sig.severity, sig.category
+		FROM top
+		JOIN {signatures} AS sig ON sig.id = top.signature
+		JOIN {signature_hits} AS hits ON hits.signature = top.signature AND hits.tick BETWEEN ?1 AND ?2
+		ORDER BY top.total DESC, top.signature, hits.tick`), tickFrom, tickTo, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find signatures: %v", err)
+	}
+	defer rows.Close()
+
+	stats := make([]SignatureStats, 0)
+	for rows.Next() {
+		var (
+			stat        SignatureStats
+			hits        SignatureHits
+			objID, tags string
+			sig         = &stat.Signature
+		)
+		err := rows.Scan(&stat.Hits, &hits.Tick, &hits.Hits,
+			&objID, &sig.GID, &sig.ID, &sig.Rev, &sig.Msg, &sig.Action, &tags, &sig.Severity, &sig.Category)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode signature: %v", err)
+		}
+		sig.MongoID = parseHexID(objID)
+		if n := len(stats); n > 0 && stats[n-1].Signature.MongoID == sig.MongoID {
+			stats[n-1].Ticks = append(stats[n-1].Ticks, hits)
+			continue
+		}
+		if err := decodeSignatureTags(sig, tags); err != nil {
+			return nil, err
+		}
+		stat.Ticks = []SignatureHits{hits}
+		stats = append(stats, stat)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to find signatures: %v", err)
+	}
+	return stats, nil
+}
+
+const pcapColumns = `file_name, position, finished, location, size, archived_at, removed`
+
+func scanPcap(row rowScanner) (PcapFile, error) {
+	var file PcapFile
+	err := row.Scan(&file.FileName, &file.Position, &file.Finished, &file.Location, &file.Size,
+		&file.ArchivedAt, &file.Removed)
+	return file, err
+}
+
+func (s *SqliteDatabase) GetPcap(ctx context.Context, name string) (PcapFile, error) {
+	file, err := scanPcap(s.db.QueryRowContext(ctx, s.sql(`SELECT `+pcapColumns+` FROM {files_imported} WHERE file_name = ?`), name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return PcapFile{}, ErrNotFound
+	} else if err != nil {
+		return PcapFile{}, fmt.Errorf("failed to find pcap file: %v", err)
+	}
+	return file, nil
+}
+
+func (s *SqliteDatabase) InsertPcap(ctx context.Context, file PcapFile) error {
+	_, err := s.db.ExecContext(ctx, s.sql(`INSERT INTO {files_imported} (`+pcapColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (file_name) DO UPDATE SET
+			position = excluded.position, finished = excluded.finished, location = excluded.location,
+			size = excluded.size, archived_at = excluded.archived_at, removed = excluded.removed`),
+		file.FileName, file.Position, file.Finished, file.Location, file.Size, file.ArchivedAt, file.Removed)
+	if err != nil {
+		return fmt.Errorf("failed to insert pcap file: %v", err)
+	}
+	return nil
+}
+
+func (s *SqliteDatabase) GetPcapList(ctx context.Context) ([]PcapFile, error) {
+	rows, err := s.db.QueryContext(ctx, s.sql(`SELECT `+pcapColumns+` FROM {files_imported} ORDER BY rowid`))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find pcap files: %v", err)
+	}
+	defer rows.Close()
+
+	results := make([]PcapFile, 0)
+	for rows.Next() {
+		file, err := scanPcap(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode pcap file: %v", err)
+		}
+		results = append(results, file)
+	}
+	return results, rows.Err()
+}
+
+func (s *SqliteDatabase) AddDeadLetter(ctx context.Context, letter DeadLetter) error {
+	_, err := s.db.ExecContext(ctx, s.sql(`INSERT INTO {dead_letters} (id, event, reason, attempts, first_seen, dead_at)
+		VALUES (?, ?, ?, ?, ?, ?)`),
+		primitive.NewObjectID().Hex(), letter.Event, letter.Reason, letter.Attempts, letter.FirstSeen, letter.DeadAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert dead letter: %v", err)
+	}
+	return nil
+}
+
+func (s *SqliteDatabase) GetDeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.QueryContext(ctx, s.sql(`SELECT id, event, reason, attempts, first_seen, dead_at
+		FROM {dead_letters} ORDER BY rowid DESC LIMIT ?`), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find dead letters: %v", err)
+	}
+	defer rows.Close()
+
+	letters := make([]DeadLetter, 0)
+	for rows.Next() {
+		var (
+			letter DeadLetter
+			id     string
+		)
+		if err := rows.Scan(&id, &letter.Event, &letter.Reason, &letter.Attempts, &letter.FirstSeen, &letter.DeadAt); err != nil {
+			return nil, fmt.Errorf("failed to decode dead letter: %v", err)
+		}
+		letter.MongoID = parseHexID(id)
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
+
+func (s *SqliteDatabase) GetFlagIds(ctx context.Context) ([]FlagIdEntry, error) {
+	rows, err := s.db.QueryContext(ctx,
+		s.sql(`SELECT service, team, round, description, flagid FROM {flagids} WHERE flagid != '' ORDER BY rowid`))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find flag ids: %v", err)
+	}
+	defer rows.Close()
+
+	entries := make([]FlagIdEntry, 0)
+	for rows.Next() {
+		var entry FlagIdEntry
+		if err := rows.Scan(&entry.Service, &entry.Team, &entry.Round, &entry.Description, &entry.FlagId); err != nil {
+			return nil, fmt.Errorf("failed to decode flag id: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// InsertFlagIds stores flag IDs, replacing the ones with the same service,
+// team, round and value.
+func (s *SqliteDatabase) InsertFlagIds(ctx context.Context, ids []FlagIdEntry) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		_, err := tx.ExecContext(ctx, s.sql(`INSERT INTO {flagids} (service, team, round, description, flagid)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (service, team, round, flagid) DO UPDATE SET description = excluded.description`),
+			id.Service, id.Team, id.Round, id.Description, id.FlagId)
+		if err != nil {
+			return fmt.Errorf("failed to insert flag id: %v", err)
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,250 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSqliteDatabase(t *testing.T) {
+	testConformance(t, func(t *testing.T) Database {
+		database, err := ConnectSqlite(filepath.Join(t.TempDir(), "tulip.db"))
+		if err != nil {
+			t.Fatalf("ConnectSqlite failed: %v", err)
+		}
+		t.Cleanup(func() { database.Close(context.Background()) })
+		return database
+	})
+}
+
+func TestConnect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tulip.db")
+
+	cases := []struct {
+		uri     string
+		want    string
+		wantErr bool
+	}{
+		{"sqlite://" + path, "*db.SqliteDatabase", false},
+		{"memory://", "*db.MemoryDatabase", false},
+		{"sqlite://", "", true},
+		{"localhost:27017", "", true},
+		{"redis://localhost", "", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.uri, func(t *testing.T) {
+			database, err := Connect(tc.uri)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Connect(%q) succeeded, want error", tc.uri)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Connect(%q) failed: %v", tc.uri, err)
+			}
+			defer database.Close(context.Background())
+			if got := fmt.Sprintf("%T", database); got != tc.want {
+				t.Errorf("Connect(%q) = %s, want %s", tc.uri, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSqliteDatabase_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tulip.db")
+
+	database, err := Connect("sqlite://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InsertFlow(t.Context(), FlowEntry{SrcPort: 1234, Tags: []string{"tcp"}}); err != nil {
+		t.Fatal(err)
+	}
+	database.Close(t.Context())
+
+	database, err = Connect("sqlite://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close(t.Context())
+	flows, err := database.GetFlows(t.Context(), nil)
+	if err != nil || len(flows) != 1 || flows[0].SrcPort != 1234 {
+		t.Errorf("GetFlows after reopening = %+v, %v", flows, err)
+	}
+}
+
+func TestConnectNamespace(t *testing.T) {
+	uri := "sqlite://" + filepath.Join(t.TempDir(), "tulip.db")
+
+	database, err := ConnectNamespace(uri, "game2")
+	if err != nil {
+		t.Fatalf("ConnectNamespace failed: %v", err)
+	}
+	defer database.Close(context.Background())
+	if database.Namespace() != "game2" {
+		t.Errorf("Namespace = %q, want game2", database.Namespace())
+	}
+
+	if _, err := ConnectNamespace(uri, "game 2"); err == nil {
+		t.Error("ConnectNamespace with an invalid namespace succeeded, want error")
+	}
+}
+
+func TestSqliteDatabase_Migrate(t *testing.T) {
+	database, err := ConnectSqlite(filepath.Join(t.TempDir(), "tulip.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close(t.Context())
+	oldSig, newSig := primitive.NewObjectID().Hex(), primitive.NewObjectID().Hex()
+	flow := FlowEntry{SrcIp: "10.0.0.2", SrcPort: 1234, DstIp: "10.0.0.1", DstPort: 80, Tick: 7, Tags: []string{"tcp"}, Suricata: []string{oldSig},
+		Flow: []FlowItem{{From: "c", Data: "GET /flag\x00 HTTP/1.0"}}}
+	if err := database.InsertFlow(t.Context(), flow); err != nil {
+		t.Fatal(err)
+	}
+
+	// turn it into a version 1 namespace: no version, printable raw, no payload
+	// indexes, bare tags, signatures without revisions and flows without
+	// community_id, app nor vars
+	for _, query := range []string{
+		`DROP INDEX {flows_community_id}`,
+		`ALTER TABLE {flows} DROP COLUMN community_id`,
+		`ALTER TABLE {flows} DROP COLUMN app`,
+		`ALTER TABLE {flows} DROP COLUMN vars`,
+		`DROP TABLE {signatures}`,
+		`CREATE TABLE {signatures} (id TEXT PRIMARY KEY, sig_id INTEGER NOT NULL, msg TEXT NOT NULL,
+			action TEXT NOT NULL, tag TEXT NOT NULL, UNIQUE (sig_id, msg, action, tag))`,
+		`INSERT INTO {signatures} VALUES ('` + oldSig + `', 1000, 'old message', 'allowed', ''),
+			('` + newSig + `', 1000, 'new message', 'allowed', 'exploit')`,
+		`DELETE FROM {meta}`,
+		`DROP TABLE {tags}`,
+		`CREATE TABLE {tags} (name TEXT PRIMARY KEY)`,
+		`INSERT INTO {tags} (name) VALUES ('legacy')`,
+		`UPDATE {flows} SET flow = '[{"from":"c","data":"GET /flag\u0000 HTTP/1.0","b64":"R0VUIC9mbGFnIEhUVFAvMS4w","time":0}]'`,
+		`INSERT INTO {flows_fts} ({flows_fts}) VALUES ('delete-all')`,
+		`DELETE FROM {flows_ngrams}`,
+	} {
+		if _, err := database.db.Exec(database.sql(query)); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+
+	var schemaErr *SchemaError
+	if err := CheckSchema(t.Context(), database); !errors.As(err, &schemaErr) || schemaErr.Version != 1 {
+		t.Fatalf("CheckSchema = %v, want a SchemaError for version 1", err)
+	}
+
+	if err := database.Migrate(t.Context()); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if err := CheckSchema(t.Context(), database); err != nil {
+		t.Errorf("CheckSchema after Migrate failed: %v", err)
+	}
+
+	pattern, _ := ParsePattern("flag|00|")
+	for _, opts := range []*GetFlowsOptions{{Contains: pattern}, {Search: "flag"}} {
+		flows, err := database.GetFlows(t.Context(), opts)
+		if err != nil || len(flows) != 1 {
+			t.Fatalf("GetFlows(%+v) after Migrate = %d flows, %v; want 1", opts, len(flows), err)
+		}
+		if raw := string(flows[0].Flow[0].Raw); raw != flow.Flow[0].Data {
+			t.Errorf("Raw = %q, want %q", raw, flow.Flow[0].Data)
+		}
+	}
+
+	if err := database.InsertTag(t.Context(), Tag{Name: "legacy", Color: "info", Origin: TagOriginSuricata}); err != nil {
+		t.Fatalf("InsertTag after Migrate failed: %v", err)
+	}
+	if tags, err := database.GetTags(t.Context()); err != nil || !slices.ContainsFunc(tags, func(tag Tag) bool {
+		return tag.Name == "legacy" && tag.Color == "info" && tag.Origin == TagOriginSuricata
+	}) {
+		t.Errorf("GetTags after Migrate = %v, %v; want the legacy tag with its metadata", tags, err)
+	}
+
+	if sig, err := database.GetSignature(t.Context(), "1000"); err != nil || sig.Msg != "new message" || sig.Rev != -1 || sig.GID != 1 ||
+		!slices.Equal(sig.Tags, []string{"exploit"}) {
+		t.Errorf("GetSignature after Migrate = %+v, %v; want the last signature with revision -1", sig, err)
+	}
+	if sig, err := database.GetSignature(t.Context(), oldSig); err != nil || sig.Rev != -2 {
+		t.Errorf("GetSignature(%s) after Migrate = %+v, %v; want revision -2", oldSig, sig, err)
+	}
+	stats, err := database.GetTopSignatures(t.Context(), nil)
+	if err != nil || len(stats) != 1 || stats[0].Signature.Msg != "old message" ||
+		!slices.Equal(stats[0].Ticks, []SignatureHits{{Tick: 7, Hits: 1}}) {
+		t.Errorf("GetTopSignatures after Migrate = %+v, %v; want the hits counted from the flows", stats, err)
+	}
+
+	var stored string
+	if err := database.db.QueryRow(database.sql(`SELECT flow FROM {flows}`)).Scan(&stored); err != nil || strings.Contains(stored, "b64") {
+		t.Errorf("stored messages = %s, %v; want raw dropped", stored, err)
+	}
+
+	found, err := database.AddTagsToFlow(t.Context(),
+		FlowID{Src_ip: "10.0.0.1", Src_port: 80, Dst_ip: "10.0.0.2", Dst_port: 1234, Time: time.UnixMilli(0), CommunityID: flowCommunityID(flow)},
+		[]string{"matched"}, 5000)
+	if err != nil || !found {
+		t.Errorf("AddTagsToFlow on the computed community_id after Migrate = %v, %v; want the flow", found, err)
+	}
+	found, err = database.AddAppLayerToFlow(t.Context(),
+		FlowID{Src_ip: "10.0.0.2", Src_port: 1234, Dst_ip: "10.0.0.1", Dst_port: 80, Time: time.UnixMilli(0)},
+		AppLayer{Hostnames: []string{"service.local"}}, 5000)
+	if err != nil || !found {
+		t.Errorf("AddAppLayerToFlow after Migrate = %v, %v; want the flow", found, err)
+	}
+	if flows, err := database.GetFlows(t.Context(), &GetFlowsOptions{Hostname: "service.local"}); err != nil || len(flows) != 1 {
+		t.Errorf("GetFlows on the hostname after Migrate = %d flows, %v; want 1", len(flows), err)
+	} else if !flows[0].Vars.IsZero() {
+		t.Errorf("Vars after Migrate = %+v, want none", flows[0].Vars)
+	}
+
+	// newer versions are refused
+	if _, err := database.db.Exec(database.sql(`UPDATE {meta} SET value = ?`), SchemaVersion+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Migrate(t.Context()); !errors.As(err, &schemaErr) || schemaErr.Version != SchemaVersion+1 {
+		t.Errorf("Migrate of a newer version = %v, want a SchemaError", err)
+	}
+}
+
+func TestSqliteDatabase_MigrateSignatureTags(t *testing.T) {
+	database, err := ConnectSqlite(filepath.Join(t.TempDir(), "tulip.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close(t.Context())
+
+	// turn it into a version 6 namespace, whose signatures have one tag
+	for _, query := range []string{
+		`ALTER TABLE {signatures} ADD COLUMN tag TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE {signatures} DROP COLUMN tags`,
+		`INSERT INTO {signatures} (id, gid, sig_id, rev, msg, action, tag, severity, category)
+			VALUES ('` + primitive.NewObjectID().Hex() + `', 1, 1, 1, 'untagged', 'allowed', '', 1, ''),
+			('` + primitive.NewObjectID().Hex() + `', 1, 2, 1, 'tagged', 'allowed', 'FLAG OUT', 1, '')`,
+		`UPDATE {meta} SET value = 6`,
+	} {
+		if _, err := database.db.Exec(database.sql(query)); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+
+	if err := database.Migrate(t.Context()); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	for sid, want := range map[string][]string{"1": nil, "2": {"FLAG OUT"}} {
+		if sig, err := database.GetSignature(t.Context(), sid); err != nil || !slices.Equal(sig.Tags, want) {
+			t.Errorf("GetSignature(%s) after Migrate = %+v, %v; want tags %v", sid, sig, err, want)
+		}
+	}
+}
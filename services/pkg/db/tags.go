@@ -0,0 +1,100 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package db
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// TagOrigin tells what created a tag.
+type TagOrigin string
+
+const (
+	TagOriginAssembler TagOrigin = "assembler" // Tags set by the assembler, see DefaultTags
+	TagOriginSuricata  TagOrigin = "suricata"  // Tags of Suricata signatures and flowbits
+	TagOriginUser      TagOrigin = "user"      // Tags created through the API
+	TagOriginRule      TagOrigin = "rule"      // Tags set by Tulip rules
+)
+
+// Tag is the record of a tag, with the metadata used to render it.
+type Tag struct {
+	Name        string    `bson:"_id" json:"name"`
+	Color       string    `bson:"color" json:"color"`             // One of TagColors or a "#rrggbb" color, empty to pick one from the name
+	Description string    `bson:"description" json:"description"` // What the flows with the tag have in common
+	Origin      TagOrigin `bson:"origin" json:"origin"`           // Empty for the tags only found on flows
+	CreatedAt   int64     `bson:"created_at" json:"created_at"`   // When the tag was registered (epoch ms)
+}
+
+// TagColors are the named colors of tags, as found in the metadata of the
+// Suricata rules (`metadata: tag FLAG OUT, color danger;`). The frontend maps
+// them to its palette.
+var TagColors = []string{"primary", "secondary", "success", "danger", "warning", "info", "light", "dark"}
+
+var (
+	tagColorRegex = regexp.MustCompile(`^#([0-9A-Fa-f]{3}|[0-9A-Fa-f]{6})$`)
+	tagNameRegex  = regexp.MustCompile(`^[^\x00-\x1f\x7f]{1,64}$`)
+)
+
+// ValidateTag checks the fields of a tag coming from the outside.
+func ValidateTag(tag Tag) error {
+	if !tagNameRegex.MatchString(tag.Name) {
+		return fmt.Errorf("invalid tag name %q: use up to 64 printable characters", tag.Name)
+	}
+	if tag.Color != "" && !slices.Contains(TagColors, tag.Color) && !tagColorRegex.MatchString(tag.Color) {
+		return fmt.Errorf("invalid tag color %q: use one of %v or #rrggbb", tag.Color, TagColors)
+	}
+	switch tag.Origin {
+	case "", TagOriginAssembler, TagOriginSuricata, TagOriginUser, TagOriginRule:
+		return nil
+	default:
+		return fmt.Errorf("invalid tag origin %q", tag.Origin)
+	}
+}
+
+// DefaultTags are the tags created by ConfigureDatabase.
+var DefaultTags = []Tag{
+	{Name: "flag-in", Color: "#d1d5db", Description: "A flag was sent to the service", Origin: TagOriginAssembler},
+	{Name: "flag-out", Color: "danger", Description: "A flag was sent by the service", Origin: TagOriginAssembler},
+	{Name: "blocked", Color: "#e9d5ff", Description: "Suricata dropped the flow", Origin: TagOriginAssembler},
+	{Name: "suricata", Description: "A Suricata signature matched the flow", Origin: TagOriginAssembler},
+	{Name: "starred", Color: "warning", Description: "Starred from the UI", Origin: TagOriginAssembler},
+	{Name: "flagid", Description: "The flow contains a flag ID", Origin: TagOriginAssembler},
+	{Name: "tcp", Origin: TagOriginAssembler},
+	{Name: "udp", Origin: TagOriginAssembler},
+}
+
+// fillTag sets the empty fields of an existing tag from an inserted one, as
+// done by InsertTag.
+func fillTag(existing *Tag, tag Tag) {
+	if existing.Color == "" {
+		existing.Color = tag.Color
+	}
+	if existing.Description == "" {
+		existing.Description = tag.Description
+	}
+	if existing.Origin == "" {
+		existing.Origin = tag.Origin
+	}
+	if existing.CreatedAt == 0 {
+		existing.CreatedAt = tag.CreatedAt
+	}
+}
+
+// mergeTags returns the records of the tags in names, in that order, with an
+// empty record for the tags that were never registered.
+func mergeTags(names []string, records []Tag) []Tag {
+	tags := make([]Tag, 0, len(names))
+	for _, name := range names {
+		i := slices.IndexFunc(records, func(tag Tag) bool { return tag.Name == name })
+		if i >= 0 {
+			tags = append(tags, records[i])
+		} else {
+			tags = append(tags, Tag{Name: name})
+		}
+	}
+	return tags
+}
@@ -0,0 +1,163 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+// Package game holds the Attack/Defense game configuration shared by the
+// services: tick timing and the list of game services.
+package game
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Service represents a single service with a name and port.
+type Service struct {
+	Name string
+	Port int
+}
+
+// Config describes the running game.
+type Config struct {
+	TickStart  time.Time     // Start of the first tick
+	TickLength time.Duration // Length of a single tick
+	Services   []Service     // Services exposed by the vulnbox
+}
+
+// NoTick is the tick assigned to flows when tick timing is not configured.
+const NoTick = -1
+
+// ParseServices parses a space-separated list of service:port pairs.
+func ParseServices(s string) ([]Service, error) {
+	var services []Service
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return services, nil
+	}
+
+	parts := strings.FieldsSeq(s)
+	for part := range parts {
+		split := strings.Split(part, ":")
+		if len(split) != 2 {
+			return nil, fmt.Errorf("invalid service definition: %s", part)
+		}
+
+		name := split[0]
+		port, err := strconv.Atoi(split[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid port for service %s: %v", part, err)
+		} else if port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("port out of range for service %s: %d", part, port)
+		}
+
+		services = append(services, Service{Name: name, Port: port})
+	}
+
+	return services, nil
+}
+
+// tickStartLayouts are the accepted formats of TICK_START, the second one is
+// what the example configuration (and the frontend) use.
+var tickStartLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+}
+
+// ParseTickStart parses the start date of the game.
+func ParseTickStart(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range tickStartLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid tick start %q, expected a RFC3339 date", s)
+}
+
+// New builds a game configuration from the raw TICK_START, TICK_LENGTH (in ms)
+// and GAME_SERVICES values. Empty values leave the respective part unset.
+func New(tickStart, tickLengthMs, services string) (*Config, error) {
+	cfg := &Config{}
+
+	if tickStart != "" {
+		start, err := ParseTickStart(tickStart)
+		if err != nil {
+			return nil, err
+		}
+		cfg.TickStart = start
+	}
+
+	if tickLengthMs != "" {
+		ms, err := strconv.Atoi(tickLengthMs)
+		if err != nil || ms < 0 {
+			return nil, fmt.Errorf("invalid tick length %q", tickLengthMs)
+		}
+		cfg.TickLength = time.Duration(ms) * time.Millisecond
+	}
+
+	var err error
+	cfg.Services, err = ParseServices(services)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// HasTicks reports whether tick timing is configured.
+func (c *Config) HasTicks() bool {
+	return c != nil && !c.TickStart.IsZero() && c.TickLength > 0
+}
+
+// Tick returns the tick a timestamp (epoch ms) belongs to, or NoTick if tick
+// timing is not configured. Timestamps before the start of the game belong
+// to tick 0, so that a real tick is never negative and cannot be mistaken
+// for NoTick.
+func (c *Config) Tick(epochMs int64) int {
+	if !c.HasTicks() {
+		return NoTick
+	}
+	elapsed := max(epochMs-c.TickStart.UnixMilli(), 0)
+	return int(elapsed / c.TickLength.Milliseconds())
+}
+
+// TickStartTime returns the start time of a tick as epoch ms.
+func (c *Config) TickStartTime(tick int) int64 {
+	return c.TickStart.UnixMilli() + int64(tick)*c.TickLength.Milliseconds()
+}
+
+// ServiceName returns the name of the service a flow belongs to, looking at
+// the destination port first and at the source port for reversed flows.
+// It returns an empty string for flows not belonging to any service.
+func (c *Config) ServiceName(srcPort, dstPort int) string {
+	if c == nil {
+		return ""
+	}
+	for _, svc := range c.Services {
+		if svc.Port == dstPort {
+			return svc.Name
+		}
+	}
+	for _, svc := range c.Services {
+		if svc.Port == srcPort {
+			return svc.Name
+		}
+	}
+	return ""
+}
+
+// ServicePort returns the port of the service with the given name.
+func (c *Config) ServicePort(name string) (int, bool) {
+	if c == nil {
+		return 0, false
+	}
+	for _, svc := range c.Services {
+		if svc.Name == name {
+			return svc.Port, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,91 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package game
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	cfg, err := New("2018-06-27T13:00+02:00", "180000", "srv1:5000 srv2:3000")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	wantStart := time.Date(2018, 6, 27, 11, 0, 0, 0, time.UTC)
+	if !cfg.TickStart.Equal(wantStart) {
+		t.Errorf("TickStart = %v, want %v", cfg.TickStart, wantStart)
+	}
+	if cfg.TickLength != 3*time.Minute {
+		t.Errorf("TickLength = %v, want 3m", cfg.TickLength)
+	}
+	if len(cfg.Services) != 2 || cfg.Services[1] != (Service{Name: "srv2", Port: 3000}) {
+		t.Errorf("Services = %v", cfg.Services)
+	}
+
+	for _, args := range [][3]string{
+		{"yesterday", "", ""},
+		{"", "-5", ""},
+		{"", "", "srv1:99999"},
+		{"", "", "srv1"},
+	} {
+		if _, err := New(args[0], args[1], args[2]); err == nil {
+			t.Errorf("New(%q, %q, %q) should fail", args[0], args[1], args[2])
+		}
+	}
+}
+
+func TestTick(t *testing.T) {
+	cfg, _ := New("2025-01-01T00:00:00Z", "60000", "")
+	start := cfg.TickStart.UnixMilli()
+
+	cases := map[int64]int{
+		start:                  0,
+		start + 59_999:         0,
+		start + 60_000:         1,
+		start + 42*60_000:      42,
+		start - 1:              0, // before the game
+		start - 60_001:         0,
+		start + 100*60_000 + 1: 100,
+	}
+	for ts, want := range cases {
+		if got := cfg.Tick(ts); got != want {
+			t.Errorf("Tick(start%+d) = %d, want %d", ts-start, got, want)
+		}
+	}
+
+	if got := cfg.TickStartTime(3); got != start+3*60_000 {
+		t.Errorf("TickStartTime(3) = %d", got)
+	}
+
+	var empty *Config
+	if got := empty.Tick(start); got != NoTick {
+		t.Errorf("Tick without config = %d, want %d", got, NoTick)
+	}
+}
+
+func TestServiceName(t *testing.T) {
+	cfg, _ := New("", "", "web:80 db:5432")
+
+	cases := []struct {
+		src, dst int
+		want     string
+	}{
+		{40000, 80, "web"},
+		{5432, 40000, "db"},
+		{80, 5432, "db"},
+		{40000, 40001, ""},
+	}
+	for _, tc := range cases {
+		if got := cfg.ServiceName(tc.src, tc.dst); got != tc.want {
+			t.Errorf("ServiceName(%d, %d) = %q, want %q", tc.src, tc.dst, got, tc.want)
+		}
+	}
+
+	if port, ok := cfg.ServicePort("db"); !ok || port != 5432 {
+		t.Errorf("ServicePort(db) = %d, %v", port, ok)
+	}
+}
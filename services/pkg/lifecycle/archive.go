@@ -0,0 +1,274 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package lifecycle
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"tulip/pkg/db"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// RestoredTag is added to the flows restored from the archive, so that the
+// retention does not remove them again.
+const RestoredTag = "restored"
+
+// Archive stores the flows removed by retention on disk, in one JSON Lines
+// file compressed with zstd per namespace and tick:
+//
+//	<dir>/<namespace>/tick-42.jsonl.zst
+//	<dir>/<namespace>/tick-unknown.jsonl.zst   flows without a tick
+//
+// Flows archived later are appended to the file as a new zstd frame.
+type Archive struct {
+	Dir string
+}
+
+const (
+	archivePrefix    = "tick-"
+	archiveExtension = ".jsonl.zst"
+	unknownTickName  = "unknown"
+)
+
+// archivedFlow is a flow as stored in the archive. JSON strings only hold
+// UTF-8 text, so binary payloads are kept in Bytes. Raw is not stored, it is
+// derived from Data when the flow is inserted again.
+type archivedFlow struct {
+	db.FlowEntry
+	Flow []archivedItem `json:"flow"`
+}
+
+type archivedItem struct {
+	From  string `json:"from"`
+	Data  string `json:"data,omitempty"`
+	Bytes []byte `json:"bytes,omitempty"`
+	Time  int    `json:"time"`
+}
+
+// path returns the archive file of a tick, negative for flows without one.
+func (a Archive) path(namespace string, tick int) string {
+	name := unknownTickName
+	if tick >= 0 {
+		name = strconv.Itoa(tick)
+	}
+	return filepath.Join(a.Dir, namespace, archivePrefix+name+archiveExtension)
+}
+
+// Append archives flows, grouped by tick.
+func (a Archive) Append(namespace string, flows []db.FlowEntry) error {
+	if a.Dir == "" {
+		return errors.New("no archive directory configured")
+	}
+	if err := os.MkdirAll(filepath.Join(a.Dir, namespace), 0o755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	byTick := map[int][]db.FlowEntry{}
+	for _, flow := range flows {
+		tick := max(flow.Tick, -1)
+		byTick[tick] = append(byTick[tick], flow)
+	}
+	for tick, flows := range byTick {
+		if err := a.appendTick(a.path(namespace, tick), flows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendTick writes flows to path as a single zstd frame, so that a partial
+// write only loses the last frame.
+func (a Archive) appendTick(path string, flows []db.FlowEntry) error {
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	if err != nil {
+		return fmt.Errorf("failed to create writer: %w", err)
+	}
+	enc := json.NewEncoder(zw)
+	for _, flow := range flows {
+		if err := enc.Encode(toArchived(flow)); err != nil {
+			zw.Close()
+			return fmt.Errorf("failed to encode flow %s: %w", flow.Id.Hex(), err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to compress flows: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open archive file: %w", err)
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write archive file: %w", err)
+	}
+	return file.Close()
+}
+
+// Ticks returns the archived ticks of a namespace, sorted, with -1 for the
+// flows without a tick.
+func (a Archive) Ticks(namespace string) ([]int, error) {
+	if a.Dir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(filepath.Join(a.Dir, namespace))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list archive directory: %w", err)
+	}
+
+	ticks := []int{}
+	for _, entry := range entries {
+		name, ok := strings.CutPrefix(entry.Name(), archivePrefix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		name, ok = strings.CutSuffix(name, archiveExtension)
+		if !ok {
+			continue
+		}
+		if name == unknownTickName {
+			ticks = append(ticks, -1)
+		} else if tick, err := strconv.Atoi(name); err == nil && tick >= 0 {
+			ticks = append(ticks, tick)
+		}
+	}
+	slices.Sort(ticks)
+	return ticks, nil
+}
+
+// Restore inserts the archived flows of a tick back into database, tagged
+// with RestoredTag, and removes them from the archive. Flows still in the
+// database are skipped. It returns the number of flows inserted, and
+// db.ErrNotFound if the tick is not archived.
+func (a Archive) Restore(ctx context.Context, database db.Database, tick int) (int, error) {
+	path := a.path(database.Namespace(), tick)
+
+	// flows archived while restoring go to a new file. An interrupted
+	// restore is resumed first, then the flows archived since are restored
+	// too.
+	restoring := path + ".restoring"
+	restored, resumed := 0, false
+	if _, err := os.Stat(restoring); err == nil {
+		n, err := restoreFile(ctx, database, restoring)
+		if err != nil {
+			return n, err
+		}
+		restored, resumed = n, true
+	}
+	if err := os.Rename(path, restoring); errors.Is(err, os.ErrNotExist) {
+		if !resumed {
+			return 0, db.ErrNotFound
+		}
+		return restored, nil
+	} else if err != nil {
+		return restored, fmt.Errorf("failed to open archive file: %w", err)
+	}
+	n, err := restoreFile(ctx, database, restoring)
+	return restored + n, err
+}
+
+// restoreFile inserts the flows of an archive file that are not in database,
+// then removes the file. It returns the number of flows inserted.
+func restoreFile(ctx context.Context, database db.Database, path string) (int, error) {
+	flows, err := readArchive(path)
+	if err != nil {
+		return 0, err
+	}
+	// restores are requested through the API
+	restoredTag := db.Tag{Name: RestoredTag, Description: "Restored from the flow archive", Origin: db.TagOriginUser}
+	if err := database.InsertTag(ctx, restoredTag); err != nil {
+		return 0, fmt.Errorf("failed to register tag: %w", err)
+	}
+
+	restored := 0
+	for _, flow := range flows {
+		if _, err := database.GetFlowByID(ctx, flow.Id.Hex()); err == nil {
+			continue
+		} else if !errors.Is(err, db.ErrNotFound) {
+			return restored, err
+		}
+		if !slices.Contains(flow.Tags, RestoredTag) {
+			flow.Tags = append(flow.Tags, RestoredTag)
+		}
+		if err := database.InsertFlow(ctx, flow); err != nil {
+			return restored, fmt.Errorf("failed to insert flow %s: %w", flow.Id.Hex(), err)
+		}
+		restored++
+	}
+
+	if err := os.Remove(path); err != nil {
+		return restored, fmt.Errorf("failed to remove archive file: %w", err)
+	}
+	return restored, nil
+}
+
+// readArchive reads all the flows of an archive file, in the order they were
+// archived.
+func readArchive(path string) ([]db.FlowEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive file: %w", err)
+	}
+	defer file.Close()
+
+	zr, err := zstd.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zstd stream: %w", err)
+	}
+	defer zr.Close()
+
+	var flows []db.FlowEntry
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(nil, 1<<30) // flows hold whole payloads
+	for scanner.Scan() {
+		var flow archivedFlow
+		if err := json.Unmarshal(scanner.Bytes(), &flow); err != nil {
+			return nil, fmt.Errorf("failed to decode archived flow: %w", err)
+		}
+		flows = append(flows, fromArchived(flow))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read archive file: %w", err)
+	}
+	return flows, nil
+}
+
+func toArchived(flow db.FlowEntry) archivedFlow {
+	archived := archivedFlow{FlowEntry: flow, Flow: make([]archivedItem, len(flow.Flow))}
+	archived.FlowEntry.Flow = nil
+	for i, item := range flow.Flow {
+		archived.Flow[i] = archivedItem{From: item.From, Data: item.Data, Time: item.Time}
+		if !utf8.ValidString(item.Data) {
+			archived.Flow[i].Data, archived.Flow[i].Bytes = "", []byte(item.Data)
+		}
+	}
+	return archived
+}
+
+func fromArchived(archived archivedFlow) db.FlowEntry {
+	flow := archived.FlowEntry
+	flow.Flow = make([]db.FlowItem, len(archived.Flow))
+	for i, item := range archived.Flow {
+		flow.Flow[i] = db.FlowItem{From: item.From, Data: item.Data, Time: item.Time}
+		if item.Bytes != nil {
+			flow.Flow[i].Data = string(item.Bytes)
+		}
+	}
+	return flow
+}
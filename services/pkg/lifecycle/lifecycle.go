@@ -0,0 +1,381 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+// Package lifecycle takes care of PCAP files once the assembler is done with
+// them: it moves them to an archive directory, compresses them and deletes the
+// oldest ones to keep the traffic directory within a disk quota.
+package lifecycle
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"tulip/pkg/db"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the algorithm used to compress archived PCAP files.
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// ParseCompression validates a compression name coming from the configuration.
+func ParseCompression(s string) (Compression, error) {
+	switch c := Compression(strings.ToLower(strings.TrimSpace(s))); c {
+	case "":
+		return CompressionNone, nil
+	case CompressionNone, CompressionGzip, CompressionZstd:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown compression %q (expected none, gzip or zstd)", s)
+	}
+}
+
+// extension returns the file extension appended to compressed files.
+func (c Compression) extension() string {
+	switch c {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// Policy describes what happens to PCAP files after they were fully processed.
+type Policy struct {
+	ArchiveDir  string        // Directory finished files are moved to, empty to leave them in place
+	Compression Compression   // Compression applied to finished files
+	Delay       time.Duration // Minimum age of a finished file before it is archived, so other readers (Suricata) are done too
+	MaxSize     int64         // Maximum total size in bytes of finished files, 0 for no limit
+	MaxAge      time.Duration // Maximum age of finished files, 0 for no limit
+}
+
+// Enabled reports whether the policy does anything at all.
+func (p Policy) Enabled() bool {
+	return p.ArchiveDir != "" || (p.Compression != "" && p.Compression != CompressionNone) ||
+		p.MaxSize > 0 || p.MaxAge > 0
+}
+
+// Manager applies a Policy to the files recorded in the database.
+type Manager struct {
+	Policy
+	DB db.Database
+}
+
+// NewManager creates a new Manager.
+func NewManager(policy Policy, database db.Database) *Manager {
+	return &Manager{Policy: policy, DB: database}
+}
+
+// Run applies the policy every interval until ctx is cancelled.
+func (m *Manager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		m.Apply(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Apply archives the finished files that are old enough and then enforces
+// the quota and age limits.
+func (m *Manager) Apply(ctx context.Context) {
+	files, err := m.DB.GetPcapList(ctx)
+	if err != nil {
+		slog.Error("Failed to list pcap files", slog.Any("err", err))
+		return
+	}
+
+	// only finished files that are still on disk are managed
+	files = slices.DeleteFunc(files, func(f db.PcapFile) bool { return !f.Finished || f.Removed })
+
+	for i := range files {
+		file := &files[i]
+		if file.ArchivedAt != 0 {
+			continue
+		}
+
+		info, err := os.Stat(file.Path())
+		if err != nil {
+			slog.Warn("Finished pcap file is missing", slog.String("file", file.Path()), slog.Any("err", err))
+			continue
+		}
+		if time.Since(info.ModTime()) < m.Delay {
+			continue
+		}
+
+		if err := m.archive(file); err != nil {
+			slog.Error("Failed to archive pcap file", slog.String("file", file.FileName), slog.Any("err", err))
+			continue
+		}
+		if err := m.DB.InsertPcap(ctx, *file); err != nil {
+			slog.Error("Failed to record archived pcap file", slog.String("file", file.FileName), slog.Any("err", err))
+			continue
+		}
+		slog.Info("Archived pcap file", slog.String("file", file.FileName), slog.String("location", file.Location))
+	}
+
+	m.enforceLimits(ctx, files)
+}
+
+// archive moves and compresses a single file, updating its record.
+func (m *Manager) archive(file *db.PcapFile) error {
+	src := file.Path()
+
+	dir := filepath.Dir(src)
+	if m.ArchiveDir != "" {
+		dir = m.ArchiveDir
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create archive directory: %w", err)
+		}
+	}
+
+	dst := filepath.Join(dir, filepath.Base(src)+m.Compression.extension())
+	if dst != src {
+		dst = uniquePath(dst)
+		var err error
+		if m.Compression.extension() != "" {
+			err = compressFile(src, dst, m.Compression)
+		} else {
+			err = moveFile(src, dst)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	info, err := os.Stat(dst)
+	if err != nil {
+		return fmt.Errorf("failed to stat archived file: %w", err)
+	}
+
+	file.Location = dst
+	file.Size = info.Size()
+	file.ArchivedAt = time.Now().UnixMilli()
+	return nil
+}
+
+// enforceLimits deletes the oldest files until both the age and size limits are respected.
+func (m *Manager) enforceLimits(ctx context.Context, files []db.PcapFile) {
+	if m.MaxSize <= 0 && m.MaxAge <= 0 {
+		return
+	}
+
+	type entry struct {
+		file  db.PcapFile
+		size  int64
+		mtime time.Time
+	}
+
+	entries := make([]entry, 0, len(files))
+	total := int64(0)
+	for _, file := range files {
+		info, err := os.Stat(file.Path())
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry{file: file, size: info.Size(), mtime: info.ModTime()})
+		total += info.Size()
+	}
+
+	slices.SortFunc(entries, func(a, b entry) int { return a.mtime.Compare(b.mtime) })
+
+	for _, e := range entries {
+		tooOld := m.MaxAge > 0 && time.Since(e.mtime) > m.MaxAge
+		tooBig := m.MaxSize > 0 && total > m.MaxSize
+		if !tooOld && !tooBig {
+			break
+		}
+
+		if err := os.Remove(e.file.Path()); err != nil {
+			slog.Error("Failed to delete pcap file", slog.String("file", e.file.Path()), slog.Any("err", err))
+			continue
+		}
+		total -= e.size
+
+		e.file.Location = ""
+		e.file.Size = 0
+		e.file.Removed = true
+		if err := m.DB.InsertPcap(ctx, e.file); err != nil {
+			slog.Error("Failed to record deleted pcap file", slog.String("file", e.file.FileName), slog.Any("err", err))
+		}
+		slog.Info("Deleted pcap file", slog.String("file", e.file.FileName), slog.Bool("age_limit", tooOld))
+	}
+}
+
+// Open opens a file recorded in the database, transparently decompressing it.
+func Open(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch filepath.Ext(path) {
+	case CompressionGzip.extension():
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		return &readCloser{Reader: zr, close: func() { zr.Close(); file.Close() }}, nil
+	case CompressionZstd.extension():
+		zr, err := zstd.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to open zstd stream: %w", err)
+		}
+		return &readCloser{Reader: zr, close: func() { zr.Close(); file.Close() }}, nil
+	default:
+		return file, nil
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	close func()
+}
+
+func (r *readCloser) Close() error {
+	r.close()
+	return nil
+}
+
+// ParseSize parses a human readable size such as "512M" or "20GB".
+func ParseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	if s == "" {
+		return 0, nil
+	}
+
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	case strings.HasSuffix(s, "T"):
+		mult = 1 << 40
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * mult, nil
+}
+
+// uniquePath returns path, or a variant of it with a numeric suffix if it already exists.
+func uniquePath(path string) string {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return path
+	}
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// moveFile renames src to dst, copying the file across filesystems if needed.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	if err := copyFile(src, dst, func(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil }); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// compressFile writes a compressed copy of src to dst and removes src.
+func compressFile(src, dst string, c Compression) error {
+	err := copyFile(src, dst, func(w io.Writer) (io.WriteCloser, error) {
+		if c == CompressionGzip {
+			return gzip.NewWriter(w), nil
+		}
+		return zstd.NewWriter(w)
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copyFile copies src into dst through the writer returned by wrap, keeping
+// the mtime of src: the age limit and the eviction order of enforceLimits
+// are those of the capture, not of the copy. dst is removed if anything goes
+// wrong.
+func copyFile(src, dst string, wrap func(io.Writer) (io.WriteCloser, error)) (err error) {
+	input, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer input.Close()
+	info, err := input.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat source file: %w", err)
+	}
+
+	output, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create destination file: %w", err)
+	}
+	defer func() {
+		if cerr := output.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("failed to close destination file: %w", cerr)
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	w, err := wrap(output)
+	if err != nil {
+		return fmt.Errorf("failed to create writer: %w", err)
+	}
+	if _, err := io.Copy(w, input); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to flush destination file: %w", err)
+	}
+	if err := os.Chtimes(dst, time.Time{}, info.ModTime()); err != nil {
+		return fmt.Errorf("failed to set destination mtime: %w", err)
+	}
+	return nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
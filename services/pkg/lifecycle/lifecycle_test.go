@@ -0,0 +1,179 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package lifecycle
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"tulip/pkg/db"
+)
+
+// pcapRecord returns the record of a file in the database.
+func pcapRecord(t *testing.T, database db.Database, path string) db.PcapFile {
+	t.Helper()
+	file, err := database.GetPcap(t.Context(), path)
+	if err != nil {
+		t.Fatalf("GetPcap(%s) failed: %v", path, err)
+	}
+	return file
+}
+
+func writeFile(t *testing.T, path string, size int, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, bytes.Repeat([]byte{0x42}, size), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("failed to set mtime: %v", err)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{
+		"":      0,
+		"100":   100,
+		"2k":    2 << 10,
+		"512M":  512 << 20,
+		"20GB":  20 << 30,
+		"1GiB":  1 << 30,
+		" 3T ":  3 << 40,
+		"1024b": 1024,
+	}
+	for in, want := range cases {
+		got, err := ParseSize(in)
+		if err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	if _, err := ParseSize("lots"); err == nil {
+		t.Error("ParseSize(\"lots\") should fail")
+	}
+	if _, err := ParseSize("abcMB"); err == nil || !strings.Contains(err.Error(), `"abcMB"`) {
+		t.Errorf("ParseSize(\"abcMB\") error = %v, want it to quote the input", err)
+	}
+}
+
+func TestManager_ArchiveAndCompress(t *testing.T) {
+	for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			trafficDir, archiveDir := t.TempDir(), t.TempDir()
+			old := time.Now().Add(-time.Hour)
+
+			finished := filepath.Join(trafficDir, "finished.pcap")
+			recent := filepath.Join(trafficDir, "recent.pcap")
+			partial := filepath.Join(trafficDir, "partial.pcap")
+			writeFile(t, finished, 1000, old)
+			writeFile(t, recent, 1000, time.Now())
+			writeFile(t, partial, 1000, old)
+
+			store := db.NewMemoryDatabase()
+			for _, file := range []db.PcapFile{
+				{FileName: finished, Finished: true},
+				{FileName: recent, Finished: true},
+				{FileName: partial, Finished: false},
+			} {
+				store.InsertPcap(t.Context(), file)
+			}
+
+			m := NewManager(Policy{ArchiveDir: archiveDir, Compression: compression, Delay: time.Minute}, store)
+			m.Apply(t.Context())
+
+			rec := pcapRecord(t, store, finished)
+			if rec.ArchivedAt == 0 || filepath.Dir(rec.Location) != archiveDir {
+				t.Fatalf("finished file not archived: %+v", rec)
+			}
+			if _, err := os.Stat(finished); !os.IsNotExist(err) {
+				t.Errorf("original file still exists after archiving")
+			}
+
+			r, err := Open(rec.Location)
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			defer r.Close()
+			data, err := io.ReadAll(r)
+			if err != nil || !bytes.Equal(data, bytes.Repeat([]byte{0x42}, 1000)) {
+				t.Errorf("archived content mismatch (len %d, err %v)", len(data), err)
+			}
+
+			for _, path := range []string{recent, partial} {
+				if pcapRecord(t, store, path).Location != "" {
+					t.Errorf("%s should not be archived yet", path)
+				}
+				if _, err := os.Stat(path); err != nil {
+					t.Errorf("%s should still exist: %v", path, err)
+				}
+			}
+		})
+	}
+}
+
+func TestManager_EnforceLimits(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	store := db.NewMemoryDatabase()
+	for i, age := range []time.Duration{5 * time.Hour, 3 * time.Hour, 2 * time.Hour, time.Hour} {
+		path := filepath.Join(dir, string(rune('a'+i))+".pcap")
+		writeFile(t, path, 100, now.Add(-age))
+		store.InsertPcap(t.Context(), db.PcapFile{FileName: path, Finished: true})
+	}
+	unfinished := filepath.Join(dir, "z.pcap")
+	writeFile(t, unfinished, 1000, now.Add(-10*time.Hour))
+	store.InsertPcap(t.Context(), db.PcapFile{FileName: unfinished})
+
+	m := NewManager(Policy{MaxAge: 4 * time.Hour, MaxSize: 250}, store)
+	m.Apply(t.Context())
+
+	removed := map[string]bool{"a.pcap": true, "b.pcap": true, "c.pcap": false, "d.pcap": false, "z.pcap": false}
+	for name, want := range removed {
+		path := filepath.Join(dir, name)
+		if got := pcapRecord(t, store, path).Removed; got != want {
+			t.Errorf("%s removed = %v, want %v", name, got, want)
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) != want {
+			t.Errorf("%s exists on disk = %v, want %v", name, !os.IsNotExist(err), !want)
+		}
+	}
+}
+
+func TestManager_CompressedAge(t *testing.T) {
+	trafficDir, archiveDir := t.TempDir(), t.TempDir()
+	now := time.Now()
+
+	store := db.NewMemoryDatabase()
+	paths := map[string]time.Time{
+		filepath.Join(trafficDir, "old.pcap"):    now.Add(-5 * time.Hour),
+		filepath.Join(trafficDir, "recent.pcap"): now.Add(-time.Hour),
+	}
+	for path, mtime := range paths {
+		writeFile(t, path, 100, mtime)
+		store.InsertPcap(t.Context(), db.PcapFile{FileName: path, Finished: true})
+	}
+
+	// archived and compressed now, the files are as old as their captures
+	m := NewManager(Policy{ArchiveDir: archiveDir, Compression: CompressionZstd, MaxAge: 4 * time.Hour}, store)
+	m.Apply(t.Context())
+
+	for path, mtime := range paths {
+		rec := pcapRecord(t, store, path)
+		if old := now.Sub(mtime) > 4*time.Hour; rec.Removed != old {
+			t.Errorf("%s removed = %v, want %v", filepath.Base(path), rec.Removed, old)
+			continue
+		}
+		if rec.Removed {
+			continue
+		}
+		info, err := os.Stat(rec.Location)
+		if err != nil || !info.ModTime().Equal(mtime) {
+			t.Errorf("%s archived with mtime %v, %v; want %v", filepath.Base(path), info.ModTime(), err, mtime)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+	"tulip/pkg/db"
+	"tulip/pkg/game"
+)
+
+// RetentionMode is what happens to the flows removed from the database.
+type RetentionMode string
+
+const (
+	RetentionArchive RetentionMode = "archive" // Flows are written to an Archive before being deleted
+	RetentionDrop    RetentionMode = "drop"    // Flows are deleted
+)
+
+// ParseRetentionMode validates a retention mode coming from the configuration.
+func ParseRetentionMode(s string) (RetentionMode, error) {
+	switch m := RetentionMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case "":
+		return RetentionArchive, nil
+	case RetentionArchive, RetentionDrop:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown retention mode %q (expected archive or drop)", s)
+	}
+}
+
+// KeptTags are the tags of the flows never removed by retention: the flows
+// someone found interesting, and the ones explicitly restored from the archive.
+var KeptTags = []string{"starred", "flag-in", "flag-out", RestoredTag}
+
+// untaggedTags are the tags that do not make a flow tagged for
+// Retention.UntaggedAge, since every flow has one of them.
+var untaggedTags = []string{"tcp", "udp"}
+
+// retentionBatch is the number of flows removed at once.
+const retentionBatch = 500
+
+// Retention describes which flows are removed from the database.
+type Retention struct {
+	MaxTicks    int           // Number of most recent ticks whose flows are kept, 0 for no limit
+	UntaggedAge time.Duration // Age after which untagged flows are removed, 0 for no limit
+	Mode        RetentionMode // What happens to the removed flows
+	ArchiveDir  string        // Directory of the Archive, required by RetentionArchive
+}
+
+// Enabled reports whether the retention removes any flow.
+func (r Retention) Enabled() bool {
+	return r.MaxTicks > 0 || r.UntaggedAge > 0
+}
+
+// Pruner applies a Retention to the flows of a namespace.
+type Pruner struct {
+	Retention
+	DB   db.Database
+	Game *game.Config // Used to compute the current tick for MaxTicks
+}
+
+// NewPruner creates a new Pruner.
+func NewPruner(retention Retention, database db.Database, gameConfig *game.Config) *Pruner {
+	return &Pruner{Retention: retention, DB: database, Game: gameConfig}
+}
+
+// Run applies the retention every interval until ctx is cancelled.
+func (p *Pruner) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.Apply(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Apply removes the flows of the ticks that are too old, then the untagged
+// flows that are too old.
+func (p *Pruner) Apply(ctx context.Context) {
+	now := time.Now()
+
+	if p.MaxTicks > 0 && p.Game.HasTicks() {
+		first, last := 0, p.Game.Tick(now.UnixMilli())-p.MaxTicks
+		if last >= 0 {
+			p.prune(ctx, "tick limit", &db.GetFlowsOptions{TickFrom: &first, TickTo: &last, ExcludeTags: KeptTags})
+		}
+	}
+
+	if p.UntaggedAge > 0 {
+		tags, err := p.DB.GetTagList(ctx)
+		if err != nil {
+			slog.Error("Failed to list tags", slog.Any("err", err))
+			return
+		}
+		// flows with any tag but the transport ones are tagged, tags
+		// that were never registered are not on any flow
+		exclude := slices.DeleteFunc(tags, func(tag string) bool { return slices.Contains(untaggedTags, tag) })
+		for _, tag := range KeptTags {
+			if !slices.Contains(exclude, tag) {
+				exclude = append(exclude, tag)
+			}
+		}
+		p.prune(ctx, "untagged age", &db.GetFlowsOptions{ToTime: now.Add(-p.UntaggedAge).UnixMilli(), ExcludeTags: exclude})
+	}
+}
+
+// prune removes the flows matching opts, archiving them first if needed.
+func (p *Pruner) prune(ctx context.Context, reason string, opts *db.GetFlowsOptions) {
+	opts.Limit = retentionBatch
+	archive := Archive{Dir: p.ArchiveDir}
+
+	total := 0
+	for ctx.Err() == nil {
+		flows, err := p.DB.GetFlows(ctx, opts)
+		if err != nil {
+			slog.Error("Failed to find flows to remove", slog.String("reason", reason), slog.Any("err", err))
+			break
+		}
+		if len(flows) == 0 {
+			break
+		}
+
+		if p.Mode == RetentionArchive {
+			if err := archive.Append(p.DB.Namespace(), flows); err != nil {
+				// keep the flows rather than losing them
+				slog.Error("Failed to archive flows", slog.String("reason", reason), slog.Any("err", err))
+				break
+			}
+		}
+
+		ids := make([]string, len(flows))
+		for i, flow := range flows {
+			ids[i] = flow.Id.Hex()
+		}
+		deleted, err := p.DB.DeleteFlows(ctx, ids)
+		if err != nil {
+			slog.Error("Failed to delete flows", slog.String("reason", reason), slog.Any("err", err))
+			break
+		}
+		total += deleted
+		if deleted == 0 {
+			break // the database does not let us delete them, do not loop forever
+		}
+	}
+
+	if total > 0 {
+		slog.Info("Removed old flows", slog.String("reason", reason), slog.Int("flows", total), slog.String("mode", string(p.Mode)))
+	}
+}
@@ -0,0 +1,164 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package lifecycle
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+	"tulip/pkg/db"
+	"tulip/pkg/game"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// insertFlows inserts a flow at the start of each tick, one minute long,
+// ending with the current one.
+func insertFlows(t *testing.T, database db.Database, ticks int, tags map[int][]string) *game.Config {
+	t.Helper()
+	now := time.Now()
+	gameConfig := &game.Config{TickStart: now.Add(-time.Duration(ticks-1) * time.Minute), TickLength: time.Minute}
+	for tick := range ticks {
+		start := int(gameConfig.TickStartTime(tick))
+		flow := db.FlowEntry{
+			SrcIp: "10.0.0.1", SrcPort: 1000 + tick, DstIp: "10.0.0.2", DstPort: 80,
+			Time: start, Tick: tick, Tags: append([]string{"tcp"}, tags[tick]...),
+			Flow: []db.FlowItem{{From: "c", Data: "GET / HTTP/1.0\r\n\r\n\xff\xfe", Time: start}},
+		}
+		if err := database.InsertFlow(t.Context(), flow); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return gameConfig
+}
+
+// flowTicks returns the ticks of the flows left in the database, sorted.
+func flowTicks(t *testing.T, database db.Database) []int {
+	t.Helper()
+	flows, err := database.GetFlows(t.Context(), &db.GetFlowsOptions{Limit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticks := make([]int, 0, len(flows))
+	for _, flow := range flows {
+		ticks = append(ticks, flow.Tick)
+	}
+	slices.Sort(ticks)
+	return ticks
+}
+
+func TestParseRetentionMode(t *testing.T) {
+	cases := map[string]RetentionMode{"": RetentionArchive, "archive": RetentionArchive, " DROP ": RetentionDrop}
+	for in, want := range cases {
+		if got, err := ParseRetentionMode(in); err != nil || got != want {
+			t.Errorf("ParseRetentionMode(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseRetentionMode("delete"); err == nil {
+		t.Error("ParseRetentionMode(\"delete\") should fail")
+	}
+}
+
+func TestPruner_TickLimit(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	gameConfig := insertFlows(t, database, 10, map[int][]string{1: {"starred"}, 2: {"flag-out"}, 3: {"flag-in"}, 4: {"suricata"}})
+
+	archive := Archive{Dir: t.TempDir()}
+	retention := Retention{MaxTicks: 3, Mode: RetentionArchive, ArchiveDir: archive.Dir}
+	NewPruner(retention, database, gameConfig).Apply(t.Context())
+
+	// the last 3 ticks are kept, and the starred and flag flows
+	if got, want := flowTicks(t, database), []int{1, 2, 3, 7, 8, 9}; !slices.Equal(got, want) {
+		t.Errorf("ticks left = %v, want %v", got, want)
+	}
+	ticks, err := archive.Ticks(database.Namespace())
+	if want := []int{0, 4, 5, 6}; err != nil || !slices.Equal(ticks, want) {
+		t.Errorf("archived ticks = %v, %v; want %v", ticks, err, want)
+	}
+}
+
+func TestPruner_UntaggedAge(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	gameConfig := insertFlows(t, database, 10, map[int][]string{0: {"suricata"}, 1: {"starred"}})
+
+	// dropped flows are not archived
+	archiveDir := t.TempDir()
+	retention := Retention{UntaggedAge: 5*time.Minute - time.Second, Mode: RetentionDrop, ArchiveDir: archiveDir}
+	NewPruner(retention, database, gameConfig).Apply(t.Context())
+
+	if got, want := flowTicks(t, database), []int{0, 1, 5, 6, 7, 8, 9}; !slices.Equal(got, want) {
+		t.Errorf("ticks left = %v, want %v", got, want)
+	}
+	if entries, _ := os.ReadDir(archiveDir); len(entries) != 0 {
+		t.Errorf("archive directory has %d entries, want none", len(entries))
+	}
+}
+
+func TestArchive_Restore(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	gameConfig := insertFlows(t, database, 4, nil)
+	first := 0
+	original, _ := database.GetFlows(t.Context(), &db.GetFlowsOptions{TickFrom: &first, TickTo: &first})
+
+	archive := Archive{Dir: t.TempDir()}
+	pruner := NewPruner(Retention{MaxTicks: 2, ArchiveDir: archive.Dir, Mode: RetentionArchive}, database, gameConfig)
+	pruner.Apply(t.Context())
+	if got := flowTicks(t, database); !slices.Equal(got, []int{2, 3}) {
+		t.Fatalf("ticks left = %v, want [2 3]", got)
+	}
+
+	n, err := archive.Restore(t.Context(), database, 0)
+	if err != nil || n != 1 {
+		t.Fatalf("Restore = %d, %v; want 1 flow", n, err)
+	}
+	restored, err := database.GetFlowByID(t.Context(), original[0].Id.Hex())
+	if err != nil {
+		t.Fatalf("restored flow not found: %v", err)
+	}
+	if restored.Flow[0].Data != original[0].Flow[0].Data || !slices.Equal(restored.Tags, []string{"tcp", RestoredTag}) {
+		t.Errorf("restored flow = %q %v, want %q [tcp restored]", restored.Flow[0].Data, restored.Tags, original[0].Flow[0].Data)
+	}
+	if _, err := os.Stat(filepath.Join(archive.Dir, database.Namespace(), "tick-0.jsonl.zst")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("archive file of a restored tick: %v, want it removed", err)
+	}
+
+	// the restored flows are kept
+	pruner.Apply(t.Context())
+	if got := flowTicks(t, database); !slices.Equal(got, []int{0, 2, 3}) {
+		t.Errorf("ticks left after restoring = %v, want [0 2 3]", got)
+	}
+	if ticks, _ := archive.Ticks(database.Namespace()); !slices.Equal(ticks, []int{1}) {
+		t.Errorf("archived ticks = %v, want [1]", ticks)
+	}
+
+	if _, err := archive.Restore(t.Context(), database, 0); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Restore of a tick not archived error = %v, want ErrNotFound", err)
+	}
+
+	// an interrupted restore of tick 1, with flows archived since
+	path := filepath.Join(archive.Dir, database.Namespace(), "tick-1.jsonl.zst")
+	if err := os.Rename(path, path+".restoring"); err != nil {
+		t.Fatal(err)
+	}
+	late := db.FlowEntry{Id: primitive.NewObjectID(), SrcIp: "10.0.0.1", SrcPort: 2001, DstIp: "10.0.0.2", DstPort: 80,
+		Time: int(gameConfig.TickStartTime(1)) + 1000, Tick: 1, Tags: []string{"tcp"}, Flow: []db.FlowItem{{From: "c", Data: "late"}}}
+	if err := archive.Append(database.Namespace(), []db.FlowEntry{late}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := archive.Restore(t.Context(), database, 1); err != nil || n != 2 {
+		t.Errorf("Restore of an interrupted tick = %d, %v; want both flows", n, err)
+	}
+	for _, file := range []string{path, path + ".restoring"} {
+		if _, err := os.Stat(file); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s after Restore: %v, want it removed", filepath.Base(file), err)
+		}
+	}
+	if got := flowTicks(t, database); !slices.Equal(got, []int{0, 1, 1, 2, 3}) {
+		t.Errorf("ticks after restoring tick 1 = %v, want [0 1 1 2 3]", got)
+	}
+}
@@ -0,0 +1,176 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned when no rule of the file has the sid.
+	ErrNotFound = errors.New("rule not found")
+	// ErrExists is returned when a rule of the file already has the sid.
+	ErrExists = errors.New("a rule with this sid already exists")
+)
+
+// disabledPrefix comments out a disabled rule.
+const disabledPrefix = "# "
+
+// File is a rule file. The lines that are not rules, such as comments, are
+// kept as they are; a commented line holding a valid rule is a disabled rule.
+type File struct {
+	path  string
+	mode  os.FileMode
+	lines []string
+}
+
+// Load reads the rule file at path.
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat rules: %v", err)
+	}
+	f := &File{path: path, mode: info.Mode().Perm()}
+	if text := strings.TrimSuffix(string(data), "\n"); text != "" {
+		f.lines = strings.Split(text, "\n")
+	}
+	return f, nil
+}
+
+// Rules returns the enabled and disabled rules of the file, in file order.
+// The lines that are not valid rules are skipped.
+func (f *File) Rules() []Rule {
+	var rules []Rule
+	for i := range f.lines {
+		if rule, ok := f.rule(i); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// Get returns the rule with the sid.
+func (f *File) Get(sid int) (Rule, error) {
+	i, err := f.find(sid)
+	if err != nil {
+		return Rule{}, err
+	}
+	rule, _ := f.rule(i)
+	return rule, nil
+}
+
+// Add appends a rule to the file, ErrExists if its sid is already used.
+func (f *File) Add(rule Rule) (Rule, error) {
+	if _, err := f.find(rule.SID); err == nil {
+		return Rule{}, ErrExists
+	}
+	f.lines = append(f.lines, line(rule))
+	rule.Line = len(f.lines)
+	return rule, nil
+}
+
+// Replace replaces the rule with the sid, keeping its position in the file.
+// The new rule may have another sid, as long as no other rule uses it.
+func (f *File) Replace(sid int, rule Rule) (Rule, error) {
+	i, err := f.find(sid)
+	if err != nil {
+		return Rule{}, err
+	}
+	if rule.SID != sid {
+		if _, err := f.find(rule.SID); err == nil {
+			return Rule{}, ErrExists
+		}
+	}
+	f.lines[i] = line(rule)
+	rule.Line = i + 1
+	return rule, nil
+}
+
+// SetEnabled enables or disables the rule with the sid.
+func (f *File) SetEnabled(sid int, enabled bool) (Rule, error) {
+	i, err := f.find(sid)
+	if err != nil {
+		return Rule{}, err
+	}
+	rule, _ := f.rule(i)
+	if rule.Enabled != enabled {
+		rule.Enabled = enabled
+		f.lines[i] = line(rule)
+	}
+	return rule, nil
+}
+
+// Save writes the file back. The file is replaced atomically when possible,
+// and overwritten in place otherwise, e.g. when it is bind mounted in a
+// container.
+func (f *File) Save() error {
+	data := []byte(strings.Join(f.lines, "\n") + "\n")
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), "."+filepath.Base(f.path)+".*")
+	if err == nil {
+		name := tmp.Name()
+		_, err = tmp.Write(data)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Chmod(name, f.mode)
+		}
+		if err == nil {
+			err = os.Rename(name, f.path)
+		}
+		if err == nil {
+			return nil
+		}
+		os.Remove(name)
+	}
+
+	if err := os.WriteFile(f.path, data, f.mode); err != nil {
+		return fmt.Errorf("failed to write rules: %v", err)
+	}
+	return nil
+}
+
+// rule parses the line at index i.
+func (f *File) rule(i int) (Rule, bool) {
+	text := strings.TrimSpace(f.lines[i])
+	enabled := !strings.HasPrefix(text, "#")
+	if !enabled {
+		text = strings.TrimLeft(text, "# \t")
+	}
+	rule, err := Parse(text)
+	if err != nil {
+		return Rule{}, false
+	}
+	rule.Enabled = enabled
+	rule.Line = i + 1
+	return rule, true
+}
+
+// find returns the index of the line of the rule with the sid.
+func (f *File) find(sid int) (int, error) {
+	for i := range f.lines {
+		if rule, ok := f.rule(i); ok && rule.SID == sid {
+			return i, nil
+		}
+	}
+	return 0, ErrNotFound
+}
+
+// line returns the line of a rule in a rule file.
+func line(rule Rule) string {
+	if rule.Enabled {
+		return rule.Text
+	}
+	return disabledPrefix + rule.Text
+}
@@ -0,0 +1,101 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package rules
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testRules = `# Flags (sid 1-1000)
+alert ip any any -> any any (msg:"flag out"; content:"FLAG{"; sid:1;)
+# alert ip any any -> any any (msg:"flag in"; content:"FLAG{"; sid:2;)
+alert ip any any -> any any (msg:"broken"
+`
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "suricata.rules")
+	if err := os.WriteFile(path, []byte(testRules), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	rules := f.Rules()
+	if len(rules) != 2 {
+		t.Fatalf("Rules = %+v, want 2 rules", rules)
+	}
+	if rules[0].SID != 1 || !rules[0].Enabled || rules[0].Line != 2 {
+		t.Errorf("first rule = %+v, want sid 1 enabled on line 2", rules[0])
+	}
+	if rules[1].SID != 2 || rules[1].Enabled || rules[1].Msg != "flag in" {
+		t.Errorf("second rule = %+v, want sid 2 disabled", rules[1])
+	}
+
+	added, err := Parse(`alert tcp any any -> any 80 (msg:"new"; sid:3;)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Add(Rule{SID: 1, Text: "alert ip any any -> any any (sid:1;)", Enabled: true}); !errors.Is(err, ErrExists) {
+		t.Errorf("Add of a used sid = %v, want ErrExists", err)
+	}
+	if added, err = f.Add(added); err != nil || added.Line != 5 {
+		t.Errorf("Add = %+v, %v, want the rule on line 5", added, err)
+	}
+	if _, err := f.SetEnabled(1, false); err != nil {
+		t.Errorf("SetEnabled failed: %v", err)
+	}
+	if _, err := f.SetEnabled(2, true); err != nil {
+		t.Errorf("SetEnabled failed: %v", err)
+	}
+	edited, err := Parse(`alert ip any any -> any any (msg:"flag in, edited"; sid:20;)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Replace(2, Rule{SID: 1, Text: "alert ip any any -> any any (sid:1;)", Enabled: true}); !errors.Is(err, ErrExists) {
+		t.Errorf("Replace with a used sid = %v, want ErrExists", err)
+	}
+	if _, err := f.Replace(2, edited); err != nil {
+		t.Errorf("Replace failed: %v", err)
+	}
+	if _, err := f.Replace(2, edited); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Replace of a missing sid = %v, want ErrNotFound", err)
+	}
+	if err := f.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# Flags (sid 1-1000)
+# alert ip any any -> any any (msg:"flag out"; content:"FLAG{"; sid:1;)
+alert ip any any -> any any (msg:"flag in, edited"; sid:20;)
+alert ip any any -> any any (msg:"broken"
+alert tcp any any -> any 80 (msg:"new"; sid:3;)
+`
+	if string(data) != want {
+		t.Errorf("saved file =\n%s\nwant\n%s", data, want)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o640 {
+		t.Errorf("saved file mode = %v, %v, want 0640", info.Mode().Perm(), err)
+	}
+
+	f, err = Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule, err := f.Get(20); err != nil || !rule.Enabled || rule.Line != 3 {
+		t.Errorf("Get = %+v, %v, want sid 20 enabled on line 3", rule, err)
+	}
+	if _, err := f.Get(2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a replaced sid = %v, want ErrNotFound", err)
+	}
+}
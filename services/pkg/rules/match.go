@@ -0,0 +1,589 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package rules
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"tulip/pkg/db"
+)
+
+// maxSteps bounds the backtracking of the payload keywords on a message, as
+// the inspection recursion limit of Suricata does.
+const maxSteps = 3000
+
+// ignoredKeywords do not change which flows a rule matches.
+var ignoredKeywords = map[string]bool{
+	"msg": true, "sid": true, "rev": true, "gid": true, "classtype": true, "reference": true,
+	"metadata": true, "priority": true, "fast_pattern": true, "target": true,
+}
+
+// Matcher matches a rule against stored flows, outside of Suricata. It
+// supports a practical subset of the rule language:
+//   - the header, with ip, tcp, udp or an app-layer protocol recorded on the
+//     flow (see db.AppLayer), addresses and ports without variables;
+//   - content, with nocase, depth, offset, distance, within, startswith and
+//     endswith;
+//   - pcre, with the i, s, m and R flags, as far as Go regexps go;
+//   - flow directions (to_server, to_client, ...);
+//   - the metadata tags and the priority.
+//
+// The payload keywords are matched against each message of the flow, as
+// shown in the flow view. Setting flowbits and flowints is ignored.
+type Matcher struct {
+	Rule     Rule
+	Tags     []db.Tag // Tags of the metadata, with the color at the same position, as applied by the enricher
+	Priority int      // Priority of the rule, 0 if unset
+
+	proto     string
+	src, dst  addresses
+	srcPorts  ports
+	dstPorts  ports
+	both      bool   // "<>" header, matching either direction
+	direction string // "c" or "s" to only match the messages of the client or the server
+	patterns  []pattern
+}
+
+// Compile prepares the matching of a rule, returning an error if it uses a
+// keyword that is not supported.
+func Compile(rule Rule) (*Matcher, error) {
+	text := strings.TrimSpace(rule.Text)
+	start := strings.IndexByte(text, '(')
+	if start < 0 || !strings.HasSuffix(text, ")") {
+		return nil, fmt.Errorf("options must be enclosed in parentheses")
+	}
+	header := strings.Fields(text[:start])
+	if len(header) != 7 {
+		return nil, fmt.Errorf("invalid header")
+	}
+	if header[0] == "pass" {
+		return nil, fmt.Errorf("pass rules raise no alerts")
+	}
+
+	m := &Matcher{Rule: rule, proto: header[1], both: header[4] == "<>"}
+	var err error
+	if m.src, err = parseAddresses(header[2]); err != nil {
+		return nil, err
+	}
+	if m.srcPorts, err = parsePorts(header[3]); err != nil {
+		return nil, err
+	}
+	if m.dst, err = parseAddresses(header[5]); err != nil {
+		return nil, err
+	}
+	if m.dstPorts, err = parsePorts(header[6]); err != nil {
+		return nil, err
+	}
+
+	options, err := ParseOptions(text[start+1 : len(text)-1])
+	if err != nil {
+		return nil, err
+	}
+	var colors []string
+	for _, option := range options {
+		if err := m.addOption(option, &colors); err != nil {
+			return nil, err
+		}
+	}
+	for i := range m.Tags {
+		if len(colors) > 0 {
+			m.Tags[i].Color = colors[min(i, len(colors)-1)]
+		}
+	}
+	return m, nil
+}
+
+func (m *Matcher) addOption(option Option, colors *[]string) error {
+	// last is the pattern the modifiers apply to
+	var last *pattern
+	if len(m.patterns) > 0 {
+		last = &m.patterns[len(m.patterns)-1]
+	}
+	value := option.Value
+
+	switch option.Name {
+	case "content":
+		p, err := parseContent(value)
+		if err != nil {
+			return err
+		}
+		m.patterns = append(m.patterns, p)
+	case "pcre":
+		p, err := parsePcre(value)
+		if err != nil {
+			return err
+		}
+		m.patterns = append(m.patterns, p)
+	case "nocase", "startswith", "endswith":
+		if last == nil || last.content == nil {
+			return fmt.Errorf("%s must follow a content", option.Name)
+		}
+		switch option.Name {
+		case "nocase":
+			last.nocase = true
+			last.content = lower(last.content)
+		case "startswith":
+			last.offset, last.depth, last.hasDepth = 0, len(last.content), true
+		case "endswith":
+			last.endswith = true
+		}
+	case "depth", "offset", "distance", "within":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", option.Name, value)
+		}
+		if last == nil {
+			return fmt.Errorf("%s must follow a content or a pcre", option.Name)
+		}
+		switch option.Name {
+		case "depth", "offset":
+			if last.content == nil || last.relative {
+				return fmt.Errorf("%s must follow a content that is not relative", option.Name)
+			}
+			if option.Name == "depth" {
+				last.depth, last.hasDepth = n, true
+			} else {
+				last.offset = n
+			}
+		case "distance", "within":
+			if last.offset != 0 || last.hasDepth {
+				return fmt.Errorf("%s cannot be mixed with offset and depth", option.Name)
+			}
+			last.relative = true
+			if option.Name == "distance" {
+				last.distance = n
+			} else {
+				last.within, last.hasWithin = n, true
+			}
+		}
+	case "flow":
+		for _, flag := range strings.Split(value, ",") {
+			switch strings.TrimSpace(flag) {
+			case "to_server", "from_client":
+				m.direction = "c"
+			case "to_client", "from_server":
+				m.direction = "s"
+			case "established", "not_established", "stateless", "only_stream", "no_stream":
+			default:
+				return fmt.Errorf("unsupported flow option %q", flag)
+			}
+		}
+	case "metadata":
+		for _, entry := range strings.Split(value, ",") {
+			key, val, _ := strings.Cut(strings.TrimSpace(entry), " ")
+			val = strings.TrimSpace(val)
+			switch {
+			case key == "tag" && val != "":
+				m.Tags = append(m.Tags, db.Tag{Name: val, Origin: db.TagOriginSuricata})
+			case key == "color" && val != "":
+				*colors = append(*colors, val)
+			}
+		}
+	case "priority":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid priority %q", value)
+		}
+		m.Priority = n
+	case "flowint":
+		// counting is ignored, checking a counter is not supported
+		args := strings.Split(value, ",")
+		if len(args) < 2 || !slices.Contains([]string{"+", "-", "="}, strings.TrimSpace(args[1])) {
+			return fmt.Errorf("unsupported flowint %q", value)
+		}
+	case "flowbits":
+		switch op, _, _ := strings.Cut(value, ","); strings.TrimSpace(op) {
+		case "set", "unset", "toggle":
+		case "noalert":
+			return fmt.Errorf("the rule raises no alerts")
+		default:
+			return fmt.Errorf("unsupported flowbits %q", value)
+		}
+	case "noalert":
+		return fmt.Errorf("the rule raises no alerts")
+	default:
+		if !ignoredKeywords[option.Name] {
+			return fmt.Errorf("unsupported keyword %q", option.Name)
+		}
+	}
+	return nil
+}
+
+// Match reports whether the rule matches a flow.
+func (m *Matcher) Match(flow *db.FlowEntry) bool {
+	proto := "tcp"
+	if slices.Contains(flow.Tags, "udp") {
+		proto = "udp"
+	}
+	switch m.proto {
+	case "ip":
+	case "tcp", "tcp-pkt", "tcp-stream", "udp":
+		if !strings.HasPrefix(m.proto, proto) {
+			return false
+		}
+	default:
+		if !slices.Contains(flow.App.Protocols, m.proto) {
+			return false
+		}
+	}
+
+	// the client is the source of the flow
+	client, _ := netip.ParseAddr(flow.SrcIp)
+	server, _ := netip.ParseAddr(flow.DstIp)
+	sides := map[string]bool{
+		"c": m.direction != "s" && m.header(client, flow.SrcPort, server, flow.DstPort),
+		"s": m.direction != "c" && m.header(server, flow.DstPort, client, flow.SrcPort),
+	}
+	if len(m.patterns) == 0 {
+		return sides["c"] || sides["s"]
+	}
+	for _, item := range flow.Flow {
+		if sides[item.From] && m.matchPayload([]byte(item.Data)) {
+			return true
+		}
+	}
+	return false
+}
+
+// header reports whether the header matches a packet.
+func (m *Matcher) header(src netip.Addr, srcPort int, dst netip.Addr, dstPort int) bool {
+	if m.src.match(src) && m.srcPorts.match(srcPort) && m.dst.match(dst) && m.dstPorts.match(dstPort) {
+		return true
+	}
+	return m.both && m.src.match(dst) && m.srcPorts.match(dstPort) && m.dst.match(src) && m.dstPorts.match(srcPort)
+}
+
+// matchPayload reports whether the payload keywords match a message.
+func (m *Matcher) matchPayload(payload []byte) bool {
+	var lowered []byte
+	buffer := func(p *pattern) []byte {
+		if !p.nocase {
+			return payload
+		}
+		if lowered == nil {
+			lowered = lower(payload)
+		}
+		return lowered
+	}
+
+	steps := 0
+	// try matches the patterns from i, the previous match ending at prev
+	var try func(i, prev int) bool
+	try = func(i, prev int) bool {
+		if i == len(m.patterns) {
+			return true
+		}
+		if steps++; steps > maxSteps {
+			return false
+		}
+		p := &m.patterns[i]
+		buf := buffer(p)
+		lo, hi := p.window(prev, len(buf))
+		if p.negated {
+			if _, _, ok := p.find(buf, lo, hi); ok {
+				return false
+			}
+			return try(i+1, prev)
+		}
+		for lo <= hi {
+			start, end, ok := p.find(buf, lo, hi)
+			if !ok {
+				return false
+			}
+			if try(i+1, end) {
+				return true
+			}
+			if p.re != nil {
+				return false // like Suricata, only the first match of a pcre is tried
+			}
+			lo = start + 1
+		}
+		return false
+	}
+	return try(0, 0)
+}
+
+// pattern is a content or a pcre, with its modifiers.
+type pattern struct {
+	content  []byte         // nil for a pcre
+	re       *regexp.Regexp // nil for a content
+	negated  bool
+	nocase   bool // content is lowercase
+	endswith bool
+
+	offset, depth int // window from the start of the message
+	hasDepth      bool
+
+	relative         bool // window after the previous match
+	distance, within int
+	hasWithin        bool
+}
+
+// window returns the bounds of the message the pattern must be found in,
+// the previous match ending at prev.
+func (p *pattern) window(prev, size int) (int, int) {
+	lo, hi := p.offset, size
+	if p.hasDepth {
+		hi = p.offset + p.depth
+	}
+	if p.relative {
+		lo = prev + p.distance
+		if p.hasWithin {
+			hi = lo + p.within
+		}
+	}
+	return max(lo, 0), min(hi, size)
+}
+
+// find returns the bounds of the first match of the pattern in buf[lo:hi].
+func (p *pattern) find(buf []byte, lo, hi int) (int, int, bool) {
+	if lo > hi {
+		return 0, 0, false
+	}
+	if p.re != nil {
+		loc := p.re.FindIndex(buf[lo:hi])
+		if loc == nil {
+			return 0, 0, false
+		}
+		return lo + loc[0], lo + loc[1], true
+	}
+	if p.endswith {
+		if hi != len(buf) || !bytes.HasSuffix(buf[lo:hi], p.content) {
+			return 0, 0, false
+		}
+		return hi - len(p.content), hi, true
+	}
+	i := bytes.Index(buf[lo:hi], p.content)
+	if i < 0 {
+		return 0, 0, false
+	}
+	return lo + i, lo + i + len(p.content), true
+}
+
+// parseContent parses the value of a content: a quoted string, possibly
+// negated, where bytes can be written in hex between pipes.
+func parseContent(value string) (pattern, error) {
+	var p pattern
+	if rest, ok := strings.CutPrefix(value, "!"); ok {
+		p.negated, value = true, strings.TrimSpace(rest)
+	}
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return p, fmt.Errorf("content must be a quoted string")
+	}
+	value = value[1 : len(value)-1]
+
+	var content []byte
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\':
+			if i+1 < len(value) {
+				i++
+				content = append(content, value[i])
+			}
+		case '|':
+			end := strings.IndexByte(value[i+1:], '|')
+			if end < 0 {
+				return p, fmt.Errorf("unterminated hex bytes in content")
+			}
+			decoded, err := hex.DecodeString(strings.Join(strings.Fields(value[i+1:i+1+end]), ""))
+			if err != nil {
+				return p, fmt.Errorf("invalid hex bytes in content: %v", err)
+			}
+			content = append(content, decoded...)
+			i += end + 1
+		default:
+			content = append(content, c)
+		}
+	}
+	if len(content) == 0 {
+		return p, fmt.Errorf("empty content")
+	}
+	p.content = content
+	return p, nil
+}
+
+// parsePcre parses the value of a pcre: "/regex/flags", possibly negated and
+// followed by the variable capturing the match.
+func parsePcre(value string) (pattern, error) {
+	var p pattern
+	if rest, ok := strings.CutPrefix(value, "!"); ok {
+		p.negated, value = true, strings.TrimSpace(rest)
+	}
+	value = unquoteRaw(value)
+	first, last := strings.IndexByte(value, '/'), strings.LastIndexByte(value, '/')
+	if first != 0 || last <= first {
+		return p, fmt.Errorf("pcre must be written /regex/flags")
+	}
+	flags, _, _ := strings.Cut(value[last+1:], ",")
+
+	prefix := ""
+	for _, flag := range strings.TrimSpace(flags) {
+		switch flag {
+		case 'i', 's', 'm':
+			prefix += "(?" + string(flag) + ")"
+		case 'R':
+			p.relative = true
+		default:
+			return p, fmt.Errorf("unsupported pcre flag %q", flag)
+		}
+	}
+	re, err := regexp.Compile(prefix + value[1:last])
+	if err != nil {
+		return p, fmt.Errorf("unsupported pcre: %v", err)
+	}
+	p.re = re
+	return p, nil
+}
+
+// unquoteRaw removes the quotes of a value, keeping its escapes.
+func unquoteRaw(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// lower returns a copy of b with the ASCII letters in lowercase, as nocase
+// does.
+func lower(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		out[i] = c
+	}
+	return out
+}
+
+// addresses is the source or destination of a header.
+type addresses struct {
+	negated bool
+	include []netip.Prefix // Any address if empty
+	exclude []netip.Prefix
+}
+
+func parseAddresses(s string) (addresses, error) {
+	var a addresses
+	if rest, ok := strings.CutPrefix(s, "!"); ok {
+		a.negated, s = true, rest
+	}
+	if s == "any" {
+		return a, nil
+	}
+	for _, item := range listItems(s) {
+		negated := false
+		if rest, ok := strings.CutPrefix(item, "!"); ok {
+			negated, item = true, rest
+		}
+		if item == "any" && !negated {
+			a.include = append(a.include, netip.Prefix{})
+			continue
+		}
+		if strings.HasPrefix(item, "$") || strings.HasPrefix(item, "[") {
+			return a, fmt.Errorf("unsupported address %q", item)
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(item)
+			if addrErr != nil {
+				return a, fmt.Errorf("invalid address %q", item)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if negated {
+			a.exclude = append(a.exclude, prefix.Masked())
+		} else {
+			a.include = append(a.include, prefix.Masked())
+		}
+	}
+	return a, nil
+}
+
+func (a addresses) match(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	in := len(a.include) == 0 || slices.ContainsFunc(a.include, func(p netip.Prefix) bool {
+		return !p.IsValid() || p.Contains(addr)
+	})
+	if in && slices.ContainsFunc(a.exclude, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+		in = false
+	}
+	return in != a.negated
+}
+
+// ports is the source or destination port of a header.
+type ports struct {
+	negated bool
+	include [][2]int // Ranges of ports, any port if empty
+	exclude [][2]int
+}
+
+func parsePorts(s string) (ports, error) {
+	var p ports
+	if rest, ok := strings.CutPrefix(s, "!"); ok {
+		p.negated, s = true, rest
+	}
+	if s == "any" {
+		return p, nil
+	}
+	for _, item := range listItems(s) {
+		negated := false
+		if rest, ok := strings.CutPrefix(item, "!"); ok {
+			negated, item = true, rest
+		}
+		if item == "any" && !negated {
+			p.include = append(p.include, [2]int{0, 65535})
+			continue
+		}
+		lo, hi, isRange := strings.Cut(item, ":")
+		if !isRange {
+			hi = lo
+		}
+		if lo == "" {
+			lo = "0"
+		}
+		if hi == "" {
+			hi = "65535"
+		}
+		from, errLo := strconv.Atoi(lo)
+		to, errHi := strconv.Atoi(hi)
+		if errLo != nil || errHi != nil || from > to {
+			return p, fmt.Errorf("unsupported port %q", item)
+		}
+		if negated {
+			p.exclude = append(p.exclude, [2]int{from, to})
+		} else {
+			p.include = append(p.include, [2]int{from, to})
+		}
+	}
+	return p, nil
+}
+
+func (p ports) match(port int) bool {
+	contains := func(r [2]int) bool { return r[0] <= port && port <= r[1] }
+	in := len(p.include) == 0 || slices.ContainsFunc(p.include, contains)
+	if in && slices.ContainsFunc(p.exclude, contains) {
+		in = false
+	}
+	return in != p.negated
+}
+
+// listItems splits a list such as "[80,443]", or returns the single item.
+func listItems(s string) []string {
+	if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+		return []string{s}
+	}
+	var items []string
+	for _, item := range strings.Split(s[1:len(s)-1], ",") {
+		items = append(items, strings.TrimSpace(item))
+	}
+	return items
+}
@@ -0,0 +1,181 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package rules
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"tulip/pkg/db"
+)
+
+// testFlow is an HTTP request to 10.0.0.2:8080 leaking a flag.
+func testFlow() db.FlowEntry {
+	return db.FlowEntry{
+		SrcIp: "10.0.0.1", SrcPort: 40000, DstIp: "10.0.0.2", DstPort: 8080,
+		Tags: []string{"tcp"},
+		App:  db.AppLayer{Protocols: []string{"http"}},
+		Flow: []db.FlowItem{
+			{From: "c", Data: "GET /flag HTTP/1.1\r\nHost: vuln\r\n\r\n"},
+			{From: "s", Data: "HTTP/1.1 200 OK\r\n\r\nFLAG{AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=} \x00\xff"},
+		},
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  string
+		match bool
+	}{
+		{"content", `content:"FLAG{"; sid:1;`, true},
+		{"missing content", `content:"CTF{"; sid:1;`, false},
+		{"negated content", `flow:to_client; content:!"FLAG{"; sid:1;`, false},
+		{"negated content in another message", `content:!"FLAG{"; sid:1;`, true},
+		{"nocase", `content:"get /FLAG"; nocase; sid:1;`, true},
+		{"case sensitive", `content:"get /FLAG"; sid:1;`, false},
+		{"hex content", `content:"|00 ff|"; sid:1;`, true},
+		{"depth", `content:"GET"; depth:3; sid:1;`, true},
+		{"depth too short", `content:"/flag"; depth:5; sid:1;`, false},
+		{"offset", `content:"/flag"; offset:4; depth:5; sid:1;`, true},
+		{"offset too far", `content:"GET"; offset:1; sid:1;`, false},
+		{"startswith", `content:"HTTP/1.1 200"; startswith; sid:1;`, true},
+		{"endswith", `content:"|00 ff|"; endswith; sid:1;`, true},
+		{"distance", `content:"FLAG{"; content:"=}"; distance:31; sid:1;`, true},
+		{"distance too far", `content:"FLAG{"; content:"=}"; distance:32; sid:1;`, false},
+		{"within", `content:"HTTP/1.1"; content:"OK"; within:7; sid:1;`, true},
+		{"within too short", `content:"HTTP/1.1"; content:"OK"; within:6; sid:1;`, false},
+		{"backtracking", `content:"0"; content:" OK"; within:3; sid:1;`, true},
+		{"pcre", `pcre:"/FLAG\{[A-Z]{31}=\}/"; sid:1;`, true},
+		{"pcre flags", `pcre:"/^http\/1\.1 200/i"; sid:1;`, true},
+		{"negated pcre", `flow:to_client; pcre:!"/FLAG/"; sid:1;`, false},
+		{"relative pcre", `content:"200"; pcre:"/^ OK/R"; sid:1;`, true},
+		{"relative pcre with distance", `content:"="; pcre:"/(FLAG\{[A-Z]{31}=)/, flow:match"; distance:-37; content:!"BBBBB="; distance:-6; sid:1;`, true},
+		{"negated relative content", `content:"="; pcre:"/(FLAG\{[A-Z]{31}=)/"; distance:-37; content:!"AAAAA="; distance:-6; sid:1;`, false},
+		{"to_client", `flow:established,to_client; content:"FLAG{"; sid:1;`, true},
+		{"to_server", `flow:to_server; content:"FLAG{"; sid:1;`, false},
+		{"no payload keywords", `flow:to_server; sid:1;`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := Parse("alert ip any any -> any any (" + tt.rule + ")")
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := Compile(rule)
+			if err != nil {
+				t.Fatalf("Compile failed: %v", err)
+			}
+			flow := testFlow()
+			if got := m.Match(&flow); got != tt.match {
+				t.Errorf("Match = %v, want %v", got, tt.match)
+			}
+		})
+	}
+}
+
+func TestMatcher_Header(t *testing.T) {
+	tests := []struct {
+		header string
+		match  bool
+	}{
+		{"alert tcp any any -> any 8080", true},
+		{"alert udp any any -> any any", false},
+		{"alert http any any -> any any", true},
+		{"alert tls any any -> any any", false},
+		{"alert ip 10.0.0.1 any -> 10.0.0.0/24 any", true},
+		{"alert ip 10.0.0.2 any -> any any", false},
+		{"alert ip any any -> ![10.0.0.2,10.0.1.0/24] any", false},
+		{"alert ip any any -> [10.0.0.0/8,!10.0.0.3] any", true},
+		{"alert ip any any -> any [80,8000:8100]", true},
+		{"alert ip any any -> any !8080", false},
+		{"alert ip any 1024: -> any :9000", true},
+		// the client sends the request, the server port is the destination
+		{"alert ip any 8080 -> any any", false},
+		{"alert ip any 8080 <> any any", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			rule, err := Parse(tt.header + ` (content:"GET"; sid:1;)`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := Compile(rule)
+			if err != nil {
+				t.Fatalf("Compile failed: %v", err)
+			}
+			flow := testFlow()
+			if got := m.Match(&flow); got != tt.match {
+				t.Errorf("Match = %v, want %v", got, tt.match)
+			}
+		})
+	}
+}
+
+func TestCompile(t *testing.T) {
+	rule, err := Parse(`alert ip any any -> any any (msg:"flag"; content:"FLAG{"; metadata: tag FLAG OUT, tag exploit, color danger; priority:2; flowint: tag_FLAG_OUT, +, 1; flowbits:set,leak; sid:1;)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Compile(rule)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	want := []db.Tag{
+		{Name: "FLAG OUT", Color: "danger", Origin: db.TagOriginSuricata},
+		{Name: "exploit", Color: "danger", Origin: db.TagOriginSuricata},
+	}
+	if !slices.Equal(m.Tags, want) || m.Priority != 2 {
+		t.Errorf("Compile = tags %+v, priority %d; want %+v, 2", m.Tags, m.Priority, want)
+	}
+
+	unsupported := map[string]string{
+		"keyword":         `file.data; content:"x"; sid:1;`,
+		"flowbits check":  `flowbits:isset,leak; sid:1;`,
+		"flowint check":   `flowint: count, >, 1; sid:1;`,
+		"noalert":         `content:"x"; flowbits:noalert; sid:1;`,
+		"pcre flag":       `pcre:"/x/U"; sid:1;`,
+		"pcre lookahead":  `pcre:"/x(?=y)/"; sid:1;`,
+		"modifier first":  `nocase; content:"x"; sid:1;`,
+		"mixed modifiers": `content:"x"; offset:1; distance:2; sid:1;`,
+		"variable":        `sid:1;`,
+		"priority":        `content:"x"; priority:high; sid:1;`,
+	}
+	for name, options := range unsupported {
+		header := "alert ip any any -> any any"
+		if name == "variable" {
+			header = "alert ip $HOME_NET any -> any any"
+		}
+		rule, err := Parse(header + " (" + options + ")")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Compile(rule); err == nil {
+			t.Errorf("Compile of %s succeeded", name)
+		}
+	}
+}
+
+// TestCompile_Ruleset checks that the flag rules shipped with Tulip can be
+// matched, except the ones on decoded buffers.
+func TestCompile_Ruleset(t *testing.T) {
+	path := "../../../suricata.rules"
+	if _, err := os.Stat(path); err != nil {
+		t.Skip("no rule file")
+	}
+	f, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range f.Rules() {
+		if rule.SID > 1000 || strings.Contains(rule.Text, "file.data") {
+			continue
+		}
+		if _, err := Compile(rule); err != nil {
+			t.Errorf("Compile of sid %d failed: %v", rule.SID, err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package rules
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+	"tulip/pkg/db"
+)
+
+// retroBatch is the number of flows read at once by Retro.
+const retroBatch = 200
+
+// RetroOptions selects the flows scanned by Retro.
+type RetroOptions struct {
+	TickFrom *int // First game tick to scan
+	TickTo   *int // Last game tick to scan
+}
+
+// RetroProgress is the progress of a Retro scan.
+type RetroProgress struct {
+	Total   int           `json:"total"`             // Flows to scan
+	Scanned int           `json:"scanned"`           // Flows scanned so far
+	Matched int           `json:"matched"`           // Signatures attached to the flows
+	Skipped []SkippedRule `json:"skipped,omitempty"` // Rules that cannot be matched, see Compile
+}
+
+// SkippedRule is a rule Retro cannot match.
+type SkippedRule struct {
+	SID   int    `json:"sid"`
+	Error string `json:"error"`
+}
+
+// retroRule is a rule matched by Retro, with its signature.
+type retroRule struct {
+	matcher *Matcher
+	sig     db.Signature
+	id      string // ID of the stored signature, empty until known
+}
+
+// Retro matches rules against the flows stored before the scan starts, newest
+// first, attaching the signature of each rule to the flows it matches as the
+// enricher does with the alerts of Suricata. Flows already holding the
+// signature of a rule are skipped, so running Retro again does not count the
+// alerts twice. progress, if not nil, is called after each batch of flows.
+func Retro(ctx context.Context, database db.Database, rules []Rule, opts RetroOptions, progress func(RetroProgress)) (RetroProgress, error) {
+	var status RetroProgress
+	var matched []*retroRule
+	for _, rule := range rules {
+		matcher, err := Compile(rule)
+		if err != nil {
+			status.Skipped = append(status.Skipped, SkippedRule{SID: rule.SID, Error: err.Error()})
+			continue
+		}
+		r, err := prepareRetro(ctx, database, matcher)
+		if err != nil {
+			return status, err
+		}
+		matched = append(matched, r)
+	}
+	if len(matched) == 0 {
+		return status, nil
+	}
+
+	query := db.GetFlowsOptions{
+		ToTime:   time.Now().UnixMilli() + 1, // the new flows get their alerts from Suricata
+		TickFrom: opts.TickFrom,
+		TickTo:   opts.TickTo,
+	}
+	total, err := database.CountFlows(ctx, &query)
+	if err != nil {
+		return status, err
+	}
+	status.Total = total
+
+	query.Limit = retroBatch
+	for {
+		if err := ctx.Err(); err != nil {
+			return status, err
+		}
+		flows, err := database.GetFlows(ctx, &query)
+		if err != nil {
+			return status, err
+		}
+		if len(flows) == 0 {
+			return status, nil
+		}
+		for i := range flows {
+			n, err := retroFlow(ctx, database, matched, &flows[i])
+			if err != nil {
+				return status, err
+			}
+			status.Matched += n
+		}
+		status.Scanned += len(flows)
+		last := flows[len(flows)-1]
+		query.Cursor = &db.FlowCursor{Time: last.Time, Id: last.Id}
+		if progress != nil {
+			progress(status)
+		}
+	}
+}
+
+// prepareRetro registers the tags of a rule and builds its signature, keeping
+// the fields reported by Suricata when it already raised alerts for it.
+func prepareRetro(ctx context.Context, database db.Database, matcher *Matcher) (*retroRule, error) {
+	rule := matcher.Rule
+	r := &retroRule{matcher: matcher, sig: db.Signature{
+		GID:      1,
+		ID:       rule.SID,
+		Rev:      rule.Rev,
+		Msg:      rule.Msg,
+		Action:   "allowed",
+		Severity: cmp.Or(matcher.Priority, 3),
+	}}
+	stored, err := database.GetSignature(ctx, strconv.Itoa(rule.SID))
+	if err == nil && stored.GID == 1 && stored.Rev == rule.Rev {
+		r.id = stored.MongoID.Hex()
+		r.sig.Action, r.sig.Severity, r.sig.Category = stored.Action, stored.Severity, stored.Category
+	} else if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return nil, err
+	}
+
+	for _, tag := range matcher.Tags {
+		if db.ValidateTag(tag) != nil {
+			tag = db.Tag{Name: tag.Name, Origin: tag.Origin}
+		}
+		if err := database.InsertTag(ctx, tag); err != nil {
+			return nil, err
+		}
+		r.sig.Tags = append(r.sig.Tags, tag.Name)
+	}
+	return r, nil
+}
+
+// retroFlow attaches to a flow the signatures of the rules matching it, and
+// returns how many were attached.
+func retroFlow(ctx context.Context, database db.Database, rules []*retroRule, flow *db.FlowEntry) (int, error) {
+	// the exact flow, not the latest one with its Community ID
+	id := db.FlowID{
+		Src_port: flow.SrcPort,
+		Dst_port: flow.DstPort,
+		Src_ip:   flow.SrcIp,
+		Dst_ip:   flow.DstIp,
+		Time:     time.UnixMilli(int64(flow.Time)),
+	}
+	attached := 0
+	for _, r := range rules {
+		if r.id != "" && slices.Contains(flow.Suricata, r.id) {
+			continue
+		}
+		if !r.matcher.Match(flow) {
+			continue
+		}
+		found, err := database.AddSignatureToFlow(ctx, id, r.sig, 1)
+		if err != nil {
+			return attached, fmt.Errorf("failed to attach signature %d: %v", r.sig.ID, err)
+		}
+		if !found {
+			continue // removed since it was read
+		}
+		attached++
+		if r.id == "" {
+			if stored, err := database.GetSignature(ctx, strconv.Itoa(r.sig.ID)); err == nil && stored.Rev == r.sig.Rev {
+				r.id = stored.MongoID.Hex()
+			}
+		}
+	}
+	return attached, nil
+}
@@ -0,0 +1,91 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package rules
+
+import (
+	"slices"
+	"testing"
+	"time"
+	"tulip/pkg/db"
+)
+
+func TestRetro(t *testing.T) {
+	database := db.NewMemoryDatabase()
+	start := int(time.Now().Add(-time.Hour).UnixMilli())
+	for i := range 450 {
+		flow := testFlow()
+		flow.SrcPort += i
+		flow.Time, flow.Tick = start+i, i/100
+		if i%3 != 0 {
+			flow.Flow = flow.Flow[:1]
+		}
+		if err := database.InsertFlow(t.Context(), flow); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var list []Rule
+	for _, text := range []string{
+		`alert ip any any -> any any (msg:"flag out"; flow:to_client; content:"FLAG{"; metadata: tag FLAG OUT, color danger; sid:1; rev:2;)`,
+		`alert ip any any -> any any (msg:"decoded"; file.data; content:"FLAG{"; sid:2;)`,
+	} {
+		rule, err := Parse(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, rule)
+	}
+
+	var calls int
+	status, err := Retro(t.Context(), database, list, RetroOptions{}, func(RetroProgress) { calls++ })
+	if err != nil {
+		t.Fatalf("Retro failed: %v", err)
+	}
+	if status.Total != 450 || status.Scanned != 450 || status.Matched != 150 || calls != 3 {
+		t.Errorf("Retro = %+v after %d batches, want 150 of 450 flows matched in 3 batches", status, calls)
+	}
+	if len(status.Skipped) != 1 || status.Skipped[0].SID != 2 {
+		t.Errorf("skipped rules = %+v, want sid 2", status.Skipped)
+	}
+
+	sig, err := database.GetSignature(t.Context(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.Msg != "flag out" || sig.Rev != 2 || !slices.Equal(sig.Tags, []string{"FLAG OUT"}) {
+		t.Errorf("signature = %+v, want the rule with its tag", sig)
+	}
+	flows, err := database.GetFlows(t.Context(), &db.GetFlowsOptions{IncludeTags: []string{"FLAG OUT"}, Limit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 150 || !slices.Contains(flows[0].Suricata, sig.MongoID.Hex()) {
+		t.Errorf("got %d tagged flows, want 150 with the signature", len(flows))
+	}
+	tags, err := database.GetTags(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := slices.IndexFunc(tags, func(tag db.Tag) bool { return tag.Name == "FLAG OUT" }); i < 0 || tags[i].Color != "danger" {
+		t.Errorf("tags = %+v, want FLAG OUT registered with its color", tags)
+	}
+
+	// a second run does not count the alerts again
+	first, last := 0, 1
+	status, err = Retro(t.Context(), database, list[:1], RetroOptions{TickFrom: &first, TickTo: &last}, nil)
+	if err != nil {
+		t.Fatalf("Retro failed: %v", err)
+	}
+	if status.Total != 200 || status.Matched != 0 {
+		t.Errorf("second Retro = %+v, want 200 flows scanned and none matched", status)
+	}
+	stats, err := database.GetTopSignatures(t.Context(), &db.SignatureStatsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Hits != 150 {
+		t.Errorf("signature stats = %+v, want 150 hits", stats)
+	}
+}
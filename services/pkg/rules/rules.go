@@ -0,0 +1,169 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package rules reads and edits Suricata rule files, asks a running Suricata
+// to reload them through its unix command socket, and matches them against the
+// stored flows, see Retro.
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// actions are the actions a rule can start with.
+var actions = []string{"alert", "pass", "drop", "reject", "rejectsrc", "rejectdst", "rejectboth"}
+
+// directions are the operators between the source and the destination.
+var directions = []string{"->", "<>", "=>"}
+
+var optionName = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// Rule is a rule of a rule file.
+type Rule struct {
+	SID     int    `json:"sid"`
+	Rev     int    `json:"rev,omitempty"`
+	Msg     string `json:"msg"`
+	Action  string `json:"action"`
+	Enabled bool   `json:"enabled"` // Disabled rules are commented out
+	Text    string `json:"rule"`    // The rule, without the comment marker of disabled rules
+	Line    int    `json:"line"`    // 1-based line of the rule in its file, 0 if not in a file
+}
+
+// Option is a keyword of the options of a rule, such as "msg" or "content".
+type Option struct {
+	Name  string
+	Value string // Raw value, with quotes and escapes, empty for options such as "nocase"
+}
+
+// Parse parses and validates a rule, checking its header, that its options
+// are well formed and that it has a sid. The rule is enabled.
+//
+// The check is syntactic: only Suricata knows whether the keywords and their
+// values are valid, see Reload.
+func Parse(text string) (Rule, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return Rule{}, fmt.Errorf("empty rule")
+	}
+	if strings.ContainsAny(text, "\r\n") {
+		return Rule{}, fmt.Errorf("a rule must be on a single line")
+	}
+	start := strings.IndexByte(text, '(')
+	if start < 0 || !strings.HasSuffix(text, ")") {
+		return Rule{}, fmt.Errorf("options must be enclosed in parentheses")
+	}
+
+	header := strings.Fields(text[:start])
+	if len(header) != 7 {
+		return Rule{}, fmt.Errorf("header must be \"action proto src_addr src_port direction dst_addr dst_port\", got %d fields", len(header))
+	}
+	if !slices.Contains(actions, header[0]) {
+		return Rule{}, fmt.Errorf("unknown action %q", header[0])
+	}
+	if !slices.Contains(directions, header[4]) {
+		return Rule{}, fmt.Errorf("unknown direction %q", header[4])
+	}
+
+	options, err := ParseOptions(text[start+1 : len(text)-1])
+	if err != nil {
+		return Rule{}, err
+	}
+	rule := Rule{Action: header[0], Enabled: true, Text: text}
+	for _, option := range options {
+		switch option.Name {
+		case "sid", "rev":
+			n, err := strconv.Atoi(option.Value)
+			if err != nil || n <= 0 {
+				return Rule{}, fmt.Errorf("invalid %s %q", option.Name, option.Value)
+			}
+			if option.Name == "sid" {
+				rule.SID = n
+			} else {
+				rule.Rev = n
+			}
+		case "msg":
+			rule.Msg = unquote(option.Value)
+		}
+	}
+	if rule.SID == 0 {
+		return Rule{}, fmt.Errorf("missing sid")
+	}
+	return rule, nil
+}
+
+// ParseOptions splits the options of a rule, the text between its
+// parentheses. Options end with a semicolon, which must be escaped as "\;"
+// in their values, even in quoted strings.
+func ParseOptions(text string) ([]Option, error) {
+	var options []Option
+	var current strings.Builder
+	escaped := false
+	for _, c := range text {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == ';':
+			option, err := parseOption(current.String())
+			if err != nil {
+				return nil, err
+			}
+			options = append(options, option)
+			current.Reset()
+			continue
+		}
+		current.WriteRune(c)
+	}
+	if strings.TrimSpace(current.String()) != "" {
+		return nil, fmt.Errorf("option %q must end with a semicolon", strings.TrimSpace(current.String()))
+	}
+	if len(options) == 0 {
+		return nil, fmt.Errorf("rule has no options")
+	}
+	return options, nil
+}
+
+func parseOption(text string) (Option, error) {
+	name, value, _ := strings.Cut(text, ":")
+	option := Option{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)}
+	if !optionName.MatchString(option.Name) {
+		return Option{}, fmt.Errorf("invalid option %q", strings.TrimSpace(text))
+	}
+	quotes, escaped := 0, false
+	for _, c := range option.Value {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quotes++
+		}
+	}
+	if quotes%2 != 0 {
+		return Option{}, fmt.Errorf("unterminated quoted string in option %q", option.Name)
+	}
+	return option, nil
+}
+
+// unquote removes the quotes and the escapes of an option value.
+func unquote(value string) string {
+	value = strings.TrimPrefix(strings.TrimSuffix(value, `"`), `"`)
+	var b strings.Builder
+	escaped := false
+	for _, c := range value {
+		if c == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(c)
+	}
+	return b.String()
+}
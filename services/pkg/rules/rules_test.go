@@ -0,0 +1,59 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package rules
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		want    Rule
+		wantErr string
+	}{
+		{
+			name: "flag rule",
+			rule: `alert ip any any -> any any (msg: "A flag was sent"; flow:to_client; pcre: "/(\d[A-Z0-9]{28}=)/, flow:match"; metadata: tag FLAG OUT, color danger; sid: 1; rev: 2;)`,
+			want: Rule{SID: 1, Rev: 2, Msg: "A flag was sent", Action: "alert", Enabled: true},
+		},
+		{
+			name: "escaped semicolon and quote",
+			rule: `alert http any any <> $HOME_NET 80 (msg:"a \"b\"\; c"; content:"x\;y"; nocase; sid:42;)`,
+			want: Rule{SID: 42, Msg: `a "b"; c`, Action: "alert", Enabled: true},
+		},
+		{name: "empty", rule: "  ", wantErr: "empty rule"},
+		{name: "no options", rule: "alert ip any any -> any any", wantErr: "parentheses"},
+		{name: "short header", rule: "alert ip any -> any (sid:1;)", wantErr: "header"},
+		{name: "unknown action", rule: "log ip any any -> any any (sid:1;)", wantErr: "unknown action"},
+		{name: "unknown direction", rule: "alert ip any any <- any any (sid:1;)", wantErr: "unknown direction"},
+		{name: "missing sid", rule: `alert ip any any -> any any (msg:"x";)`, wantErr: "missing sid"},
+		{name: "invalid sid", rule: "alert ip any any -> any any (sid:abc;)", wantErr: "invalid sid"},
+		{name: "missing semicolon", rule: "alert ip any any -> any any (sid:1)", wantErr: "semicolon"},
+		{name: "unescaped semicolon", rule: `alert ip any any -> any any (msg:"a;b"; sid:1;)`, wantErr: "unterminated"},
+		{name: "invalid option", rule: "alert ip any any -> any any (con tent:\"x\"; sid:1;)", wantErr: "invalid option"},
+		{name: "multiple lines", rule: "alert ip any any -> any any (sid:1;\nsid:2;)", wantErr: "single line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.rule)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Parse error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			tt.want.Text = strings.TrimSpace(tt.rule)
+			if got != tt.want {
+				t.Errorf("Parse = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// socketVersion is the version of the unix socket protocol of Suricata.
+const socketVersion = "0.2"
+
+// reloadTimeout bounds a reload when the context has no deadline. Loading a
+// large ruleset takes a while, and the command returns once it is done.
+const reloadTimeout = 2 * time.Minute
+
+// FailedRule is a rule Suricata could not load.
+type FailedRule struct {
+	Rule     string `json:"rule"`
+	Filename string `json:"filename,omitempty"`
+	Line     int    `json:"line,omitempty"`
+}
+
+// CommandError is a command refused by Suricata.
+type CommandError struct {
+	Command string
+	Message string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("suricata refused %s: %s", e.Command, e.Message)
+}
+
+// Reload asks the Suricata listening on the unix command socket at path to
+// reload its rules, and waits for the new rules to be in use. It returns the
+// rules Suricata could not load, which it skips, and a CommandError if the
+// reload failed altogether.
+func Reload(ctx context.Context, path string) ([]FailedRule, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, reloadTimeout)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to suricata: %v", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// unblock the exchange when the request is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	s := &socket{encoder: json.NewEncoder(conn), decoder: json.NewDecoder(conn)}
+	if _, err := s.send("version", map[string]string{"version": socketVersion}); err != nil {
+		return nil, err
+	}
+	if _, err := s.command("ruleset-reload-rules"); err != nil {
+		return nil, err
+	}
+
+	// older versions of Suricata do not track the failed rules
+	message, err := s.command("ruleset-failed-rules")
+	if err != nil {
+		return nil, nil
+	}
+	var failed []FailedRule
+	if err := json.Unmarshal(message, &failed); err != nil {
+		return nil, nil
+	}
+	return failed, nil
+}
+
+// socket exchanges messages with Suricata, each request getting a response
+// of the form {"return": "OK" or "NOK", "message": ...}.
+type socket struct {
+	encoder *json.Encoder
+	decoder *json.Decoder
+}
+
+func (s *socket) command(name string) (json.RawMessage, error) {
+	return s.send(name, map[string]string{"command": name})
+}
+
+func (s *socket) send(name string, request any) (json.RawMessage, error) {
+	if err := s.encoder.Encode(request); err != nil {
+		return nil, fmt.Errorf("failed to send %s to suricata: %v", name, err)
+	}
+	var response struct {
+		Return  string          `json:"return"`
+		Message json.RawMessage `json:"message"`
+	}
+	if err := s.decoder.Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to read the response of suricata to %s: %v", name, err)
+	}
+	if response.Return != "OK" {
+		var message string
+		if json.Unmarshal(response.Message, &message) != nil {
+			message = string(response.Message)
+		}
+		return nil, &CommandError{Command: name, Message: message}
+	}
+	return response.Message, nil
+}
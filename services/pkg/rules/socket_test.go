@@ -0,0 +1,93 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// fakeSuricata answers the commands received on a unix socket with the
+// responses, by command name, and returns the socket path and the commands.
+func fakeSuricata(t *testing.T, responses map[string]string) (string, <-chan string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "suricata-command.socket")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	commands := make(chan string, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		decoder := json.NewDecoder(conn)
+		for {
+			var request map[string]string
+			if err := decoder.Decode(&request); err != nil {
+				close(commands)
+				return
+			}
+			name := request["command"]
+			if name == "" {
+				name = "version"
+			}
+			commands <- name
+			response, ok := responses[name]
+			if !ok {
+				response = `{"return": "OK", "message": "done"}`
+			}
+			conn.Write([]byte(response + "\n"))
+		}
+	}()
+	return path, commands
+}
+
+func TestReload(t *testing.T) {
+	path, commands := fakeSuricata(t, map[string]string{
+		"ruleset-failed-rules": `{"return": "OK", "message": [{"tenant_id": 0, "rule": "alert ip any any -> any any (foo; sid:9;)", "filename": "suricata.rules", "line": 7}]}`,
+	})
+
+	failed, err := Reload(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	want := []FailedRule{{Rule: "alert ip any any -> any any (foo; sid:9;)", Filename: "suricata.rules", Line: 7}}
+	if !slices.Equal(failed, want) {
+		t.Errorf("failed rules = %+v, want %+v", failed, want)
+	}
+	var got []string
+	for command := range commands {
+		got = append(got, command)
+	}
+	if want := []string{"version", "ruleset-reload-rules", "ruleset-failed-rules"}; !slices.Equal(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestReloadRefused(t *testing.T) {
+	path, _ := fakeSuricata(t, map[string]string{
+		"ruleset-reload-rules": `{"return": "NOK", "message": "Reload already in progress"}`,
+	})
+
+	_, err := Reload(context.Background(), path)
+	var commandErr *CommandError
+	if !errors.As(err, &commandErr) || commandErr.Message != "Reload already in progress" {
+		t.Errorf("Reload error = %v, want the message of suricata", err)
+	}
+
+	if _, err := Reload(context.Background(), filepath.Join(t.TempDir(), "missing.socket")); err == nil {
+		t.Error("Reload without suricata succeeded")
+	}
+}
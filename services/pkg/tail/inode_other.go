@@ -0,0 +1,14 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+//go:build !unix
+
+package tail
+
+import "os"
+
+// inode returns 0, positions are then only checked against the file size.
+func inode(os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,229 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package tail follows a growing file of lines, such as the eve.json log of
+// Suricata, across rotations and restarts.
+package tail
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// maxLine is the size above which a line is split, so that a corrupted file
+// cannot exhaust the memory.
+const maxLine = 16 << 20
+
+// Position is the point up to which a file was read, to resume from it.
+type Position struct {
+	Offset int64  `json:"offset"`
+	Inode  uint64 `json:"inode"` // Identity of the file the offset is in, 0 if unknown
+}
+
+// Follower reads the lines appended to a file. When the file is replaced, as
+// done by log rotation, the rest of the old file is read before switching to
+// the new one, and a file truncated in place is read again from its start.
+type Follower struct {
+	path    string
+	file    *os.File // nil while the file does not exist
+	reader  *bufio.Reader
+	inode   uint64
+	offset  int64  // offset of the first byte of partial
+	partial []byte // incomplete last line
+}
+
+// Open starts following path from pos. If the file of pos was rotated, as
+// path.1 for instance, the rest of it is read first. Otherwise the file is
+// read from its start if pos is in another file or past its end. The file
+// does not need to exist yet.
+func Open(path string, pos Position) (*Follower, error) {
+	f := &Follower{path: path}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	if pos.Inode != 0 && pos.Inode != f.inode && pos.Offset > 0 {
+		found, err := f.openRotated(pos)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if !found {
+			slog.Warn("File rotated while stopped and not found next to it, the rest of it is lost",
+				slog.String("file", path), slog.Int64("offset", pos.Offset))
+		}
+		return f, nil
+	}
+	if f.file == nil {
+		return f, nil
+	}
+
+	info, err := f.file.Stat()
+	if err != nil {
+		f.file.Close()
+		return nil, fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+	if pos.Offset > info.Size() {
+		slog.Warn("File truncated while stopped, reading it from the start",
+			slog.String("file", path), slog.Int64("offset", pos.Offset))
+		return f, nil
+	}
+	if err := f.seek(pos.Offset); err != nil {
+		f.file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// openRotated looks for the file of pos among the rotated siblings of path,
+// named path.<suffix>, and switches to it at pos. Once it is read, the
+// follower moves on to path as after any rotation.
+func (f *Follower) openRotated(pos Position) (bool, error) {
+	siblings, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return false, err
+	}
+	for _, sibling := range siblings {
+		info, err := os.Stat(sibling)
+		if err != nil || !info.Mode().IsRegular() || inode(info) != pos.Inode || pos.Offset > info.Size() {
+			continue
+		}
+		file, err := os.Open(sibling)
+		if err != nil {
+			return false, fmt.Errorf("failed to open %s: %v", sibling, err)
+		}
+		f.Close()
+		f.file, f.reader, f.inode, f.partial = file, bufio.NewReader(file), pos.Inode, nil
+		if err := f.seek(pos.Offset); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// seek moves to offset in the current file.
+func (f *Follower) seek(offset int64) error {
+	if _, err := f.file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek %s: %v", f.file.Name(), err)
+	}
+	f.reader.Reset(f.file)
+	f.offset = offset
+	return nil
+}
+
+// open opens the file at path, leaving f.file nil if it does not exist.
+func (f *Follower) open() error {
+	file, err := os.Open(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open %s: %v", f.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat %s: %v", f.path, err)
+	}
+	f.file, f.reader, f.inode, f.offset, f.partial = file, bufio.NewReader(file), inode(info), 0, nil
+	return nil
+}
+
+// Position returns the position after the last line returned by ReadLines.
+func (f *Follower) Position() Position {
+	return Position{Offset: f.offset, Inode: f.inode}
+}
+
+// ReadLines returns up to n complete lines available now, without their
+// line endings, and none once it reached the end of the file.
+func (f *Follower) ReadLines(n int) ([]string, error) {
+	var lines []string
+	for len(lines) < n {
+		if f.file == nil {
+			if err := f.open(); err != nil || f.file == nil {
+				return lines, err
+			}
+		}
+
+		chunk, err := f.reader.ReadSlice('\n')
+		f.partial = append(f.partial, chunk...)
+		switch {
+		case err == nil || (errors.Is(err, bufio.ErrBufferFull) && len(f.partial) >= maxLine):
+			line := f.partial
+			f.offset += int64(len(line))
+			f.partial = f.partial[:0]
+			if line = trimEOL(line); len(line) > 0 {
+				lines = append(lines, string(line))
+			}
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case errors.Is(err, io.EOF):
+			switched, err := f.checkRotation()
+			if err != nil || !switched {
+				return lines, err
+			}
+		default:
+			return lines, fmt.Errorf("failed to read %s: %v", f.path, err)
+		}
+	}
+	return lines, nil
+}
+
+// checkRotation switches to the file now at path if it was replaced, or
+// rewinds the file if it was truncated, once the end of the current one was
+// reached. It reports whether there may be more to read.
+func (f *Follower) checkRotation() (bool, error) {
+	info, err := os.Stat(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %v", f.path, err)
+	}
+
+	current, err := f.file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %v", f.path, err)
+	}
+	if !os.SameFile(info, current) {
+		// the incomplete last line of the old file is dropped
+		f.file.Close()
+		f.file = nil
+		return true, f.open()
+	}
+	if current.Size() < f.offset+int64(len(f.partial)) {
+		if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+			return false, fmt.Errorf("failed to seek %s: %v", f.path, err)
+		}
+		f.reader.Reset(f.file)
+		f.offset, f.partial = 0, nil
+		return true, nil
+	}
+	return false, nil
+}
+
+// Close closes the file.
+func (f *Follower) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func trimEOL(line []byte) []byte {
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+	}
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return line
+}
@@ -0,0 +1,143 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: GPL-3.0-only
+
+package tail
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func appendFile(t *testing.T, path, data string) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectLines(t *testing.T, f *Follower, want ...string) {
+	t.Helper()
+	got, err := f.ReadLines(100)
+	if err != nil {
+		t.Fatalf("ReadLines failed: %v", err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("ReadLines = %q, want %q", got, want)
+	}
+}
+
+func TestFollower(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "eve.json")
+
+	f, err := Open(path, Position{})
+	if err != nil {
+		t.Fatalf("Open of a missing file failed: %v", err)
+	}
+	defer f.Close()
+	expectLines(t, f)
+
+	appendFile(t, path, "a\nb\r\n\nc")
+	expectLines(t, f, "a", "b")
+	appendFile(t, path, "d\n")
+	expectLines(t, f, "cd")
+	if pos := f.Position(); pos.Offset != 9 {
+		t.Errorf("Position = %+v, want offset 9", pos)
+	}
+
+	// rotation: the rest of the old file comes first
+	appendFile(t, path, "e\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path+".1", "f\n")
+	appendFile(t, path, "g\n")
+	expectLines(t, f, "e", "f", "g")
+
+	// truncation in place
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, f)
+	appendFile(t, path, "h\n")
+	expectLines(t, f, "h")
+
+	got, err := f.ReadLines(1)
+	if err != nil || len(got) != 0 {
+		t.Errorf("ReadLines at the end = %q, %v; want none", got, err)
+	}
+}
+
+func TestOpenPosition(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "eve.json")
+	appendFile(t, path, "a\nb\n")
+
+	f, err := Open(path, Position{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := f.ReadLines(1); !slices.Equal(got, []string{"a"}) {
+		t.Fatalf("ReadLines(1) = %q, want a", got)
+	}
+	pos := f.Position()
+	f.Close()
+
+	for _, tc := range []struct {
+		name string
+		pos  Position
+		want []string
+	}{
+		{"resume", pos, []string{"b"}},
+		{"past the end", Position{Offset: 100, Inode: pos.Inode}, []string{"a", "b"}},
+		{"other file", Position{Offset: pos.Offset, Inode: pos.Inode + 1}, []string{"a", "b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := Open(path, tc.pos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			expectLines(t, f, tc.want...)
+		})
+	}
+}
+
+func TestOpenRotated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "eve.json")
+	appendFile(t, path, "a\nb\n")
+
+	f, err := Open(path, Position{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, f, "a", "b")
+	pos := f.Position()
+	f.Close()
+	if pos.Inode == 0 {
+		t.Skip("inodes not available")
+	}
+
+	// rotated while stopped, with lines written before and after
+	appendFile(t, path, "c\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "d\n")
+
+	f, err = Open(path, pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	expectLines(t, f, "c", "d")
+	if got := f.Position(); got.Inode == pos.Inode || got.Offset != 2 {
+		t.Errorf("Position = %+v, want offset 2 in the new file", got)
+	}
+}
@@ -0,0 +1,422 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+// Package watcher discovers PCAP files dropped into a directory tree and hands
+// them over for processing once they are no longer being written.
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Order selects the order in which ready files are handed to the handler.
+type Order string
+
+const (
+	OrderName        Order = "name"         // lexicographic order of the full path
+	OrderMtime       Order = "mtime"        // oldest modification time first
+	OrderFirstPacket Order = "first-packet" // oldest first packet timestamp first
+)
+
+// ParseOrder validates an order name coming from the configuration.
+func ParseOrder(s string) (Order, error) {
+	switch o := Order(strings.ToLower(strings.TrimSpace(s))); o {
+	case "":
+		return OrderName, nil
+	case OrderName, OrderMtime, OrderFirstPacket:
+		return o, nil
+	default:
+		return "", fmt.Errorf("unknown watch order %q (expected name, mtime or first-packet)", s)
+	}
+}
+
+// Config holds the watcher settings.
+type Config struct {
+	Dir          string        // Root directory to watch
+	Recursive    bool          // Also watch subdirectories
+	Extensions   []string      // File extensions to pick up, e.g. ".pcap"
+	Exclude      []string      // Directories that are never scanned, e.g. an archive directory
+	StableFor    time.Duration // How long size and mtime must stay unchanged before a file is ready
+	PollInterval time.Duration // Interval between readiness checks (and rescans when polling)
+	Order        Order         // Processing order of files that become ready together
+	Polling      bool          // Disable fsnotify and only rely on polling
+}
+
+// Handler is called, sequentially, for every file that is ready to be processed.
+type Handler func(ctx context.Context, path string)
+
+// fileState tracks a candidate file until it is considered complete.
+type fileState struct {
+	size    int64
+	mtime   time.Time
+	changed time.Time // last time the size or mtime changed
+}
+
+// Watcher discovers files in Config.Dir and reports them once they are stable.
+type Watcher struct {
+	cfg Config
+
+	pending map[string]*fileState // files seen but not handled yet
+	handled map[string]struct{}   // handled files that still exist on disk
+
+	fsw *fsnotify.Watcher // nil when polling
+}
+
+// New creates a new Watcher. fsnotify is used unless Config.Polling is set or
+// it cannot be initialised, in which case the watcher falls back to polling.
+func New(cfg Config) (*Watcher, error) {
+	info, err := os.Stat(cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat watch directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("watch path is not a directory: %s", cfg.Dir)
+	}
+
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 2 * time.Second
+	}
+	if cfg.Order == "" {
+		cfg.Order = OrderName
+	}
+	if len(cfg.Extensions) == 0 {
+		cfg.Extensions = []string{".pcap"}
+	}
+	exclude := make([]string, 0, len(cfg.Exclude))
+	for _, dir := range cfg.Exclude {
+		if dir != "" {
+			exclude = append(exclude, absPath(dir))
+		}
+	}
+	cfg.Exclude = exclude
+
+	w := &Watcher{
+		cfg:     cfg,
+		pending: make(map[string]*fileState),
+		handled: make(map[string]struct{}),
+	}
+
+	if !cfg.Polling {
+		fsw, err := fsnotify.NewWatcher()
+		if err != nil {
+			slog.Warn("fsnotify unavailable, falling back to polling", slog.Any("err", err))
+		} else {
+			w.fsw = fsw
+		}
+	}
+
+	return w, nil
+}
+
+// Run watches the directory until ctx is cancelled, calling handle for every
+// ready file.
+func (w *Watcher) Run(ctx context.Context, handle Handler) error {
+	if w.fsw != nil {
+		defer w.fsw.Close()
+	}
+
+	// Initial scan also registers the fsnotify watches on every directory
+	w.scan()
+
+	ticker := time.NewTicker(w.cfg.PollInterval)
+	defer ticker.Stop()
+
+	var (
+		events <-chan fsnotify.Event
+		errs   <-chan error
+	)
+	if w.fsw != nil {
+		events = w.fsw.Events
+		errs = w.fsw.Errors
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			w.handleEvent(ev)
+
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			// Most likely an event queue overflow: resync with a full scan
+			slog.Warn("fsnotify error, rescanning watch directory", slog.Any("err", err))
+			w.scan()
+
+		case <-ticker.C:
+			if w.fsw == nil {
+				w.scan()
+			}
+			for _, path := range w.ready() {
+				if ctx.Err() != nil {
+					return nil
+				}
+				handle(ctx, path)
+				w.handled[path] = struct{}{}
+			}
+		}
+	}
+}
+
+// scan walks the watch directory, tracking new files and forgetting handled
+// files that no longer exist.
+func (w *Watcher) scan() {
+	present := make(map[string]struct{})
+
+	err := filepath.WalkDir(w.cfg.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The entry may have vanished while walking, skip it
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			slog.Warn("Failed to read watch entry", slog.String("path", path), slog.Any("err", err))
+			return nil
+		}
+
+		if d.IsDir() {
+			if path != w.cfg.Dir && !w.watchesDir(path) {
+				return filepath.SkipDir
+			}
+			w.addWatch(path)
+			return nil
+		}
+
+		if !w.matches(path) {
+			return nil
+		}
+		present[path] = struct{}{}
+		w.track(path)
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to scan watch directory", slog.String("dir", w.cfg.Dir), slog.Any("err", err))
+		return
+	}
+
+	for path := range w.handled {
+		if _, ok := present[path]; !ok {
+			delete(w.handled, path)
+		}
+	}
+	for path := range w.pending {
+		if _, ok := present[path]; !ok {
+			delete(w.pending, path)
+		}
+	}
+}
+
+// addWatch registers a directory with fsnotify, switching to polling if that fails.
+func (w *Watcher) addWatch(dir string) {
+	if w.fsw == nil {
+		return
+	}
+	if slices.Contains(w.fsw.WatchList(), dir) {
+		return
+	}
+	if err := w.fsw.Add(dir); err != nil {
+		slog.Warn("Failed to watch directory, falling back to polling",
+			slog.String("dir", dir), slog.Any("err", err))
+		w.fsw.Close()
+		w.fsw = nil
+	}
+}
+
+// handleEvent updates the tracked state after a filesystem notification.
+func (w *Watcher) handleEvent(ev fsnotify.Event) {
+	path := ev.Name
+
+	switch {
+	case ev.Has(fsnotify.Create):
+		info, err := os.Stat(path)
+		if err != nil {
+			return
+		}
+		if info.IsDir() {
+			if w.watchesDir(path) {
+				// Files may have been created before the watch was added
+				w.scan()
+			}
+			return
+		}
+		if w.matches(path) {
+			// Files renamed into place keep their mtime, so they are
+			// already stable unless they were just written.
+			w.track(path)
+		}
+
+	case ev.Has(fsnotify.Write):
+		if !w.matches(path) {
+			return
+		}
+		w.track(path)
+		if st, ok := w.pending[path]; ok {
+			st.changed = time.Now()
+		}
+
+	case ev.Has(fsnotify.Remove), ev.Has(fsnotify.Rename):
+		delete(w.pending, path)
+		delete(w.handled, path)
+	}
+}
+
+// track starts tracking path if it is neither pending nor handled yet.
+func (w *Watcher) track(path string) {
+	if _, ok := w.handled[path]; ok {
+		return
+	}
+	if _, ok := w.pending[path]; ok {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	// Files found on disk are considered unchanged since their last modification,
+	// so files that were already complete at startup are picked up right away.
+	w.pending[path] = &fileState{
+		size:    info.Size(),
+		mtime:   info.ModTime(),
+		changed: info.ModTime(),
+	}
+}
+
+// ready returns the pending files that are complete, in processing order, and
+// removes them from the pending set.
+func (w *Watcher) ready() []string {
+	now := time.Now()
+	ready := make([]string, 0)
+
+	for path, st := range w.pending {
+		info, err := os.Stat(path)
+		if err != nil {
+			delete(w.pending, path)
+			continue
+		}
+
+		if info.Size() != st.size || !info.ModTime().Equal(st.mtime) {
+			st.size = info.Size()
+			st.mtime = info.ModTime()
+			st.changed = now
+			continue
+		}
+
+		if st.size == 0 {
+			continue // not even a PCAP header yet
+		}
+
+		if now.Sub(st.changed) >= w.cfg.StableFor {
+			ready = append(ready, path)
+		}
+	}
+
+	w.sort(ready)
+	for _, path := range ready {
+		delete(w.pending, path)
+	}
+	return ready
+}
+
+// sort orders the ready files according to the configured Order.
+func (w *Watcher) sort(paths []string) {
+	keys := make(map[string]time.Time, len(paths))
+	switch w.cfg.Order {
+	case OrderMtime:
+		for _, path := range paths {
+			if info, err := os.Stat(path); err == nil {
+				keys[path] = info.ModTime()
+			}
+		}
+	case OrderFirstPacket:
+		for _, path := range paths {
+			keys[path] = firstPacketTime(path)
+		}
+	}
+
+	slices.SortFunc(paths, func(a, b string) int {
+		if c := keys[a].Compare(keys[b]); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+}
+
+// watchesDir reports whether a subdirectory should be scanned.
+func (w *Watcher) watchesDir(path string) bool {
+	if !w.cfg.Recursive || strings.HasPrefix(filepath.Base(path), ".") {
+		return false
+	}
+	path = absPath(path)
+	for _, excluded := range w.cfg.Exclude {
+		if excluded == path {
+			return false
+		}
+	}
+	return true
+}
+
+// absPath returns the absolute form of path, so that relative and absolute
+// paths to the same directory compare equal.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// matches reports whether the file has one of the configured extensions.
+func (w *Watcher) matches(path string) bool {
+	if strings.HasPrefix(filepath.Base(path), ".") {
+		return false // hidden files are temporary files of rsync & co.
+	}
+	return slices.Contains(w.cfg.Extensions, filepath.Ext(path))
+}
+
+// firstPacketTime returns the timestamp of the first packet in a PCAP or
+// PCAPNG file, or the zero time if it cannot be read.
+func firstPacketTime(path string) time.Time {
+	file, err := os.Open(path)
+	if err != nil {
+		return time.Time{}
+	}
+	defer file.Close()
+
+	if r, err := pcapgo.NewReader(file); err == nil {
+		if _, ci, err := r.ReadPacketData(); err == nil {
+			return ci.Timestamp
+		}
+		return time.Time{}
+	}
+
+	if _, err := file.Seek(0, 0); err != nil {
+		return time.Time{}
+	}
+	if r, err := pcapgo.NewNgReader(file, pcapgo.DefaultNgReaderOptions); err == nil {
+		if _, ci, err := r.ReadPacketData(); err == nil {
+			return ci.Timestamp
+		}
+	}
+	return time.Time{}
+}
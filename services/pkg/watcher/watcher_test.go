@@ -0,0 +1,266 @@
+// SPDX-FileCopyrightText: 2025 Eyad Issa <eyadlorenzo@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// makePcap returns a PCAP file containing a single packet captured at ts.
+func makePcap(t *testing.T, ts time.Time) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+	data := []byte{0xde, 0xad, 0xbe, 0xef}
+	ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(data), Length: len(data)}
+	if err := w.WritePacket(ci, data); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func writeFile(t *testing.T, path string, data []byte, mtime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("failed to set mtime: %v", err)
+	}
+}
+
+// collect runs the watcher until n files were handled or the timeout expires.
+func collect(t *testing.T, cfg Config, n int, timeout time.Duration) []string {
+	t.Helper()
+	w, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), timeout)
+	defer cancel()
+
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	w.Run(ctx, func(ctx context.Context, path string) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, path)
+		if len(got) == n {
+			cancel()
+		}
+	})
+	return got
+}
+
+func TestParseOrder(t *testing.T) {
+	for _, s := range []string{"", "name", "MTIME", "first-packet"} {
+		if _, err := ParseOrder(s); err != nil {
+			t.Errorf("ParseOrder(%q) failed: %v", s, err)
+		}
+	}
+	if _, err := ParseOrder("size"); err == nil {
+		t.Error("ParseOrder(\"size\") should fail")
+	}
+}
+
+func TestWatcher_RecursiveOrders(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+	base := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		order Order
+		want  []string
+	}{
+		{OrderName, []string{"a.pcap", "b.pcap", "sub/c.pcap"}},
+		{OrderMtime, []string{"sub/c.pcap", "b.pcap", "a.pcap"}},
+		{OrderFirstPacket, []string{"b.pcap", "a.pcap", "sub/c.pcap"}},
+	}
+
+	for _, tc := range cases {
+		for _, polling := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s/polling=%v", tc.order, polling), func(t *testing.T) {
+				dir := t.TempDir()
+				writeFile(t, filepath.Join(dir, "a.pcap"), makePcap(t, base.Add(time.Minute)), old.Add(2*time.Second))
+				writeFile(t, filepath.Join(dir, "b.pcap"), makePcap(t, base), old.Add(time.Second))
+				writeFile(t, filepath.Join(dir, "sub", "c.pcap"), makePcap(t, base.Add(time.Hour)), old)
+				writeFile(t, filepath.Join(dir, "ignored.txt"), []byte("nope"), old)
+				writeFile(t, filepath.Join(dir, ".hidden.pcap"), makePcap(t, base), old)
+
+				got := collect(t, Config{
+					Dir:          dir,
+					Recursive:    true,
+					StableFor:    time.Second,
+					PollInterval: 20 * time.Millisecond,
+					Order:        tc.order,
+					Polling:      polling,
+				}, 3, 5*time.Second)
+
+				want := make([]string, len(tc.want))
+				for i, name := range tc.want {
+					want[i] = filepath.Join(dir, name)
+				}
+				if !slices.Equal(got, want) {
+					t.Errorf("got %v, want %v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestWatcher_NonRecursive(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "sub", "c.pcap"), makePcap(t, old), old)
+	writeFile(t, filepath.Join(dir, "a.pcap"), makePcap(t, old), old)
+
+	got := collect(t, Config{
+		Dir:          dir,
+		PollInterval: 20 * time.Millisecond,
+		Polling:      true,
+	}, 2, 300*time.Millisecond)
+
+	if want := []string{filepath.Join(dir, "a.pcap")}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWatcher_Exclude(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "archive", "b.pcap"), makePcap(t, old), old)
+	writeFile(t, filepath.Join(dir, "a.pcap"), makePcap(t, old), old)
+	t.Chdir(dir)
+
+	for _, exclude := range []string{filepath.Join(dir, "archive"), "archive", "./archive/"} {
+		t.Run(exclude, func(t *testing.T) {
+			got := collect(t, Config{
+				Dir:          dir,
+				Recursive:    true,
+				Exclude:      []string{exclude},
+				PollInterval: 20 * time.Millisecond,
+				Polling:      true,
+			}, 2, 300*time.Millisecond)
+
+			if want := []string{filepath.Join(dir, "a.pcap")}; !slices.Equal(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestWatcher_WaitsForStableFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "growing.pcap")
+	writeFile(t, path, makePcap(t, time.Now()), time.Now())
+
+	stableFor := 300 * time.Millisecond
+	start := time.Now()
+	got := collect(t, Config{
+		Dir:          dir,
+		StableFor:    stableFor,
+		PollInterval: 20 * time.Millisecond,
+		Polling:      true,
+	}, 1, 5*time.Second)
+
+	if len(got) != 1 {
+		t.Fatalf("expected the file to be handled, got %v", got)
+	}
+	if elapsed := time.Since(start); elapsed < stableFor-50*time.Millisecond {
+		t.Errorf("file handled after %v, before it was stable for %v", elapsed, stableFor)
+	}
+}
+
+func TestWatcher_WrittenSlowly(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "capture.pcap")
+	pcap := makePcap(t, time.Now())
+
+	stableFor := 200 * time.Millisecond
+	w, err := New(Config{Dir: dir, StableFor: stableFor, Polling: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	// like tcpdump -w: the header is written before the Create event is
+	// handled, then the packets come in slowly
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write(pcap[:24])
+	w.handleEvent(fsnotify.Event{Name: path, Op: fsnotify.Create})
+	for i := 0; i <= 3; i++ {
+		if got := w.ready(); len(got) > 0 {
+			t.Fatalf("ready() = %v after %d packets, the file is still being written", got, i)
+		}
+		if i < 3 {
+			time.Sleep(stableFor / 2)
+			f.Write(pcap[24:])
+			w.handleEvent(fsnotify.Event{Name: path, Op: fsnotify.Write})
+		}
+	}
+
+	time.Sleep(stableFor + 50*time.Millisecond)
+	if got := w.ready(); !slices.Equal(got, []string{path}) {
+		t.Errorf("ready() = %v once stable, want %v", got, []string{path})
+	}
+}
+
+func TestWatcher_RenamedIntoPlace(t *testing.T) {
+	dir := t.TempDir()
+	tmp := filepath.Join(t.TempDir(), "incoming.pcap")
+	// moving a file keeps its mtime, older than StableFor
+	writeFile(t, tmp, makePcap(t, time.Now()), time.Now().Add(-2*time.Hour))
+
+	w, err := New(Config{Dir: dir, StableFor: time.Hour, PollInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if w.fsw == nil {
+		t.Skip("fsnotify not available")
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	dst := filepath.Join(dir, "incoming.pcap")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		os.Rename(tmp, dst)
+	}()
+
+	var got []string
+	w.Run(ctx, func(ctx context.Context, path string) {
+		got = append(got, path)
+		cancel()
+	})
+
+	if !slices.Equal(got, []string{dst}) {
+		t.Errorf("got %v, want %v", got, []string{dst})
+	}
+}
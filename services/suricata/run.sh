@@ -17,4 +17,10 @@ suricata \
   --set "outputs.1.eve-log.filetype=redis" \
   --set "outputs.1.eve-log.redis.server=${REDIS_HOST}" \
   --set "outputs.1.eve-log.redis.port=${REDIS_PORT}" \
+  --set "outputs.1.eve-log.redis.mode=${REDIS_MODE:-list}" \
+  --set "outputs.1.eve-log.redis.key=${REDIS_KEY:-suricata}" \
+  --set "outputs.1.eve-log.community-id=true" \
+  --set "app-layer.protocols.tls.ja3-fingerprints=yes" \
+  --set "unix-command.enabled=yes" \
+  --set "unix-command.filename=/var/run/suricata/suricata-command.socket" \
   --set outputs.7.stats.enabled=false